@@ -0,0 +1,313 @@
+package accesslog
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akrennmair/cabinet/basicauth"
+)
+
+type Format int
+
+const (
+	Combined Format = iota
+	JSON
+)
+
+// ParseFormat returns the log format with the given name, either "combined"
+// or "json".
+func ParseFormat(name string) (Format, error) {
+	switch name {
+	case "combined":
+		return Combined, nil
+	case "json":
+		return JSON, nil
+	}
+	return Combined, fmt.Errorf("unknown access log format %q", name)
+}
+
+// Logger writes access log lines to a file. The file can be reopened, e.g.
+// after it has been rotated away by logrotate. A path of "-" writes to
+// stdout.
+type Logger struct {
+	path string
+	mtx  sync.Mutex
+	w    io.Writer
+	f    *os.File
+}
+
+func Open(path string) (*Logger, error) {
+	l := &Logger{path: path}
+	if err := l.Reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Logger) Reopen() error {
+	if l.path == "-" {
+		l.mtx.Lock()
+		l.w = os.Stdout
+		l.mtx.Unlock()
+		return nil
+	}
+
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	l.mtx.Lock()
+	oldFile := l.f
+	l.f, l.w = f, f
+	l.mtx.Unlock()
+
+	if oldFile != nil {
+		return oldFile.Close()
+	}
+	return nil
+}
+
+func (l *Logger) Close() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f, l.w = nil, io.Discard
+	return err
+}
+
+func (l *Logger) write(line []byte) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.w.Write(line)
+}
+
+// Entry is a single access log record.
+type Entry struct {
+	Time      time.Time     `json:"time"`
+	RemoteIP  string        `json:"remote_ip"`
+	User      string        `json:"user,omitempty"`
+	Method    string        `json:"method"`
+	Path      string        `json:"path"`
+	Proto     string        `json:"proto"`
+	Drawer    string        `json:"drawer,omitempty"`
+	Status    int           `json:"status"`
+	Bytes     int64         `json:"bytes"`
+	Duration  time.Duration `json:"-"`
+	Referer   string        `json:"referer,omitempty"`
+	UserAgent string        `json:"user_agent,omitempty"`
+}
+
+func (e *Entry) combined() []byte {
+	user := e.User
+	if user == "" {
+		user = "-"
+	}
+	return []byte(fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %d %q %q %q %.6f\n",
+		e.RemoteIP, user, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		e.Method, e.Path, e.Proto, e.Status, e.Bytes,
+		dashIfEmpty(e.Referer), dashIfEmpty(e.UserAgent), dashIfEmpty(e.Drawer), e.Duration.Seconds()))
+}
+
+func (e *Entry) json() []byte {
+	type jsonEntry struct {
+		*Entry
+		Duration float64 `json:"duration"`
+	}
+	line, _ := json.Marshal(jsonEntry{Entry: e, Duration: e.Duration.Seconds()})
+	return append(line, '\n')
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// Handler logs every request that passes through it.
+type Handler struct {
+	h              http.Handler
+	logger         *Logger
+	format         Format
+	trustedProxies []*net.IPNet
+}
+
+// NewHandler returns a handler that logs all requests to h. The
+// X-Forwarded-For header is only honored for requests coming from one of
+// the trusted proxy networks.
+func NewHandler(h http.Handler, logger *Logger, format Format, trustedProxies []*net.IPNet) *Handler {
+	return &Handler{h: h, logger: logger, format: format, trustedProxies: trustedProxies}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ts := time.Now()
+	rw := &responseWriter{ResponseWriter: w, status: http.StatusOK}
+
+	// the drawer needs to be determined before the handler runs, because
+	// it will consume a multipart upload body.
+	drawer := DrawerName(r)
+
+	// only users that were authenticated by the handler are logged, not
+	// whatever a client claims to be.
+	r = basicauth.WithUser(r)
+	h.h.ServeHTTP(rw, r)
+
+	entry := &Entry{
+		Time:      ts,
+		RemoteIP:  h.remoteIP(r),
+		User:      basicauth.User(r),
+		Method:    r.Method,
+		Path:      r.RequestURI,
+		Proto:     r.Proto,
+		Drawer:    drawer,
+		Status:    rw.status,
+		Bytes:     rw.n,
+		Duration:  time.Since(ts),
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+	}
+
+	switch h.format {
+	case JSON:
+		h.logger.write(entry.json())
+	default:
+		h.logger.write(entry.combined())
+	}
+}
+
+func (h *Handler) remoteIP(r *http.Request) string {
+	return RemoteIP(r, h.trustedProxies)
+}
+
+// RemoteIP returns the client's IP address. If the request came through
+// trusted proxies, the X-Forwarded-For header is walked from right to left
+// until the first untrusted address is found.
+func RemoteIP(r *http.Request, trustedProxies []*net.IPNet) string {
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+
+	if !trusted(trustedProxies, ip) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if addr == "" {
+			continue
+		}
+		ip = addr
+		if !trusted(trustedProxies, addr) {
+			break
+		}
+	}
+
+	return ip
+}
+
+func trusted(trustedProxies []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseNetworks parses a comma-separated list of IP addresses and CIDR
+// networks.
+func ParseNetworks(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+// DrawerName extracts the drawer a request refers to, either from the
+// drawer parameter of an API request or from the first element of a file
+// path.
+func DrawerName(r *http.Request) string {
+	if strings.HasPrefix(r.URL.Path, "/api/") {
+		return r.URL.Query().Get("drawer")
+	}
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if len(parts) != 2 {
+		return ""
+	}
+	return parts[0]
+}
+
+type responseWriter struct {
+	http.ResponseWriter
+	status      int
+	n           int64
+	wroteHeader bool
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *responseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("underlying ResponseWriter doesn't support hijacking")
+	}
+	conn, rw, err := hj.Hijack()
+	if err == nil {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
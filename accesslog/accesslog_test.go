@@ -0,0 +1,86 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/akrennmair/cabinet/basicauth"
+)
+
+func TestRemoteIP(t *testing.T) {
+	trusted, err := ParseNetworks("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHandler(nil, nil, Combined, trusted)
+
+	testData := []struct {
+		remoteAddr string
+		forwarded  string
+		expected   string
+	}{
+		{"1.2.3.4:1234", "", "1.2.3.4"},
+		{"1.2.3.4:1234", "5.6.7.8", "1.2.3.4"},
+		{"10.1.1.1:1234", "5.6.7.8", "5.6.7.8"},
+		{"10.1.1.1:1234", "6.6.6.6, 5.6.7.8, 192.168.1.1", "5.6.7.8"},
+		{"10.1.1.1:1234", "10.2.2.2", "10.2.2.2"},
+		{"10.1.1.1:1234", "", "10.1.1.1"},
+	}
+
+	for _, td := range testData {
+		r := httptest.NewRequest("GET", "/foo/bar", nil)
+		r.RemoteAddr = td.remoteAddr
+		if td.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", td.forwarded)
+		}
+		if ip := h.remoteIP(r); ip != td.expected {
+			t.Errorf("%s with X-Forwarded-For %q: expected %s, got %s instead.", td.remoteAddr, td.forwarded, td.expected, ip)
+		}
+	}
+}
+
+func TestJSONLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger := &Logger{w: &buf}
+
+	h := NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !basicauth.Authenticate(w, r, func(u, p string) bool { return u == "admin" && p == "secret" }) {
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}), logger, JSON, nil)
+
+	type entry struct {
+		User   string `json:"user"`
+		Drawer string `json:"drawer"`
+		Status int    `json:"status"`
+		Bytes  int64  `json:"bytes"`
+	}
+
+	testData := []struct {
+		password string
+		expected entry
+	}{
+		{"secret", entry{User: "admin", Drawer: "test", Status: http.StatusCreated, Bytes: 5}},
+		{"wrong", entry{Drawer: "test", Status: http.StatusUnauthorized, Bytes: 13}},
+	}
+
+	for _, td := range testData {
+		buf.Reset()
+		r := httptest.NewRequest("POST", "/api/upload?drawer=test", nil)
+		r.SetBasicAuth("admin", td.password)
+		h.ServeHTTP(httptest.NewRecorder(), r)
+
+		var logged entry
+		if err := json.Unmarshal(buf.Bytes(), &logged); err != nil {
+			t.Fatalf("couldn't decode log line %q: %v", buf.String(), err)
+		}
+		if logged != td.expected {
+			t.Errorf("password %q: expected log entry %+v, got %+v instead.", td.password, td.expected, logged)
+		}
+	}
+}
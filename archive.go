@@ -0,0 +1,273 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/akrennmair/cabinet/basicauth"
+	"github.com/akrennmair/cabinet/data"
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Archives contain the files of a drawer as files/<drawer>/<filename>, each
+// preceded by its metadata as JSON in meta/<drawer>/<filename>.json.
+const (
+	archiveFiles = "files"
+	archiveMeta  = "meta"
+)
+
+// exportHandler streams the files of a drawer as tar archive. It reads from
+// a snapshot of the database, so the archive is consistent even while files
+// are uploaded or deleted.
+type exportHandler struct {
+	DB         *leveldb.DB
+	AuthFunc   basicauth.AuthenticatorFunc
+	AccessFunc drawerAccessFunc
+}
+
+func (h *exportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !basicauth.Authenticate(w, r, h.AuthFunc) {
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	drawerName := r.FormValue("drawer")
+	if drawerName == "" || !validDrawerName(drawerName) {
+		http.Error(w, "invalid drawer name", http.StatusNotAcceptable)
+		return
+	}
+
+	if !h.AccessFunc.permits(r, drawerName) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	snapshot, err := h.DB.GetSnapshot()
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("getting snapshot for export of %s failed: %v", drawerName, err)
+		return
+	}
+	defer snapshot.Release()
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+drawerName+".tar\"")
+
+	prefix := "file:" + drawerName + ":"
+	iterator := snapshot.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iterator.Release()
+
+	tw := tar.NewWriter(w)
+	now := time.Now()
+
+	writeEntry := func(name string, content []byte) error {
+		if err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			ModTime:  now,
+		}); err != nil {
+			return err
+		}
+		_, err := tw.Write(content)
+		return err
+	}
+
+	for iterator.Next() {
+		filename := strings.TrimPrefix(string(iterator.Key()), prefix)
+
+		var metadata data.MetaData
+		if rawMetaData, err := snapshot.Get([]byte("meta:"+drawerName+":"+filename), nil); err == nil {
+			if err := proto.Unmarshal(rawMetaData, &metadata); err != nil {
+				log.Printf("proto.Unmarshal of metadata for %s:%s failed: %v", drawerName, filename, err)
+			}
+		}
+		if metadata.ContentType == nil {
+			metadata.ContentType = proto.String("application/octet-stream")
+		}
+		if metadata.Sha256 == nil {
+			metadata.Sha256 = proto.String(contentHash(iterator.Value()))
+		}
+
+		rawJSON, err := json.Marshal(&metadata)
+		if err != nil {
+			log.Printf("encoding metadata of %s:%s failed: %v", drawerName, filename, err)
+			return
+		}
+
+		if err := writeEntry(path.Join(archiveMeta, drawerName, filename+".json"), rawJSON); err != nil {
+			log.Printf("export of %s failed: %v", drawerName, err)
+			return
+		}
+		if err := writeEntry(path.Join(archiveFiles, drawerName, filename), iterator.Value()); err != nil {
+			log.Printf("export of %s failed: %v", drawerName, err)
+			return
+		}
+	}
+
+	if err := iterator.Error(); err != nil {
+		// the archive is left incomplete, so that clients notice the error.
+		log.Printf("export of %s failed: %v", drawerName, err)
+		return
+	}
+
+	if err := tw.Close(); err != nil {
+		log.Printf("export of %s failed: %v", drawerName, err)
+	}
+}
+
+// importHandler restores files from an archive created by exportHandler. The
+// files are imported into the drawer they were exported from, or into the
+// drawer given as parameter. Existing files of the same name are replaced.
+type importHandler struct {
+	DB         *leveldb.DB
+	Frontend   string
+	Events     chan<- *data.Event
+	AuthFunc   basicauth.AuthenticatorFunc
+	AccessFunc drawerAccessFunc
+	LimitsFunc drawerLimitsFunc
+
+	// Scanner scans the imported files. If nil, they aren't scanned.
+	Scanner *uploadScanner
+}
+
+func (h *importHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !basicauth.Authenticate(w, r, h.AuthFunc) {
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	target := r.URL.Query().Get("drawer")
+	if target != "" && !validDrawerName(target) {
+		http.Error(w, "invalid drawer name", http.StatusNotAcceptable)
+		return
+	}
+
+	var events []*data.Event
+	defer func() {
+		if h.Events != nil {
+			for _, event := range events {
+				h.Events <- event
+			}
+		}
+	}()
+
+	metadata := make(map[string]*data.MetaData)
+	urls := []string{}
+
+	tr := tar.NewReader(r.Body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, "reading archive failed: "+err.Error(), http.StatusNotAcceptable)
+			return
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		fields := strings.SplitN(hdr.Name, "/", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		kind, drawerName, filename := fields[0], fields[1], fields[2]
+
+		switch kind {
+		case archiveMeta:
+			var md data.MetaData
+			if err := json.NewDecoder(tr).Decode(&md); err != nil {
+				http.Error(w, "invalid metadata in "+hdr.Name+": "+err.Error(), http.StatusNotAcceptable)
+				return
+			}
+			metadata[drawerName+"/"+strings.TrimSuffix(filename, ".json")] = &md
+		case archiveFiles:
+			md := metadata[drawerName+"/"+filename]
+			delete(metadata, drawerName+"/"+filename)
+
+			if target != "" {
+				drawerName = target
+			}
+			if !validDrawerName(drawerName) || !validFileName(filename) {
+				http.Error(w, "invalid file name "+hdr.Name, http.StatusNotAcceptable)
+				return
+			}
+			if !h.AccessFunc.permits(r, drawerName) {
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+
+			if err := h.LimitsFunc.limits(drawerName).checkFileSize(hdr.Size); err != nil {
+				http.Error(w, hdr.Name+": "+err.Error(), limitStatus(err))
+				return
+			}
+
+			content, err := ioutil.ReadAll(tr)
+			if err != nil {
+				http.Error(w, "reading archive failed: "+err.Error(), http.StatusNotAcceptable)
+				return
+			}
+
+			if md == nil {
+				md = &data.MetaData{}
+			}
+			if md.Sha256 != nil && md.GetSha256() != contentHash(content) {
+				http.Error(w, "checksum mismatch for "+hdr.Name, http.StatusNotAcceptable)
+				return
+			}
+			userMetadata := metadataUser(md)
+			if err := userMetadata.validate(); err != nil {
+				http.Error(w, "invalid metadata for "+hdr.Name+": "+err.Error(), http.StatusNotAcceptable)
+				return
+			}
+			userMetadata.apply(md)
+
+			// the archive can't vouch for what this server determines
+			// itself, the file is scanned and versioned like any upload.
+			md.Scan, md.Deleted, md.Version, md.Uploaded = nil, nil, nil, nil
+			if name := originalName(md.GetOriginalName()); name != "" {
+				md.OriginalName = proto.String(name)
+			} else {
+				md.OriginalName = nil
+			}
+
+			event, err := putFile(r.Context(), h.DB, h.Scanner, drawerName, filename, content, md, h.LimitsFunc.limits(drawerName))
+			if le, ok := err.(*limitError); ok {
+				http.Error(w, hdr.Name+": "+le.Error(), le.StatusCode)
+				return
+			} else if err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				log.Printf("importing %s:%s failed: %v", drawerName, filename, err)
+				return
+			}
+			events = append(events, event)
+			urls = append(urls, h.Frontend+"/"+drawerName+"/"+filename)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(urls); err != nil {
+		log.Printf("encoding list of imported files failed: %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akrennmair/cabinet/client"
+	"github.com/akrennmair/cabinet/data"
+	"github.com/golang/protobuf/proto"
+)
+
+func TestExportImport(t *testing.T) {
+	parent := newTestParent(t, nil)
+	defer parent.Server.Close()
+
+	childDB, r := newTestChild(t, parent.Server.URL, nil)
+	defer r.stop()
+
+	c := client.New(parent.Server.URL, "dummy", "auth")
+	ctx := context.Background()
+
+	files := map[string]string{
+		"index.html":   "<html>hello</html>",
+		"css/site.css": "body { color: red; }",
+	}
+	for name, content := range files {
+		if _, err := c.UploadWithOptions(ctx, strings.NewReader(content), &client.UploadOptions{Drawer: "site", ContentType: "text/x-test", Name: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archive, err := c.Export(ctx, "site")
+	if err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	rawArchive, err := ioutil.ReadAll(archive)
+	archive.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	urls, err := c.Import(ctx, bytes.NewReader(rawArchive), "restored")
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if len(urls) != len(files) {
+		t.Fatalf("expected %d imported files, got %v", len(files), urls)
+	}
+
+	restored, err := c.List(ctx, "restored", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range restored {
+		if f.ContentType != "text/x-test" || f.SHA256 != contentHash([]byte(files[f.Name])) {
+			t.Errorf("unexpected restored file %+v", f)
+		}
+	}
+
+	waitFor(t, "imported files on child", func() bool {
+		for name := range files {
+			if found, _ := childDB.Has([]byte("file:restored:"+name), nil); !found {
+				return false
+			}
+		}
+		return true
+	})
+
+	// importing without a drawer restores into the exported drawer.
+	if _, err := c.Import(ctx, bytes.NewReader(rawArchive), ""); err != nil {
+		t.Fatalf("Import into original drawer failed: %v", err)
+	}
+}
+
+func TestImportChecksumMismatch(t *testing.T) {
+	parent := newTestParent(t, nil)
+	defer parent.Server.Close()
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, entry := range []struct{ name, content string }{
+		{"meta/site/a.txt.json", `{"content_type":"text/plain","sha256":"0000"}`},
+		{"files/site/a.txt", "tampered"},
+	} {
+		tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: entry.name, Mode: 0644, Size: int64(len(entry.content))})
+		tw.Write([]byte(entry.content))
+	}
+	tw.Close()
+
+	c := client.New(parent.Server.URL, "dummy", "auth")
+	if _, err := c.Import(context.Background(), &archive, ""); !errors.Is(err, client.ErrNotAcceptable) {
+		t.Fatalf("expected ErrNotAcceptable, got %v", err)
+	}
+	if found, _ := parent.DB.Has([]byte("file:site:a.txt"), nil); found {
+		t.Fatal("file with checksum mismatch was imported")
+	}
+}
+
+func TestImportScanning(t *testing.T) {
+	parent := newTestParent(t, nil)
+	defer parent.Server.Close()
+
+	parent.setScanner(&uploadScanner{Scanner: fakeClamd(t), Kind: "clamd", Timeout: defaultScanTimeout})
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "files/site/eicar.com", Mode: 0644, Size: int64(len(eicar))})
+	tw.Write([]byte(eicar))
+	tw.Close()
+
+	c := client.New(parent.Server.URL, "dummy", "auth")
+	if _, err := c.Import(context.Background(), &archive, ""); !errors.Is(err, client.ErrInfected) {
+		t.Fatalf("expected ErrInfected, got %v", err)
+	}
+	if found, _ := parent.DB.Has([]byte("file:site:eicar.com"), nil); found {
+		t.Fatal("infected file was imported")
+	}
+}
+
+func TestImportMetadataValidation(t *testing.T) {
+	parent := newTestParent(t, nil)
+	defer parent.Server.Close()
+
+	c := client.New(parent.Server.URL, "dummy", "auth")
+	importFile := func(meta string) error {
+		var archive bytes.Buffer
+		tw := tar.NewWriter(&archive)
+		for _, entry := range []struct{ name, content string }{
+			{"meta/site/a.txt.json", meta},
+			{"files/site/a.txt", "hello"},
+		} {
+			tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: entry.name, Mode: 0644, Size: int64(len(entry.content))})
+			tw.Write([]byte(entry.content))
+		}
+		tw.Close()
+		_, err := c.Import(context.Background(), &archive, "")
+		return err
+	}
+
+	for _, meta := range []string{
+		`{"content_type":"text/plain","tags":["x:y:z"]}`,
+		`{"content_type":"text/plain","tags":["<b>"]}`,
+		`{"content_type":"text/plain","attributes":[{"key":"a b","value":"c"}]}`,
+	} {
+		if err := importFile(meta); !errors.Is(err, client.ErrNotAcceptable) {
+			t.Errorf("importing %s returned %v", meta, err)
+		}
+	}
+	if found, _ := parent.DB.Has([]byte("file:site:a.txt"), nil); found {
+		t.Fatal("file with invalid metadata was imported")
+	}
+
+	// fields owned by the server are replaced.
+	if err := importFile(`{"content_type":"text/plain","original_name":"../x\\evil\u0007.txt","scan":{"scanner":"clamd","infected":false},"version":7,"deleted":1,"uploaded":1}`); err != nil {
+		t.Fatal(err)
+	}
+	rawMetaData, err := parent.DB.Get([]byte("meta:site:a.txt"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var md data.MetaData
+	if err := proto.Unmarshal(rawMetaData, &md); err != nil {
+		t.Fatal(err)
+	}
+	if md.Scan != nil || md.Deleted != nil || md.GetVersion() != 1 || md.GetOriginalName() != "evil.txt" || time.Now().Unix()-md.GetUploaded() > 60 {
+		t.Fatalf("imported metadata wasn't sanitized: %v", &md)
+	}
+}
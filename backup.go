@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/akrennmair/cabinet/basicauth"
+	"github.com/akrennmair/cabinet/data"
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// A backup stream consists of records that each start with an operation
+// byte, followed by the key and the value, each prefixed by its length as
+// uvarint. backupReset deletes all keys of the kind given as key, of the
+// drawer given as e.g. file:<drawer>, or of the file given as e.g.
+// version:<drawer>:<filename>. The last record is backupEnd, whose value
+// contains the number of keys of each kind in the backed up database as
+// JSON, so that the backup can be verified. Kinds that are missing from the
+// counts don't exist in the backed up database anymore, and are deleted.
+// Records are applied in batches, but latest_event is only written together
+// with the end record, so that an interrupted backup is repeated from the
+// previous latest event.
+const (
+	backupPut    = 'P'
+	backupDelete = 'D'
+	backupReset  = 'R'
+	backupEnd    = 'E'
+
+	maxBackupFieldSize = 1 << 30
+)
+
+func writeBackupRecord(w io.Writer, op byte, key, value []byte) error {
+	buf := make([]byte, 1+2*binary.MaxVarintLen64)
+	buf[0] = op
+	n := 1 + binary.PutUvarint(buf[1:], uint64(len(key)))
+	if _, err := w.Write(buf[:n]); err != nil {
+		return err
+	}
+	if _, err := w.Write(key); err != nil {
+		return err
+	}
+	n = binary.PutUvarint(buf, uint64(len(value)))
+	if _, err := w.Write(buf[:n]); err != nil {
+		return err
+	}
+	_, err := w.Write(value)
+	return err
+}
+
+func readBackupRecord(r *bufio.Reader) (op byte, key, value []byte, err error) {
+	if op, err = r.ReadByte(); err != nil {
+		return 0, nil, nil, err
+	}
+
+	readField := func() ([]byte, error) {
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if size > maxBackupFieldSize {
+			return nil, fmt.Errorf("record field of %d bytes is too large", size)
+		}
+		field := make([]byte, size)
+		_, err = io.ReadFull(r, field)
+		return field, err
+	}
+
+	if key, err = readField(); err != nil {
+		return 0, nil, nil, unexpectedEOF(err)
+	}
+	if value, err = readField(); err != nil {
+		return 0, nil, nil, unexpectedEOF(err)
+	}
+	return op, key, value, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// keyKind returns the kind of a database key, i.e. the part before the first
+// colon, or the whole key if it doesn't contain one.
+func keyKind(key []byte) string {
+	s := string(key)
+	if n := strings.Index(s, ":"); n != -1 {
+		return s[:n]
+	}
+	return s
+}
+
+// backupHandler streams a backup of the whole database, read from a
+// snapshot. With a since parameter, it only contains the events following
+// that event and the current state of the files they refer to, including
+// their old versions and the trash, plus all keys that aren't files,
+// metadata, versions, trashed files or events.
+type backupHandler struct {
+	DB         *leveldb.DB
+	AuthFunc   basicauth.AuthenticatorFunc
+	AccessFunc drawerAccessFunc
+}
+
+func (h *backupHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !basicauth.Authenticate(w, r, h.AuthFunc) {
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	// backups contain all drawers.
+	if !h.AccessFunc.permits(r, "") {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	since := r.FormValue("since")
+	if since != "" && !strings.HasPrefix(since, "event:") {
+		http.Error(w, "invalid event ID", http.StatusNotAcceptable)
+		return
+	}
+
+	snapshot, err := h.DB.GetSnapshot()
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("getting snapshot for backup failed: %v", err)
+		return
+	}
+	defer snapshot.Release()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	bw := bufio.NewWriter(w)
+
+	if err := writeBackup(snapshot, bw, since); err != nil {
+		// the end record is missing, so clients notice the error.
+		log.Printf("backup failed: %v", err)
+		return
+	}
+
+	if err := bw.Flush(); err != nil {
+		log.Printf("backup failed: %v", err)
+	}
+}
+
+// incrementalKinds are the kinds of keys that incremental backups derive from
+// the event log. All other kinds are sent in full.
+var incrementalKinds = map[string]bool{"file": true, "meta": true, "version": true, "vmeta": true, "trash": true, "tmeta": true, "event": true}
+
+func writeBackup(snapshot *leveldb.Snapshot, w io.Writer, since string) error {
+	counts := make(map[string]int)
+
+	iterator := snapshot.NewIterator(nil, nil)
+	for iterator.Next() {
+		kind := keyKind(iterator.Key())
+		counts[kind]++
+
+		if since != "" {
+			if incrementalKinds[kind] {
+				continue
+			}
+			if counts[kind] == 1 {
+				if err := writeBackupRecord(w, backupReset, []byte(kind), nil); err != nil {
+					iterator.Release()
+					return err
+				}
+			}
+		}
+
+		if err := writeBackupRecord(w, backupPut, iterator.Key(), iterator.Value()); err != nil {
+			iterator.Release()
+			return err
+		}
+	}
+	iterator.Release()
+	if err := iterator.Error(); err != nil {
+		return err
+	}
+
+	if since != "" {
+		if err := writeIncrementalBackup(snapshot, w, since); err != nil {
+			return err
+		}
+	}
+
+	rawCounts, err := json.Marshal(counts)
+	if err != nil {
+		return err
+	}
+	return writeBackupRecord(w, backupEnd, nil, rawCounts)
+}
+
+func writeIncrementalBackup(snapshot *leveldb.Snapshot, w io.Writer, since string) error {
+	// the files touched by the events since the last backup, as
+	// drawer:filename, mapped to their drawer.
+	touched := make(map[string]string)
+
+	// the drawers that were deleted or renamed since the last backup, whose
+	// files are replaced completely.
+	reset := make(map[string]bool)
+
+	keyRange := util.BytesPrefix([]byte("event:"))
+	keyRange.Start = []byte(since + "\x00")
+
+	iterator := snapshot.NewIterator(keyRange, nil)
+	for iterator.Next() {
+		var event data.Event
+		if err := proto.Unmarshal(iterator.Value(), &event); err != nil {
+			iterator.Release()
+			return fmt.Errorf("unmarshalling %s failed: %v", iterator.Key(), err)
+		}
+		switch event.GetType() {
+		case data.Event_DRAWER:
+		case data.Event_DRAWER_DELETE:
+			reset[event.GetDrawer()] = true
+		case data.Event_DRAWER_RENAME:
+			reset[event.GetDrawer()] = true
+			reset[event.GetNewName()] = true
+		default:
+			touched[event.GetDrawer()+":"+event.GetFilename()] = event.GetDrawer()
+		}
+
+		if err := writeBackupRecord(w, backupPut, iterator.Key(), iterator.Value()); err != nil {
+			iterator.Release()
+			return err
+		}
+	}
+	iterator.Release()
+	if err := iterator.Error(); err != nil {
+		return err
+	}
+
+	var drawers []string
+	for d := range reset {
+		drawers = append(drawers, d)
+	}
+	sort.Strings(drawers)
+
+	for _, d := range drawers {
+		for _, kind := range []string{"file:", "meta:", "version:", "vmeta:", "trash:", "tmeta:"} {
+			if err := writeBackupPrefix(snapshot, w, kind+d); err != nil {
+				return err
+			}
+		}
+	}
+
+	var files []string
+	for f, d := range touched {
+		if !reset[d] {
+			files = append(files, f)
+		}
+	}
+	sort.Strings(files)
+
+	for _, f := range files {
+		for _, key := range [][]byte{[]byte("file:" + f), []byte("meta:" + f), []byte("trash:" + f), []byte("tmeta:" + f)} {
+			value, err := snapshot.Get(key, nil)
+			switch err {
+			case nil:
+				err = writeBackupRecord(w, backupPut, key, value)
+			case leveldb.ErrNotFound:
+				err = writeBackupRecord(w, backupDelete, key, nil)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		// old versions are added, pruned and deleted with the file.
+		for _, kind := range []string{"version:", "vmeta:"} {
+			if err := writeBackupPrefix(snapshot, w, kind+f); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// writeBackupPrefix replaces the key prefix and all keys starting with
+// prefix: in the backup with the ones of the snapshot.
+func writeBackupPrefix(snapshot *leveldb.Snapshot, w io.Writer, prefix string) error {
+	if err := writeBackupRecord(w, backupReset, []byte(prefix), nil); err != nil {
+		return err
+	}
+	iterator := snapshot.NewIterator(util.BytesPrefix([]byte(prefix+":")), nil)
+	defer iterator.Release()
+	for iterator.Next() {
+		if err := writeBackupRecord(w, backupPut, iterator.Key(), iterator.Value()); err != nil {
+			return err
+		}
+	}
+	return iterator.Error()
+}
+
+// applyBackup writes a backup stream to db, and returns the key counts
+// of the backed up database from the end record.
+func applyBackup(db *leveldb.DB, r io.Reader) (map[string]int, error) {
+	const batchSize = 1000
+
+	br := bufio.NewReader(r)
+	batch := new(leveldb.Batch)
+
+	// the new latest_event, or nil if it is deleted.
+	var (
+		latest        []byte
+		latestChanged bool
+	)
+
+	for {
+		op, key, value, err := readBackupRecord(br)
+		if err == io.EOF {
+			return nil, errors.New("backup is incomplete")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if string(key) == "latest_event" && (op == backupPut || op == backupDelete || op == backupReset) {
+			latest, latestChanged = nil, true
+			if op == backupPut {
+				latest = value
+			}
+			continue
+		}
+
+		switch op {
+		case backupPut:
+			batch.Put(key, value)
+		case backupDelete:
+			batch.Delete(key)
+		case backupReset:
+			if err := deleteKind(db, batch, string(key)); err != nil {
+				return nil, err
+			}
+		case backupEnd:
+			var counts map[string]int
+			if err := json.Unmarshal(value, &counts); err != nil {
+				return nil, fmt.Errorf("invalid key counts: %v", err)
+			}
+			// incremental backups only reset the kinds that still
+			// exist, e.g. not the storejob keys once the last job
+			// expired.
+			if err := deleteMissingKinds(db, batch, counts); err != nil {
+				return nil, err
+			}
+			if latestChanged {
+				if latest != nil {
+					batch.Put([]byte("latest_event"), latest)
+				} else {
+					batch.Delete([]byte("latest_event"))
+				}
+			}
+			if err := db.Write(batch, nil); err != nil {
+				return nil, err
+			}
+			return counts, nil
+		default:
+			return nil, fmt.Errorf("invalid backup record type %q", op)
+		}
+
+		if batch.Len() >= batchSize {
+			if err := db.Write(batch, nil); err != nil {
+				return nil, err
+			}
+			batch.Reset()
+		}
+	}
+}
+
+// deleteKind adds the deletion of all keys of a kind to batch.
+func deleteKind(db *leveldb.DB, batch *leveldb.Batch, kind string) error {
+	batch.Delete([]byte(kind))
+
+	iterator := db.NewIterator(util.BytesPrefix([]byte(kind+":")), nil)
+	defer iterator.Release()
+	for iterator.Next() {
+		batch.Delete(iterator.Key())
+	}
+	return iterator.Error()
+}
+
+// deleteMissingKinds adds the deletion of all keys whose kind is missing from
+// counts to batch.
+func deleteMissingKinds(db *leveldb.DB, batch *leveldb.Batch, counts map[string]int) error {
+	iterator := db.NewIterator(nil, nil)
+	defer iterator.Release()
+	for iterator.Next() {
+		if _, found := counts[keyKind(iterator.Key())]; !found {
+			batch.Delete(iterator.Key())
+		}
+	}
+	return iterator.Error()
+}
+
+// verifyBackup compares the number of keys of each kind in db with the
+// expected counts.
+func verifyBackup(db *leveldb.DB, expected map[string]int) error {
+	counts := make(map[string]int)
+
+	iterator := db.NewIterator(nil, nil)
+	for iterator.Next() {
+		counts[keyKind(iterator.Key())]++
+	}
+	iterator.Release()
+	if err := iterator.Error(); err != nil {
+		return err
+	}
+
+	var mismatches []string
+	for kind := range mergeKinds(counts, expected) {
+		if counts[kind] != expected[kind] {
+			mismatches = append(mismatches, fmt.Sprintf("%s: %d instead of %d", kind, counts[kind], expected[kind]))
+		}
+	}
+	if len(mismatches) > 0 {
+		sort.Strings(mismatches)
+		return fmt.Errorf("backup doesn't match the server's key counts: %s", strings.Join(mismatches, ", "))
+	}
+	return nil
+}
+
+func mergeKinds(a, b map[string]int) map[string]bool {
+	kinds := make(map[string]bool)
+	for kind := range a {
+		kinds[kind] = true
+	}
+	for kind := range b {
+		kinds[kind] = true
+	}
+	return kinds
+}
+
+func backupCommand(c *cli, fs *flag.FlagSet) func(args []string) error {
+	incremental := fs.Bool("incremental", false, "only fetch the changes since the latest event of an existing backup")
+
+	return func(args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+		dir := args[0]
+
+		if !*incremental {
+			if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+				return fmt.Errorf("%s is not empty, use -incremental to update an existing backup", dir)
+			}
+		}
+
+		db, err := leveldb.OpenFile(dir, nil)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		since := ""
+		if *incremental {
+			latest, err := db.Get([]byte("latest_event"), nil)
+			if err != nil && err != leveldb.ErrNotFound {
+				return err
+			}
+			since = string(latest)
+		}
+
+		stream, err := c.api.Backup(context.Background(), since)
+		if err != nil {
+			return err
+		}
+		defer stream.Close()
+
+		counts, err := applyBackup(db, stream)
+		if err != nil {
+			return err
+		}
+
+		if err := verifyBackup(db, counts); err != nil {
+			return err
+		}
+
+		latest, _ := db.Get([]byte("latest_event"), nil)
+		if c.json {
+			return c.printJSON(map[string]interface{}{"latest_event": string(latest), "keys": counts})
+		}
+		fmt.Fprintf(c.stdout, "backup of %s verified, latest event %s\n", c.URL, latest)
+		return nil
+	}
+}
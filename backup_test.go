@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/akrennmair/cabinet/client"
+	"github.com/akrennmair/cabinet/data"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func TestBackup(t *testing.T) {
+	parent := newTestParent(t, nil)
+	defer parent.Server.Close()
+
+	c := &cli{URL: parent.Server.URL, User: "dummy", Password: "auth"}
+	dir := filepath.Join(t.TempDir(), "backup")
+
+	first := parent.upload(t, http.DefaultClient, "test", "text/plain", "first")
+	parent.upload(t, http.DefaultClient, "other", "text/plain", "second")
+
+	// the only key of its kind, which is removed before the incremental
+	// backup.
+	if err := parent.DB.Put(storeJobKey("expired"), []byte(`{"id":"expired"}`), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := runTestCommand(c, "backup", dir); err != nil {
+		t.Fatalf("full backup failed: %v", err)
+	}
+	expectSameDB(t, parent.DB, dir)
+
+	if _, err := runTestCommand(c, "backup", dir); err == nil {
+		t.Fatal("full backup into existing backup succeeded")
+	}
+
+	parent.upload(t, http.DefaultClient, "test", "text/plain", "third")
+	if _, err := runTestCommand(c, "rm", first); err != nil {
+		t.Fatal(err)
+	}
+	if resp := drawerRequest(t, parent, "POST", "/api/drawers/other/rename?to=renamed", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("renaming drawer returned %d", resp.StatusCode)
+	}
+
+	// old versions are part of incremental backups.
+	if resp := drawerRequest(t, parent, "POST", "/api/drawers", `{"name": "docs", "versioning": true}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("creating drawer returned %d", resp.StatusCode)
+	}
+	cl := client.New(parent.Server.URL, "dummy", "auth")
+	for _, content := range []string{"draft", "final"} {
+		if _, err := cl.UploadWithOptions(context.Background(), strings.NewReader(content), &client.UploadOptions{Drawer: "docs", Name: "report.txt"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := parent.DB.Delete(storeJobKey("expired"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := runTestCommand(c, "backup", "-incremental", dir); err != nil {
+		t.Fatalf("incremental backup failed: %v", err)
+	}
+	expectSameDB(t, parent.DB, dir)
+}
+
+func TestBackupIncomplete(t *testing.T) {
+	parent := newTestParent(t, nil)
+	defer parent.Server.Close()
+
+	parent.upload(t, http.DefaultClient, "test", "text/plain", "content")
+
+	snapshot, err := parent.DB.GetSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Release()
+
+	var stream bytes.Buffer
+	if err := writeBackup(snapshot, &stream, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	db := openBackup(t, t.TempDir())
+	defer db.Close()
+
+	if _, err := applyBackup(db, bytes.NewReader(stream.Bytes()[:stream.Len()-10])); err == nil {
+		t.Fatal("applying truncated backup succeeded")
+	}
+
+	counts, err := applyBackup(db, &stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyBackup(db, counts); err != nil {
+		t.Fatal(err)
+	}
+
+	counts["file"]++
+	if err := verifyBackup(db, counts); err == nil {
+		t.Fatal("verification with wrong key count succeeded")
+	}
+}
+
+func TestBackupInterrupted(t *testing.T) {
+	parent := newTestParent(t, nil)
+	defer parent.Server.Close()
+
+	c := &cli{URL: parent.Server.URL, User: "dummy", Password: "auth"}
+	dir := filepath.Join(t.TempDir(), "backup")
+
+	parent.upload(t, http.DefaultClient, "test", "text/plain", "first")
+	if _, err := runTestCommand(c, "backup", dir); err != nil {
+		t.Fatalf("full backup failed: %v", err)
+	}
+
+	// enough changes for the stream to be applied in several batches.
+	for i := 0; i < 600; i++ {
+		if _, err := putFile(context.Background(), parent.DB, nil, "test", fmt.Sprintf("file%d", i), []byte("content"), &data.MetaData{}, drawerLimits{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db := openBackup(t, dir)
+	since, err := db.Get([]byte("latest_event"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := parent.DB.GetSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stream bytes.Buffer
+	err = writeBackup(snapshot, &stream, string(since))
+	snapshot.Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := applyBackup(db, bytes.NewReader(stream.Bytes()[:stream.Len()*3/4])); err == nil {
+		t.Fatal("applying interrupted backup succeeded")
+	}
+	if latest, _ := db.Get([]byte("latest_event"), nil); !bytes.Equal(latest, since) {
+		t.Fatalf("interrupted backup moved latest_event from %s to %s", since, latest)
+	}
+	db.Close()
+
+	if _, err := runTestCommand(c, "backup", "-incremental", dir); err != nil {
+		t.Fatalf("incremental backup after interruption failed: %v", err)
+	}
+	expectSameDB(t, parent.DB, dir)
+}
+
+func openBackup(t *testing.T, dir string) *leveldb.DB {
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// expectSameDB compares all keys and values of db with the backup in dir.
+func expectSameDB(t *testing.T, db *leveldb.DB, dir string) {
+	t.Helper()
+
+	backup := openBackup(t, dir)
+	defer backup.Close()
+
+	expected := db.NewIterator(nil, nil)
+	defer expected.Release()
+	actual := backup.NewIterator(nil, nil)
+	defer actual.Release()
+
+	for expected.Next() {
+		if !actual.Next() {
+			t.Fatalf("backup lacks %s", expected.Key())
+		}
+		if !bytes.Equal(expected.Key(), actual.Key()) || !bytes.Equal(expected.Value(), actual.Value()) {
+			t.Fatalf("backup contains %s instead of %s", actual.Key(), expected.Key())
+		}
+	}
+	if actual.Next() {
+		t.Fatalf("backup contains additional key %s", actual.Key())
+	}
+}
@@ -2,6 +2,7 @@ package basicauth
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"net/http"
 	"strings"
@@ -50,6 +51,9 @@ func Authenticate(w http.ResponseWriter, r *http.Request, authFunc Authenticator
 		if err == nil {
 			pair := bytes.SplitN(payload, []byte(":"), 2)
 			if len(pair) == 2 && authFunc(string(pair[0]), string(pair[1])) {
+				if user, ok := r.Context().Value(userKey{}).(*string); ok {
+					*user = string(pair[0])
+				}
 				return true
 			}
 		}
@@ -61,3 +65,20 @@ func Authenticate(w http.ResponseWriter, r *http.Request, authFunc Authenticator
 	}
 	return false
 }
+
+type userKey struct{}
+
+// WithUser returns a copy of r in which Authenticate records the name of the
+// user it authenticated successfully. It can be read with User.
+func WithUser(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userKey{}, new(string)))
+}
+
+// User returns the name of the user that was authenticated for a request
+// returned by WithUser, or "" if no user has been authenticated.
+func User(r *http.Request) string {
+	if user, ok := r.Context().Value(userKey{}).(*string); ok {
+		return *user
+	}
+	return ""
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
 )
 
 func main() {
@@ -19,13 +20,13 @@ func main() {
 	if *uri == "" {
 		fmt.Println("No URL for deletion provided!")
 		flag.Usage()
-		return
+		os.Exit(1)
 	}
 
 	req, err := http.NewRequest("DELETE", *uri, nil)
 	if err != nil {
 		fmt.Printf("Creating request failed: %v\n", err)
-		return
+		os.Exit(1)
 	}
 
 	req.SetBasicAuth(*user, *pass)
@@ -33,14 +34,14 @@ func main() {
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		fmt.Printf("Request failed: %v\n", err)
-		return
+		os.Exit(1)
 	}
 
 	if resp.StatusCode != http.StatusNoContent {
 		fmt.Printf("Request failed: HTTP code = %d\n", resp.StatusCode)
 		errbody, _ := ioutil.ReadAll(resp.Body)
 		fmt.Printf("Additional output: %s\n", string(errbody))
-		return
+		os.Exit(1)
 	}
 
 	fmt.Println("OK")
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/akrennmair/cabinet/client"
+)
+
+// cli contains the settings shared by all client subcommands.
+type cli struct {
+	URL      string `toml:"url"`
+	User     string `toml:"user"`
+	Password string `toml:"pass"`
+
+	json   bool
+	stdout io.Writer
+	api    *client.Client
+}
+
+// clientCommand registers a subcommand's flags on fs and returns the
+// function that runs the subcommand with the remaining arguments.
+type clientCommand func(c *cli, fs *flag.FlagSet) func(args []string) error
+
+var commands = map[string]struct {
+	cmd   clientCommand
+	usage string
+}{
+	"put":      {putCommand, "put -drawer <drawer> <file>... - upload files, - reads from stdin"},
+	"get":      {getCommand, "get [-o <file>] <url> - download a file"},
+	"rm":       {rmCommand, "rm <url>... - delete files"},
+	"undelete": {undeleteCommand, "undelete <url>... - restore deleted files from the trash"},
+	"ls":       {lsCommand, "ls [<drawer>] - list drawers, or files within a drawer"},
+	"stat":     {statCommand, "stat <url> - show information about a file"},
+	"store":    {storeCommand, "store -drawer <drawer> <url>... - store files from remote URLs"},
+	"sign":     {signCommand, "sign [-ttl <duration>] <url> - create a signed, time-limited URL"},
+	"backup":   {backupCommand, "backup [-incremental] <dir> - create or update a backup of the whole database"},
+	"export":   {exportCommand, "export [-o <file>] <drawer> - download a drawer as tar archive"},
+	"import":   {importCommand, "import [-drawer <drawer>] <file> - restore an exported archive, - reads from stdin"},
+	"fsck":     {fsckCommand, "fsck [-repair] -datafile <file> - check the data file of a stopped server"},
+	"sync":     {syncCommand, "sync [-delete] [-dry-run] <dir> <drawer> - upload changed files, or with -pull, sync <drawer> <dir> to download them"},
+}
+
+// offlineCommands work directly on a data file instead of talking to a
+// server.
+var offlineCommands = map[string]bool{"fsck": true}
+
+// errUsage indicates that a subcommand was called with invalid arguments.
+var errUsage = errors.New("invalid arguments")
+
+func commandUsage() {
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "Usage: cabinet [flags] to run the server, or cabinet <command> [flags] [args]:\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  cabinet %s\n", commands[name].usage)
+	}
+	fmt.Fprintf(os.Stderr, "Run cabinet <command> -h for the flags of a command.\n")
+}
+
+// runCommand runs a client subcommand and returns the exit code.
+func runCommand(name string, args []string) int {
+	command, found := commands[name]
+	if !found {
+		fmt.Fprintf(os.Stderr, "Unknown command %s.\n", name)
+		commandUsage()
+		return 2
+	}
+
+	c := &cli{stdout: os.Stdout}
+	offline := offlineCommands[name]
+
+	fs := flag.NewFlagSet("cabinet "+name, flag.ContinueOnError)
+	var configFile, serverURL, user, pass *string
+	if !offline {
+		configFile = fs.String("config", defaultClientConfig(), "path to client configuration file")
+		serverURL = fs.String("url", "", "cabinet server URL, e.g. http://localhost:8080")
+		user = fs.String("user", "", "user name")
+		pass = fs.String("pass", "", "password")
+	}
+	fs.BoolVar(&c.json, "json", false, "print JSON output")
+	run := command.cmd(c, fs)
+
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if !offline {
+		if err := c.loadConfig(*configFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+		if *serverURL != "" {
+			c.URL = *serverURL
+		}
+		if *user != "" {
+			c.User = *user
+		}
+		if *pass != "" {
+			c.Password = *pass
+		}
+		if c.URL == "" {
+			fmt.Fprintf(os.Stderr, "Error: no server URL configured, use -url or CABINET_URL\n")
+			return 1
+		}
+		c.api = client.New(c.URL, c.User, c.Password)
+	}
+
+	if err := run(fs.Args()); err != nil {
+		if err == errUsage {
+			fmt.Fprintf(os.Stderr, "Usage: cabinet %s\n", command.usage)
+			fs.PrintDefaults()
+			return 2
+		}
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+func defaultClientConfig() string {
+	if dir, err := os.UserConfigDir(); err == nil {
+		return filepath.Join(dir, "cabinet", "client.toml")
+	}
+	return ""
+}
+
+// loadConfig reads the client configuration file, if it exists, and applies
+// the CABINET_URL, CABINET_USER and CABINET_PASS environment variables.
+func (c *cli) loadConfig(configFile string) error {
+	if configFile != "" {
+		if _, err := toml.DecodeFile(configFile, c); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	for setting, field := range map[string]*string{"url": &c.URL, "user": &c.User, "pass": &c.Password} {
+		if value, ok := os.LookupEnv(envName(setting)); ok {
+			*field = value
+		}
+	}
+
+	return nil
+}
+
+func (c *cli) printJSON(v interface{}) error {
+	enc := json.NewEncoder(c.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func putCommand(c *cli, fs *flag.FlagSet) func(args []string) error {
+	drawer := fs.String("drawer", "", "drawer name")
+	contentType := fs.String("type", "", "MIME type of the files; detected from the file names and contents if empty")
+	ext := fs.String("ext", "", "file name extension; taken from the file names if empty")
+
+	return func(args []string) error {
+		if *drawer == "" || len(args) == 0 {
+			return errUsage
+		}
+
+		type result struct {
+			File string `json:"file"`
+			URL  string `json:"url"`
+		}
+		var results []result
+
+		for _, fn := range args {
+			uri, err := c.put(fn, *drawer, *contentType, *ext)
+			if err != nil {
+				return err
+			}
+			if !c.json {
+				fmt.Fprintln(c.stdout, uri)
+			}
+			results = append(results, result{File: fn, URL: uri})
+		}
+
+		if c.json {
+			return c.printJSON(results)
+		}
+		return nil
+	}
+}
+
+func (c *cli) put(fn, drawer, contentType, ext string) (string, error) {
+	var f io.Reader = os.Stdin
+	if fn != "-" {
+		file, err := os.Open(fn)
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+		f = file
+
+		if ext == "" {
+			ext = strings.TrimPrefix(filepath.Ext(fn), ".")
+		}
+	}
+
+	buffered := bufio.NewReaderSize(f, 512)
+	if contentType == "" {
+		contentType = detectContentType(fn, buffered)
+	}
+
+	return c.api.UploadWithOptions(context.Background(), rewound(f, buffered), &client.UploadOptions{
+		Drawer:      drawer,
+		ContentType: contentType,
+		Ext:         ext,
+		Filename:    filepath.Base(fn),
+	})
+}
+
+// rewound returns f after seeking back to its start, so that the client can
+// retry uploading it, or buffered if f can't seek.
+func rewound(f io.Reader, buffered *bufio.Reader) io.Reader {
+	if file, ok := f.(*os.File); ok {
+		if _, err := file.Seek(0, io.SeekStart); err == nil {
+			return file
+		}
+	}
+	return buffered
+}
+
+// detectContentType determines a file's MIME type from its extension, or by
+// peeking at the beginning of its content.
+func detectContentType(fn string, r *bufio.Reader) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(fn)); contentType != "" {
+		return contentType
+	}
+	head, _ := r.Peek(512)
+	return http.DetectContentType(head)
+}
+
+func getCommand(c *cli, fs *flag.FlagSet) func(args []string) error {
+	output := fs.String("o", "-", "output file, - for stdout")
+
+	return func(args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+
+		body, _, err := c.api.Get(context.Background(), args[0])
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		out := c.stdout
+		if *output != "-" {
+			f, err := os.Create(*output)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			out = f
+		}
+
+		if _, err := io.Copy(out, body); err != nil {
+			return err
+		}
+
+		if f, ok := out.(*os.File); ok && f != os.Stdout {
+			return f.Close()
+		}
+		return nil
+	}
+}
+
+func undeleteCommand(c *cli, fs *flag.FlagSet) func(args []string) error {
+	return func(args []string) error {
+		if len(args) == 0 {
+			return errUsage
+		}
+
+		var restored []string
+
+		for _, ref := range args {
+			uri, _, _, err := c.api.FileURL(ref)
+			if err != nil {
+				return err
+			}
+
+			if err := c.api.Undelete(context.Background(), uri); err != nil {
+				return err
+			}
+
+			if !c.json {
+				fmt.Fprintf(c.stdout, "restored %s\n", uri)
+			}
+			restored = append(restored, uri)
+		}
+
+		if c.json {
+			return c.printJSON(restored)
+		}
+		return nil
+	}
+}
+
+func rmCommand(c *cli, fs *flag.FlagSet) func(args []string) error {
+	return func(args []string) error {
+		if len(args) == 0 {
+			return errUsage
+		}
+
+		var deleted []string
+
+		for _, ref := range args {
+			uri, _, _, err := c.api.FileURL(ref)
+			if err != nil {
+				return err
+			}
+
+			if err := c.api.Delete(context.Background(), uri); err != nil {
+				return err
+			}
+
+			if !c.json {
+				fmt.Fprintf(c.stdout, "deleted %s\n", uri)
+			}
+			deleted = append(deleted, uri)
+		}
+
+		if c.json {
+			return c.printJSON(deleted)
+		}
+		return nil
+	}
+}
+
+func lsCommand(c *cli, fs *flag.FlagSet) func(args []string) error {
+	limit := fs.Int("limit", 0, "maximum number of files to list, 0 for all")
+
+	return func(args []string) error {
+		if len(args) > 1 {
+			return errUsage
+		}
+
+		if len(args) == 0 {
+			drawers, err := c.api.ListDrawers(context.Background())
+			if err != nil {
+				return err
+			}
+			if c.json {
+				return c.printJSON(drawers)
+			}
+			for _, d := range drawers {
+				fmt.Fprintln(c.stdout, d.Name)
+			}
+			return nil
+		}
+
+		files, err := c.api.List(context.Background(), args[0], &client.ListOptions{Limit: *limit})
+		if err != nil {
+			return err
+		}
+		if c.json {
+			return c.printJSON(files)
+		}
+		for _, f := range files {
+			fmt.Fprintf(c.stdout, "%10d  %-30s  %s\n", f.Size, f.ContentType, f.URL)
+		}
+		return nil
+	}
+}
+
+func statCommand(c *cli, fs *flag.FlagSet) func(args []string) error {
+	return func(args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+
+		info, err := c.api.Stat(context.Background(), args[0])
+		if err != nil {
+			return err
+		}
+
+		if c.json {
+			return c.printJSON(info)
+		}
+
+		fmt.Fprintf(c.stdout, "URL:          %s\n", info.URL)
+		fmt.Fprintf(c.stdout, "Drawer:       %s\n", info.Drawer)
+		fmt.Fprintf(c.stdout, "Name:         %s\n", info.Name)
+		if info.OriginalName != "" {
+			fmt.Fprintf(c.stdout, "Original:     %s\n", info.OriginalName)
+		}
+		if info.Version != 0 {
+			fmt.Fprintf(c.stdout, "Version:      %d\n", info.Version)
+		}
+		fmt.Fprintf(c.stdout, "Size:         %d\n", info.Size)
+		fmt.Fprintf(c.stdout, "Content-Type: %s\n", info.ContentType)
+		if info.Source != "" {
+			fmt.Fprintf(c.stdout, "Source:       %s\n", info.Source)
+		}
+		return nil
+	}
+}
+
+func storeCommand(c *cli, fs *flag.FlagSet) func(args []string) error {
+	drawer := fs.String("drawer", "", "drawer name")
+	ext := fs.String("ext", "", "file name extension; taken from the URL if empty")
+
+	return func(args []string) error {
+		if *drawer == "" || len(args) == 0 {
+			return errUsage
+		}
+
+		type result struct {
+			Source string `json:"source"`
+			URL    string `json:"url"`
+		}
+		var results []result
+
+		for _, source := range args {
+			uri, err := c.api.Store(context.Background(), source, *drawer, *ext)
+			if err != nil {
+				return err
+			}
+			if !c.json {
+				fmt.Fprintln(c.stdout, uri)
+			}
+			results = append(results, result{Source: source, URL: uri})
+		}
+
+		if c.json {
+			return c.printJSON(results)
+		}
+		return nil
+	}
+}
+
+func signCommand(c *cli, fs *flag.FlagSet) func(args []string) error {
+	ttl := fs.Duration("ttl", defaultSignatureTTL, "how long the signed URL is valid")
+
+	return func(args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+
+		uri, err := c.api.Sign(context.Background(), args[0], *ttl)
+		if err != nil {
+			return err
+		}
+
+		if c.json {
+			return c.printJSON(map[string]string{"url": uri})
+		}
+		fmt.Fprintln(c.stdout, uri)
+		return nil
+	}
+}
+
+func exportCommand(c *cli, fs *flag.FlagSet) func(args []string) error {
+	output := fs.String("o", "-", "output file, - for stdout")
+
+	return func(args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+
+		archive, err := c.api.Export(context.Background(), args[0])
+		if err != nil {
+			return err
+		}
+		defer archive.Close()
+
+		if *output == "-" {
+			_, err := io.Copy(c.stdout, archive)
+			return err
+		}
+
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, archive); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+}
+
+func importCommand(c *cli, fs *flag.FlagSet) func(args []string) error {
+	drawer := fs.String("drawer", "", "drawer to import into; the exported drawer if empty")
+
+	return func(args []string) error {
+		if len(args) != 1 {
+			return errUsage
+		}
+
+		var archive io.Reader = os.Stdin
+		if args[0] != "-" {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			archive = f
+		}
+
+		urls, err := c.api.Import(context.Background(), archive, *drawer)
+		if err != nil {
+			return err
+		}
+
+		if c.json {
+			return c.printJSON(urls)
+		}
+		for _, uri := range urls {
+			fmt.Fprintln(c.stdout, uri)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/akrennmair/cabinet/client"
+)
+
+func runTestCommand(c *cli, name string, args ...string) (string, error) {
+	var stdout bytes.Buffer
+	c.stdout = &stdout
+
+	c.api = client.New(c.URL, c.User, c.Password)
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.BoolVar(&c.json, "json", false, "")
+	run := commands[name].cmd(c, fs)
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+
+	err := run(fs.Args())
+	return stdout.String(), err
+}
+
+func TestClientCommands(t *testing.T) {
+	parent := newTestParent(t, nil)
+	defer parent.Server.Close()
+
+	c := &cli{URL: parent.Server.URL, User: "dummy", Password: "auth"}
+
+	fn := filepath.Join(t.TempDir(), "hello.txt")
+	if err := os.WriteFile(fn, []byte("hello world!"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := runTestCommand(c, "put", "-drawer=test", fn)
+	if err != nil {
+		t.Fatalf("put failed: %v", err)
+	}
+	fileURL := strings.TrimSpace(out)
+	if !strings.HasPrefix(fileURL, parent.Server.URL+"/test/") || !strings.HasSuffix(fileURL, ".txt") {
+		t.Fatalf("unexpected URL %s", fileURL)
+	}
+
+	out, err = runTestCommand(c, "ls", "-json", "test")
+	if err != nil {
+		t.Fatalf("ls failed: %v", err)
+	}
+	var files []fileInfo
+	if err := json.Unmarshal([]byte(out), &files); err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].URL != fileURL || files[0].Size != 12 || !strings.HasPrefix(files[0].ContentType, "text/plain") {
+		t.Fatalf("unexpected file list %+v", files)
+	}
+
+	out, err = runTestCommand(c, "ls")
+	if err != nil {
+		t.Fatalf("ls failed: %v", err)
+	}
+	if out != "test\n" {
+		t.Fatalf("expected drawer test, got %q", out)
+	}
+
+	out, err = runTestCommand(c, "stat", "-json", fileURL)
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	var info fileInfo
+	if err := json.Unmarshal([]byte(out), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != 12 || info.Drawer != "test" {
+		t.Fatalf("unexpected file info %+v", info)
+	}
+
+	out, err = runTestCommand(c, "get", strings.TrimPrefix(fileURL, parent.Server.URL+"/"))
+	if err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if out != "hello world!" {
+		t.Fatalf("expected hello world!, got %q", out)
+	}
+
+	out, err = runTestCommand(c, "sign", "-ttl=1h", fileURL)
+	if err != nil {
+		t.Fatalf("sign failed: %v", err)
+	}
+	resp, err := http.Get(strings.TrimSpace(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "hello world!" {
+		t.Fatalf("signed URL returned %d %q", resp.StatusCode, body)
+	}
+
+	resp, err = http.Get(strings.Replace(strings.TrimSpace(out), "signature=", "signature=00", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for invalid signature, got %d instead.", resp.StatusCode)
+	}
+
+	if _, err := runTestCommand(c, "rm", fileURL); err != nil {
+		t.Fatalf("rm failed: %v", err)
+	}
+
+	if _, err := runTestCommand(c, "stat", fileURL); err == nil {
+		t.Fatal("stat of deleted file succeeded")
+	}
+
+	if _, err := runTestCommand(c, "put", fn); err != errUsage {
+		t.Fatalf("expected usage error for put without drawer, got %v", err)
+	}
+}
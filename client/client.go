@@ -0,0 +1,770 @@
+// Package client implements a client for the cabinet HTTP API.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	metaHeaderPrefix = "X-Cabinet-Meta-"
+	tagsHeader       = "X-Cabinet-Tags"
+	versionHeader    = "X-Cabinet-Version"
+)
+
+// Client talks to a cabinet server. Requests that fail with a network
+// error or a 5xx status code are retried with exponential backoff.
+type Client struct {
+	// URL is the cabinet server's base URL, e.g. http://localhost:8080.
+	URL      string
+	Username string
+	Password string
+
+	// HTTPClient is used for all requests. If nil, http.DefaultClient is
+	// used.
+	HTTPClient *http.Client
+
+	// MaxRetries is the number of times a failed request is retried.
+	MaxRetries int
+
+	// RetryDelay is the delay before the first retry. It doubles with
+	// every further retry.
+	RetryDelay time.Duration
+}
+
+// New returns a client for the cabinet server at baseURL.
+func New(baseURL, username, password string) *Client {
+	return &Client{
+		URL:        strings.TrimSuffix(baseURL, "/"),
+		Username:   username,
+		Password:   password,
+		MaxRetries: 3,
+		RetryDelay: 500 * time.Millisecond,
+	}
+}
+
+var (
+	ErrUnauthorized  = errors.New("cabinet: unauthorized")
+	ErrForbidden     = errors.New("cabinet: forbidden")
+	ErrNotFound      = errors.New("cabinet: not found")
+	ErrNotAcceptable = errors.New("cabinet: not acceptable")
+
+	// ErrTooLarge is returned for files exceeding the maximum file size,
+	// ErrQuotaExceeded for uploads exceeding the drawer's quota.
+	ErrTooLarge      = errors.New("cabinet: file too large")
+	ErrQuotaExceeded = errors.New("cabinet: quota exceeded")
+
+	// ErrInfected is returned for uploads that the server's malware
+	// scanner found to be infected.
+	ErrInfected = errors.New("cabinet: file is infected")
+)
+
+// Error is returned for responses with an unexpected status code. It
+// matches ErrUnauthorized, ErrForbidden, ErrNotFound, ErrNotAcceptable,
+// ErrTooLarge, ErrQuotaExceeded and ErrInfected with errors.Is, depending on
+// the status code.
+type Error struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %s: %d %s", e.Method, e.URL, e.StatusCode, e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrNotAcceptable:
+		return e.StatusCode == http.StatusNotAcceptable
+	case ErrTooLarge:
+		return e.StatusCode == http.StatusRequestEntityTooLarge
+	case ErrQuotaExceeded:
+		return e.StatusCode == http.StatusInsufficientStorage
+	case ErrInfected:
+		return e.StatusCode == http.StatusUnprocessableEntity
+	}
+	return false
+}
+
+// FileInfo describes a stored file.
+type FileInfo struct {
+	Name        string `json:"name"`
+	Drawer      string `json:"drawer"`
+	URL         string `json:"url"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+	Source      string `json:"source,omitempty"`
+
+	// OriginalName is the name of the file when it was uploaded or stored,
+	// if known.
+	OriginalName string `json:"original_name,omitempty"`
+
+	// SHA256 is the hex-encoded SHA-256 hash of the content. It is only set
+	// by List.
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Version counts the uploads of the file, starting with 1.
+	Version int64 `json:"version,omitempty"`
+
+	// Attributes are the key/value pairs attached to the file, with keys in
+	// lower case. Tags are sorted.
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Tags       []string          `json:"tags,omitempty"`
+}
+
+// Version describes a version of a file. Old versions are only kept in
+// drawers with versioning.
+type Version struct {
+	Version     int64  `json:"version"`
+	URL         string `json:"url"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+	SHA256      string `json:"sha256"`
+	Uploaded    int64  `json:"uploaded,omitempty"`
+	Current     bool   `json:"current,omitempty"`
+}
+
+// Drawer describes a drawer.
+type Drawer struct {
+	Name string `json:"name"`
+}
+
+// UploadOptions control how a file is uploaded.
+type UploadOptions struct {
+	Drawer      string
+	ContentType string
+
+	// Ext is appended to the generated file name.
+	Ext string
+
+	// Filename is sent as the file name of the uploaded part. The server
+	// keeps it as the original name of the file, and takes the extension
+	// from it unless Ext is set.
+	Filename string
+
+	// Name is the name the file is stored under, instead of a generated
+	// one. An existing file of that name is overwritten. Names may contain
+	// slashes.
+	Name string
+
+	// Attributes and Tags are attached to the file. Attribute keys may
+	// contain lower case letters, digits, '-' and '_', tags may contain
+	// letters, digits, '.', '_' and '-'.
+	Attributes map[string]string
+	Tags       []string
+}
+
+// Upload uploads the content read from r to a drawer, and returns the new
+// file's URL. The content is streamed, so it is only retried if r is an
+// io.Seeker that can seek, like an *os.File of a regular file. Uploads
+// without a Name are only retried after 5xx responses, not after network
+// errors, as the file might have been stored under a new name anyway.
+func (c *Client) Upload(ctx context.Context, r io.Reader, contentType, drawer, ext string) (string, error) {
+	return c.UploadWithOptions(ctx, r, &UploadOptions{Drawer: drawer, ContentType: contentType, Ext: ext})
+}
+
+// UploadWithOptions works like Upload, but allows for more options.
+func (c *Client) UploadWithOptions(ctx context.Context, r io.Reader, opts *UploadOptions) (string, error) {
+	query := url.Values{}
+	query.Set("drawer", opts.Drawer)
+	if opts.Ext != "" {
+		query.Set("ext", opts.Ext)
+	}
+	if opts.Name != "" {
+		query.Set("name", opts.Name)
+	}
+	uri := c.URL + "/api/upload?" + query.Encode()
+
+	contentType := opts.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	// Every attempt copies r into the request body in its own goroutine,
+	// which has to be finished with r before r is rewound for the next
+	// attempt or handed back to the caller.
+	var pr *io.PipeReader
+	var done chan struct{}
+	wait := func() {
+		if pr != nil {
+			pr.Close()
+			<-done
+		}
+	}
+	defer wait()
+
+	retry := retryAll
+	if opts.Name == "" {
+		retry = retryResponses
+	}
+	rewind, retry := rewinder(r, retry)
+	newRequest := func() (*http.Request, error) {
+		wait()
+		if err := rewind(); err != nil {
+			return nil, err
+		}
+
+		var pw *io.PipeWriter
+		pr, pw = io.Pipe()
+		done = make(chan struct{})
+		mw := multipart.NewWriter(pw)
+
+		go func() {
+			defer close(done)
+			headers := make(textproto.MIMEHeader)
+			headers.Set("Content-Type", contentType)
+			if opts.Filename != "" {
+				headers.Set("Content-Disposition", mime.FormatMediaType("form-data", map[string]string{
+					"name":     "file",
+					"filename": opts.Filename,
+				}))
+			}
+			for key, value := range opts.Attributes {
+				headers.Set(metaHeaderPrefix+key, value)
+			}
+			if len(opts.Tags) > 0 {
+				headers.Set(tagsHeader, strings.Join(opts.Tags, ","))
+			}
+			part, err := mw.CreatePart(headers)
+			if err == nil {
+				_, err = io.Copy(part, r)
+			}
+			if err == nil {
+				err = mw.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+
+		req, err := http.NewRequest("POST", uri, pr)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		return req, nil
+	}
+
+	resp, err := c.send(ctx, newRequest, http.StatusOK, retry)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var urls []string
+	if err := json.NewDecoder(resp.Body).Decode(&urls); err != nil {
+		return "", fmt.Errorf("decoding upload response failed: %v", err)
+	}
+	if len(urls) != 1 {
+		return "", fmt.Errorf("expected 1 URL in upload response, got %d", len(urls))
+	}
+
+	return urls[0], nil
+}
+
+// Store lets the server fetch a file from sourceURL and store it in a
+// drawer. It returns the new file's URL. If ext is empty, the extension is
+// taken from sourceURL.
+func (c *Client) Store(ctx context.Context, sourceURL, drawer, ext string) (string, error) {
+	query := url.Values{}
+	query.Set("url", sourceURL)
+	query.Set("drawer", drawer)
+	if ext != "" {
+		query.Set("ext", ext)
+	}
+	return c.getText(ctx, c.URL+"/api/store?"+query.Encode())
+}
+
+// Delete deletes a file. The file can be referred to by its URL or as
+// drawer/filename.
+func (c *Client) Delete(ctx context.Context, file string) error {
+	uri, _, _, err := c.FileURL(file)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(ctx, simpleRequest("DELETE", uri), http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Get downloads a file. The caller needs to close the returned reader.
+func (c *Client) Get(ctx context.Context, file string) (io.ReadCloser, *FileInfo, error) {
+	resp, info, err := c.fileRequest(ctx, "GET", file)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.Body, info, nil
+}
+
+// Stat returns information about a file.
+func (c *Client) Stat(ctx context.Context, file string) (*FileInfo, error) {
+	resp, info, err := c.fileRequest(ctx, "HEAD", file)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return info, nil
+}
+
+func (c *Client) fileRequest(ctx context.Context, method, file string) (*http.Response, *FileInfo, error) {
+	uri, drawer, filename, err := c.FileURL(file)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := c.do(ctx, simpleRequest(method, uri), http.StatusOK)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info := &FileInfo{
+		Name:        filename,
+		Drawer:      drawer,
+		URL:         uri,
+		Size:        resp.ContentLength,
+		ContentType: resp.Header.Get("Content-Type"),
+		Source:      resp.Header.Get("Content-Location"),
+	}
+	for name, values := range resp.Header {
+		if strings.HasPrefix(name, metaHeaderPrefix) && len(values) > 0 {
+			if info.Attributes == nil {
+				info.Attributes = make(map[string]string)
+			}
+			info.Attributes[strings.ToLower(strings.TrimPrefix(name, metaHeaderPrefix))] = values[0]
+		}
+	}
+	if tags := resp.Header.Get(tagsHeader); tags != "" {
+		info.Tags = strings.Split(tags, ",")
+	}
+	if version, err := strconv.ParseInt(resp.Header.Get(versionHeader), 10, 64); err == nil {
+		info.Version = version
+	}
+	if disposition := resp.Header.Get("Content-Disposition"); disposition != "" {
+		if _, params, err := mime.ParseMediaType(disposition); err == nil {
+			info.OriginalName = params["filename"]
+		}
+	}
+
+	return resp, info, nil
+}
+
+// MetadataUpdate changes the attributes and tags of a file.
+type MetadataUpdate struct {
+	// Attributes are added or replaced, and removed if their value is nil.
+	Attributes map[string]*string `json:"attributes,omitempty"`
+
+	// Tags replace all tags of the file, unless they're nil.
+	Tags []string `json:"tags,omitempty"`
+}
+
+// UpdateMetadata changes the attributes and tags of a file without
+// uploading it again.
+func (c *Client) UpdateMetadata(ctx context.Context, file string, update *MetadataUpdate) error {
+	_, drawer, filename, err := c.FileURL(file)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+
+	uri := c.URL + "/api/meta/" + drawer + "/" + filename
+	resp, err := c.do(ctx, func() (*http.Request, error) {
+		return http.NewRequest("PATCH", uri, bytes.NewReader(body))
+	}, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Versions lists the current and the old versions of a file, newest first.
+// Old versions are fetched with Get from their URL.
+func (c *Client) Versions(ctx context.Context, file string) ([]Version, error) {
+	_, drawer, filename, err := c.FileURL(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []Version
+	if err := c.getJSON(ctx, c.URL+"/api/versions/"+drawer+"/"+filename, &versions); err != nil {
+		return nil, err
+	}
+	return versions, nil
+}
+
+// Restore makes an old version the current version of a file, and returns
+// the version number of the restored file.
+func (c *Client) Restore(ctx context.Context, file string, version int64) (int64, error) {
+	_, drawer, filename, err := c.FileURL(file)
+	if err != nil {
+		return 0, err
+	}
+
+	uri := c.URL + "/api/versions/" + drawer + "/" + filename + "?restore=" + strconv.FormatInt(version, 10)
+	resp, err := c.do(ctx, simpleRequest("POST", uri), http.StatusNoContent)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return strconv.ParseInt(resp.Header.Get(versionHeader), 10, 64)
+}
+
+// TrashedFile describes a deleted file in the trash. Deleted and Purge are
+// the times it was deleted and will be purged, in seconds since the epoch.
+type TrashedFile struct {
+	Name         string `json:"name"`
+	Drawer       string `json:"drawer"`
+	Size         int64  `json:"size"`
+	ContentType  string `json:"content_type"`
+	OriginalName string `json:"original_name,omitempty"`
+	Version      int64  `json:"version"`
+	Deleted      int64  `json:"deleted"`
+	Purge        int64  `json:"purge"`
+}
+
+// Trash lists the deleted files of a drawer that can still be undeleted.
+func (c *Client) Trash(ctx context.Context, drawer string) ([]TrashedFile, error) {
+	var files []TrashedFile
+	if err := c.getJSON(ctx, c.URL+"/api/trash/"+drawer, &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// Undelete restores a deleted file from the trash. It fails with ErrNotFound
+// if the file isn't in the trash.
+func (c *Client) Undelete(ctx context.Context, file string) error {
+	_, drawer, filename, err := c.FileURL(file)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(ctx, simpleRequest("POST", c.URL+"/api/undelete/"+drawer+"/"+filename), http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// ListOptions restrict which files are listed.
+type ListOptions struct {
+	// After only lists files whose names sort after it.
+	After string
+
+	// Limit is the maximum number of files listed. 0 means no limit.
+	Limit int
+
+	// Tags only lists files with all of the tags. With tags, the drawer may
+	// be empty to list the files of all drawers, and After then takes
+	// drawer:filename.
+	Tags []string
+}
+
+// List lists the files in a drawer.
+func (c *Client) List(ctx context.Context, drawer string, opts *ListOptions) ([]FileInfo, error) {
+	query := url.Values{}
+	if drawer != "" {
+		query.Set("drawer", drawer)
+	}
+	if opts != nil {
+		for _, tag := range opts.Tags {
+			query.Add("tag", tag)
+		}
+		if opts.After != "" {
+			query.Set("after", opts.After)
+		}
+		if opts.Limit > 0 {
+			query.Set("limit", strconv.Itoa(opts.Limit))
+		}
+	}
+
+	var files []FileInfo
+	if err := c.getJSON(ctx, c.URL+"/api/list?"+query.Encode(), &files); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// ListDrawers lists all drawers the user can access.
+func (c *Client) ListDrawers(ctx context.Context) ([]Drawer, error) {
+	var drawers []Drawer
+	if err := c.getJSON(ctx, c.URL+"/api/list", &drawers); err != nil {
+		return nil, err
+	}
+	return drawers, nil
+}
+
+// Sign returns a signed URL that grants access to a file for the duration
+// of ttl.
+func (c *Client) Sign(ctx context.Context, file string, ttl time.Duration) (string, error) {
+	_, drawer, filename, err := c.FileURL(file)
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{}
+	query.Set("drawer", drawer)
+	query.Set("file", filename)
+	query.Set("ttl", ttl.String())
+
+	return c.getText(ctx, c.URL+"/api/sign?"+query.Encode())
+}
+
+// Export downloads all files of a drawer as tar archive. The caller needs
+// to close the returned reader.
+func (c *Client) Export(ctx context.Context, drawer string) (io.ReadCloser, error) {
+	query := url.Values{}
+	query.Set("drawer", drawer)
+
+	resp, err := c.do(ctx, simpleRequest("GET", c.URL+"/api/export?"+query.Encode()), http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Import restores the files from a tar archive created by Export, and
+// returns their URLs. If drawer is empty, the files are imported into the
+// drawer they were exported from. Only io.Seeker archives are retried.
+func (c *Client) Import(ctx context.Context, archive io.Reader, drawer string) ([]string, error) {
+	query := url.Values{}
+	if drawer != "" {
+		query.Set("drawer", drawer)
+	}
+	uri := c.URL + "/api/import?" + query.Encode()
+
+	rewind, retry := rewinder(archive, retryAll)
+	newRequest := func() (*http.Request, error) {
+		if err := rewind(); err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest("POST", uri, ioutil.NopCloser(archive))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-tar")
+		return req, nil
+	}
+
+	resp, err := c.send(ctx, newRequest, http.StatusOK, retry)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var urls []string
+	if err := json.NewDecoder(resp.Body).Decode(&urls); err != nil {
+		return nil, fmt.Errorf("decoding import response failed: %v", err)
+	}
+	return urls, nil
+}
+
+// Backup downloads a backup stream of the whole database. If since is an
+// event ID, the backup only contains the changes following that event. The
+// caller needs to close the returned reader.
+func (c *Client) Backup(ctx context.Context, since string) (io.ReadCloser, error) {
+	query := url.Values{}
+	if since != "" {
+		query.Set("since", since)
+	}
+
+	resp, err := c.do(ctx, simpleRequest("GET", c.URL+"/api/backup?"+query.Encode()), http.StatusOK)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// FileURL turns a file reference, either a full URL or drawer/filename,
+// into a URL and the drawer and filename it refers to.
+func (c *Client) FileURL(file string) (uri, drawer, filename string, err error) {
+	uri = file
+	if !strings.Contains(file, "://") {
+		uri = c.URL + "/" + strings.TrimPrefix(file, "/")
+	}
+
+	parsedURL, err := url.Parse(uri)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(parsedURL.Path, "/"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", "", fmt.Errorf("%s doesn't refer to a file, expected drawer/filename", file)
+	}
+
+	return uri, parts[0], parts[1], nil
+}
+
+func (c *Client) getText(ctx context.Context, uri string) (string, error) {
+	resp, err := c.do(ctx, simpleRequest("GET", uri), http.StatusOK)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(body)), nil
+}
+
+func (c *Client) getJSON(ctx context.Context, uri string, v interface{}) error {
+	resp, err := c.do(ctx, simpleRequest("GET", uri), http.StatusOK)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("decoding response from %s failed: %v", uri, err)
+	}
+	return nil
+}
+
+// retryPolicy determines which failed attempts of a request are retried.
+type retryPolicy int
+
+const (
+	// retryAll retries after network errors and 5xx responses.
+	retryAll retryPolicy = iota
+
+	// retryResponses only retries after 5xx responses, for requests that
+	// must not be repeated if they might have succeeded.
+	retryResponses
+
+	// retryNone sends a request only once.
+	retryNone
+)
+
+// rewinder returns a function to be called before every attempt to send r.
+// From the second attempt on, it seeks back to where r started. If r can't
+// seek, the returned policy is retryNone, otherwise it is retry.
+func rewinder(r io.Reader, retry retryPolicy) (func() error, retryPolicy) {
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		return func() error { return nil }, retryNone
+	}
+	// stdin is an *os.File, too, but can't seek if it is a pipe.
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return func() error { return nil }, retryNone
+	}
+
+	attempt := 0
+	return func() error {
+		if attempt++; attempt == 1 {
+			return nil
+		}
+		_, err := seeker.Seek(start, io.SeekStart)
+		return err
+	}, retry
+}
+
+func simpleRequest(method, uri string) func() (*http.Request, error) {
+	return func() (*http.Request, error) {
+		return http.NewRequest(method, uri, nil)
+	}
+}
+
+// do sends the request returned by newRequest, retrying it on network
+// errors and 5xx responses other than 507, as an exceeded quota doesn't go
+// away by retrying. Responses with a status code other than
+// expectedStatus are returned as *Error.
+func (c *Client) do(ctx context.Context, newRequest func() (*http.Request, error), expectedStatus int) (*http.Response, error) {
+	return c.send(ctx, newRequest, expectedStatus, retryAll)
+}
+
+// send works like do, but only retries as allowed by retry. If a request
+// can't be created again, the error of the previous attempt is returned.
+func (c *Client) send(ctx context.Context, newRequest func() (*http.Request, error), expectedStatus int, retry retryPolicy) (*http.Response, error) {
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	var lastErr error
+	delay := c.RetryDelay
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			delay *= 2
+		}
+
+		req, err := newRequest()
+		if err != nil {
+			if lastErr != nil {
+				return nil, lastErr
+			}
+			return nil, err
+		}
+		req = req.WithContext(ctx)
+		if c.Username != "" || c.Password != "" {
+			req.SetBasicAuth(c.Username, c.Password)
+		}
+
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			if ctx.Err() != nil || retry != retryAll || attempt >= c.MaxRetries {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+
+		if resp.StatusCode == expectedStatus {
+			return resp, nil
+		}
+
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+
+		apiErr := &Error{
+			Method:     req.Method,
+			URL:        req.URL.String(),
+			StatusCode: resp.StatusCode,
+			Message:    strings.TrimSpace(string(msg)),
+		}
+		if apiErr.Message == "" {
+			apiErr.Message = http.StatusText(resp.StatusCode)
+		}
+
+		if resp.StatusCode < 500 || resp.StatusCode == http.StatusInsufficientStorage || retry == retryNone || attempt >= c.MaxRetries {
+			return nil, apiErr
+		}
+		lastErr = apiErr
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/akrennmair/cabinet/client"
+)
+
+func TestClient(t *testing.T) {
+	parent := newTestParent(t, nil)
+	defer parent.Server.Close()
+
+	c := client.New(parent.Server.URL, "dummy", "auth")
+	ctx := context.Background()
+
+	fileURL, err := c.Upload(ctx, strings.NewReader("hello world!"), "text/plain", "test", "txt")
+	if err != nil {
+		t.Fatalf("Upload failed: %v", err)
+	}
+	if !strings.HasPrefix(fileURL, parent.Server.URL+"/test/") || !strings.HasSuffix(fileURL, ".txt") {
+		t.Fatalf("unexpected URL %s", fileURL)
+	}
+
+	files, err := c.List(ctx, "test", nil)
+	if err != nil {
+		t.Fatalf("List failed: %v", err)
+	}
+	if len(files) != 1 || files[0].URL != fileURL || files[0].Size != 12 || files[0].ContentType != "text/plain" {
+		t.Fatalf("unexpected file list %+v", files)
+	}
+
+	drawers, err := c.ListDrawers(ctx)
+	if err != nil {
+		t.Fatalf("ListDrawers failed: %v", err)
+	}
+	if len(drawers) != 1 || drawers[0].Name != "test" {
+		t.Fatalf("unexpected drawer list %+v", drawers)
+	}
+
+	body, info, err := c.Get(ctx, fileURL)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	content, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "hello world!" || info.Drawer != "test" || info.ContentType != "text/plain" {
+		t.Fatalf("unexpected content %q and info %+v", content, info)
+	}
+
+	if err := c.Delete(ctx, fileURL); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+
+	if _, err := c.Stat(ctx, fileURL); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("expected ErrNotFound after Delete, got %v", err)
+	}
+
+	if _, err := c.Upload(ctx, strings.NewReader("x"), "text/plain", "invalid drawer", ""); !errors.Is(err, client.ErrNotAcceptable) {
+		t.Fatalf("expected ErrNotAcceptable for invalid drawer, got %v", err)
+	}
+}
+
+func TestClientUnauthorized(t *testing.T) {
+	parent := newTestParent(t, nil)
+	defer parent.Server.Close()
+
+	server := httptest.NewServer(&listHandler{DB: parent.DB, AuthFunc: func(username, password string) bool {
+		return username == "dummy" && password == "auth"
+	}})
+	defer server.Close()
+
+	c := client.New(server.URL, "dummy", "wrong")
+	if _, err := c.ListDrawers(context.Background()); !errors.Is(err, client.ErrUnauthorized) {
+		t.Fatalf("expected ErrUnauthorized, got %v", err)
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	parent := newTestParent(t, nil)
+	defer parent.Server.Close()
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= 2 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		parent.Server.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	c := client.New(server.URL, "dummy", "auth")
+	c.RetryDelay = time.Millisecond
+
+	// strings.Reader is seekable, so the upload can be retried.
+	if _, err := c.Upload(context.Background(), strings.NewReader("hello"), "text/plain", "test", ""); err != nil {
+		t.Fatalf("Upload failed despite retries: %v", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Fatalf("expected 3 requests, got %d", n)
+	}
+
+	atomic.StoreInt32(&requests, 0)
+	c.MaxRetries = 1
+	if _, err := c.ListDrawers(context.Background()); err == nil {
+		t.Fatal("expected error after exhausting retries")
+	}
+
+	atomic.StoreInt32(&requests, 0)
+	c.MaxRetries = 3
+	c.RetryDelay = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.ListDrawers(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestClientRetryPolicies(t *testing.T) {
+	parent := newTestParent(t, nil)
+	defer parent.Server.Close()
+
+	var requests, failures int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch n := atomic.LoadInt32(&failures); {
+		case n > 0:
+			atomic.AddInt32(&failures, -1)
+			http.Error(w, "disk on fire", http.StatusInternalServerError)
+		case n < 0:
+			// drop the connection after reading the request, as if the
+			// response got lost.
+			atomic.AddInt32(&failures, 1)
+			ioutil.ReadAll(r.Body)
+			conn, _, _ := w.(http.Hijacker).Hijack()
+			conn.Close()
+		default:
+			parent.Server.Config.Handler.ServeHTTP(w, r)
+		}
+	}))
+	defer server.Close()
+
+	c := client.New(server.URL, "dummy", "auth")
+	c.RetryDelay = time.Millisecond
+	ctx := context.Background()
+
+	// bodies that can't seek are sent only once, and the server's error is
+	// returned.
+	atomic.StoreInt32(&requests, 0)
+	atomic.StoreInt32(&failures, 1)
+	body := ioutil.NopCloser(strings.NewReader("hello"))
+	if _, err := c.Upload(ctx, body, "text/plain", "test", ""); err == nil || !strings.Contains(err.Error(), "disk on fire") {
+		t.Fatalf("expected the server's error, got %v", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("upload that can't seek was sent %d times", n)
+	}
+
+	// uploads with generated names aren't repeated after network errors.
+	atomic.StoreInt32(&requests, 0)
+	atomic.StoreInt32(&failures, -1)
+	if _, err := c.Upload(ctx, strings.NewReader("hello"), "text/plain", "test", ""); err == nil {
+		t.Fatal("expected an error after the connection was dropped")
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("upload with a generated name was sent %d times", n)
+	}
+
+	// named uploads replace the same file, so they are.
+	atomic.StoreInt32(&requests, 0)
+	atomic.StoreInt32(&failures, -1)
+	if _, err := c.UploadWithOptions(ctx, strings.NewReader("hello"), &client.UploadOptions{Drawer: "test", Name: "hello.txt"}); err != nil {
+		t.Fatalf("named upload failed despite retries: %v", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Fatalf("expected 2 requests, got %d", n)
+	}
+}
@@ -0,0 +1,566 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/akrennmair/cabinet/accesslog"
+	"github.com/akrennmair/cabinet/data"
+)
+
+// config contains all settings of a cabinet instance. Settings are taken
+// from the command line defaults, the configuration file, environment
+// variables and command line flags, with the latter overriding the former.
+type config struct {
+	Listen          string        `toml:"listen"`
+	DataFile        string        `toml:"datafile"`
+	Frontend        string        `toml:"frontend"`
+	Parent          string        `toml:"parent"`
+	ParentUser      string        `toml:"parent_user"`
+	ParentPassword  string        `toml:"parent_pass"`
+	ForceParent     bool          `toml:"forceparent"`
+	ShutdownTimeout time.Duration `toml:"shutdown_timeout"`
+	SignKey         string        `toml:"sign_key"`
+
+	// User and Password are the credentials provided through -user and
+	// -pass or the CABINET_USER and CABINET_PASS environment variables.
+	User     string `toml:"-"`
+	Password string `toml:"-"`
+
+	Users    map[string]*userConfig    `toml:"users"`
+	Log      logConfig                 `toml:"log"`
+	TLS      tlsConfig                 `toml:"tls"`
+	Webhooks map[string]*webhookConfig `toml:"webhooks"`
+	Store    storeConfig               `toml:"store"`
+	Scan     scanConfig                `toml:"scan"`
+
+	// MaxFileSize limits the size of files in all drawers.
+	MaxFileSize int64                    `toml:"max_file_size"`
+	RateLimits  rateLimitConfig          `toml:"rate_limits"`
+	Drawers     map[string]*drawerConfig `toml:"drawers"`
+
+	// ExplicitDrawers refuses uploads to drawers that weren't created
+	// through /api/drawers.
+	ExplicitDrawers bool `toml:"explicit_drawers"`
+
+	// TrashRetention is how long deleted files are kept in the trash, from
+	// where they can be undeleted. If 0, files are deleted immediately.
+	TrashRetention time.Duration `toml:"trash_retention"`
+}
+
+type userConfig struct {
+	Password string `toml:"password"`
+
+	// Drawers restricts the user to the listed drawers. If empty, the user
+	// can access all drawers.
+	Drawers []string `toml:"drawers"`
+}
+
+// drawerConfig contains the quotas of a drawer.
+type drawerConfig struct {
+	MaxBytes    int64 `toml:"max_bytes"`
+	MaxFiles    int64 `toml:"max_files"`
+	MaxFileSize int64 `toml:"max_file_size"`
+
+	// RateLimits replaces the global rate limits for the drawer.
+	RateLimits *rateLimitConfig `toml:"rate_limits"`
+}
+
+type webhookConfig struct {
+	URL string `toml:"url"`
+
+	// Secret is the key of the HMAC-SHA256 signature sent with every
+	// delivery.
+	Secret string `toml:"secret"`
+
+	// Drawers and Events restrict the webhook to the listed drawers and
+	// event types (upload, delete, metadata, restore, trash, undelete,
+	// drawer, drawer_delete, drawer_rename). If empty, all are delivered.
+	Drawers []string `toml:"drawers"`
+	Events  []string `toml:"events"`
+
+	// MaxAttempts is the number of delivery attempts before an event is
+	// dead-lettered.
+	MaxAttempts int `toml:"max_attempts"`
+}
+
+// storeConfig restricts the remote fetches of /api/store. Zero values
+// select the defaults.
+type storeConfig struct {
+	ConnectTimeout time.Duration `toml:"connect_timeout"`
+	Timeout        time.Duration `toml:"timeout"`
+	MaxSize        int64         `toml:"max_size"`
+
+	// Schemes defaults to http and https.
+	Schemes []string `toml:"schemes"`
+
+	// AllowHosts restricts fetches to the listed hosts, DenyHosts excludes
+	// hosts. Entries starting with a dot match all subdomains.
+	AllowHosts []string `toml:"allow_hosts"`
+	DenyHosts  []string `toml:"deny_hosts"`
+
+	// AllowNetworks exempts networks from the blocking of loopback, private
+	// and link-local addresses.
+	AllowNetworks []string `toml:"allow_networks"`
+
+	// Workers is the number of asynchronous store jobs that run at the same
+	// time, MaxAttempts the number of attempts for each job.
+	Workers     int `toml:"workers"`
+	MaxAttempts int `toml:"max_attempts"`
+}
+
+type logConfig struct {
+	AccessLog      string   `toml:"access_log"`
+	Format         string   `toml:"format"`
+	TrustedProxies []string `toml:"trusted_proxies"`
+}
+
+// scanConfig configures the malware scanning of uploads. At most one of
+// Clamd, Command and URL selects the scanner; without any, uploads aren't
+// scanned.
+type scanConfig struct {
+	// Clamd is the address of a clamd daemon, either host:port or the path
+	// of its unix socket.
+	Clamd string `toml:"clamd"`
+
+	// Command is run with the file on its standard input, and exits with 0
+	// for clean and 1 for infected files, like clamscan -.
+	Command []string `toml:"command"`
+
+	// URL receives the file as POST request, and responds with JSON like
+	// {"infected": true, "signature": "..."}.
+	URL string `toml:"url"`
+
+	// Timeout limits the scan of a file, 60 seconds by default.
+	Timeout time.Duration `toml:"timeout"`
+
+	// Drawers restricts scanning to the listed drawers. If empty, uploads
+	// to all drawers are scanned.
+	Drawers []string `toml:"drawers"`
+
+	// Action is "reject" (the default) or "quarantine", which keeps
+	// infected files in the private QuarantineDrawer ("quarantine" by
+	// default) in addition to rejecting them.
+	Action           string `toml:"action"`
+	QuarantineDrawer string `toml:"quarantine_drawer"`
+}
+
+func (s *scanConfig) validate() error {
+	configured := 0
+	for _, set := range []bool{s.Clamd != "", len(s.Command) > 0, s.URL != ""} {
+		if set {
+			configured++
+		}
+	}
+	if configured > 1 {
+		return errors.New("only one of clamd, command and url can be set")
+	}
+	if s.Timeout < 0 {
+		return errors.New("timeout must not be negative")
+	}
+	switch s.Action {
+	case "", "reject", "quarantine":
+	default:
+		return fmt.Errorf("unknown action %q", s.Action)
+	}
+	if s.QuarantineDrawer != "" && !validDrawerName(s.QuarantineDrawer) {
+		return fmt.Errorf("invalid quarantine drawer %q", s.QuarantineDrawer)
+	}
+	if s.URL != "" {
+		if u, err := url.Parse(s.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid url %q", s.URL)
+		}
+	}
+	return nil
+}
+
+type tlsConfig struct {
+	Cert       string `toml:"cert"`
+	Key        string `toml:"key"`
+	ClientCA   string `toml:"client_ca"`
+	ReplMTLS   bool   `toml:"repl_mtls"`
+	ParentCA   string `toml:"parent_ca"`
+	ParentCert string `toml:"parent_cert"`
+	ParentKey  string `toml:"parent_key"`
+}
+
+// settings maps the names of all settings that can be overridden through
+// environment variables and flags to the corresponding fields.
+func (c *config) settings() map[string]interface{} {
+	return map[string]interface{}{
+		"listen":           &c.Listen,
+		"datafile":         &c.DataFile,
+		"frontend":         &c.Frontend,
+		"parent":           &c.Parent,
+		"parent_user":      &c.ParentUser,
+		"parent_pass":      &c.ParentPassword,
+		"forceparent":      &c.ForceParent,
+		"shutdown_timeout": &c.ShutdownTimeout,
+		"sign_key":         &c.SignKey,
+		"max_file_size":    &c.MaxFileSize,
+		"explicit_drawers": &c.ExplicitDrawers,
+		"trash_retention":  &c.TrashRetention,
+		"user":             &c.User,
+		"pass":             &c.Password,
+
+		"log.access_log":      &c.Log.AccessLog,
+		"log.format":          &c.Log.Format,
+		"log.trusted_proxies": &c.Log.TrustedProxies,
+
+		"tls.cert":        &c.TLS.Cert,
+		"tls.key":         &c.TLS.Key,
+		"tls.client_ca":   &c.TLS.ClientCA,
+		"tls.repl_mtls":   &c.TLS.ReplMTLS,
+		"tls.parent_ca":   &c.TLS.ParentCA,
+		"tls.parent_cert": &c.TLS.ParentCert,
+		"tls.parent_key":  &c.TLS.ParentKey,
+
+		"store.connect_timeout": &c.Store.ConnectTimeout,
+		"store.timeout":         &c.Store.Timeout,
+		"store.max_size":        &c.Store.MaxSize,
+		"store.schemes":         &c.Store.Schemes,
+		"store.allow_hosts":     &c.Store.AllowHosts,
+		"store.deny_hosts":      &c.Store.DenyHosts,
+		"store.allow_networks":  &c.Store.AllowNetworks,
+		"store.workers":         &c.Store.Workers,
+		"store.max_attempts":    &c.Store.MaxAttempts,
+
+		"scan.clamd":             &c.Scan.Clamd,
+		"scan.command":           &c.Scan.Command,
+		"scan.url":               &c.Scan.URL,
+		"scan.timeout":           &c.Scan.Timeout,
+		"scan.drawers":           &c.Scan.Drawers,
+		"scan.action":            &c.Scan.Action,
+		"scan.quarantine_drawer": &c.Scan.QuarantineDrawer,
+
+		"rate_limits.read_rate":          &c.RateLimits.ReadRate,
+		"rate_limits.read_burst":         &c.RateLimits.ReadBurst,
+		"rate_limits.write_rate":         &c.RateLimits.WriteRate,
+		"rate_limits.write_burst":        &c.RateLimits.WriteBurst,
+		"rate_limits.max_uploads":        &c.RateLimits.MaxUploads,
+		"rate_limits.delivery_bandwidth": &c.RateLimits.DeliveryBandwidth,
+	}
+}
+
+// flagSettings maps command line flags to settings.
+var flagSettings = map[string]string{
+	"listen":           "listen",
+	"datafile":         "datafile",
+	"user":             "user",
+	"pass":             "pass",
+	"frontend":         "frontend",
+	"parent":           "parent",
+	"forceparent":      "forceparent",
+	"shutdown-timeout": "shutdown_timeout",
+	"signkey":          "sign_key",
+	"accesslog":        "log.access_log",
+	"accesslog-format": "log.format",
+	"trusted-proxies":  "log.trusted_proxies",
+	"tls-cert":         "tls.cert",
+	"tls-key":          "tls.key",
+	"tls-client-ca":    "tls.client_ca",
+	"repl-mtls":        "tls.repl_mtls",
+	"parent-ca":        "tls.parent_ca",
+	"parent-cert":      "tls.parent_cert",
+	"parent-key":       "tls.parent_key",
+}
+
+// envName returns the name of the environment variable that overrides a
+// setting, e.g. CABINET_LOG_ACCESS_LOG for log.access_log.
+func envName(setting string) string {
+	return "CABINET_" + strings.ToUpper(strings.Replace(setting, ".", "_", -1))
+}
+
+func (c *config) set(setting, value string) error {
+	field, found := c.settings()[setting]
+	if !found {
+		return fmt.Errorf("unknown setting %s", setting)
+	}
+
+	var err error
+	switch v := field.(type) {
+	case *string:
+		*v = value
+	case *bool:
+		*v, err = strconv.ParseBool(value)
+	case *int:
+		*v, err = strconv.Atoi(value)
+	case *int64:
+		*v, err = strconv.ParseInt(value, 10, 64)
+	case *float64:
+		*v, err = strconv.ParseFloat(value, 64)
+	case *time.Duration:
+		*v, err = time.ParseDuration(value)
+	case *[]string:
+		*v = nil
+		for _, s := range strings.Split(value, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				*v = append(*v, s)
+			}
+		}
+	default:
+		return fmt.Errorf("setting %s has unsupported type %T", setting, field)
+	}
+
+	if err != nil {
+		return fmt.Errorf("invalid value %q for %s: %v", value, setting, err)
+	}
+	return nil
+}
+
+// loadConfig loads the configuration. The defaults are taken from fs,
+// overridden by the configuration file (if any), environment variables and
+// the flags that were set on the command line.
+func loadConfig(configFile string, fs *flag.FlagSet) (*config, error) {
+	c := &config{}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if setting, ok := flagSettings[f.Name]; ok && err == nil {
+			err = c.set(setting, f.DefValue)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if configFile != "" {
+		md, err := toml.DecodeFile(configFile, c)
+		if err != nil {
+			return nil, err
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("unknown settings in %s: %v", configFile, undecoded)
+		}
+	}
+
+	for setting := range c.settings() {
+		if value, ok := os.LookupEnv(envName(setting)); ok {
+			if err := c.set(setting, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		if setting, ok := flagSettings[f.Name]; ok && err == nil {
+			err = c.set(setting, f.Value.String())
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Password != "" {
+		if c.Users == nil {
+			c.Users = make(map[string]*userConfig)
+		}
+		c.Users[c.User] = &userConfig{Password: c.Password}
+	}
+
+	if c.ParentUser == "" && c.ParentPassword == "" {
+		c.ParentUser, c.ParentPassword = c.User, c.Password
+	}
+
+	return c, c.validate()
+}
+
+func (c *config) validate() error {
+	if len(c.Users) == 0 {
+		return errors.New("You need to provide username and password!")
+	}
+
+	for name, user := range c.Users {
+		if name == "" || user == nil || user.Password == "" {
+			return fmt.Errorf("user %q has no password", name)
+		}
+	}
+
+	if c.Frontend == "" {
+		return errors.New("You need to provide a front-facing URL, e.g. http://localhost:8080")
+	}
+
+	if _, err := url.Parse(c.Frontend); err != nil {
+		return fmt.Errorf("Invalid front-facing URL: %v", err)
+	}
+
+	if (c.TLS.Cert == "") != (c.TLS.Key == "") {
+		return errors.New("You need to provide both a TLS certificate and key!")
+	}
+
+	if c.TLS.ReplMTLS && (c.TLS.Cert == "" || c.TLS.ClientCA == "") {
+		return errors.New("Client certificate authentication for replication requires a TLS certificate, key and client CA!")
+	}
+
+	for name, webhook := range c.Webhooks {
+		if err := webhook.validate(); err != nil {
+			return fmt.Errorf("webhook %s: %v", name, err)
+		}
+	}
+
+	if c.MaxFileSize < 0 {
+		return errors.New("max_file_size must not be negative")
+	}
+	if c.TrashRetention < 0 {
+		return errors.New("trash_retention must not be negative")
+	}
+
+	for name, drawer := range c.Drawers {
+		if !validDrawerName(name) {
+			return fmt.Errorf("invalid drawer name %q", name)
+		}
+		if drawer == nil || drawer.MaxBytes < 0 || drawer.MaxFiles < 0 || drawer.MaxFileSize < 0 {
+			return fmt.Errorf("drawer %s: limits must not be negative", name)
+		}
+		if drawer.RateLimits != nil {
+			if err := drawer.RateLimits.validate(); err != nil {
+				return fmt.Errorf("drawer %s: %v", name, err)
+			}
+		}
+	}
+
+	if err := c.RateLimits.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Store.validate(); err != nil {
+		return fmt.Errorf("store: %v", err)
+	}
+
+	if err := c.Scan.validate(); err != nil {
+		return fmt.Errorf("scan: %v", err)
+	}
+
+	if _, err := accesslog.ParseFormat(c.Log.Format); err != nil {
+		return err
+	}
+
+	if _, err := accesslog.ParseNetworks(strings.Join(c.Log.TrustedProxies, ",")); err != nil {
+		return fmt.Errorf("Invalid trusted proxies: %v", err)
+	}
+
+	return nil
+}
+
+// restartRequired returns the settings that differ between c and old but
+// can't be changed without restarting.
+func (c *config) restartRequired(old *config) []string {
+	var changed []string
+
+	if !reflect.DeepEqual(c.Webhooks, old.Webhooks) {
+		changed = append(changed, "webhooks")
+	}
+
+	for setting, field := range c.settings() {
+		if strings.HasPrefix(setting, "log.") || setting == "user" || setting == "pass" || setting == "shutdown_timeout" || setting == "max_file_size" || setting == "explicit_drawers" || setting == "trash_retention" || strings.HasPrefix(setting, "rate_limits.") {
+			continue
+		}
+		if !reflect.DeepEqual(field, old.settings()[setting]) {
+			changed = append(changed, setting)
+		}
+	}
+
+	return changed
+}
+
+func (c *config) authenticate(username, password string) bool {
+	user, found := c.Users[username]
+	if !found {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) == 1
+}
+
+// canAccess reports whether a user may access a drawer. An empty drawer
+// name asks for access to all drawers.
+func (c *config) canAccess(username, drawer string) bool {
+	user, found := c.Users[username]
+	if !found {
+		return false
+	}
+	if len(user.Drawers) == 0 {
+		return true
+	}
+	for _, d := range user.Drawers {
+		if d == drawer {
+			return true
+		}
+	}
+	return false
+}
+
+// drawerLimits returns the limits of a drawer. A drawer's own maximum file
+// size takes precedence over the global one.
+func (c *config) drawerLimits(drawer string) drawerLimits {
+	limits := drawerLimits{MaxFileSize: c.MaxFileSize}
+	if d, found := c.Drawers[drawer]; found && d != nil {
+		limits.MaxBytes = d.MaxBytes
+		limits.MaxFiles = d.MaxFiles
+		if d.MaxFileSize > 0 {
+			limits.MaxFileSize = d.MaxFileSize
+		}
+	}
+	return limits
+}
+
+// rateLimits returns the rate limits of a drawer and the scope they apply
+// to, which is the drawer itself if it has its own limits.
+func (c *config) rateLimits(drawer string) (rateLimitConfig, string) {
+	if d, found := c.Drawers[drawer]; found && d != nil && d.RateLimits != nil {
+		return *d.RateLimits, drawer
+	}
+	return c.RateLimits, ""
+}
+
+func (w *webhookConfig) validate() error {
+	if w == nil {
+		return errors.New("no URL")
+	}
+
+	u, err := url.Parse(w.URL)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("URL %q is not an HTTP URL", w.URL)
+	}
+
+	for _, event := range w.Events {
+		if _, found := data.Event_Type_value[strings.ToUpper(event)]; !found || strings.EqualFold(event, "going_away") {
+			return fmt.Errorf("unknown event type %s", event)
+		}
+	}
+
+	if w.MaxAttempts < 0 {
+		return errors.New("max_attempts must not be negative")
+	}
+
+	return nil
+}
+
+func (s *storeConfig) validate() error {
+	for _, scheme := range s.Schemes {
+		if scheme != "http" && scheme != "https" {
+			return fmt.Errorf("unsupported scheme %s", scheme)
+		}
+	}
+
+	if s.ConnectTimeout < 0 || s.Timeout < 0 || s.MaxSize < 0 || s.Workers < 0 || s.MaxAttempts < 0 {
+		return errors.New("timeouts, max_size, workers and max_attempts must not be negative")
+	}
+
+	if _, err := accesslog.ParseNetworks(strings.Join(s.AllowNetworks, ",")); err != nil {
+		return fmt.Errorf("invalid allowed networks: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "cabinet.toml")
+	err := os.WriteFile(configFile, []byte(`
+listen = "localhost:9090"
+frontend = "http://files.example.com"
+datafile = "/var/lib/cabinet/data.db"
+
+[users.alice]
+password = "secret"
+drawers = ["alice"]
+
+[log]
+access_log = "/var/log/cabinet/access.log"
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("cabinet", flag.ContinueOnError)
+	fs.String("listen", "localhost:8080", "")
+	fs.String("datafile", "./data.db", "")
+	fs.String("user", "admin", "")
+	fs.String("pass", "", "")
+	fs.String("frontend", "", "")
+	fs.String("accesslog-format", "combined", "")
+	fs.Duration("shutdown-timeout", 30*time.Second, "")
+	if err := fs.Parse([]string{"-datafile=/tmp/data.db"}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("CABINET_LISTEN", "localhost:7070")
+	t.Setenv("CABINET_DATAFILE", "/srv/data.db")
+	t.Setenv("CABINET_PASS", "adminpass")
+
+	c, err := loadConfig(configFile, fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Listen != "localhost:7070" {
+		t.Errorf("expected listen address from environment, got %s instead.", c.Listen)
+	}
+	if c.DataFile != "/tmp/data.db" {
+		t.Errorf("expected data file from flag, got %s instead.", c.DataFile)
+	}
+	if c.Frontend != "http://files.example.com" {
+		t.Errorf("expected frontend from config file, got %s instead.", c.Frontend)
+	}
+	if c.Log.Format != "combined" || c.ShutdownTimeout != 30*time.Second {
+		t.Errorf("expected defaults from flags, got %q and %s instead.", c.Log.Format, c.ShutdownTimeout)
+	}
+
+	if !c.authenticate("alice", "secret") || !c.authenticate("admin", "adminpass") || c.authenticate("alice", "adminpass") {
+		t.Error("authentication doesn't match configured users")
+	}
+	if !c.canAccess("alice", "alice") || c.canAccess("alice", "bob") || c.canAccess("alice", "") || !c.canAccess("admin", "") {
+		t.Error("drawer access doesn't match configured users")
+	}
+
+	old := *c
+	c.Users = nil
+	c.Log.AccessLog = ""
+	if changed := c.restartRequired(&old); len(changed) != 0 {
+		t.Errorf("expected no settings requiring restart, got %v", changed)
+	}
+	c.Listen = "localhost:6060"
+	if changed := c.restartRequired(&old); len(changed) != 1 || changed[0] != "listen" {
+		t.Errorf("expected listen to require restart, got %v", changed)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// genericContentTypes are sent by clients that don't know the type of a
+// file. Files declared with them, or without any type, get a detected type
+// instead.
+var genericContentTypes = map[string]bool{
+	"":                         true,
+	"application/octet-stream": true,
+	"binary/octet-stream":      true,
+	"application/binary":       true,
+	"application/unknown":      true,
+}
+
+// riskyContentTypes can contain scripts that browsers execute in the origin
+// of the server. In drawers for user uploads, they're always delivered as
+// attachment.
+var riskyContentTypes = []string{
+	"text/html",
+	"application/xhtml+xml",
+	"image/svg+xml",
+	"text/xml",
+	"application/xml",
+	"text/javascript",
+	"application/javascript",
+	"application/ecmascript",
+	"text/ecmascript",
+	"application/x-shockwave-flash",
+}
+
+// resolveContentType returns the content type of a file. The declared type is
+// kept unless it is missing or generic, in which case the type is looked up
+// by the extension of name, and sniffed from the content if the extension is
+// unknown.
+func resolveContentType(declared, name string, content []byte) string {
+	mediaType, _, _ := mime.ParseMediaType(declared)
+	if !genericContentTypes[mediaType] {
+		return declared
+	}
+
+	if ext := path.Ext(name); ext != "" {
+		if contentType := mime.TypeByExtension(strings.ToLower(ext)); contentType != "" {
+			return contentType
+		}
+	}
+	return http.DetectContentType(content)
+}
+
+// matchContentType reports whether contentType matches one of patterns.
+// Patterns ending in /* match all subtypes.
+func matchContentType(patterns []string, contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+		if mediaType == pattern || strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(pattern, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// riskyContentType reports whether files of contentType could run scripts
+// when they're shown in a browser.
+func riskyContentType(contentType string) bool {
+	return matchContentType(riskyContentTypes, contentType)
+}
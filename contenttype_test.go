@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/akrennmair/cabinet/client"
+)
+
+func TestResolveContentType(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+	for _, tc := range []struct {
+		declared, name string
+		content        []byte
+		expected       string
+	}{
+		{"image/jpeg", "photo.png", png, "image/jpeg"},
+		{"", "style.css", []byte("body {}"), "text/css; charset=utf-8"},
+		{"application/octet-stream", "STYLE.CSS", []byte("body {}"), "text/css; charset=utf-8"},
+		{"application/octet-stream", "abc123", png, "image/png"},
+		{"", "abc123", []byte("<!DOCTYPE html><p>hi"), "text/html; charset=utf-8"},
+		{"binary/octet-stream", "", []byte{0, 1, 2}, "application/octet-stream"},
+	} {
+		if contentType := resolveContentType(tc.declared, tc.name, tc.content); contentType != tc.expected {
+			t.Errorf("resolveContentType(%q, %q) = %q, expected %q", tc.declared, tc.name, contentType, tc.expected)
+		}
+	}
+
+	limits := drawerLimits{ContentTypes: []string{"image/*", "text/*"}, DenyContentTypes: []string{"image/svg+xml", "text/html"}}
+	for contentType, allowed := range map[string]bool{
+		"image/png":                 true,
+		"text/plain; charset=utf-8": true,
+		"image/svg+xml":             false,
+		"text/html; charset=utf-8":  false,
+		"application/pdf":           false,
+	} {
+		if err := limits.checkContentType(contentType); (err == nil) != allowed {
+			t.Errorf("checkContentType(%q) returned %v", contentType, err)
+		}
+	}
+}
+
+func TestUserUploads(t *testing.T) {
+	parent := newTestParent(t, nil)
+	defer parent.Server.Close()
+
+	if resp := drawerRequest(t, parent, "POST", "/api/drawers", `{"name": "uploads", "user_uploads": true, "deny_content_types": ["application/x-msdownload"]}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("creating drawer returned %d", resp.StatusCode)
+	}
+
+	c := client.New(parent.Server.URL, "dummy", "auth")
+	ctx := context.Background()
+
+	page, err := c.UploadWithOptions(ctx, strings.NewReader("<html><script>alert(1)</script></html>"), &client.UploadOptions{Drawer: "uploads", Filename: "page.html"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") || !strings.HasPrefix(resp.Header.Get("Content-Disposition"), "attachment;") || resp.Header.Get("X-Content-Type-Options") != "nosniff" {
+		t.Fatalf("HTML file was delivered with %v", resp.Header)
+	}
+
+	image, err := c.UploadWithOptions(ctx, strings.NewReader("GIF89a..."), &client.UploadOptions{Drawer: "uploads"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := c.Stat(ctx, image); err != nil {
+		t.Fatal(err)
+	} else if info.ContentType != "image/gif" {
+		t.Fatalf("expected sniffed type image/gif, got %s", info.ContentType)
+	}
+	resp, err = http.Get(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("Content-Disposition") != "" {
+		t.Fatalf("image was delivered with Content-Disposition %q", resp.Header.Get("Content-Disposition"))
+	}
+
+	var apiErr *client.Error
+	if _, err := c.UploadWithOptions(ctx, strings.NewReader("MZ"), &client.UploadOptions{Drawer: "uploads", ContentType: "application/x-msdownload"}); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("uploading denied content type returned %v", err)
+	}
+}
@@ -1,110 +1,244 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"mime/multipart"
+	"mime"
 	"net/http"
-	"net/textproto"
 	"os"
-	"path"
+	"path/filepath"
 	"strings"
 	"time"
+
+	"github.com/akrennmair/cabinet/client"
 )
 
+// upload is a single file to upload. name is the file's name relative to the
+// directory it was found in, or its base name. Files found in directories
+// keep their relative name on the server, all others get a generated one.
+type upload struct {
+	path string
+	name string
+	keep bool
+}
+
 func main() {
 	var (
-		destinationAddr = flag.String("dest", "http://localhost:8080", "destination instance to which the file shall be uploaded")
-		mimeType        = flag.String("mimetype", "application/octet-stream", "MIME type of file")
-		inputFile       = flag.String("file", "", "file to upload")
+		destinationAddr = flag.String("dest", "http://localhost:8080", "destination instance to which the files shall be uploaded")
+		mimeType        = flag.String("mimetype", "", "MIME type of the files; detected from the file names and contents if empty")
+		inputFile       = flag.String("file", "", "file to upload; files can also be provided as arguments")
 		drawerName      = flag.String("drawer", "", "drawer name")
 		auth            = flag.String("auth", "", "authentication information, provided as username:password")
+		quiet           = flag.Bool("quiet", false, "don't show upload progress")
 	)
 
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] <file|glob|directory|->...\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+
 	flag.Parse()
 
-	if *inputFile == "" {
+	args := flag.Args()
+	if *inputFile != "" {
+		args = append([]string{*inputFile}, args...)
+	}
+
+	if len(args) == 0 {
 		fmt.Println("No input file provided!")
 		flag.Usage()
-		return
+		os.Exit(1)
 	}
 
 	if *drawerName == "" {
 		fmt.Println("No drawer name provided!")
 		flag.Usage()
-		return
+		os.Exit(1)
 	}
 
-	f, err := os.Open(*inputFile)
+	uploads, err := collectUploads(args)
 	if err != nil {
-		fmt.Printf("Error: couldn't open %s: %v\n", *inputFile, err)
-		return
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
 	}
 
-	var mpBuf bytes.Buffer
-	mw := multipart.NewWriter(&mpBuf)
-	mw.SetBoundary("cabinet-upload-" + time.Now().Format("20060102150405999999999"))
-
-	mimeHeaders := make(textproto.MIMEHeader)
-	mimeHeaders.Set("Content-Type", *mimeType)
+	c := client.New(*destinationAddr, "", "")
+	if *auth != "" {
+		elems := strings.SplitN(*auth, ":", 2)
+		if len(elems) != 2 {
+			fmt.Println("Error: authentication information must be in the format username:password!")
+			os.Exit(1)
+		}
+		c.Username, c.Password = elems[0], elems[1]
+	}
 
-	pw, err := mw.CreatePart(mimeHeaders)
-	if err != nil {
-		fmt.Printf("Error: couldn't create multipart data: %v\n", err)
-		return
+	for _, u := range uploads {
+		fileURL, err := uploadFile(c, u, *drawerName, *mimeType, !*quiet)
+		if err != nil {
+			fmt.Printf("Error: upload of %s failed: %v\n", u.path, err)
+			os.Exit(1)
+		}
+		fmt.Println(fileURL)
 	}
+}
+
+// collectUploads expands the arguments into the files to upload. Arguments
+// can be files, glob patterns, directories, which are walked recursively,
+// or - for stdin.
+func collectUploads(args []string) ([]upload, error) {
+	var uploads []upload
+
+	for _, arg := range args {
+		if arg == "-" {
+			uploads = append(uploads, upload{path: "-"})
+			continue
+		}
+
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %s: %v", arg, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("%s: no such file", arg)
+		}
 
-	if _, err := io.Copy(pw, f); err != nil {
-		fmt.Printf("Error: couldn't add file content to multipart data: %v\n", err)
-		return
+		for _, match := range matches {
+			fi, err := os.Stat(match)
+			if err != nil {
+				return nil, err
+			}
+
+			if !fi.IsDir() {
+				uploads = append(uploads, upload{path: match, name: filepath.Base(match)})
+				continue
+			}
+
+			err = filepath.Walk(match, func(path string, info os.FileInfo, err error) error {
+				if err != nil || !info.Mode().IsRegular() {
+					return err
+				}
+				rel, err := filepath.Rel(match, path)
+				if err != nil {
+					return err
+				}
+				uploads = append(uploads, upload{path: path, name: filepath.ToSlash(rel), keep: true})
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	if err := mw.Close(); err != nil {
-		fmt.Printf("Error: couldn't finish up multipart data: %v\n", err)
-		return
+	return uploads, nil
+}
+
+func uploadFile(c *client.Client, u upload, drawer, contentType string, showProgress bool) (string, error) {
+	var (
+		f    io.Reader = os.Stdin
+		size int64     = -1
+		ext  string
+	)
+
+	if u.path != "-" {
+		file, err := os.Open(u.path)
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+		f = file
+
+		if fi, err := file.Stat(); err == nil {
+			size = fi.Size()
+		}
+		ext = strings.TrimPrefix(filepath.Ext(u.path), ".")
 	}
 
-	basename := path.Base(*inputFile)
-	baseParts := strings.Split(basename, ".")
-	extension := baseParts[len(baseParts)-1]
+	// peek at the beginning of the content to detect its type.
+	buffered := bufio.NewReaderSize(f, 512)
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(u.path))
+		if contentType == "" {
+			head, _ := buffered.Peek(512)
+			contentType = http.DetectContentType(head)
+		}
+	}
 
-	req, err := http.NewRequest("POST", *destinationAddr+"/api/upload?drawer="+*drawerName+"&ext="+extension, &mpBuf)
-	if err != nil {
-		fmt.Printf("Error: couldn't create request: %v\n", err)
-		return
+	// files are uploaded unbuffered, so that the client can rewind them
+	// for retries.
+	var r io.Reader = buffered
+	if file, ok := f.(*os.File); ok && u.path != "-" {
+		if _, err := file.Seek(0, io.SeekStart); err == nil {
+			r = file
+		}
 	}
-	req.Header.Set("Content-Type", mw.FormDataContentType())
-	if *auth != "" {
-		elems := strings.Split(*auth, ":")
-		if len(elems) != 2 {
-			fmt.Println("Error: authentication information must be in the format username:password!")
-			return
+	if showProgress {
+		name := u.path
+		if name == "-" {
+			name = "stdin"
 		}
-		req.SetBasicAuth(elems[0], elems[1])
+		p := &progressReader{r: r, name: name, size: size}
+		defer p.finish()
+		r = p
 	}
 
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		fmt.Printf("Error: upload failed: %v\n", err)
-		return
+	opts := &client.UploadOptions{
+		Drawer:      drawer,
+		ContentType: contentType,
+		Ext:         ext,
+		Filename:    u.name,
 	}
-	if resp.StatusCode != http.StatusOK {
-		fmt.Print("Error: upload failed: ")
-		io.Copy(os.Stdout, resp.Body)
-		return
+	if u.keep {
+		opts.Name = u.name
 	}
+	return c.UploadWithOptions(context.Background(), r, opts)
+}
+
+// progressReader prints the progress of reading from r to stderr.
+type progressReader struct {
+	r       io.Reader
+	name    string
+	size    int64
+	read    int64
+	printed time.Time
+}
 
-	filenames := []string{}
+func (p *progressReader) Read(buf []byte) (int, error) {
+	n, err := p.r.Read(buf)
+	p.read += int64(n)
+	if time.Since(p.printed) >= 100*time.Millisecond {
+		p.print()
+	}
+	return n, err
+}
 
-	if err := json.NewDecoder(resp.Body).Decode(&filenames); err != nil {
-		fmt.Printf("Decoding response failed: %v\n", err)
-		return
+// Seek rewinds r for another attempt, if r can seek.
+func (p *progressReader) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := p.r.(io.Seeker)
+	if !ok {
+		return 0, errors.New("can't seek")
+	}
+	pos, err := seeker.Seek(offset, whence)
+	if err == nil {
+		p.read = pos
 	}
+	return pos, err
+}
 
-	for _, fn := range filenames {
-		fmt.Println(fn)
+func (p *progressReader) print() {
+	p.printed = time.Now()
+	if p.size > 0 {
+		fmt.Fprintf(os.Stderr, "\r%s: %d/%d bytes (%d%%)", p.name, p.read, p.size, p.read*100/p.size)
+	} else {
+		fmt.Fprintf(os.Stderr, "\r%s: %d bytes", p.name, p.read)
 	}
 }
+
+func (p *progressReader) finish() {
+	p.print()
+	fmt.Fprintln(os.Stderr)
+}
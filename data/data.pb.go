@@ -11,6 +11,8 @@ It is generated from these files:
 It has these top-level messages:
 	Event
 	MetaData
+	Attribute
+	ScanResult
 	ReplicationStart
 */
 package data
@@ -27,15 +29,48 @@ type Event_Type int32
 const (
 	Event_UPLOAD Event_Type = 1
 	Event_DELETE Event_Type = 2
+	// sent to replication children when the parent shuts down.
+	Event_GOING_AWAY Event_Type = 3
+	// a drawer was created or its settings were changed.
+	Event_DRAWER Event_Type = 4
+	// a drawer was deleted together with all its files.
+	Event_DRAWER_DELETE Event_Type = 5
+	// a drawer was renamed to new_name, together with all its files.
+	Event_DRAWER_RENAME Event_Type = 6
+	// the metadata of a file was changed.
+	Event_METADATA Event_Type = 7
+	// an older version of a file was restored as new version.
+	Event_RESTORE Event_Type = 8
+	// a file was moved to the trash, from where it can be undeleted
+	// until it is purged with a DELETE event.
+	Event_TRASH Event_Type = 9
+	// a file was restored from the trash.
+	Event_UNDELETE Event_Type = 10
 )
 
 var Event_Type_name = map[int32]string{
-	1: "UPLOAD",
-	2: "DELETE",
+	1:  "UPLOAD",
+	2:  "DELETE",
+	3:  "GOING_AWAY",
+	4:  "DRAWER",
+	5:  "DRAWER_DELETE",
+	6:  "DRAWER_RENAME",
+	7:  "METADATA",
+	8:  "RESTORE",
+	9:  "TRASH",
+	10: "UNDELETE",
 }
 var Event_Type_value = map[string]int32{
-	"UPLOAD": 1,
-	"DELETE": 2,
+	"UPLOAD":        1,
+	"DELETE":        2,
+	"GOING_AWAY":    3,
+	"DRAWER":        4,
+	"DRAWER_DELETE": 5,
+	"DRAWER_RENAME": 6,
+	"METADATA":      7,
+	"RESTORE":       8,
+	"TRASH":         9,
+	"UNDELETE":      10,
 }
 
 func (x Event_Type) Enum() *Event_Type {
@@ -60,6 +95,11 @@ type Event struct {
 	Drawer           *string     `protobuf:"bytes,2,req,name=drawer" json:"drawer,omitempty"`
 	Filename         *string     `protobuf:"bytes,3,req,name=filename" json:"filename,omitempty"`
 	Id               *string     `protobuf:"bytes,4,req,name=id" json:"id,omitempty"`
+	Settings         *string     `protobuf:"bytes,5,opt,name=settings" json:"settings,omitempty"`
+	NewName          *string     `protobuf:"bytes,6,opt,name=new_name" json:"new_name,omitempty"`
+	Metadata         *MetaData   `protobuf:"bytes,7,opt,name=metadata" json:"metadata,omitempty"`
+	Version          *int64      `protobuf:"varint,8,opt,name=version" json:"version,omitempty"`
+	RestoredVersion  *int64      `protobuf:"varint,9,opt,name=restored_version" json:"restored_version,omitempty"`
 	XXX_unrecognized []byte      `json:"-"`
 }
 
@@ -95,10 +135,53 @@ func (m *Event) GetId() string {
 	return ""
 }
 
+func (m *Event) GetSettings() string {
+	if m != nil && m.Settings != nil {
+		return *m.Settings
+	}
+	return ""
+}
+
+func (m *Event) GetNewName() string {
+	if m != nil && m.NewName != nil {
+		return *m.NewName
+	}
+	return ""
+}
+
+func (m *Event) GetMetadata() *MetaData {
+	if m != nil {
+		return m.Metadata
+	}
+	return nil
+}
+
+func (m *Event) GetVersion() int64 {
+	if m != nil && m.Version != nil {
+		return *m.Version
+	}
+	return 0
+}
+
+func (m *Event) GetRestoredVersion() int64 {
+	if m != nil && m.RestoredVersion != nil {
+		return *m.RestoredVersion
+	}
+	return 0
+}
+
 type MetaData struct {
-	ContentType      *string `protobuf:"bytes,1,req,name=content_type" json:"content_type,omitempty"`
-	Source           *string `protobuf:"bytes,2,opt,name=source" json:"source,omitempty"`
-	XXX_unrecognized []byte  `json:"-"`
+	ContentType      *string      `protobuf:"bytes,1,req,name=content_type" json:"content_type,omitempty"`
+	Source           *string      `protobuf:"bytes,2,opt,name=source" json:"source,omitempty"`
+	Sha256           *string      `protobuf:"bytes,3,opt,name=sha256" json:"sha256,omitempty"`
+	Uploaded         *int64       `protobuf:"varint,4,opt,name=uploaded" json:"uploaded,omitempty"`
+	Attributes       []*Attribute `protobuf:"bytes,5,rep,name=attributes" json:"attributes,omitempty"`
+	Tags             []string     `protobuf:"bytes,6,rep,name=tags" json:"tags,omitempty"`
+	OriginalName     *string      `protobuf:"bytes,7,opt,name=original_name" json:"original_name,omitempty"`
+	Scan             *ScanResult  `protobuf:"bytes,8,opt,name=scan" json:"scan,omitempty"`
+	Version          *int64       `protobuf:"varint,9,opt,name=version" json:"version,omitempty"`
+	Deleted          *int64       `protobuf:"varint,10,opt,name=deleted" json:"deleted,omitempty"`
+	XXX_unrecognized []byte       `json:"-"`
 }
 
 func (m *MetaData) Reset()         { *m = MetaData{} }
@@ -119,6 +202,126 @@ func (m *MetaData) GetSource() string {
 	return ""
 }
 
+func (m *MetaData) GetSha256() string {
+	if m != nil && m.Sha256 != nil {
+		return *m.Sha256
+	}
+	return ""
+}
+
+func (m *MetaData) GetUploaded() int64 {
+	if m != nil && m.Uploaded != nil {
+		return *m.Uploaded
+	}
+	return 0
+}
+
+func (m *MetaData) GetAttributes() []*Attribute {
+	if m != nil {
+		return m.Attributes
+	}
+	return nil
+}
+
+func (m *MetaData) GetTags() []string {
+	if m != nil {
+		return m.Tags
+	}
+	return nil
+}
+
+func (m *MetaData) GetOriginalName() string {
+	if m != nil && m.OriginalName != nil {
+		return *m.OriginalName
+	}
+	return ""
+}
+
+func (m *MetaData) GetScan() *ScanResult {
+	if m != nil {
+		return m.Scan
+	}
+	return nil
+}
+
+func (m *MetaData) GetVersion() int64 {
+	if m != nil && m.Version != nil {
+		return *m.Version
+	}
+	return 0
+}
+
+func (m *MetaData) GetDeleted() int64 {
+	if m != nil && m.Deleted != nil {
+		return *m.Deleted
+	}
+	return 0
+}
+
+type Attribute struct {
+	Key              *string `protobuf:"bytes,1,req,name=key" json:"key,omitempty"`
+	Value            *string `protobuf:"bytes,2,req,name=value" json:"value,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *Attribute) Reset()         { *m = Attribute{} }
+func (m *Attribute) String() string { return proto.CompactTextString(m) }
+func (*Attribute) ProtoMessage()    {}
+
+func (m *Attribute) GetKey() string {
+	if m != nil && m.Key != nil {
+		return *m.Key
+	}
+	return ""
+}
+
+func (m *Attribute) GetValue() string {
+	if m != nil && m.Value != nil {
+		return *m.Value
+	}
+	return ""
+}
+
+type ScanResult struct {
+	Scanner          *string `protobuf:"bytes,1,req,name=scanner" json:"scanner,omitempty"`
+	Infected         *bool   `protobuf:"varint,2,req,name=infected" json:"infected,omitempty"`
+	Signature        *string `protobuf:"bytes,3,opt,name=signature" json:"signature,omitempty"`
+	Scanned          *int64  `protobuf:"varint,4,opt,name=scanned" json:"scanned,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *ScanResult) Reset()         { *m = ScanResult{} }
+func (m *ScanResult) String() string { return proto.CompactTextString(m) }
+func (*ScanResult) ProtoMessage()    {}
+
+func (m *ScanResult) GetScanner() string {
+	if m != nil && m.Scanner != nil {
+		return *m.Scanner
+	}
+	return ""
+}
+
+func (m *ScanResult) GetInfected() bool {
+	if m != nil && m.Infected != nil {
+		return *m.Infected
+	}
+	return false
+}
+
+func (m *ScanResult) GetSignature() string {
+	if m != nil && m.Signature != nil {
+		return *m.Signature
+	}
+	return ""
+}
+
+func (m *ScanResult) GetScanned() int64 {
+	if m != nil && m.Scanned != nil {
+		return *m.Scanned
+	}
+	return 0
+}
+
 type ReplicationStart struct {
 	Event            *string `protobuf:"bytes,1,req,name=event" json:"event,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxOriginalName is the maximum length of original file names in bytes.
+const maxOriginalName = 255
+
+// originalName cleans a file name supplied by a client or taken from a URL,
+// removing any directories and control characters. It returns "" if nothing
+// useful is left.
+func originalName(name string) string {
+	name = path.Base(strings.Replace(name, "\\", "/", -1))
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "." || name == "/" || name == ".." {
+		return ""
+	}
+
+	for len(name) > maxOriginalName {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
+
+// contentDisposition formats a Content-Disposition header as described in RFC
+// 6266. Names that aren't plain ASCII are sent in the extended filename*
+// parameter, with an ASCII approximation in filename for older clients.
+func contentDisposition(disposition, name string) string {
+	var fallback strings.Builder
+	plain := true
+	for _, r := range name {
+		if r < ' ' || r > '~' || r == '"' || r == '\\' || r == '%' {
+			fallback.WriteByte('_')
+			plain = false
+		} else {
+			fallback.WriteRune(r)
+		}
+	}
+
+	header := fmt.Sprintf("%s; filename=\"%s\"", disposition, fallback.String())
+	if !plain {
+		header += "; filename*=UTF-8''" + encodeExtValue(name)
+	}
+	return header
+}
+
+// encodeExtValue percent-encodes all bytes of s that aren't an attr-char of
+// RFC 5987.
+func encodeExtValue(s string) string {
+	const attrChars = "!#$&+-.^_`|~"
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte(attrChars, c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// dispositionName returns the file name of a Content-Disposition header, or
+// "" if there is none.
+func dispositionName(header string) string {
+	if header == "" {
+		return ""
+	}
+	_, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		return ""
+	}
+	return originalName(params["filename"])
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/akrennmair/cabinet/client"
+	"github.com/akrennmair/cabinet/data"
+	"github.com/golang/protobuf/proto"
+)
+
+func TestContentDisposition(t *testing.T) {
+	for _, tc := range []struct {
+		disposition, name, expected string
+	}{
+		{"inline", "report.pdf", `inline; filename="report.pdf"`},
+		{"attachment", `say "hi".txt`, `attachment; filename="say _hi_.txt"; filename*=UTF-8''say%20%22hi%22.txt`},
+		{"inline", "Grüße €.txt", `inline; filename="Gr__e _.txt"; filename*=UTF-8''Gr%C3%BC%C3%9Fe%20%E2%82%AC.txt`},
+	} {
+		header := contentDisposition(tc.disposition, tc.name)
+		if header != tc.expected {
+			t.Errorf("contentDisposition(%q, %q) = %s, expected %s", tc.disposition, tc.name, header, tc.expected)
+		}
+		if name := dispositionName(header); name != tc.name {
+			t.Errorf("dispositionName(%s) = %q, expected %q", header, name, tc.name)
+		}
+	}
+
+	for name, expected := range map[string]string{
+		"C:\\Users\\jane\\photo.jpg": "photo.jpg",
+		"/etc/passwd":                "passwd",
+		"tab\tbed.txt":               "tabbed.txt",
+		"..":                         "",
+		"":                           "",
+	} {
+		if cleaned := originalName(name); cleaned != expected {
+			t.Errorf("originalName(%q) = %q, expected %q", name, cleaned, expected)
+		}
+	}
+}
+
+func TestOriginalName(t *testing.T) {
+	parent := newTestParent(t, nil)
+	defer parent.Server.Close()
+
+	childDB, r := newTestChild(t, parent.Server.URL, nil)
+	defer r.stop()
+
+	c := client.New(parent.Server.URL, "dummy", "auth")
+	ctx := context.Background()
+
+	file, err := c.UploadWithOptions(ctx, strings.NewReader("notes"), &client.UploadOptions{Drawer: "docs", ContentType: "text/plain", Filename: "Notizen für März.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(file, ".txt") {
+		t.Errorf("extension of original name wasn't kept: %s", file)
+	}
+
+	info, err := c.Stat(ctx, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.OriginalName != "Notizen für März.txt" {
+		t.Fatalf("unexpected original name %q", info.OriginalName)
+	}
+
+	resp, err := http.Get(file + "?download=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if disposition := resp.Header.Get("Content-Disposition"); !strings.HasPrefix(disposition, "attachment;") || dispositionName(disposition) != "Notizen für März.txt" {
+		t.Fatalf("unexpected Content-Disposition %q", disposition)
+	}
+
+	filename := file[len(parent.Server.URL+"/docs/"):]
+	waitFor(t, "replicated file", func() bool {
+		rawMetaData, err := childDB.Get([]byte("meta:docs:"+filename), nil)
+		if err != nil {
+			return false
+		}
+		var metadata data.MetaData
+		return proto.Unmarshal(rawMetaData, &metadata) == nil && metadata.GetOriginalName() == "Notizen für März.txt"
+	})
+
+	// files without an original name are only delivered with a disposition
+	// when they're downloaded.
+	plain := parent.upload(t, http.DefaultClient, "docs", "text/plain", "plain")
+	if resp, err := http.Get(plain); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.Header.Get("Content-Disposition") != "" {
+		t.Fatalf("unexpected Content-Disposition %q", resp.Header.Get("Content-Disposition"))
+	}
+	if resp, err := http.Get(plain + "?download=1"); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); dispositionName(resp.Header.Get("Content-Disposition")) != plain[len(parent.Server.URL+"/docs/"):] {
+		t.Fatalf("unexpected Content-Disposition %q", resp.Header.Get("Content-Disposition"))
+	}
+
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("remote"))
+	}))
+	defer remote.Close()
+
+	stored, err := c.Store(ctx, remote.URL+"/files/annual%20report.txt", "docs", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := c.Stat(ctx, stored); err != nil {
+		t.Fatal(err)
+	} else if info.OriginalName != "annual report.txt" {
+		t.Fatalf("unexpected original name of stored file %q", info.OriginalName)
+	}
+
+	files, err := c.List(ctx, "docs", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string]string)
+	for _, f := range files {
+		names[f.URL] = f.OriginalName
+	}
+	if names[file] != "Notizen für März.txt" || names[stored] != "annual report.txt" {
+		t.Fatalf("unexpected original names in list %v", names)
+	}
+}
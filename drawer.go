@@ -0,0 +1,560 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akrennmair/cabinet/basicauth"
+	"github.com/akrennmair/cabinet/data"
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// drawerRecord is a drawer that was created explicitly, together with its
+// settings. Records are stored as JSON in drawer:<name> and replicated with
+// DRAWER events.
+type drawerRecord struct {
+	Name string `json:"name"`
+
+	// Private drawers only deliver files to users that can access the
+	// drawer, and with signed URLs.
+	Private bool `json:"private,omitempty"`
+
+	// TTL is the number of seconds after their upload that files are
+	// deleted.
+	TTL int64 `json:"ttl,omitempty"`
+
+	// MaxBytes, MaxFiles and MaxFileSize replace the limits of the
+	// configuration file.
+	MaxBytes    int64 `json:"max_bytes,omitempty"`
+	MaxFiles    int64 `json:"max_files,omitempty"`
+	MaxFileSize int64 `json:"max_file_size,omitempty"`
+
+	// ContentTypes restricts uploads to the listed content types, and
+	// DenyContentTypes rejects the listed ones. Entries ending in /* match
+	// all subtypes.
+	ContentTypes     []string `json:"content_types,omitempty"`
+	DenyContentTypes []string `json:"deny_content_types,omitempty"`
+
+	// UserUploads marks drawers whose files come from untrusted users.
+	// Files that could run scripts in browsers, like HTML and SVG, are
+	// always delivered as attachment.
+	UserUploads bool `json:"user_uploads,omitempty"`
+
+	// Versioning keeps the replaced versions of files, of which
+	// MaxVersions are kept per file if it is set.
+	Versioning  bool `json:"versioning,omitempty"`
+	MaxVersions int  `json:"max_versions,omitempty"`
+
+	// CacheControl is sent as Cache-Control header with the files.
+	CacheControl string `json:"cache_control,omitempty"`
+
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+}
+
+func drawerKey(name string) []byte {
+	return []byte("drawer:" + name)
+}
+
+// readDrawer returns the record of a drawer, or nil if the drawer wasn't
+// created explicitly.
+func readDrawer(db *leveldb.DB, name string) (*drawerRecord, error) {
+	rawRecord, err := db.Get(drawerKey(name), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var record drawerRecord
+	if err := json.Unmarshal(rawRecord, &record); err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func (d *drawerRecord) validate() error {
+	if d.TTL < 0 || d.MaxBytes < 0 || d.MaxFiles < 0 || d.MaxFileSize < 0 || d.MaxVersions < 0 {
+		return errors.New("ttl and limits must not be negative")
+	}
+	for _, contentTypes := range [][]string{d.ContentTypes, d.DenyContentTypes} {
+		for _, contentType := range contentTypes {
+			if _, _, err := mime.ParseMediaType(contentType); err != nil || !strings.Contains(contentType, "/") {
+				return fmt.Errorf("invalid content type %q", contentType)
+			}
+		}
+	}
+	if strings.ContainsAny(d.CacheControl, "\r\n") {
+		return errors.New("invalid cache control")
+	}
+	return nil
+}
+
+// checkVersions rejects drawers that keep any number of versions while a
+// quota applies to them, as old versions don't count towards quotas.
+func (d *drawerRecord) checkVersions(limits drawerLimits) error {
+	limits = d.limits(limits)
+	if d.Versioning && d.MaxVersions == 0 && (limits.MaxBytes > 0 || limits.MaxFiles > 0) {
+		return errors.New("versioning drawers with quotas need max_versions")
+	}
+	return nil
+}
+
+// limits applies the limits of the drawer to the ones from the
+// configuration file. A nil record doesn't change anything.
+func (d *drawerRecord) limits(limits drawerLimits) drawerLimits {
+	if d == nil {
+		return limits
+	}
+	if d.MaxBytes > 0 {
+		limits.MaxBytes = d.MaxBytes
+	}
+	if d.MaxFiles > 0 {
+		limits.MaxFiles = d.MaxFiles
+	}
+	if d.MaxFileSize > 0 {
+		limits.MaxFileSize = d.MaxFileSize
+	}
+	limits.ContentTypes = d.ContentTypes
+	limits.DenyContentTypes = d.DenyContentTypes
+	return limits
+}
+
+func isDrawerEvent(event *data.Event) bool {
+	switch event.GetType() {
+	case data.Event_DRAWER, data.Event_DRAWER_DELETE, data.Event_DRAWER_RENAME:
+		return true
+	}
+	return false
+}
+
+func newDrawerEvent(eventType data.Event_Type, drawer string) *data.Event {
+	return &data.Event{
+		Type:     eventType.Enum(),
+		Drawer:   proto.String(drawer),
+		Filename: proto.String(""),
+		Id:       proto.String("event:" + strconv.FormatInt(time.Now().UnixNano(), 10)),
+	}
+}
+
+// applyDrawerEvent writes a drawer event together with the changes it makes
+// to the drawer records, files and usage counters. It is used for local
+// changes as well as for replicated events.
+func applyDrawerEvent(db *leveldb.DB, event *data.Event) error {
+	rawEvent, err := proto.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	// the usage counters are deleted or moved, so no upload may change
+	// them in between.
+	usageMtx.Lock()
+	defer usageMtx.Unlock()
+
+	name := event.GetDrawer()
+	usage, err := readUsage(db, name)
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	batch.Put([]byte(event.GetId()), rawEvent)
+	batch.Put([]byte("latest_event"), []byte(event.GetId()))
+
+	switch event.GetType() {
+	case data.Event_DRAWER:
+		batch.Put(drawerKey(name), []byte(event.GetSettings()))
+
+	case data.Event_DRAWER_DELETE:
+		if err := moveTags(db, batch, name, ""); err != nil {
+			return err
+		}
+		for _, prefix := range []string{"file:", "meta:", "version:", "vmeta:", "trash:", "tmeta:"} {
+			if err := moveKeys(db, batch, prefix+name+":", ""); err != nil {
+				return err
+			}
+		}
+		batch.Delete(usageKey(name))
+		batch.Delete(drawerKey(name))
+
+	case data.Event_DRAWER_RENAME:
+		newName := event.GetNewName()
+		if err := moveTags(db, batch, name, newName); err != nil {
+			return err
+		}
+		for _, prefix := range []string{"file:", "meta:", "version:", "vmeta:", "trash:", "tmeta:"} {
+			if err := moveKeys(db, batch, prefix+name+":", prefix+newName+":"); err != nil {
+				return err
+			}
+		}
+
+		if rawUsage, err := db.Get(usageKey(name), nil); err == nil {
+			batch.Put(usageKey(newName), rawUsage)
+		} else if err != leveldb.ErrNotFound {
+			return err
+		}
+		batch.Delete(usageKey(name))
+
+		record, err := readDrawer(db, name)
+		if err != nil {
+			return err
+		}
+		if record != nil {
+			record.Name = newName
+			rawRecord, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			batch.Put(drawerKey(newName), rawRecord)
+			batch.Delete(drawerKey(name))
+		}
+
+	default:
+		return fmt.Errorf("%s isn't a drawer event", event.GetType())
+	}
+
+	if err := db.Write(batch, nil); err != nil {
+		return err
+	}
+
+	switch event.GetType() {
+	case data.Event_DRAWER_DELETE:
+		drawerRemoved(name)
+	case data.Event_DRAWER_RENAME:
+		drawerRemoved(name)
+		drawerFiles.WithLabelValues(event.GetNewName()).Add(float64(usage.Files))
+		drawerBytes.WithLabelValues(event.GetNewName()).Add(float64(usage.Bytes))
+	}
+
+	return nil
+}
+
+// moveKeys adds the renaming of all keys starting with from to batch. If to
+// is empty, the keys are deleted instead.
+func moveKeys(db *leveldb.DB, batch *leveldb.Batch, from, to string) error {
+	iterator := db.NewIterator(util.BytesPrefix([]byte(from)), nil)
+	defer iterator.Release()
+	for iterator.Next() {
+		if to != "" {
+			batch.Put([]byte(to+strings.TrimPrefix(string(iterator.Key()), from)), iterator.Value())
+		}
+		batch.Delete(iterator.Key())
+	}
+	return iterator.Error()
+}
+
+// drawerHandler manages the drawers. Everyone can look at the drawers they
+// can access, but creating, changing, renaming and deleting drawers
+// requires access to all drawers.
+type drawerHandler struct {
+	DB         *leveldb.DB
+	Events     chan<- *data.Event
+	AuthFunc   basicauth.AuthenticatorFunc
+	AccessFunc drawerAccessFunc
+
+	// ConfigLimitsFunc returns the limits of the configuration file, which
+	// the drawer records override.
+	ConfigLimitsFunc drawerLimitsFunc
+}
+
+func (h *drawerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !basicauth.Authenticate(w, r, h.AuthFunc) {
+		return
+	}
+
+	path := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/drawers"), "/")
+	name, action := path, ""
+	if n := strings.Index(path, "/"); n != -1 {
+		name, action = path[:n], path[n+1:]
+	}
+
+	if name != "" && !validDrawerName(name) {
+		http.Error(w, "invalid drawer name", http.StatusNotAcceptable)
+		return
+	}
+
+	switch {
+	case name == "" && r.Method == "GET":
+		h.list(w, r)
+	case name == "" && r.Method == "POST":
+		h.create(w, r)
+	case name == "":
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	case action == "rename" && r.Method == "POST":
+		h.rename(w, r, name)
+	case action != "":
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	case r.Method == "GET":
+		h.get(w, r, name)
+	case r.Method == "PUT":
+		h.update(w, r, name)
+	case r.Method == "DELETE":
+		h.delete(w, r, name)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *drawerHandler) list(w http.ResponseWriter, r *http.Request) {
+	records := []*drawerRecord{}
+
+	iterator := h.DB.NewIterator(util.BytesPrefix([]byte("drawer:")), nil)
+	defer iterator.Release()
+	for iterator.Next() {
+		var record drawerRecord
+		if err := json.Unmarshal(iterator.Value(), &record); err != nil {
+			log.Printf("unmarshalling %s failed: %v", iterator.Key(), err)
+			continue
+		}
+		if h.AccessFunc.permits(r, record.Name) {
+			records = append(records, &record)
+		}
+	}
+	if err := iterator.Error(); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("listing drawers failed: %v", err)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, records)
+}
+
+func (h *drawerHandler) get(w http.ResponseWriter, r *http.Request, name string) {
+	if !h.AccessFunc.permits(r, name) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	record, err := readDrawer(h.DB, name)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("reading drawer %s failed: %v", name, err)
+		return
+	}
+	if record == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, record)
+}
+
+func (h *drawerHandler) create(w http.ResponseWriter, r *http.Request) {
+	if !h.AccessFunc.permits(r, "") {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	record, ok := h.readRecord(w, r)
+	if !ok {
+		return
+	}
+	if record.Name == "" || !validDrawerName(record.Name) {
+		http.Error(w, "invalid drawer name", http.StatusNotAcceptable)
+		return
+	}
+
+	existing, err := readDrawer(h.DB, record.Name)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("reading drawer %s failed: %v", record.Name, err)
+		return
+	}
+	if existing != nil {
+		http.Error(w, "drawer already exists", http.StatusConflict)
+		return
+	}
+
+	record.Created = time.Now().UTC()
+	record.Updated = record.Created
+	if !h.save(w, record) {
+		return
+	}
+
+	w.Header().Set("Location", "/api/drawers/"+record.Name)
+	h.writeJSON(w, http.StatusCreated, record)
+}
+
+// update replaces the settings of a drawer.
+func (h *drawerHandler) update(w http.ResponseWriter, r *http.Request, name string) {
+	if !h.AccessFunc.permits(r, "") {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	existing, err := readDrawer(h.DB, name)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("reading drawer %s failed: %v", name, err)
+		return
+	}
+	if existing == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	record, ok := h.readRecord(w, r)
+	if !ok {
+		return
+	}
+	if record.Name != "" && record.Name != name {
+		http.Error(w, "drawers are renamed with /api/drawers/"+name+"/rename", http.StatusNotAcceptable)
+		return
+	}
+
+	record.Name = name
+	record.Created = existing.Created
+	record.Updated = time.Now().UTC()
+	if !h.save(w, record) {
+		return
+	}
+
+	h.writeJSON(w, http.StatusOK, record)
+}
+
+// delete deletes a drawer. Drawers that still contain files are only
+// deleted with the recursive parameter.
+func (h *drawerHandler) delete(w http.ResponseWriter, r *http.Request, name string) {
+	if !h.AccessFunc.permits(r, "") {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	record, usage, err := h.lookup(name)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("looking up drawer %s failed: %v", name, err)
+		return
+	}
+	if record == nil && usage.Files == 0 {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if recursive, _ := strconv.ParseBool(r.FormValue("recursive")); usage.Files > 0 && !recursive {
+		http.Error(w, fmt.Sprintf("drawer contains %d files, delete it with recursive=1", usage.Files), http.StatusConflict)
+		return
+	}
+
+	if !h.apply(w, newDrawerEvent(data.Event_DRAWER_DELETE, name)) {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// rename renames a drawer to the name given with the to parameter. The new
+// name must not be in use yet.
+func (h *drawerHandler) rename(w http.ResponseWriter, r *http.Request, name string) {
+	if !h.AccessFunc.permits(r, "") {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	newName := r.FormValue("to")
+	if newName == "" || !validDrawerName(newName) {
+		http.Error(w, "invalid new drawer name", http.StatusNotAcceptable)
+		return
+	}
+
+	record, usage, err := h.lookup(name)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("looking up drawer %s failed: %v", name, err)
+		return
+	}
+	if record == nil && usage.Files == 0 {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	record, usage, err = h.lookup(newName)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("looking up drawer %s failed: %v", newName, err)
+		return
+	}
+	if newName == name || record != nil || usage.Files > 0 {
+		http.Error(w, "drawer "+newName+" already exists", http.StatusConflict)
+		return
+	}
+
+	event := newDrawerEvent(data.Event_DRAWER_RENAME, name)
+	event.NewName = proto.String(newName)
+	if !h.apply(w, event) {
+		return
+	}
+
+	w.Header().Set("Location", "/api/drawers/"+newName)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lookup returns the record and the usage of a drawer. Drawers that
+// weren't created explicitly only exist as long as they contain files.
+func (h *drawerHandler) lookup(name string) (*drawerRecord, drawerUsage, error) {
+	record, err := readDrawer(h.DB, name)
+	if err != nil {
+		return nil, drawerUsage{}, err
+	}
+	usage, err := readUsage(h.DB, name)
+	return record, usage, err
+}
+
+func (h *drawerHandler) readRecord(w http.ResponseWriter, r *http.Request) (*drawerRecord, bool) {
+	var record drawerRecord
+	if err := json.NewDecoder(r.Body).Decode(&record); err != nil {
+		http.Error(w, "invalid drawer: "+err.Error(), http.StatusNotAcceptable)
+		return nil, false
+	}
+	if err := record.validate(); err != nil {
+		http.Error(w, "invalid drawer: "+err.Error(), http.StatusNotAcceptable)
+		return nil, false
+	}
+	return &record, true
+}
+
+// save writes a drawer record with a DRAWER event.
+func (h *drawerHandler) save(w http.ResponseWriter, record *drawerRecord) bool {
+	if err := record.checkVersions(h.ConfigLimitsFunc.limits(record.Name)); err != nil {
+		http.Error(w, "invalid drawer: "+err.Error(), http.StatusNotAcceptable)
+		return false
+	}
+
+	rawRecord, err := json.Marshal(record)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("marshalling drawer %s failed: %v", record.Name, err)
+		return false
+	}
+
+	event := newDrawerEvent(data.Event_DRAWER, record.Name)
+	event.Settings = proto.String(string(rawRecord))
+	return h.apply(w, event)
+}
+
+func (h *drawerHandler) apply(w http.ResponseWriter, event *data.Event) bool {
+	if err := applyDrawerEvent(h.DB, event); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("applying %s to drawer %s failed: %v", event.GetType(), event.GetDrawer(), err)
+		return false
+	}
+	if h.Events != nil {
+		h.Events <- event
+	}
+	return true
+}
+
+func (h *drawerHandler) writeJSON(w http.ResponseWriter, statusCode int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("encoding drawers failed: %v", err)
+	}
+}
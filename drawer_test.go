@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akrennmair/cabinet/client"
+	"github.com/akrennmair/cabinet/data"
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestDrawers(t *testing.T) {
+	parent := newTestParent(t, nil)
+	defer parent.Server.Close()
+
+	childDB, r := newTestChild(t, parent.Server.URL, nil)
+	defer r.stop()
+
+	resp := drawerRequest(t, parent, "POST", "/api/drawers", `{"name": "docs", "private": true, "content_types": ["text/*"], "cache_control": "max-age=60"}`)
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Location") != "/api/drawers/docs" {
+		t.Fatalf("creating drawer returned %d, location %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	if resp := drawerRequest(t, parent, "POST", "/api/drawers", `{"name": "docs"}`); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("creating existing drawer returned %d", resp.StatusCode)
+	}
+	if resp := drawerRequest(t, parent, "POST", "/api/drawers", `{"name": "bad", "ttl": -1}`); resp.StatusCode != http.StatusNotAcceptable {
+		t.Fatalf("creating drawer with invalid settings returned %d", resp.StatusCode)
+	}
+	if resp := drawerRequest(t, parent, "POST", "/api/drawers", `{"name": "docs:private"}`); resp.StatusCode != http.StatusNotAcceptable {
+		t.Fatalf("creating drawer with a colon in its name returned %d", resp.StatusCode)
+	}
+
+	c := client.New(parent.Server.URL, "dummy", "auth")
+	ctx := context.Background()
+
+	var apiErr *client.Error
+	if _, err := c.Upload(ctx, strings.NewReader("image"), "image/png", "docs", ""); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("uploading disallowed content type returned %v", err)
+	}
+	file := parent.upload(t, http.DefaultClient, "docs", "text/plain; charset=utf-8", "document")
+
+	// private files are only delivered to authenticated users.
+	if resp, err := http.Get(file); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("fetching private file without authentication returned %d", resp.StatusCode)
+	}
+	if _, info, err := c.Get(ctx, file); err != nil {
+		t.Fatal(err)
+	} else if info.Size != int64(len("document")) {
+		t.Fatalf("unexpected file info %+v", info)
+	}
+	req, _ := http.NewRequest("GET", file, nil)
+	req.SetBasicAuth("dummy", "auth")
+	if resp, err := http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.Header.Get("Cache-Control") != "max-age=60" {
+		t.Fatalf("expected Cache-Control max-age=60, got %q", resp.Header.Get("Cache-Control"))
+	}
+
+	filename := file[len(parent.Server.URL+"/docs/"):]
+	waitFor(t, "replicated private file", func() bool {
+		has, _ := childDB.Has([]byte("file:docs:"+filename), nil)
+		return has
+	})
+	if record, err := readDrawer(childDB, "docs"); err != nil || record == nil || !record.Private {
+		t.Fatalf("drawer wasn't replicated: %+v, %v", record, err)
+	}
+
+	resp = drawerRequest(t, parent, "PUT", "/api/drawers/docs", `{"cache_control": "no-cache"}`)
+	var record drawerRecord
+	if err := json.NewDecoder(resp.Body).Decode(&record); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || record.Name != "docs" || record.Private || record.CacheControl != "no-cache" || record.Created.IsZero() {
+		t.Fatalf("updating drawer returned %d, %+v", resp.StatusCode, record)
+	}
+	if resp, err := http.Get(file); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusOK {
+		t.Fatalf("fetching file of public drawer returned %d", resp.StatusCode)
+	}
+
+	if resp := drawerRequest(t, parent, "POST", "/api/drawers/docs/rename?to=papers", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("renaming drawer returned %d", resp.StatusCode)
+	}
+	if resp := drawerRequest(t, parent, "POST", "/api/drawers/gone/rename?to=other", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("renaming missing drawer returned %d", resp.StatusCode)
+	}
+	if _, err := c.Stat(ctx, file); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("file is still in the old drawer: %v", err)
+	}
+	if _, err := c.Stat(ctx, parent.Server.URL+"/papers/"+filename); err != nil {
+		t.Fatalf("file wasn't moved to the new drawer: %v", err)
+	}
+	waitFor(t, "replicated rename", func() bool {
+		has, _ := childDB.Has([]byte("file:papers:"+filename), nil)
+		return has
+	})
+
+	if resp := drawerRequest(t, parent, "DELETE", "/api/drawers/papers", ""); resp.StatusCode != http.StatusConflict {
+		t.Fatalf("deleting drawer with files returned %d", resp.StatusCode)
+	}
+	if resp := drawerRequest(t, parent, "DELETE", "/api/drawers/papers?recursive=1", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("deleting drawer recursively returned %d", resp.StatusCode)
+	}
+	if resp := drawerRequest(t, parent, "GET", "/api/drawers/papers", ""); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("deleted drawer returned %d", resp.StatusCode)
+	}
+	waitFor(t, "replicated deletion", func() bool {
+		return caughtUp(parent.DB, childDB)
+	})
+
+	for name, db := range map[string]*leveldb.DB{"parent": parent.DB, "child": childDB} {
+		if usage, err := readUsage(db, "papers"); err != nil || usage.Files != 0 {
+			t.Fatalf("%s has usage %+v left: %v", name, usage, err)
+		}
+		if problems, err := fsck(db, false); err != nil || len(problems) != 0 {
+			t.Fatalf("fsck found problems on %s %+v: %v", name, problems, err)
+		}
+	}
+}
+
+func TestFileExpirer(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	event := newDrawerEvent(data.Event_DRAWER, "tmp")
+	event.Settings = proto.String(`{"name": "tmp", "ttl": 60}`)
+	if err := applyDrawerEvent(db, event); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := putFile(context.Background(), db, nil, "tmp", "new", []byte("new"), &data.MetaData{ContentType: proto.String("text/plain")}, drawerLimits{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := putFile(context.Background(), db, nil, "other", "kept", []byte("kept"), &data.MetaData{ContentType: proto.String("text/plain")}, drawerLimits{}); err != nil {
+		t.Fatal(err)
+	}
+	// a file stored before upload times were recorded.
+	if err := db.Put([]byte("file:tmp:old"), []byte("old"), nil); err != nil {
+		t.Fatal(err)
+	}
+	rawMetaData, _ := proto.Marshal(&data.MetaData{ContentType: proto.String("text/plain")})
+	if err := db.Put([]byte("meta:tmp:old"), rawMetaData, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	e := &fileExpirer{DB: db}
+	now := time.Now()
+
+	if events, err := e.expire(now.Add(30 * time.Second)); err != nil || len(events) != 0 {
+		t.Fatalf("expected no expired files, got %v: %v", events, err)
+	}
+
+	events, err := e.expire(now.Add(65 * time.Second))
+	if err != nil || len(events) != 1 || events[0].GetFilename() != "new" || events[0].GetType() != data.Event_DELETE {
+		t.Fatalf("expected new to expire, got %v: %v", events, err)
+	}
+
+	events, err = e.expire(now.Add(95 * time.Second))
+	if err != nil || len(events) != 1 || events[0].GetFilename() != "old" {
+		t.Fatalf("expected old to expire, got %v: %v", events, err)
+	}
+
+	if has, _ := db.Has([]byte("file:other:kept"), nil); !has {
+		t.Fatal("file of drawer without TTL was expired")
+	}
+}
+
+func TestExpireRecheck(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// files are expired by what they are when they're deleted, not when
+	// the drawer was scanned.
+	deadline := time.Now().Add(-time.Hour)
+	for filename, uploaded := range map[string]*int64{
+		"expired":   proto.Int64(deadline.Add(-time.Hour).Unix()),
+		"replaced":  proto.Int64(deadline.Add(-time.Hour).Unix()),
+		"unstamped": nil,
+	} {
+		if err := db.Put([]byte("file:tmp:"+filename), []byte(filename), nil); err != nil {
+			t.Fatal(err)
+		}
+		rawMetaData, _ := proto.Marshal(&data.MetaData{ContentType: proto.String("text/plain"), Uploaded: uploaded})
+		if err := db.Put([]byte("meta:tmp:"+filename), rawMetaData, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := putFile(context.Background(), db, nil, "tmp", "replaced", []byte("new"), &data.MetaData{ContentType: proto.String("text/plain")}, drawerLimits{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, filename := range []string{"replaced", "unstamped", "missing"} {
+		if _, err := expireFile(db, "tmp", filename, deadline); err != errNotExpired {
+			t.Fatalf("expiring %s returned %v", filename, err)
+		}
+	}
+	if content, err := db.Get([]byte("file:tmp:replaced"), nil); err != nil || string(content) != "new" {
+		t.Fatalf("replaced file is %q, %v", content, err)
+	}
+
+	if event, err := expireFile(db, "tmp", "expired", deadline); err != nil || event.GetType() != data.Event_DELETE {
+		t.Fatalf("expiring returned %v, %v", event, err)
+	}
+	if has, _ := db.Has([]byte("file:tmp:expired"), nil); has {
+		t.Fatal("expired file wasn't deleted")
+	}
+}
+
+func drawerRequest(t *testing.T, parent *testParent, method, path, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, parent.Server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.SetBasicAuth("dummy", "auth")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/akrennmair/cabinet/data"
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// fileExpirer deletes the files of drawers with a TTL once they're older
+// than it, and purges trashed files once they're older than the trash
+// retention. The deletions are announced with regular delete events.
+type fileExpirer struct {
+	DB       *leveldb.DB
+	Events   chan<- *data.Event
+	Interval time.Duration
+
+	// TrashRetention returns how long trashed files are kept. If it is nil,
+	// the trash isn't purged.
+	TrashRetention func() time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func (e *fileExpirer) start() {
+	e.ctx, e.cancel = context.WithCancel(context.Background())
+	e.done = make(chan struct{})
+	go e.run()
+}
+
+func (e *fileExpirer) stop() {
+	e.cancel()
+	<-e.done
+}
+
+func (e *fileExpirer) run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+
+	for {
+		events, err := e.expire(time.Now())
+		if err != nil {
+			log.Printf("expiring files failed: %v", err)
+		}
+		for _, event := range events {
+			e.Events <- event
+		}
+
+		if e.TrashRetention != nil {
+			events, err := purgeTrash(e.DB, time.Now().Add(-e.TrashRetention()))
+			if err != nil {
+				log.Printf("purging trash failed: %v", err)
+			}
+			for _, event := range events {
+				e.Events <- event
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-e.ctx.Done():
+			return
+		}
+	}
+}
+
+// expire deletes all files that expired at now, and returns the delete
+// events. Files without an upload time were stored before it was recorded;
+// they get now as upload time, and expire one TTL later.
+func (e *fileExpirer) expire(now time.Time) ([]*data.Event, error) {
+	var events []*data.Event
+
+	iterator := e.DB.NewIterator(util.BytesPrefix([]byte("drawer:")), nil)
+	defer iterator.Release()
+	for iterator.Next() {
+		var record drawerRecord
+		if err := json.Unmarshal(iterator.Value(), &record); err != nil {
+			log.Printf("unmarshalling %s failed: %v", iterator.Key(), err)
+			continue
+		}
+		if record.TTL == 0 {
+			continue
+		}
+
+		expired, err := e.expireDrawer(record.Name, now.Add(-time.Duration(record.TTL)*time.Second), now)
+		events = append(events, expired...)
+		if err != nil {
+			return events, err
+		}
+	}
+	return events, iterator.Error()
+}
+
+// errNotExpired is returned when a file was replaced or got its upload time
+// since its drawer was scanned for expired files.
+var errNotExpired = errors.New("file isn't expired")
+
+func (e *fileExpirer) expireDrawer(drawer string, deadline, now time.Time) ([]*data.Event, error) {
+	var (
+		expired, unstamped []string
+		events             []*data.Event
+	)
+
+	prefix := "meta:" + drawer + ":"
+	iterator := e.DB.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	for iterator.Next() {
+		var metadata data.MetaData
+		if err := proto.Unmarshal(iterator.Value(), &metadata); err != nil {
+			log.Printf("unmarshalling %s failed: %v", iterator.Key(), err)
+			continue
+		}
+
+		filename := strings.TrimPrefix(string(iterator.Key()), prefix)
+		switch {
+		case metadata.Uploaded == nil:
+			unstamped = append(unstamped, filename)
+		case time.Unix(metadata.GetUploaded(), 0).Before(deadline):
+			expired = append(expired, filename)
+		}
+	}
+	iterator.Release()
+	if err := iterator.Error(); err != nil {
+		return nil, err
+	}
+
+	for _, filename := range unstamped {
+		if err := stampUploaded(e.DB, drawer, filename, now); err != nil {
+			return events, err
+		}
+	}
+
+	for _, filename := range expired {
+		event, err := expireFile(e.DB, drawer, filename, deadline)
+		if err == errNotExpired {
+			// uploaded again since the drawer was scanned.
+			continue
+		} else if err != nil {
+			return events, err
+		}
+		log.Printf("expired %s:%s", drawer, filename)
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// expireFile deletes a file with removeFile, and returns the delete event.
+// It returns errNotExpired unless the file still exists and was uploaded
+// before deadline.
+func expireFile(db *leveldb.DB, drawer, filename string, deadline time.Time) (*data.Event, error) {
+	return removeFileIf(db, drawer, filename, func(metadata *data.MetaData) error {
+		if metadata == nil || metadata.Uploaded == nil || !time.Unix(metadata.GetUploaded(), 0).Before(deadline) {
+			return errNotExpired
+		}
+		return nil
+	})
+}
+
+// stampUploaded sets the upload time of a file that was stored before it
+// was recorded. The metadata is rewritten with usageMtx held, so that a
+// concurrent upload or metadata update isn't overwritten.
+func stampUploaded(db *leveldb.DB, drawer, filename string, now time.Time) error {
+	return writeWithUsage(db, drawer, drawerLimits{}, func(batch *leveldb.Batch) (drawerUsage, error) {
+		metadata, err := readMetadata(db, drawer, filename)
+		if err == leveldb.ErrNotFound {
+			return drawerUsage{}, nil
+		} else if err != nil {
+			return drawerUsage{}, err
+		}
+		if metadata.Uploaded != nil {
+			return drawerUsage{}, nil
+		}
+
+		metadata.Uploaded = proto.Int64(now.Unix())
+		rawMetaData, err := proto.Marshal(metadata)
+		if err != nil {
+			return drawerUsage{}, err
+		}
+		batch.Put([]byte("meta:"+drawer+":"+filename), rawMetaData)
+		return drawerUsage{}, nil
+	})
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/akrennmair/cabinet/basicauth"
+	"github.com/akrennmair/cabinet/data"
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// eventPayload is the JSON rendering of an event, as sent to webhooks and
+// the change feed.
+type eventPayload struct {
+	ID              string         `json:"id"`
+	Type            string         `json:"type"`
+	Drawer          string         `json:"drawer"`
+	Filename        string         `json:"filename,omitempty"`
+	URL             string         `json:"url,omitempty"`
+	MetaData        *data.MetaData `json:"metadata,omitempty"`
+	Version         int64          `json:"version,omitempty"`
+	RestoredVersion int64          `json:"restored_version,omitempty"`
+	NewName         string         `json:"new_name,omitempty"`
+	Settings        *drawerRecord  `json:"settings,omitempty"`
+}
+
+// newEventPayload renders an event, including the current metadata of
+// uploaded files and the settings of changed drawers.
+func newEventPayload(db *leveldb.DB, frontend string, event *data.Event) *eventPayload {
+	payload := &eventPayload{
+		ID:              event.GetId(),
+		Type:            event.GetType().String(),
+		Drawer:          event.GetDrawer(),
+		Filename:        event.GetFilename(),
+		Version:         event.GetVersion(),
+		RestoredVersion: event.GetRestoredVersion(),
+		NewName:         event.GetNewName(),
+	}
+	if isDrawerEvent(event) {
+		if event.Settings != nil {
+			var record drawerRecord
+			if err := json.Unmarshal([]byte(event.GetSettings()), &record); err == nil {
+				payload.Settings = &record
+			}
+		}
+		return payload
+	}
+
+	payload.URL = frontend + "/" + event.GetDrawer() + "/" + event.GetFilename()
+	if event.Metadata != nil {
+		payload.MetaData = event.Metadata
+	} else if event.GetType() != data.Event_DELETE {
+		if rawMetaData, err := db.Get([]byte("meta:"+event.GetDrawer()+":"+event.GetFilename()), nil); err == nil {
+			var metadata data.MetaData
+			if err := proto.Unmarshal(rawMetaData, &metadata); err == nil {
+				payload.MetaData = &metadata
+			}
+		}
+	}
+	return payload
+}
+
+const feedKeepAlive = 30 * time.Second
+
+// feedHandler streams events as Server-Sent Events. Clients can resume from
+// the event log with the Last-Event-ID header or the since parameter.
+// Without a drawer parameter, the events of all drawers the user can access
+// are sent.
+type feedHandler struct {
+	DB         *leveldb.DB
+	Frontend   string
+	Replicator chan<- replRequest
+	AuthFunc   basicauth.AuthenticatorFunc
+	AccessFunc drawerAccessFunc
+
+	// when Shutdown is closed, all streams are ended.
+	Shutdown <-chan struct{}
+}
+
+func (h *feedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !basicauth.Authenticate(w, r, h.AuthFunc) {
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	drawerName := r.FormValue("drawer")
+	if drawerName != "" {
+		if !validDrawerName(drawerName) {
+			http.Error(w, "invalid drawer name", http.StatusNotAcceptable)
+			return
+		}
+		if !h.AccessFunc.permits(r, drawerName) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+
+	since := r.Header.Get("Last-Event-ID")
+	if since == "" {
+		since = r.FormValue("since")
+	}
+	if since != "" && !strings.HasPrefix(since, "event:") {
+		http.Error(w, "invalid event ID", http.StatusNotAcceptable)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// subscribe before replaying the event log, so that no event gets lost
+	// in between.
+	events := make(chan *data.Event)
+	cachedEvents := make(chan *data.Event)
+	quit := make(chan bool)
+	h.Replicator <- replRequest{Type: subscribe, Events: events}
+	go cacheEvents(events, cachedEvents, quit, func(int) {})
+
+	defer func() {
+		close(quit)
+		for unsubscribed := false; !unsubscribed; {
+			select {
+			case h.Replicator <- replRequest{Type: unsubscribe, Events: events}:
+				unsubscribed = true
+			case <-events:
+			}
+		}
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	lastSent := since
+	send := func(event *data.Event) error {
+		switch {
+		case event.GetType() == data.Event_GOING_AWAY:
+			return nil
+		case event.GetId() <= lastSent:
+			return nil
+		case drawerName != "" && event.GetDrawer() != drawerName:
+			return nil
+		case drawerName == "" && !h.AccessFunc.permits(r, event.GetDrawer()):
+			return nil
+		}
+
+		rawJSON, err := json.Marshal(newEventPayload(h.DB, h.Frontend, event))
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.GetId(), strings.ToLower(event.GetType().String()), rawJSON); err != nil {
+			return err
+		}
+		flusher.Flush()
+		lastSent = event.GetId()
+		return nil
+	}
+
+	if since != "" {
+		keyRange := util.BytesPrefix([]byte("event:"))
+		keyRange.Start = []byte(since + "\x00")
+
+		iterator := h.DB.NewIterator(keyRange, nil)
+		for iterator.Next() {
+			var event data.Event
+			if err := proto.Unmarshal(iterator.Value(), &event); err != nil {
+				log.Printf("unmarshalling %s failed: %v", iterator.Key(), err)
+				continue
+			}
+			if err := send(&event); err != nil {
+				iterator.Release()
+				return
+			}
+		}
+		iterator.Release()
+	}
+
+	keepAlive := time.NewTicker(feedKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case event := <-cachedEvents:
+			if err := send(event); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-h.Shutdown:
+			return
+		}
+	}
+}
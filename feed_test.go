@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFeed(t *testing.T) {
+	parent := newTestParent(t, nil)
+	defer parent.Server.Close()
+
+	before := parent.upload(t, http.DefaultClient, "test", "text/plain", "before")
+
+	resp := openFeed(t, parent.Server.URL+"/api/events", "")
+	defer resp.Body.Close()
+	feed := bufio.NewReader(resp.Body)
+
+	// only events after subscribing are sent without since.
+	uploaded := parent.upload(t, http.DefaultClient, "other", "text/plain", "hello")
+
+	id, payload := readFeedEvent(t, feed)
+	if payload.Type != "UPLOAD" || payload.URL != uploaded || payload.MetaData.GetContentType() != "text/plain" {
+		t.Fatalf("unexpected payload %+v", payload)
+	}
+
+	latest, _ := parent.DB.Get([]byte("latest_event"), nil)
+	if id != string(latest) || payload.ID != id {
+		t.Fatalf("got event %s, expected %s", id, latest)
+	}
+
+	req, _ := http.NewRequest("DELETE", before, nil)
+	req.SetBasicAuth("dummy", "auth")
+	if resp, err := http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	} else {
+		resp.Body.Close()
+	}
+
+	// resuming from the first event replays the rest of the log, but only
+	// for the requested drawer.
+	firstEvent := parent.firstEvent(t)
+	resumed := openFeed(t, parent.Server.URL+"/api/events?drawer=test", firstEvent)
+	defer resumed.Body.Close()
+
+	_, payload = readFeedEvent(t, bufio.NewReader(resumed.Body))
+	if payload.Type != "DELETE" || payload.URL != before || payload.MetaData != nil {
+		t.Fatalf("unexpected payload %+v", payload)
+	}
+}
+
+func TestFeedAccess(t *testing.T) {
+	parent := newTestParent(t, nil)
+	defer parent.Server.Close()
+
+	parent.upload(t, http.DefaultClient, "secret", "text/plain", "hidden")
+	visible := parent.upload(t, http.DefaultClient, "public", "text/plain", "visible")
+
+	server := httptest.NewServer(&feedHandler{
+		DB:         parent.DB,
+		Frontend:   parent.Server.URL,
+		Replicator: parent.Repl.Replicator,
+		AuthFunc:   authFunc,
+		AccessFunc: func(user, drawer string) bool { return drawer == "public" },
+		Shutdown:   parent.Shutdown,
+	})
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"?drawer=secret", nil)
+	req.SetBasicAuth("dummy", "auth")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("feed of inaccessible drawer returned %d", resp.StatusCode)
+	}
+
+	all := openFeed(t, server.URL, "event:")
+	defer all.Body.Close()
+
+	_, payload := readFeedEvent(t, bufio.NewReader(all.Body))
+	if payload.URL != visible {
+		t.Fatalf("got event for %s, expected %s", payload.URL, visible)
+	}
+}
+
+func openFeed(t *testing.T, url, lastEventID string) *http.Response {
+	req, _ := http.NewRequest("GET", url, nil)
+	req.SetBasicAuth("dummy", "auth")
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		resp.Body.Close()
+		t.Fatalf("opening feed returned %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	return resp
+}
+
+// readFeedEvent reads the next event from a feed, skipping comments.
+func readFeedEvent(t *testing.T, feed *bufio.Reader) (string, *eventPayload) {
+	t.Helper()
+
+	var id, eventType string
+	var payload eventPayload
+	for {
+		line, err := feed.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading feed failed: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && id != "":
+			if eventType != strings.ToLower(payload.Type) {
+				t.Fatalf("event type %s doesn't match payload type %s", eventType, payload.Type)
+			}
+			return id, &payload
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			eventType = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &payload); err != nil {
+				t.Fatalf("decoding %s failed: %v", line, err)
+			}
+		}
+	}
+}
+
+func (p *testParent) firstEvent(t *testing.T) string {
+	iterator := p.DB.NewIterator(nil, nil)
+	defer iterator.Release()
+	for iterator.Next() {
+		if key := string(iterator.Key()); strings.HasPrefix(key, "event:") {
+			return key
+		}
+	}
+	t.Fatal("no events")
+	return ""
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/akrennmair/cabinet/accesslog"
+)
+
+const (
+	defaultFetchConnectTimeout = 10 * time.Second
+	defaultFetchTimeout        = 60 * time.Second
+	defaultFetchMaxSize        = 64 << 20
+	maxFetchRedirects          = 10
+)
+
+// deniedNetworks are the networks that remote fetches may not connect to
+// unless they're allowed explicitly: everything that isn't globally
+// routable, and the NAT64 and 6to4 ranges, which embed IPv4 addresses.
+// IPv4-mapped IPv6 addresses (::ffff:0:0/96) are checked like the IPv4
+// addresses they map to.
+var deniedNetworks = mustParseNetworks(
+	"0.0.0.0/8",       // "this network", connects to localhost on Linux
+	"10.0.0.0/8",      // private
+	"100.64.0.0/10",   // carrier-grade NAT
+	"127.0.0.0/8",     // loopback
+	"169.254.0.0/16",  // link-local, e.g. cloud metadata services
+	"172.16.0.0/12",   // private
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // documentation
+	"192.88.99.0/24",  // 6to4 relay anycast
+	"192.168.0.0/16",  // private
+	"198.18.0.0/15",   // benchmarking
+	"198.51.100.0/24", // documentation
+	"203.0.113.0/24",  // documentation
+	"224.0.0.0/4",     // multicast
+	"240.0.0.0/4",     // reserved and broadcast
+	"::/128",          // unspecified
+	"::1/128",         // loopback
+	"64:ff9b::/96",    // NAT64
+	"64:ff9b:1::/48",  // local NAT64
+	"100::/64",        // discard
+	"2001::/23",       // IETF protocol assignments, e.g. Teredo
+	"2001:db8::/32",   // documentation
+	"2002::/16",       // 6to4
+	"fc00::/7",        // unique local
+	"fe80::/10",       // link-local
+	"ff00::/8",        // multicast
+)
+
+func mustParseNetworks(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, n)
+	}
+	return networks
+}
+
+// fetchError is returned by fetcher.fetch and carries the status code to
+// respond with.
+type fetchError struct {
+	StatusCode int
+	Message    string
+
+	// Temporary is set for failures that may go away when retrying, like
+	// timeouts, network errors and server errors of the remote host.
+	Temporary bool
+}
+
+func (e *fetchError) Error() string {
+	return e.Message
+}
+
+func fetchErrorf(statusCode int, format string, args ...interface{}) *fetchError {
+	return &fetchError{StatusCode: statusCode, Message: fmt.Sprintf(format, args...)}
+}
+
+// fetcher retrieves remote files for /api/store. To prevent requests to
+// internal services, it refuses to connect to loopback, private, link-local
+// and other special addresses, unless they're part of an allowed network.
+// The addresses are checked when connecting, after DNS resolution, so this
+// applies to redirects as well.
+type fetcher struct {
+	Config *storeConfig
+
+	client   *http.Client
+	networks []*net.IPNet
+}
+
+func newFetcher(cfg *storeConfig) (*fetcher, error) {
+	f := &fetcher{Config: cfg}
+
+	var err error
+	if f.networks, err = accesslog.ParseNetworks(strings.Join(cfg.AllowNetworks, ",")); err != nil {
+		return nil, err
+	}
+
+	connectTimeout := cfg.ConnectTimeout
+	if connectTimeout == 0 {
+		connectTimeout = defaultFetchConnectTimeout
+	}
+	dialer := &net.Dialer{Timeout: connectTimeout, Control: f.checkConnect}
+
+	f.client = &http.Client{
+		Transport: &http.Transport{
+			// a proxy would hide the address that is actually requested.
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   connectTimeout,
+			ResponseHeaderTimeout: f.timeout(),
+			MaxIdleConns:          10,
+			IdleConnTimeout:       90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxFetchRedirects {
+				return fetchErrorf(http.StatusNotAcceptable, "stopped after %d redirects", maxFetchRedirects)
+			}
+			return f.checkURL(req.URL)
+		},
+	}
+
+	return f, nil
+}
+
+func (f *fetcher) timeout() time.Duration {
+	if f.Config.Timeout == 0 {
+		return defaultFetchTimeout
+	}
+	return f.Config.Timeout
+}
+
+func (f *fetcher) maxSize() int64 {
+	if f.Config.MaxSize == 0 {
+		return defaultFetchMaxSize
+	}
+	return f.Config.MaxSize
+}
+
+// fetch retrieves uri and returns its content and content type. If
+// progress is set, it is called with the number of bytes read so far and
+// the total size, or -1 if the size is unknown.
+func (f *fetcher) fetch(ctx context.Context, uri string, progress func(read, total int64)) ([]byte, string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, "", fetchErrorf(http.StatusNotAcceptable, "invalid URL: %v", err)
+	}
+	if err := f.checkURL(u); err != nil {
+		return nil, "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, f.timeout())
+	defer cancel()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, "", fetchErrorf(http.StatusNotAcceptable, "invalid URL: %v", err)
+	}
+
+	resp, err := f.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, "", f.requestError(ctx, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := fetchErrorf(http.StatusNotAcceptable, "fetching URL returned %s", resp.Status)
+		err.Temporary = resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return nil, "", err
+	}
+
+	if resp.ContentLength > f.maxSize() {
+		return nil, "", fetchErrorf(http.StatusRequestEntityTooLarge, "remote file is larger than %d bytes", f.maxSize())
+	}
+
+	var body io.Reader = io.LimitReader(resp.Body, f.maxSize()+1)
+	if progress != nil {
+		body = &progressReader{r: body, total: resp.ContentLength, progress: progress}
+	}
+
+	content, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, "", f.requestError(ctx, err)
+	}
+	if int64(len(content)) > f.maxSize() {
+		return nil, "", fetchErrorf(http.StatusRequestEntityTooLarge, "remote file is larger than %d bytes", f.maxSize())
+	}
+
+	return content, resp.Header.Get("Content-Type"), nil
+}
+
+func (f *fetcher) requestError(ctx context.Context, err error) error {
+	var fetchErr *fetchError
+	if errors.As(err, &fetchErr) {
+		return fetchErr
+	}
+
+	var netErr net.Error
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		fetchErr = fetchErrorf(http.StatusRequestTimeout, "fetching URL timed out after %s", f.timeout())
+	case errors.As(err, &netErr) && netErr.Timeout():
+		fetchErr = fetchErrorf(http.StatusRequestTimeout, "fetching URL timed out: %v", err)
+	default:
+		fetchErr = fetchErrorf(http.StatusNotAcceptable, "fetching URL failed: %v", err)
+	}
+	fetchErr.Temporary = ctx.Err() != context.Canceled
+	return fetchErr
+}
+
+// progressReader reports the number of bytes read from r.
+type progressReader struct {
+	r        io.Reader
+	read     int64
+	total    int64
+	progress func(read, total int64)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+	r.progress(r.read, r.total)
+	return n, err
+}
+
+// checkURL checks the scheme and the host of a URL against the
+// configuration.
+func (f *fetcher) checkURL(u *url.URL) error {
+	schemes := f.Config.Schemes
+	if len(schemes) == 0 {
+		schemes = []string{"http", "https"}
+	}
+	if !contains(schemes, strings.ToLower(u.Scheme)) {
+		return fetchErrorf(http.StatusNotAcceptable, "URL scheme %q is not allowed", u.Scheme)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return fetchErrorf(http.StatusNotAcceptable, "URL %q has no host", u)
+	}
+	if matchesHost(f.Config.DenyHosts, host) {
+		return fetchErrorf(http.StatusForbidden, "host %s is not allowed", host)
+	}
+	if len(f.Config.AllowHosts) > 0 && !matchesHost(f.Config.AllowHosts, host) {
+		return fetchErrorf(http.StatusForbidden, "host %s is not allowed", host)
+	}
+	return nil
+}
+
+// matchesHost reports whether host is in list. Entries starting with a dot
+// match all subdomains, e.g. .example.com matches images.example.com.
+func matchesHost(list []string, host string) bool {
+	for _, entry := range list {
+		entry = strings.ToLower(entry)
+		if host == entry || (strings.HasPrefix(entry, ".") && strings.HasSuffix(host, entry)) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkConnect is called with the resolved address of every connection.
+func (f *fetcher) checkConnect(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fetchErrorf(http.StatusForbidden, "connecting to %s is not allowed", address)
+	}
+
+	for _, n := range f.networks {
+		if n.Contains(ip) {
+			return nil
+		}
+	}
+
+	for _, n := range deniedNetworks {
+		if n.Contains(ip) {
+			return fetchErrorf(http.StatusForbidden, "connecting to %s is not allowed", ip)
+		}
+	}
+	return nil
+}
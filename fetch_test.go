@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestFetcher returns a fetcher that may connect to the test servers on
+// 127.0.0.1.
+func newTestFetcher(t *testing.T) *fetcher {
+	f, err := newFetcher(&storeConfig{AllowNetworks: []string{"127.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestFetcher(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/large":
+			w.Write([]byte(strings.Repeat("x", 2048)))
+		case "/missing":
+			http.NotFound(w, r)
+		default:
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("hello"))
+		}
+	}))
+	defer server.Close()
+
+	// a server on a different loopback address, which isn't allowed.
+	internal := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("internal"))
+	}))
+	if l, err := net.Listen("tcp", "127.0.0.2:0"); err == nil {
+		internal.Listener.Close()
+		internal.Listener = l
+	}
+	internal.Start()
+	defer internal.Close()
+
+	redirect := httptest.NewServer(http.RedirectHandler(internal.URL, http.StatusFound))
+	defer redirect.Close()
+
+	f, err := newFetcher(&storeConfig{
+		MaxSize:       1024,
+		AllowNetworks: []string{"127.0.0.1"},
+		DenyHosts:     []string{"localhost", ".internal.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, contentType, err := f.fetch(context.Background(), server.URL+"/file.txt", nil)
+	if err != nil || string(content) != "hello" || contentType != "text/plain" {
+		t.Fatalf("fetching allowed URL returned %q, %q, %v", content, contentType, err)
+	}
+
+	testCases := []struct {
+		URL        string
+		StatusCode int
+	}{
+		{server.URL + "/large", http.StatusRequestEntityTooLarge},
+		{server.URL + "/missing", http.StatusNotAcceptable},
+		{"ftp://example.com/file.txt", http.StatusNotAcceptable},
+		{"file:///etc/passwd", http.StatusNotAcceptable},
+		{strings.Replace(server.URL, "127.0.0.1", "localhost", 1), http.StatusForbidden},
+		{"http://db.internal.example.com/", http.StatusForbidden},
+		{"http://[::1]:1/", http.StatusForbidden},
+		{"http://169.254.169.254/latest/meta-data/", http.StatusForbidden},
+		{"http://10.0.0.1/", http.StatusForbidden},
+		{"http://0.0.0.0/", http.StatusForbidden},
+		{"http://0.1.2.3/", http.StatusForbidden},
+		{"http://100.64.0.1/", http.StatusForbidden},
+		{"http://100.127.255.254/", http.StatusForbidden},
+		{"http://198.18.0.1/", http.StatusForbidden},
+		{"http://198.19.255.254/", http.StatusForbidden},
+		{"http://[64:ff9b::a00:1]/", http.StatusForbidden},
+		{"http://[64:ff9b::7f00:1]/", http.StatusForbidden},
+		{"http://[::ffff:10.0.0.1]/", http.StatusForbidden},
+		{"http://[::ffff:192.168.1.1]/", http.StatusForbidden},
+		{"http://[::ffff:169.254.169.254]/", http.StatusForbidden},
+		{"http://[fd00::1]/", http.StatusForbidden},
+		{internal.URL, http.StatusForbidden},
+		{redirect.URL, http.StatusForbidden},
+	}
+
+	for _, tc := range testCases {
+		_, _, err := f.fetch(context.Background(), tc.URL, nil)
+		fe, ok := err.(*fetchError)
+		if !ok {
+			t.Errorf("fetching %s returned %v instead of a fetch error", tc.URL, err)
+			continue
+		}
+		if fe.StatusCode != tc.StatusCode {
+			t.Errorf("fetching %s returned %d (%v), expected %d", tc.URL, fe.StatusCode, fe, tc.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/akrennmair/cabinet/data"
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// putFile stores a file and its metadata together with an upload event,
+// replacing any existing file of the same name, which is kept as old version
+// if the drawer keeps versions. The event is returned so that the caller can
+// pass it on to the dispatcher once the request is done.
+// A missing or generic content type is replaced by a detected one. If the
+// file violates the limits of the drawer or is rejected by the scanner s,
+// which may be nil, a *limitError is returned.
+func putFile(ctx context.Context, db *leveldb.DB, s *uploadScanner, drawer, filename string, content []byte, metadata *data.MetaData, limits drawerLimits) (*data.Event, error) {
+	if err := limits.checkFileSize(int64(len(content))); err != nil {
+		return nil, err
+	}
+	name := metadata.GetOriginalName()
+	if name == "" {
+		name = filename
+	}
+	metadata.ContentType = proto.String(resolveContentType(metadata.GetContentType(), name, content))
+	if err := limits.checkContentType(metadata.GetContentType()); err != nil {
+		return nil, err
+	}
+	if err := s.check(ctx, db, drawer, filename, content, metadata); err != nil {
+		return nil, err
+	}
+
+	var event *data.Event
+	var replaced []byte
+	err := writeWithUsage(db, drawer, limits, func(batch *leveldb.Batch) (drawerUsage, error) {
+		// leveldb may return an empty value for deleted keys, so a missing
+		// file is normalized to nil.
+		var err error
+		replaced, err = db.Get([]byte("file:"+drawer+":"+filename), nil)
+		if err == leveldb.ErrNotFound {
+			replaced = nil
+		} else if err != nil {
+			return drawerUsage{}, err
+		}
+
+		version, err := keepVersion(db, batch, drawer, filename, replaced)
+		if err != nil {
+			return drawerUsage{}, err
+		}
+
+		metadata.Sha256 = proto.String(contentHash(content))
+		metadata.Uploaded = proto.Int64(time.Now().Unix())
+		metadata.Version = proto.Int64(version)
+		rawMetaData, err := proto.Marshal(metadata)
+		if err != nil {
+			return drawerUsage{}, err
+		}
+
+		if err := indexTags(db, batch, drawer, filename, metadata.Tags); err != nil {
+			return drawerUsage{}, err
+		}
+		batch.Put([]byte("file:"+drawer+":"+filename), content)
+		batch.Put([]byte("meta:"+drawer+":"+filename), rawMetaData)
+
+		eventKey := "event:" + strconv.FormatInt(time.Now().UnixNano(), 10)
+		event = &data.Event{
+			Type:     data.Event_UPLOAD.Enum(),
+			Drawer:   proto.String(drawer),
+			Filename: proto.String(filename),
+			Id:       proto.String(eventKey),
+			Version:  proto.Int64(version),
+		}
+		eventData, err := proto.Marshal(event)
+		if err != nil {
+			return drawerUsage{}, err
+		}
+		batch.Put([]byte(eventKey), eventData)
+		batch.Put([]byte("latest_event"), []byte(eventKey))
+
+		delta := drawerUsage{Bytes: int64(len(content) - len(replaced))}
+		if replaced == nil {
+			delta.Files = 1
+		}
+		return delta, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fileAdded(drawer, len(content))
+	if replaced != nil {
+		fileRemoved(drawer, len(replaced))
+	}
+
+	return event, nil
+}
+
+// removeFile deletes a file, its metadata, its old versions and a trashed
+// file of the same name for good, together with a delete event, which is
+// returned so that the caller can pass it on to the dispatcher.
+// The event is written even if the file doesn't exist.
+func removeFile(db *leveldb.DB, drawer, filename string) (*data.Event, error) {
+	return removeFileIf(db, drawer, filename, nil)
+}
+
+// removeFileIf deletes a file like removeFile, unless check returns an error
+// for its metadata, which is nil if the file doesn't exist. The metadata is
+// read while the usage counters are locked, so it can't change before the
+// file is deleted.
+func removeFileIf(db *leveldb.DB, drawer, filename string, check func(metadata *data.MetaData) error) (*data.Event, error) {
+	var event *data.Event
+	var removed []byte
+	err := writeWithUsage(db, drawer, drawerLimits{}, func(batch *leveldb.Batch) (drawerUsage, error) {
+		if check != nil {
+			metadata, err := readMetadata(db, drawer, filename)
+			if err == leveldb.ErrNotFound {
+				metadata = nil
+			} else if err != nil {
+				return drawerUsage{}, err
+			}
+			if err := check(metadata); err != nil {
+				return drawerUsage{}, err
+			}
+		}
+
+		var err error
+		removed, err = db.Get([]byte("file:"+drawer+":"+filename), nil)
+		if err == leveldb.ErrNotFound {
+			removed = nil
+		} else if err != nil {
+			return drawerUsage{}, err
+		}
+
+		if err := indexTags(db, batch, drawer, filename, nil); err != nil {
+			return drawerUsage{}, err
+		}
+		if err := deleteVersions(db, batch, drawer, filename); err != nil {
+			return drawerUsage{}, err
+		}
+		batch.Delete([]byte("file:" + drawer + ":" + filename))
+		batch.Delete([]byte("meta:" + drawer + ":" + filename))
+		batch.Delete([]byte("trash:" + drawer + ":" + filename))
+		batch.Delete([]byte("tmeta:" + drawer + ":" + filename))
+
+		eventKey := "event:" + strconv.FormatInt(time.Now().UnixNano(), 10)
+		event = &data.Event{
+			Type:     data.Event_DELETE.Enum(),
+			Drawer:   proto.String(drawer),
+			Filename: proto.String(filename),
+			Id:       proto.String(eventKey),
+		}
+		eventData, err := proto.Marshal(event)
+		if err != nil {
+			return drawerUsage{}, err
+		}
+		batch.Put([]byte(eventKey), eventData)
+		batch.Put([]byte("latest_event"), []byte(eventKey))
+
+		if removed == nil {
+			return drawerUsage{}, nil
+		}
+		return drawerUsage{Bytes: -int64(len(removed)), Files: -1}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if removed != nil {
+		fileRemoved(drawer, len(removed))
+	}
+
+	return event, nil
+}
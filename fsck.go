@@ -0,0 +1,478 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akrennmair/cabinet/data"
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// colonProblem is reported for keys of drawers whose names contain colons,
+// which were allowed before. Neither drawer names nor file names may contain
+// colons now, so that the keys can be split unambiguously. The drawer and
+// file names of these keys can't be told apart, so they aren't repaired and
+// are left out of all other checks.
+const colonProblem = "drawer or file name contains ':'"
+
+// fsckProblem is an inconsistency found in the data file.
+type fsckProblem struct {
+	Key      string `json:"key"`
+	Problem  string `json:"problem"`
+	Repaired bool   `json:"repaired"`
+}
+
+func fsckCommand(c *cli, fs *flag.FlagSet) func(args []string) error {
+	dataFile := fs.String("datafile", defaultDataFile, "path to data file")
+	repair := fs.Bool("repair", false, "repair the problems that can be repaired")
+
+	return func(args []string) error {
+		if len(args) != 0 {
+			return errUsage
+		}
+
+		// the data file is only written when repairing, and never created.
+		db, err := leveldb.OpenFile(*dataFile, &opt.Options{ErrorIfMissing: true, ReadOnly: !*repair})
+		if err != nil {
+			return fmt.Errorf("opening %s failed, cabinet needs to be stopped for fsck: %v", *dataFile, err)
+		}
+		defer db.Close()
+
+		problems, err := fsck(db, *repair)
+		if err != nil {
+			return err
+		}
+
+		unrepaired := 0
+		for _, p := range problems {
+			if !p.Repaired {
+				unrepaired++
+			}
+			if !c.json {
+				if p.Repaired {
+					fmt.Fprintf(c.stdout, "%s: %s (repaired)\n", p.Key, p.Problem)
+				} else {
+					fmt.Fprintf(c.stdout, "%s: %s\n", p.Key, p.Problem)
+				}
+			}
+		}
+
+		if c.json {
+			if problems == nil {
+				problems = []fsckProblem{}
+			}
+			if err := c.printJSON(problems); err != nil {
+				return err
+			}
+		}
+
+		if unrepaired > 0 {
+			return fmt.Errorf("%d of %d problems not repaired", unrepaired, len(problems))
+		}
+		return nil
+	}
+}
+
+// fsck checks the consistency of the file, metadata, version, trash, drawer,
+// event, tag index and usage keys. With repair set, it deletes orphaned
+// metadata and versions, trashed files that were replaced, stale tag index
+// entries and unparseable events, recreates missing or broken metadata and
+// tag index entries, and corrects latest_event and the usage counters. Files
+// whose metadata was recreated are announced with new upload events, so that
+// children fetch them again.
+func fsck(db *leveldb.DB, repair bool) ([]fsckProblem, error) {
+	var (
+		problems    []fsckProblem
+		latestEvent string
+		latestNanos int64
+
+		// files whose metadata needs to be recreated, by file key.
+		rebuild []string
+	)
+
+	batch := new(leveldb.Batch)
+
+	report := func(key, problem string, repaired bool) {
+		problems = append(problems, fsckProblem{Key: key, Problem: problem, Repaired: repaired && repair})
+	}
+
+	iterator := db.NewIterator(nil, nil)
+	for iterator.Next() {
+		key := string(iterator.Key())
+
+		switch {
+		case strings.HasPrefix(key, "file:"):
+			fields := strings.SplitN(key, ":", 3)
+			if len(fields) != 3 || fields[2] == "" {
+				report(key, "malformed file key", false)
+				continue
+			}
+			if strings.Contains(fields[2], ":") {
+				report(key, colonProblem, false)
+				continue
+			}
+			if fields[1] == "" || !validDrawerName(fields[1]) {
+				report(key, "invalid drawer name", false)
+			}
+
+			rawMetaData, err := db.Get([]byte("meta:"+fields[1]+":"+fields[2]), nil)
+			if err == leveldb.ErrNotFound {
+				report(key, "file without metadata", true)
+				rebuild = append(rebuild, key)
+			} else if err != nil {
+				iterator.Release()
+				return nil, err
+			} else if err := proto.Unmarshal(rawMetaData, new(data.MetaData)); err != nil {
+				report("meta:"+fields[1]+":"+fields[2], "unparseable metadata: "+err.Error(), true)
+				rebuild = append(rebuild, key)
+			}
+
+		case strings.HasPrefix(key, "meta:"):
+			fields := strings.SplitN(key, ":", 3)
+			if len(fields) != 3 {
+				report(key, "malformed metadata key", true)
+				batch.Delete(iterator.Key())
+				continue
+			}
+			if strings.Contains(fields[2], ":") {
+				report(key, colonProblem, false)
+				continue
+			}
+
+			if found, err := db.Has([]byte("file:"+fields[1]+":"+fields[2]), nil); err != nil {
+				iterator.Release()
+				return nil, err
+			} else if !found {
+				report(key, "orphaned metadata", true)
+				batch.Delete(iterator.Key())
+				continue
+			}
+
+			var metadata data.MetaData
+			if err := proto.Unmarshal(iterator.Value(), &metadata); err != nil {
+				continue
+			}
+			for _, tag := range metadata.GetTags() {
+				if found, err := db.Has(tagKey(tag, fields[1], fields[2]), nil); err != nil {
+					iterator.Release()
+					return nil, err
+				} else if !found {
+					report(key, "tag "+tag+" missing from index", true)
+					batch.Put(tagKey(tag, fields[1], fields[2]), nil)
+				}
+			}
+
+		case strings.HasPrefix(key, "tag:"):
+			fields := strings.SplitN(key, ":", 4)
+			if len(fields) != 4 {
+				report(key, "malformed tag key", true)
+				batch.Delete(iterator.Key())
+				continue
+			}
+			if strings.Contains(fields[3], ":") {
+				report(key, colonProblem, false)
+				continue
+			}
+
+			if tagged, err := hasTag(db, fields[2], fields[3], fields[1]); err != nil {
+				iterator.Release()
+				return nil, err
+			} else if !tagged {
+				report(key, "stale tag index entry", true)
+				batch.Delete(iterator.Key())
+			}
+
+		case strings.HasPrefix(key, "version:"), strings.HasPrefix(key, "vmeta:"):
+			n := strings.LastIndex(key, ":")
+			fields := strings.SplitN(key[:n], ":", 3)
+			version, err := strconv.ParseInt(key[n+1:], 10, 64)
+			if len(fields) != 3 || err != nil {
+				report(key, "malformed version key", true)
+				batch.Delete(iterator.Key())
+				continue
+			}
+			if strings.Contains(fields[2], ":") {
+				report(key, colonProblem, false)
+				continue
+			}
+
+			// old versions are deleted with their file, and their
+			// metadata with their content.
+			var problem string
+			if found, err := fileOrTrashed(db, fields[1], fields[2]); err != nil {
+				iterator.Release()
+				return nil, err
+			} else if !found {
+				problem = "old version of missing file"
+			} else if fields[0] == "vmeta" {
+				if found, err := db.Has(versionKey("version", fields[1], fields[2], version), nil); err != nil {
+					iterator.Release()
+					return nil, err
+				} else if !found {
+					problem = "orphaned version metadata"
+				}
+			}
+			if problem != "" {
+				report(key, problem, true)
+				batch.Delete(iterator.Key())
+			}
+
+		case strings.HasPrefix(key, "trash:"):
+			fields := strings.SplitN(key, ":", 3)
+			if len(fields) != 3 || fields[2] == "" {
+				report(key, "malformed trash key", false)
+				continue
+			}
+			if strings.Contains(fields[2], ":") {
+				report(key, colonProblem, false)
+				continue
+			}
+
+			// uploads replace trashed files of the same name.
+			if found, err := db.Has([]byte("file:"+fields[1]+":"+fields[2]), nil); err != nil {
+				iterator.Release()
+				return nil, err
+			} else if found {
+				report(key, "trashed file of an existing file", true)
+				batch.Delete(iterator.Key())
+				batch.Delete([]byte("tmeta:" + fields[1] + ":" + fields[2]))
+				continue
+			}
+
+			if found, err := db.Has([]byte("tmeta:"+fields[1]+":"+fields[2]), nil); err != nil {
+				iterator.Release()
+				return nil, err
+			} else if !found {
+				report(key, "trashed file without metadata", true)
+				metadata := &data.MetaData{
+					ContentType: proto.String(resolveContentType("", fields[2], iterator.Value())),
+					Sha256:      proto.String(contentHash(iterator.Value())),
+					Deleted:     proto.Int64(time.Now().Unix()),
+				}
+				rawMetaData, err := proto.Marshal(metadata)
+				if err != nil {
+					iterator.Release()
+					return nil, err
+				}
+				batch.Put([]byte("tmeta:"+fields[1]+":"+fields[2]), rawMetaData)
+			}
+
+		case strings.HasPrefix(key, "tmeta:"):
+			fields := strings.SplitN(key, ":", 3)
+			if len(fields) != 3 {
+				report(key, "malformed trash metadata key", true)
+				batch.Delete(iterator.Key())
+				continue
+			}
+			if strings.Contains(fields[2], ":") {
+				report(key, colonProblem, false)
+				continue
+			}
+			if found, err := db.Has([]byte("trash:"+fields[1]+":"+fields[2]), nil); err != nil {
+				iterator.Release()
+				return nil, err
+			} else if !found {
+				report(key, "orphaned trash metadata", true)
+				batch.Delete(iterator.Key())
+			}
+
+		case strings.HasPrefix(key, "drawer:"):
+			var record drawerRecord
+			if strings.Contains(strings.TrimPrefix(key, "drawer:"), ":") {
+				report(key, colonProblem, false)
+			} else if err := json.Unmarshal(iterator.Value(), &record); err != nil {
+				report(key, "unparseable drawer: "+err.Error(), false)
+			} else if record.Name != strings.TrimPrefix(key, "drawer:") {
+				report(key, fmt.Sprintf("drawer has mismatching name %s", record.Name), false)
+			}
+
+		case strings.HasPrefix(key, "event:"):
+			var event data.Event
+			if err := proto.Unmarshal(iterator.Value(), &event); err != nil {
+				report(key, "unparseable event: "+err.Error(), true)
+				batch.Delete(iterator.Key())
+				continue
+			}
+			if event.GetId() != key {
+				report(key, fmt.Sprintf("event has mismatching id %s", event.GetId()), false)
+			}
+
+			nanos, err := strconv.ParseInt(strings.TrimPrefix(key, "event:"), 10, 64)
+			if err != nil {
+				report(key, "malformed event key", false)
+				continue
+			}
+			if nanos > latestNanos {
+				latestNanos, latestEvent = nanos, key
+			}
+		}
+	}
+	iterator.Release()
+	if err := iterator.Error(); err != nil {
+		return nil, err
+	}
+
+	storedLatest, err := db.Get([]byte("latest_event"), nil)
+	if err != nil && err != leveldb.ErrNotFound {
+		return nil, err
+	}
+	if latestEvent == "" && storedLatest != nil {
+		report("latest_event", fmt.Sprintf("refers to %s, but the event log is empty", storedLatest), true)
+		batch.Delete([]byte("latest_event"))
+	} else if latestEvent != "" && string(storedLatest) != latestEvent {
+		report("latest_event", fmt.Sprintf("refers to %q instead of %s", storedLatest, latestEvent), true)
+		batch.Put([]byte("latest_event"), []byte(latestEvent))
+	}
+
+	if err := fsckUsage(db, batch, report); err != nil {
+		return nil, err
+	}
+
+	// corrective events are numbered after the latest event in the log, so
+	// that they are sent to children after everything else.
+	nextNanos := time.Now().UnixNano()
+	if nextNanos <= latestNanos {
+		nextNanos = latestNanos + 1
+	}
+
+	for _, fileKey := range rebuild {
+		fields := strings.SplitN(fileKey, ":", 3)
+
+		content, err := db.Get([]byte(fileKey), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var metadata data.MetaData
+		metadata.ContentType = proto.String(resolveContentType("", fields[2], content))
+		metadata.Sha256 = proto.String(contentHash(content))
+
+		// the recreated metadata follows the old versions that are kept.
+		versions, err := listVersions(db, fields[1], fields[2])
+		if err != nil {
+			return nil, err
+		}
+		metadata.Version = proto.Int64(1)
+		if len(versions) > 0 {
+			metadata.Version = proto.Int64(versions[len(versions)-1] + 1)
+		}
+		rawMetaData, err := proto.Marshal(&metadata)
+		if err != nil {
+			return nil, err
+		}
+		batch.Put([]byte("meta:"+fields[1]+":"+fields[2]), rawMetaData)
+
+		eventKey := "event:" + strconv.FormatInt(nextNanos, 10)
+		nextNanos++
+		event := &data.Event{
+			Type:     data.Event_UPLOAD.Enum(),
+			Drawer:   proto.String(fields[1]),
+			Filename: proto.String(fields[2]),
+			Id:       proto.String(eventKey),
+			Version:  metadata.Version,
+		}
+		eventData, err := proto.Marshal(event)
+		if err != nil {
+			return nil, err
+		}
+		batch.Put([]byte(eventKey), eventData)
+		batch.Put([]byte("latest_event"), []byte(eventKey))
+	}
+
+	if repair && batch.Len() > 0 {
+		if err := db.Write(batch, nil); err != nil {
+			return nil, fmt.Errorf("writing repairs failed: %v", err)
+		}
+	}
+
+	return problems, nil
+}
+
+// fsckUsage compares the usage counters with the actual files.
+func fsckUsage(db *leveldb.DB, batch *leveldb.Batch, report func(key, problem string, repaired bool)) error {
+	actual, err := computeUsage(db)
+	if err != nil {
+		return err
+	}
+
+	iterator := db.NewIterator(util.BytesPrefix([]byte("usage:")), nil)
+	for iterator.Next() {
+		key := string(iterator.Key())
+		drawer := strings.TrimPrefix(key, "usage:")
+		if strings.Contains(drawer, ":") {
+			report(key, colonProblem, false)
+			continue
+		}
+
+		var stored drawerUsage
+		if err := json.Unmarshal(iterator.Value(), &stored); err != nil {
+			report(key, "unparseable usage: "+err.Error(), true)
+		} else if stored != actual[drawer] {
+			report(key, fmt.Sprintf("counts %d bytes in %d files instead of %d bytes in %d files", stored.Bytes, stored.Files, actual[drawer].Bytes, actual[drawer].Files), true)
+		} else {
+			delete(actual, drawer)
+			continue
+		}
+
+		if u, found := actual[drawer]; found {
+			rawUsage, err := json.Marshal(u)
+			if err != nil {
+				iterator.Release()
+				return err
+			}
+			batch.Put(iterator.Key(), rawUsage)
+			delete(actual, drawer)
+		} else {
+			batch.Delete(iterator.Key())
+		}
+	}
+	iterator.Release()
+	if err := iterator.Error(); err != nil {
+		return err
+	}
+
+	// drawers whose files aren't counted at all.
+	for drawer, u := range actual {
+		report("usage:"+drawer, "missing", true)
+		rawUsage, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+		batch.Put(usageKey(drawer), rawUsage)
+	}
+
+	return nil
+}
+
+// hasTag returns whether a file exists and is tagged with tag.
+func hasTag(db *leveldb.DB, drawer, filename, tag string) (bool, error) {
+	if found, err := db.Has([]byte("file:"+drawer+":"+filename), nil); err != nil || !found {
+		return false, err
+	}
+	rawMetaData, err := db.Get([]byte("meta:"+drawer+":"+filename), nil)
+	if err == leveldb.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	var metadata data.MetaData
+	if err := proto.Unmarshal(rawMetaData, &metadata); err != nil {
+		return false, nil
+	}
+	return contains(metadata.GetTags(), tag), nil
+}
+
+// fileOrTrashed returns whether a file exists or is in the trash.
+func fileOrTrashed(db *leveldb.DB, drawer, filename string) (bool, error) {
+	if found, err := db.Has([]byte("file:"+drawer+":"+filename), nil); err != nil || found {
+		return found, err
+	}
+	return db.Has([]byte("trash:"+drawer+":"+filename), nil)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/akrennmair/cabinet/data"
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestFsck(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rawMetaData, _ := proto.Marshal(&data.MetaData{ContentType: proto.String("text/plain")})
+	rawEvent, _ := proto.Marshal(&data.Event{
+		Type:     data.Event_UPLOAD.Enum(),
+		Drawer:   proto.String("test"),
+		Filename: proto.String("ok.txt"),
+		Id:       proto.String("event:100"),
+	})
+
+	for key, value := range map[string]string{
+		"file:test:ok.txt":      "fine",
+		"meta:test:ok.txt":      string(rawMetaData),
+		"file:test:nometa.txt":  "no metadata",
+		"file:test:badmeta.txt": "broken metadata",
+		"meta:test:badmeta.txt": "\xff\xff\xff",
+		"meta:test:orphan.txt":  string(rawMetaData),
+		"file:bad drawer:x":     "x",
+		"meta:bad drawer:x":     string(rawMetaData),
+		"event:100":             string(rawEvent),
+		"event:200":             "\xff\xff\xff",
+		"latest_event":          "event:200",
+		"usage:test":            `{"bytes":4,"files":1}`,
+		"usage:bad drawer":      `{"bytes":1,"files":1}`,
+		"usage:gone":            `{"bytes":5,"files":1}`,
+	} {
+		if err := db.Put([]byte(key), []byte(value), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	problems, err := fsck(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"event:200",
+		"file:bad drawer:x",
+		"file:test:nometa.txt",
+		"latest_event",
+		"meta:test:badmeta.txt",
+		"meta:test:orphan.txt",
+		"usage:gone",
+		"usage:test",
+	}
+	if keys := problemKeys(problems); !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("expected problems with %v, got %+v", expected, problems)
+	}
+	for _, p := range problems {
+		if p.Repaired {
+			t.Fatalf("problem %+v repaired without -repair", p)
+		}
+	}
+
+	problems, err = fsck(db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range problems {
+		if p.Repaired == (p.Key == "file:bad drawer:x") {
+			t.Errorf("unexpected repair status of %+v", p)
+		}
+	}
+
+	problems, err = fsck(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := problemKeys(problems); !reflect.DeepEqual(keys, []string{"file:bad drawer:x"}) {
+		t.Fatalf("expected only the invalid drawer name to remain, got %+v", problems)
+	}
+
+	if usage, err := readUsage(db, "test"); err != nil || usage != (drawerUsage{Bytes: 30, Files: 3}) {
+		t.Fatalf("unexpected repaired usage %+v: %v", usage, err)
+	}
+	if found, _ := db.Has([]byte("usage:gone"), nil); found {
+		t.Fatal("usage of drawer without files wasn't removed")
+	}
+
+	var metadata data.MetaData
+	raw, err := db.Get([]byte("meta:test:nometa.txt"), nil)
+	if err != nil {
+		t.Fatalf("metadata wasn't recreated: %v", err)
+	}
+	if err := proto.Unmarshal(raw, &metadata); err != nil || metadata.GetSha256() != contentHash([]byte("no metadata")) {
+		t.Fatalf("unexpected recreated metadata %v: %v", metadata.String(), err)
+	}
+
+	latest, err := db.Get([]byte("latest_event"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event data.Event
+	raw, err = db.Get(latest, nil)
+	if err != nil {
+		t.Fatalf("latest_event %s doesn't exist: %v", latest, err)
+	}
+	if err := proto.Unmarshal(raw, &event); err != nil || event.GetType() != data.Event_UPLOAD {
+		t.Fatalf("expected corrective upload event, got %v: %v", event.String(), err)
+	}
+}
+
+func TestFsckColonDrawers(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	rawMetaData, _ := proto.Marshal(&data.MetaData{ContentType: proto.String("text/plain"), Tags: []string{"red"}})
+
+	// a:b is a drawer from before colons were disallowed, whose keys
+	// mustn't be mistaken for files of drawer a.
+	for key, value := range map[string]string{
+		"file:a:x":      "x",
+		"meta:a:x":      string(rawMetaData),
+		"tag:red:a:x":   "",
+		"file:a:b:y":    "yy",
+		"meta:a:b:y":    string(rawMetaData),
+		"tag:red:a:b:y": "",
+		"usage:a":       `{"bytes":1,"files":1}`,
+		"usage:a:b":     `{"bytes":2,"files":1}`,
+	} {
+		if err := db.Put([]byte(key), []byte(value), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, repair := range []bool{false, true} {
+		problems, err := fsck(db, repair)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"file:a:b:y", "meta:a:b:y", "tag:red:a:b:y", "usage:a:b"}
+		if keys := problemKeys(problems); !reflect.DeepEqual(keys, expected) {
+			t.Fatalf("expected problems with %v, got %+v", expected, problems)
+		}
+		for _, p := range problems {
+			if p.Repaired || p.Problem != colonProblem {
+				t.Fatalf("unexpected problem %+v", p)
+			}
+		}
+	}
+
+	for _, key := range []string{"tag:red:a:x", "tag:red:a:b:y", "usage:a:b"} {
+		if found, _ := db.Has([]byte(key), nil); !found {
+			t.Errorf("%s was deleted", key)
+		}
+	}
+}
+
+func problemKeys(problems []fsckProblem) []string {
+	var keys []string
+	for _, p := range problems {
+		keys = append(keys, p.Key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestFsckCommand(t *testing.T) {
+	dir := t.TempDir()
+	c := &cli{}
+
+	missing := filepath.Join(dir, "missing.db")
+	if _, err := runTestCommand(c, "fsck", "-datafile="+missing); err == nil {
+		t.Fatal("fsck of a missing data file succeeded")
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Fatalf("fsck created the data file: %v", err)
+	}
+
+	dataFile := filepath.Join(dir, "data.db")
+	db, err := leveldb.OpenFile(dataFile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := putFile(context.Background(), db, nil, "test", "file", []byte("content"), &data.MetaData{}, drawerLimits{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put([]byte("meta:test:orphan"), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if _, err := runTestCommand(c, "fsck", "-datafile="+dataFile); err == nil {
+		t.Fatal("fsck didn't report the orphaned metadata")
+	}
+	if _, err := runTestCommand(c, "fsck", "-repair", "-datafile="+dataFile); err != nil {
+		t.Fatalf("fsck -repair failed: %v", err)
+	}
+	if _, err := runTestCommand(c, "fsck", "-datafile="+dataFile); err != nil {
+		t.Fatalf("fsck after repairing failed: %v", err)
+	}
+}
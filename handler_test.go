@@ -20,7 +20,7 @@ func TestFileHandler(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	uploadHandler := &uploadFileHandler{DB: db, Frontend: "http://localhost:8080", AuthFunc: authFunc}
+	uploadHandler := &uploadFileHandler{DB: db, Frontend: "http://localhost:8080", AuthFunc: authFunc, Fetcher: newTestFetcher(t)}
 	fileHandler := &fileHandler{DB: db, AuthFunc: authFunc}
 
 	// first, upload file.
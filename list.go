@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/akrennmair/cabinet/basicauth"
+	"github.com/akrennmair/cabinet/data"
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// listHandler lists the drawers, or the files within a drawer.
+type listHandler struct {
+	DB         *leveldb.DB
+	Frontend   string
+	AuthFunc   basicauth.AuthenticatorFunc
+	AccessFunc drawerAccessFunc
+}
+
+type fileInfo struct {
+	Name         string            `json:"name"`
+	Drawer       string            `json:"drawer"`
+	URL          string            `json:"url"`
+	Size         int64             `json:"size"`
+	ContentType  string            `json:"content_type"`
+	Source       string            `json:"source,omitempty"`
+	OriginalName string            `json:"original_name,omitempty"`
+	SHA256       string            `json:"sha256"`
+	Version      int64             `json:"version"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	Tags         []string          `json:"tags,omitempty"`
+	Scan         *data.ScanResult  `json:"scan,omitempty"`
+}
+
+type drawerInfo struct {
+	Name string `json:"name"`
+}
+
+func (h *listHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !basicauth.Authenticate(w, r, h.AuthFunc) {
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	drawerName := r.FormValue("drawer")
+	tags := r.Form["tag"]
+	if drawerName == "" && len(tags) == 0 {
+		h.listDrawers(w, r)
+		return
+	}
+
+	if drawerName != "" && !validDrawerName(drawerName) {
+		http.Error(w, "invalid drawer name", http.StatusNotAcceptable)
+		return
+	}
+
+	if drawerName != "" && !h.AccessFunc.permits(r, drawerName) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	limit := 0
+	if l := r.FormValue("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			http.Error(w, "invalid limit", http.StatusNotAcceptable)
+			return
+		}
+	}
+
+	if len(tags) > 0 {
+		h.listTagged(w, r, drawerName, tags, limit)
+		return
+	}
+
+	prefix := "file:" + drawerName + ":"
+	keyRange := util.BytesPrefix([]byte(prefix))
+	if after := r.FormValue("after"); after != "" {
+		keyRange.Start = []byte(prefix + after + "\x00")
+	}
+
+	iterator := h.DB.NewIterator(keyRange, nil)
+	defer iterator.Release()
+
+	files := []fileInfo{}
+
+	for iterator.Next() && (limit == 0 || len(files) < limit) {
+		filename := strings.TrimPrefix(string(iterator.Key()), prefix)
+		files = append(files, h.fileInfo(drawerName, filename, iterator.Value()))
+	}
+
+	if err := iterator.Error(); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("listing drawer %s failed: %v", drawerName, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(files); err != nil {
+		log.Printf("encoding file list failed: %v", err)
+	}
+}
+
+// listTagged lists the files tagged with all of tags, in drawer or in all
+// drawers the user can access. The first tag is looked up in the index, the
+// others are checked against the metadata of the files. Without a drawer,
+// after refers to <drawer>:<filename>.
+func (h *listHandler) listTagged(w http.ResponseWriter, r *http.Request, drawer string, tags []string, limit int) {
+	for _, tag := range tags {
+		if !validMetaName(tag, tagChars) {
+			http.Error(w, "invalid tag", http.StatusNotAcceptable)
+			return
+		}
+	}
+
+	prefix := "tag:" + tags[0] + ":"
+	if drawer != "" {
+		prefix += drawer + ":"
+	}
+	keyRange := util.BytesPrefix([]byte(prefix))
+	if after := r.FormValue("after"); after != "" {
+		keyRange.Start = []byte(prefix + after + "\x00")
+	}
+
+	iterator := h.DB.NewIterator(keyRange, nil)
+	defer iterator.Release()
+
+	files := []fileInfo{}
+
+files:
+	for iterator.Next() && (limit == 0 || len(files) < limit) {
+		fields := strings.SplitN(strings.TrimPrefix(string(iterator.Key()), "tag:"+tags[0]+":"), ":", 2)
+		if len(fields) != 2 || !h.AccessFunc.permits(r, fields[0]) {
+			continue
+		}
+
+		content, err := h.DB.Get([]byte("file:"+fields[0]+":"+fields[1]), nil)
+		if err == leveldb.ErrNotFound {
+			continue
+		} else if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			log.Printf("reading %s:%s failed: %v", fields[0], fields[1], err)
+			return
+		}
+
+		info := h.fileInfo(fields[0], fields[1], content)
+		for _, tag := range tags[1:] {
+			if !contains(info.Tags, tag) {
+				continue files
+			}
+		}
+		files = append(files, info)
+	}
+
+	if err := iterator.Error(); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("listing files tagged %s failed: %v", tags[0], err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(files); err != nil {
+		log.Printf("encoding file list failed: %v", err)
+	}
+}
+
+// fileInfo describes a file for listings.
+func (h *listHandler) fileInfo(drawer, filename string, content []byte) fileInfo {
+	info := fileInfo{
+		Name:        filename,
+		Drawer:      drawer,
+		URL:         h.Frontend + "/" + drawer + "/" + filename,
+		Size:        int64(len(content)),
+		ContentType: "application/octet-stream",
+		Version:     1,
+	}
+
+	if rawMetaData, err := h.DB.Get([]byte("meta:"+drawer+":"+filename), nil); err == nil {
+		var metadata data.MetaData
+		if err := proto.Unmarshal(rawMetaData, &metadata); err != nil {
+			log.Printf("proto.Unmarshal of metadata for %s:%s failed: %v", drawer, filename, err)
+		} else {
+			info.ContentType = metadata.GetContentType()
+			info.Source = metadata.GetSource()
+			info.OriginalName = metadata.GetOriginalName()
+			info.SHA256 = metadata.GetSha256()
+			info.Version = currentVersion(&metadata)
+			info.Tags = metadata.GetTags()
+			info.Scan = metadata.Scan
+			if attrs := metadata.GetAttributes(); len(attrs) > 0 {
+				info.Attributes = metadataUser(&metadata).Attributes
+			}
+		}
+	}
+
+	// files stored before hashes were recorded are hashed on the fly.
+	if info.SHA256 == "" {
+		info.SHA256 = contentHash(content)
+	}
+
+	return info
+}
+
+// listDrawers lists all drawers the user can access. Instead of iterating
+// over all files, it seeks directly to the key following the last file of
+// each drawer.
+func (h *listHandler) listDrawers(w http.ResponseWriter, r *http.Request) {
+	iterator := h.DB.NewIterator(util.BytesPrefix([]byte("file:")), nil)
+	defer iterator.Release()
+
+	drawers := []drawerInfo{}
+
+	for ok := iterator.First(); ok; {
+		key := strings.SplitN(string(iterator.Key()), ":", 3)
+		if len(key) != 3 {
+			ok = iterator.Next()
+			continue
+		}
+
+		if h.AccessFunc.permits(r, key[1]) {
+			drawers = append(drawers, drawerInfo{Name: key[1]})
+		}
+
+		// ';' is the character following ':', so this skips the drawer.
+		ok = iterator.Seek([]byte("file:" + key[1] + ";"))
+	}
+
+	if err := iterator.Error(); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("listing drawers failed: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(drawers); err != nil {
+		log.Printf("encoding drawer list failed: %v", err)
+	}
+}
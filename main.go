@@ -1,8 +1,10 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"expvar"
 	"flag"
@@ -13,48 +15,73 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"net/url"
+	"os"
+	"os/signal"
+	"path"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/akrennmair/cabinet/accesslog"
 	"github.com/akrennmair/cabinet/basicauth"
 	"github.com/akrennmair/cabinet/data"
 	"github.com/akrennmair/gouuid"
 	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/syndtr/goleveldb/leveldb"
 	"golang.org/x/net/websocket"
 )
 
+// defaultDataFile is the data file used if none is configured.
+const defaultDataFile = "./data.db"
+
 func main() {
-	var (
-		listenAddr  = flag.String("listen", "localhost:8080", "listen address")
-		dataFile    = flag.String("datafile", "./data.db", "path to data file")
-		username    = flag.String("user", "admin", "user name for operations requiring authentication")
-		password    = flag.String("pass", "", "password for operations requiring authentication")
-		frontend    = flag.String("frontend", "", "front-facing URL for the file delivery")
-		parent      = flag.String("parent", "", "parent server URL, e.g. http://otherserver:8080")
-		forceParent = flag.Bool("forceparent", false, "if enabled, forces instance to act as a parent even though it replicates from another parent server")
-	)
+	// client subcommands, e.g. cabinet put, share the binary with the server.
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
+	configFile := flag.String("config", "", "path to configuration file")
+
+	flag.String("listen", "localhost:8080", "listen address")
+	flag.String("datafile", defaultDataFile, "path to data file")
+	flag.String("user", "admin", "user name for operations requiring authentication")
+	flag.String("pass", "", "password for operations requiring authentication")
+	flag.String("frontend", "", "front-facing URL for the file delivery")
+	flag.String("parent", "", "parent server URL, e.g. http://otherserver:8080")
+	flag.Bool("forceparent", false, "if enabled, forces instance to act as a parent even though it replicates from another parent server")
+	flag.String("accesslog", "", "path to access log file, or - for stdout; reopened on SIGHUP")
+	flag.String("accesslog-format", "combined", "access log format, either combined or json")
+	flag.String("trusted-proxies", "", "comma-separated list of proxy networks whose X-Forwarded-For headers are trusted")
+	flag.Duration("shutdown-timeout", 30*time.Second, "maximum time to wait for in-flight requests when shutting down")
+	flag.String("tls-cert", "", "TLS certificate file; enables HTTPS, reloaded when changed")
+	flag.String("tls-key", "", "TLS key file")
+	flag.String("tls-client-ca", "", "CA bundle to verify client certificates of replication children")
+	flag.Bool("repl-mtls", false, "require replication children to authenticate with a client certificate instead of username and password")
+	flag.String("parent-ca", "", "CA bundle to verify the parent server's certificate")
+	flag.String("parent-cert", "", "client certificate to authenticate with the parent server")
+	flag.String("parent-key", "", "client key to authenticate with the parent server")
+	flag.String("signkey", "", "secret key for signing file URLs")
 
 	flag.Parse()
 
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 
-	if *username == "" || *password == "" {
-		log.Fatal("You need to provide username and password!")
-	}
-
-	if *frontend == "" {
-		log.Fatal("You need to provide a front-facing URL, e.g. http://localhost:8080")
+	cfg, err := loadConfig(*configFile, flag.CommandLine)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	if _, err := url.Parse(*frontend); err != nil {
-		log.Fatalf("Invalid front-facing URL: %v", err)
-	}
+	var currentConfig atomic.Value
+	currentConfig.Store(cfg)
 
-	db, err := leveldb.OpenFile(*dataFile, nil)
+	db, err := leveldb.OpenFile(cfg.DataFile, nil)
 	if err != nil {
-		log.Fatalf("leveldb.OpenFile %s failed: %v", *dataFile, err)
+		log.Fatalf("leveldb.OpenFile %s failed: %v", cfg.DataFile, err)
 	}
 
 	expvar.Publish("leveldb.stats", expvar.Func(func() interface{} { stats, _ := db.GetProperty("leveldb.stats"); return stats }))
@@ -65,43 +92,324 @@ func main() {
 	expvar.Publish("leveldb.alivesnaps", expvar.Func(func() interface{} { stats, _ := db.GetProperty("leveldb.alivesnaps"); return stats }))
 	expvar.Publish("leveldb.aliveiters", expvar.Func(func() interface{} { stats, _ := db.GetProperty("leveldb.aliveiters"); return stats }))
 
-	events := make(chan *data.Event)
+	if err := initDrawerStats(db); err != nil {
+		log.Fatalf("initializing drawer statistics failed: %v", err)
+	}
+
+	if err := initUsage(db); err != nil {
+		log.Fatalf("initializing usage counters failed: %v", err)
+	}
+
+	events := make(chan *data.Event, 64)
+
+	replStats := newReplStats(db, events)
+	prometheus.MustRegister(replStats, &levelDBCollector{DB: db})
 
 	// start replication from parent server when in child mode.
-	if *parent != "" {
-		log.Printf("Starting replication from %s", *parent)
-		r := replicator{ParentServer: *parent, DB: db, Username: *username, Password: *password, Events: events}
-		go r.replicate()
+	var r *replicator
+	if cfg.Parent != "" {
+		log.Printf("Starting replication from %s", cfg.Parent)
+		parentTLS, err := clientTLSConfig(cfg.TLS.ParentCA, cfg.TLS.ParentCert, cfg.TLS.ParentKey)
+		if err != nil {
+			log.Fatalf("Loading TLS configuration for parent failed: %v", err)
+		}
+		r = &replicator{ParentServer: cfg.Parent, DB: db, Username: cfg.ParentUser, Password: cfg.ParentPassword, Events: events, TLSConfig: parentTLS}
+		r.start()
 	}
 
 	replRequests := make(chan replRequest)
 
 	go dispatchEvents(events, replRequests)
 
+	var webhooks []*webhook
+	for name, webhookConfig := range cfg.Webhooks {
+		w := &webhook{Name: name, Config: webhookConfig, DB: db, Frontend: cfg.Frontend, Replicator: replRequests, RetryDelay: time.Second, MaxRetryDelay: 5 * time.Minute}
+		if err := w.start(); err != nil {
+			log.Fatalf("Starting webhook %s failed: %v", name, err)
+		}
+		webhooks = append(webhooks, w)
+	}
+
 	authFunc := func(u, p string) bool {
-		return u == *username && p == *password
+		return currentConfig.Load().(*config).authenticate(u, p)
 	}
 
-	// only enable upload when in parent mode.
-	if *parent == "" || *forceParent {
-		uploadHandler := &uploadFileHandler{DB: db, Frontend: *frontend, Events: events, AuthFunc: authFunc}
-		http.Handle("/api/upload", uploadHandler)
-		http.Handle("/api/store", uploadHandler)
+	accessFunc := func(u, drawer string) bool {
+		return currentConfig.Load().(*config).canAccess(u, drawer)
+	}
+
+	trashRetention := func() time.Duration {
+		return currentConfig.Load().(*config).TrashRetention
+	}
+
+	configLimitsFunc := func(drawer string) drawerLimits {
+		return currentConfig.Load().(*config).drawerLimits(drawer)
 	}
-	repl := &replHandler{DB: db, AuthFunc: authFunc, Replicator: replRequests}
+
+	// drawers created through /api/drawers override the limits of the
+	// configuration file.
+	limitsFunc := func(drawer string) drawerLimits {
+		c := currentConfig.Load().(*config)
+		record, err := readDrawer(db, drawer)
+		if err != nil {
+			log.Printf("reading drawer %s failed: %v", drawer, err)
+		}
+		limits := record.limits(c.drawerLimits(drawer))
+		limits.Undefined = record == nil && c.ExplicitDrawers
+		return limits
+	}
+
+	// only enable upload when in parent mode.
+	var (
+		jobs    *storeQueue
+		expirer *fileExpirer
+	)
+	if cfg.Parent == "" || cfg.ForceParent {
+		fetcher, err := newFetcher(&cfg.Store)
+		if err != nil {
+			log.Fatalf("Invalid store configuration: %v", err)
+		}
+		malwareScanner := newUploadScanner(&cfg.Scan)
+		if malwareScanner != nil {
+			malwareScanner.Events = events
+		}
+		jobs = &storeQueue{DB: db, Fetcher: fetcher, Frontend: cfg.Frontend, Events: events, LimitsFunc: limitsFunc, Scanner: malwareScanner, Workers: cfg.Store.Workers, MaxAttempts: cfg.Store.MaxAttempts, RetryDelay: 5 * time.Second, MaxRetryDelay: 5 * time.Minute}
+		if err := jobs.start(); err != nil {
+			log.Fatalf("Starting store jobs failed: %v", err)
+		}
+		uploadHandler := &uploadFileHandler{DB: db, Frontend: cfg.Frontend, Events: events, AuthFunc: authFunc, AccessFunc: accessFunc, LimitsFunc: limitsFunc, Fetcher: fetcher, Jobs: jobs, Scanner: malwareScanner}
+		http.Handle("/api/upload", instrumentHandler("upload", uploadHandler))
+		http.Handle("/api/store", instrumentHandler("store", uploadHandler))
+		http.Handle("/api/store/jobs/", instrumentHandler("store_jobs", &storeJobHandler{Jobs: jobs, AuthFunc: authFunc, AccessFunc: accessFunc}))
+		http.Handle("/api/import", instrumentHandler("import", &importHandler{DB: db, Frontend: cfg.Frontend, Events: events, AuthFunc: authFunc, AccessFunc: accessFunc, LimitsFunc: limitsFunc, Scanner: malwareScanner}))
+		drawers := &drawerHandler{DB: db, Events: events, AuthFunc: authFunc, AccessFunc: accessFunc, ConfigLimitsFunc: configLimitsFunc}
+		http.Handle("/api/drawers", instrumentHandler("drawers", drawers))
+		http.Handle("/api/drawers/", instrumentHandler("drawers", drawers))
+		http.Handle("/api/meta/", instrumentHandler("meta", &metaHandler{DB: db, Events: events, AuthFunc: authFunc, AccessFunc: accessFunc}))
+		http.Handle("/api/versions/", instrumentHandler("versions", &versionsHandler{DB: db, Frontend: cfg.Frontend, Events: events, AuthFunc: authFunc, AccessFunc: accessFunc, LimitsFunc: limitsFunc}))
+
+		trash := &trashHandler{DB: db, Events: events, AuthFunc: authFunc, AccessFunc: accessFunc, LimitsFunc: limitsFunc, RetentionFunc: trashRetention}
+		http.Handle("/api/trash/", instrumentHandler("trash", trash))
+		http.Handle("/api/undelete/", instrumentHandler("undelete", trash))
+
+		expirer = &fileExpirer{DB: db, Events: events, Interval: time.Minute, TrashRetention: trashRetention}
+		expirer.start()
+	}
+	shutdown := make(chan struct{})
+
+	http.Handle("/api/list", instrumentHandler("list", &listHandler{DB: db, Frontend: cfg.Frontend, AuthFunc: authFunc, AccessFunc: accessFunc}))
+	http.Handle("/api/usage", instrumentHandler("usage", &usageHandler{DB: db, AuthFunc: authFunc, AccessFunc: accessFunc, LimitsFunc: limitsFunc}))
+	http.Handle("/api/backup", instrumentHandler("backup", &backupHandler{DB: db, AuthFunc: authFunc, AccessFunc: accessFunc}))
+	http.Handle("/api/export", instrumentHandler("export", &exportHandler{DB: db, AuthFunc: authFunc, AccessFunc: accessFunc}))
+	// change feeds are long-lived, so they're ended as soon as the server
+	// starts shutting down rather than waited for.
+	feedShutdown := make(chan struct{})
+	http.Handle("/api/events", instrumentHandler("events", &feedHandler{DB: db, Frontend: cfg.Frontend, Replicator: replRequests, AuthFunc: authFunc, AccessFunc: accessFunc, Shutdown: feedShutdown}))
+	http.Handle("/api/sign", instrumentHandler("sign", &signHandler{Frontend: cfg.Frontend, Key: []byte(cfg.SignKey), AuthFunc: authFunc, AccessFunc: accessFunc}))
+
+	repl := &replHandler{DB: db, AuthFunc: authFunc, AccessFunc: accessFunc, Replicator: replRequests, Stats: replStats, Shutdown: shutdown, RequireClientCert: cfg.TLS.ReplMTLS}
 	http.Handle("/api/repl", websocket.Handler(repl.handleWebsocket))
-	http.Handle("/", &fileHandler{DB: db, Events: events, AuthFunc: authFunc, ChildMode: (*parent != "" && !*forceParent)})
+	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/", instrumentHandler("file", &fileHandler{DB: db, Events: events, AuthFunc: authFunc, AccessFunc: accessFunc, SignKey: []byte(cfg.SignKey), ChildMode: (cfg.Parent != "" && !cfg.ForceParent), TrashRetention: trashRetention}))
+
+	mux := basicauth.NewHandler(http.DefaultServeMux, authFunc, []string{"/debug/vars", "/metrics"})
+
+	limiter := &rateLimiter{
+		h: mux,
+		LimitsFunc: func(drawer string) (rateLimitConfig, string) {
+			return currentConfig.Load().(*config).rateLimits(drawer)
+		},
+		ClientFunc: func(r *http.Request) string {
+			c := currentConfig.Load().(*config)
+			if user, pass, ok := r.BasicAuth(); ok && c.authenticate(user, pass) {
+				return "user:" + user
+			}
+			trustedProxies, _ := accesslog.ParseNetworks(strings.Join(c.Log.TrustedProxies, ","))
+			return "ip:" + accesslog.RemoteIP(r, trustedProxies)
+		},
+	}
+
+	handler := &accessLogHandler{h: limiter}
+	if err := handler.configure(cfg.Log); err != nil {
+		log.Fatalf("Setting up access log failed: %v", err)
+	}
+
+	// on SIGHUP, reload the configuration and reopen the access log.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			newConfig, err := loadConfig(*configFile, flag.CommandLine)
+			if err != nil {
+				log.Printf("Reloading configuration failed, keeping the old one: %v", err)
+				newConfig = currentConfig.Load().(*config)
+			} else if changed := newConfig.restartRequired(cfg); len(changed) > 0 {
+				log.Printf("Changes to %s require a restart and are ignored until then", strings.Join(changed, ", "))
+			}
+			currentConfig.Store(newConfig)
+
+			if err := handler.configure(newConfig.Log); err != nil {
+				log.Printf("Reconfiguring access log failed: %v", err)
+			}
+			log.Printf("Reloaded configuration")
+		}
+	}()
+
+	srv := &http.Server{Addr: cfg.Listen, Handler: handler}
+	srv.RegisterOnShutdown(func() { close(feedShutdown) })
+
+	if cfg.TLS.Cert != "" {
+		certs, err := newCertReloader(cfg.TLS.Cert, cfg.TLS.Key)
+		if err != nil {
+			log.Fatalf("Loading TLS certificate failed: %v", err)
+		}
+		go certs.watch(10*time.Second, shutdown)
+
+		if srv.TLSConfig, err = serverTLSConfig(certs, cfg.TLS.ClientCA); err != nil {
+			log.Fatalf("Loading TLS client CA failed: %v", err)
+		}
+	}
+
+	go func() {
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	log.Printf("Received %s, shutting down", <-sigs)
+
+	ctx, cancel := context.WithTimeout(context.Background(), currentConfig.Load().(*config).ShutdownTimeout)
+	defer cancel()
+
+	// stop accepting new connections and wait for in-flight requests.
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Draining in-flight requests failed: %v", err)
+	}
+
+	// interrupted store jobs are resumed after the next start.
+	if jobs != nil {
+		jobs.stop()
+		expirer.stop()
+	}
 
-	mux := basicauth.NewHandler(http.DefaultServeMux, authFunc, []string{"/debug/vars"})
+	// tell replication children that we're going away.
+	close(shutdown)
+	if err := repl.wait(ctx); err != nil {
+		log.Printf("Disconnecting replication children failed: %v", err)
+	}
+
+	if r != nil {
+		r.stop()
+	}
+
+	for _, w := range webhooks {
+		w.stop()
+	}
+
+	handler.close()
 
-	log.Fatal(http.ListenAndServe(*listenAddr, mux))
+	if err := db.Close(); err != nil {
+		log.Printf("Closing database failed: %v", err)
+	}
+}
+
+// accessLogHandler logs requests to h according to the current access log
+// configuration, which can be changed at runtime.
+type accessLogHandler struct {
+	h http.Handler
+
+	mtx    sync.Mutex
+	logger *accesslog.Logger
+	logged atomic.Value // http.Handler
+}
+
+func (h *accessLogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if logged, ok := h.logged.Load().(http.Handler); ok {
+		logged.ServeHTTP(w, r)
+		return
+	}
+	h.h.ServeHTTP(w, r)
+}
+
+// configure (re)opens the access log as configured. If no access log is
+// configured, requests are passed to h without logging.
+func (h *accessLogHandler) configure(c logConfig) error {
+	var (
+		logger *accesslog.Logger
+		logged http.Handler = h.h
+	)
+
+	if c.AccessLog != "" {
+		format, err := accesslog.ParseFormat(c.Format)
+		if err != nil {
+			return err
+		}
+
+		trustedProxies, err := accesslog.ParseNetworks(strings.Join(c.TrustedProxies, ","))
+		if err != nil {
+			return err
+		}
+
+		if logger, err = accesslog.Open(c.AccessLog); err != nil {
+			return err
+		}
+
+		logged = accesslog.NewHandler(h.h, logger, format, trustedProxies)
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.logged.Store(logged)
+	if h.logger != nil {
+		h.logger.Close()
+	}
+	h.logger = logger
+
+	return nil
+}
+
+func (h *accessLogHandler) close() {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if h.logger != nil {
+		h.logger.Close()
+	}
+}
+
+// drawerAccessFunc reports whether an authenticated user may access a
+// drawer. An empty drawer name asks for access to all drawers.
+type drawerAccessFunc func(user, drawer string) bool
+
+// permits reports whether the user that authenticated r may access drawer.
+// A nil drawerAccessFunc permits everything.
+func (f drawerAccessFunc) permits(r *http.Request, drawer string) bool {
+	if f == nil {
+		return true
+	}
+	user, _, _ := r.BasicAuth()
+	return f(user, drawer)
 }
 
 type fileHandler struct {
-	DB        *leveldb.DB
-	Events    chan<- *data.Event
-	ChildMode bool
-	AuthFunc  basicauth.AuthenticatorFunc
+	DB         *leveldb.DB
+	Events     chan<- *data.Event
+	ChildMode  bool
+	AuthFunc   basicauth.AuthenticatorFunc
+	AccessFunc drawerAccessFunc
+	SignKey    []byte
+
+	// TrashRetention returns how long deleted files are kept in the trash.
+	// If it is nil or returns 0, files are deleted immediately.
+	TrashRetention func() time.Duration
 }
 
 var (
@@ -118,7 +426,7 @@ func (h *fileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		h.deleteFile(w, r)
-	case "GET":
+	case "GET", "HEAD":
 		h.deliverFile(w, r)
 	default:
 		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
@@ -126,13 +434,7 @@ func (h *fileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *fileHandler) deliverFile(w http.ResponseWriter, r *http.Request) {
-	ts := time.Now()
-	defer func() {
-		duration := time.Since(ts)
-		log.Printf("delivering %s took %s", r.RequestURI, duration)
-	}()
-
-	uriParts := strings.Split(r.URL.Path[1:], "/")
+	uriParts := strings.SplitN(r.URL.Path[1:], "/", 2)
 	if len(uriParts) != 2 {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
@@ -144,6 +446,22 @@ func (h *fileHandler) deliverFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	signed, valid := checkSignature(h.SignKey, r, drawer, filename)
+	if signed && !valid {
+		http.Error(w, "invalid or expired signature", http.StatusForbidden)
+		return
+	}
+
+	record, err := readDrawer(h.DB, drawer)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("reading drawer %s failed: %v", drawer, err)
+		return
+	}
+	if record != nil && record.Private && !signed && !h.authorized(w, r, drawer) {
+		return
+	}
+
 	fileContent, err := h.DB.Get([]byte("file:"+drawer+":"+filename), nil)
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusNoContent), http.StatusNotFound)
@@ -164,10 +482,64 @@ func (h *fileHandler) deliverFile(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// old versions are delivered with ?version=<version>.
+	version := currentVersion(&metadata)
+	if v := r.URL.Query().Get("version"); v != "" {
+		requested, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid version", http.StatusBadRequest)
+			return
+		}
+		if requested != version {
+			if fileContent, err = h.DB.Get(versionKey("version", drawer, filename, requested), nil); err != nil {
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			metadata.Reset()
+			if rawMetaData, err := h.DB.Get(versionKey("vmeta", drawer, filename, requested), nil); err != nil {
+				metadata.ContentType = proto.String("application/octet-stream")
+			} else if err := proto.Unmarshal(rawMetaData, &metadata); err != nil {
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+				log.Printf("proto.Unmarshal of metadata for %s:%s version %d failed: %v", drawer, filename, requested, err)
+				return
+			}
+			version = requested
+		}
+	}
+	w.Header().Set(versionHeader, strconv.FormatInt(version, 10))
+
 	w.Header().Set("Content-Type", metadata.GetContentType())
+	if record != nil && record.CacheControl != "" {
+		w.Header().Set("Cache-Control", record.CacheControl)
+	} else if record != nil && record.Private {
+		w.Header().Set("Cache-Control", "private")
+	}
 	if metadata.Source != nil {
 		w.Header().Set("Content-Location", metadata.GetSource())
 	}
+	writeMetadataHeaders(w.Header(), &metadata)
+	if metadata.Scan != nil {
+		w.Header().Set(scanHeader, formatScanHeader(metadata.Scan))
+	}
+
+	// files are shown inline with their original name, unless a download
+	// is requested. Browsers must not guess a different type, and files of
+	// user upload drawers that could run scripts are never shown inline.
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	name := metadata.GetOriginalName()
+	download, _ := strconv.ParseBool(r.URL.Query().Get("download"))
+	if record != nil && record.UserUploads && riskyContentType(metadata.GetContentType()) {
+		download = true
+	}
+	if download {
+		if name == "" {
+			name = path.Base(filename)
+		}
+		w.Header().Set("Content-Disposition", contentDisposition("attachment", name))
+	} else if name != "" {
+		w.Header().Set("Content-Disposition", contentDisposition("inline", name))
+	}
+
 	w.Header().Set("Content-Length", strconv.FormatInt(int64(len(fileContent)), 10))
 	if _, err := w.Write(fileContent); err != nil {
 		log.Printf("delivery of %s:%s failed: %v", drawer, filename, err)
@@ -176,12 +548,29 @@ func (h *fileHandler) deliverFile(w http.ResponseWriter, r *http.Request) {
 	deliverCount.Add(1)
 }
 
+// authorized reports whether r may fetch files from a private drawer, which
+// requires a user that can access the drawer or a replication child with a
+// verified client certificate. Otherwise, an error is sent.
+func (h *fileHandler) authorized(w http.ResponseWriter, r *http.Request, drawer string) bool {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return true
+	}
+	if !basicauth.Authenticate(w, r, h.AuthFunc) {
+		return false
+	}
+	if !h.AccessFunc.permits(r, drawer) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
 func (h *fileHandler) deleteFile(w http.ResponseWriter, r *http.Request) {
 	if !basicauth.Authenticate(w, r, h.AuthFunc) {
 		return
 	}
 
-	uriParts := strings.Split(r.URL.Path[1:], "/")
+	uriParts := strings.SplitN(r.URL.Path[1:], "/", 2)
 	if len(uriParts) != 2 {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
@@ -199,27 +588,24 @@ func (h *fileHandler) deleteFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	batch := new(leveldb.Batch)
-	batch.Delete([]byte("file:" + drawerName + ":" + filename))
-	batch.Delete([]byte("meta:" + drawerName + ":" + filename))
-
-	eventKey := "event:" + strconv.FormatInt(time.Now().UnixNano(), 10)
-	event := &data.Event{
-		Type:     data.Event_DELETE.Enum(),
-		Drawer:   proto.String(drawerName),
-		Filename: proto.String(filename),
-		Id:       proto.String(eventKey),
-	}
-
-	eventData, err := proto.Marshal(event)
-	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+	if !h.AccessFunc.permits(r, drawerName) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 		return
 	}
-	batch.Put([]byte(eventKey), eventData)
-	batch.Put([]byte("latest_event"), []byte(eventKey))
 
-	if err := h.DB.Write(batch, nil); err != nil {
+	// with a trash retention, files are moved to the trash first. Deleting
+	// a trashed file purges it.
+	var (
+		event *data.Event
+		err   error
+	)
+	if h.TrashRetention != nil && h.TrashRetention() > 0 {
+		event, err = trashFile(h.DB, drawerName, filename)
+	}
+	if event == nil && (err == nil || err == leveldb.ErrNotFound) {
+		event, err = removeFile(h.DB, drawerName, filename)
+	}
+	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		log.Printf("deleting file %s:%s failed: %v", drawerName, filename, err)
 		return
@@ -233,10 +619,17 @@ func (h *fileHandler) deleteFile(w http.ResponseWriter, r *http.Request) {
 }
 
 type uploadFileHandler struct {
-	DB       *leveldb.DB
-	Frontend string
-	Events   chan<- *data.Event
-	AuthFunc basicauth.AuthenticatorFunc
+	DB         *leveldb.DB
+	Frontend   string
+	Events     chan<- *data.Event
+	AuthFunc   basicauth.AuthenticatorFunc
+	AccessFunc drawerAccessFunc
+	LimitsFunc drawerLimitsFunc
+	Fetcher    *fetcher
+	Jobs       *storeQueue
+
+	// Scanner scans uploads for malware. If nil, they aren't scanned.
+	Scanner *uploadScanner
 }
 
 func (h *uploadFileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -278,8 +671,7 @@ func (h *uploadFileHandler) store(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "empty url parameter", http.StatusNotAcceptable)
 		return
 	}
-	parsedURI, err := url.Parse(uri)
-	if err != nil {
+	if _, err := url.Parse(uri); err != nil {
 		http.Error(w, "invalid URL: "+err.Error(), http.StatusNotAcceptable)
 		return
 	}
@@ -290,72 +682,50 @@ func (h *uploadFileHandler) store(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var buf bytes.Buffer
-	resp, err := http.Get(uri)
-	if err != nil {
-		http.Error(w, "Fetching URL failed: "+err.Error(), http.StatusInternalServerError)
+	if !h.AccessFunc.permits(r, drawerName) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 		return
 	}
-	defer resp.Body.Close()
 
-	if _, err := io.Copy(&buf, resp.Body); err != nil {
-		http.Error(w, "Reading HTTP body failed: "+err.Error(), http.StatusInternalServerError)
+	userMetadata, err := parseUserMetadata(r.Header, r.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
 		return
 	}
 
-	filename := gouuid.New().ShortString()
-	if extension := r.Form.Get("ext"); extension != "" {
-		filename += "." + extension
-	} else if n := strings.LastIndex(parsedURI.Path, "."); n != -1 {
-		filename += parsedURI.Path[n:]
-	}
-
-	batch := new(leveldb.Batch)
-
-	var metadata data.MetaData
-	metadata.ContentType = proto.String(resp.Header.Get("Content-Type"))
-	metadata.Source = proto.String(uri)
-	rawMetaData, err := proto.Marshal(&metadata)
-	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-		log.Printf("proto.Marshal failed: %v", err)
+	if async, _ := strconv.ParseBool(r.FormValue("async")); async {
+		h.storeAsync(w, r, uri, drawerName, userMetadata)
 		return
 	}
 
-	batch.Put([]byte("file:"+drawerName+":"+filename), buf.Bytes())
-	batch.Put([]byte("meta:"+drawerName+":"+filename), rawMetaData)
-
-	eventKey := "event:" + strconv.FormatInt(time.Now().UnixNano(), 10)
-	event := &data.Event{
-		Type:     data.Event_UPLOAD.Enum(),
-		Drawer:   proto.String(drawerName),
-		Filename: proto.String(filename),
-		Id:       proto.String(eventKey),
-	}
-	eventData, err := proto.Marshal(event)
+	content, contentType, err := h.Fetcher.fetch(r.Context(), uri, nil)
 	if err != nil {
-		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		statusCode := http.StatusInternalServerError
+		if fe, ok := err.(*fetchError); ok {
+			statusCode = fe.StatusCode
+		}
+		http.Error(w, err.Error(), statusCode)
 		return
 	}
-	batch.Put([]byte(eventKey), eventData)
-	batch.Put([]byte("latest_event"), []byte(eventKey))
 
-	if err := h.DB.Write(batch, nil); err != nil {
+	filename, event, err := storeFetched(r.Context(), h.DB, h.Scanner, drawerName, uri, r.Form.Get("ext"), content, contentType, userMetadata, h.LimitsFunc.limits(drawerName))
+	if le, ok := err.(*limitError); ok {
+		http.Error(w, le.Error(), le.StatusCode)
+		return
+	} else if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		log.Printf("store transaction failed: %v", err)
 		return
 	}
 
+	if h.Events != nil {
+		h.Events <- event
+	}
+
 	fmt.Fprintf(w, "%s/%s/%s", h.Frontend, drawerName, filename)
 }
 
 func (h *uploadFileHandler) upload(w http.ResponseWriter, r *http.Request) {
-	ts := time.Now()
-	defer func() {
-		duration := time.Since(ts)
-		log.Printf("upload took %s", duration)
-	}()
-
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, "parsing multipart form failed: "+err.Error(), http.StatusNotAcceptable)
 		return
@@ -367,11 +737,39 @@ func (h *uploadFileHandler) upload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var filenames []string
+	if !h.AccessFunc.permits(r, drawerName) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
 
-	var events []*data.Event
+	// a name replaces the generated file name, and overwrites any existing
+	// file of that name.
+	name := r.Form.Get("name")
+	if name != "" && !validFileName(name) {
+		http.Error(w, "invalid file name", http.StatusNotAcceptable)
+		return
+	}
 
-	batch := new(leveldb.Batch)
+	// attributes and tags of the request apply to all files, those of the
+	// parts only to their file.
+	requestMetadata, err := parseUserMetadata(r.Header, r.Form)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+
+	// uploadedFile is a part of the upload. The files are only stored once
+	// all parts were read and checked.
+	type uploadedFile struct {
+		filename string
+		content  []byte
+		metadata *data.MetaData
+	}
+
+	var files []uploadedFile
+
+	limits := h.LimitsFunc.limits(drawerName)
+	var added drawerUsage
 
 	multipartReader, err := r.MultipartReader()
 	if err != nil {
@@ -390,56 +788,175 @@ func (h *uploadFileHandler) upload(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		uuid := gouuid.New()
-		partData, err := ioutil.ReadAll(part)
-		if err != nil {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		if name != "" && len(files) > 0 {
+			http.Error(w, "only one file can be uploaded with a name", http.StatusNotAcceptable)
 			return
 		}
 
-		filename := uuid.ShortString()
-		if extension := r.Form.Get("ext"); extension != "" {
-			filename += "." + extension
+		var partReader io.Reader = part
+		if limits.MaxFileSize > 0 {
+			partReader = io.LimitReader(part, limits.MaxFileSize+1)
 		}
-		batch.Put([]byte("file:"+drawerName+":"+filename), partData)
-
-		var metadata data.MetaData
-		metadata.ContentType = proto.String(part.Header.Get("Content-Type"))
-		rawMetaData, err := proto.Marshal(&metadata)
+		partData, err := ioutil.ReadAll(partReader)
 		if err != nil {
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			log.Printf("proto.Marshal failed: %v", err)
 			return
 		}
+		if err := limits.checkFileSize(int64(len(partData))); err != nil {
+			http.Error(w, err.Error(), limitStatus(err))
+			return
+		}
+		userMetadata, err := parseUserMetadata(http.Header(part.Header), nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotAcceptable)
+			return
+		}
+		userMetadata.merge(requestMetadata)
+
+		// without an ext parameter, the extension of the part's file name
+		// is kept.
+		partName := originalName(part.FileName())
+		extension := r.Form.Get("ext")
+		if extension == "" {
+			if ext := path.Ext(partName); len(ext) > 1 && validFileName(ext[1:]) {
+				extension = ext[1:]
+			}
+		}
 
-		batch.Put([]byte("meta:"+drawerName+":"+filename), rawMetaData)
+		filename := name
+		if filename == "" {
+			filename = gouuid.New().ShortString()
+			if extension != "" {
+				filename += "." + extension
+			}
+		}
 
-		eventKey := "event:" + strconv.FormatInt(time.Now().UnixNano(), 10)
-		event := &data.Event{
-			Type:     data.Event_UPLOAD.Enum(),
-			Drawer:   proto.String(drawerName),
-			Filename: proto.String(filename),
-			Id:       proto.String(eventKey),
+		typeName := partName
+		if typeName == "" {
+			typeName = filename
+		}
+		contentType := resolveContentType(part.Header.Get("Content-Type"), typeName, partData)
+		if err := limits.checkContentType(contentType); err != nil {
+			http.Error(w, err.Error(), limitStatus(err))
+			return
 		}
 
-		eventData, err := proto.Marshal(event)
-		if err != nil {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		metadata := &data.MetaData{ContentType: proto.String(contentType)}
+		if partName != "" {
+			metadata.OriginalName = proto.String(partName)
+		}
+		if err := userMetadata.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusNotAcceptable)
+			return
+		}
+		userMetadata.apply(metadata)
+
+		// infected files are rejected together with the rest of the
+		// upload, after they were quarantined.
+		if err := h.Scanner.check(r.Context(), h.DB, drawerName, filename, partData, metadata); err != nil {
+			http.Error(w, err.Error(), limitStatus(err))
+			if _, ok := err.(*limitError); !ok {
+				log.Printf("scanning upload failed: %v", err)
+			}
 			return
 		}
-		batch.Put([]byte(eventKey), eventData)
-		batch.Put([]byte("latest_event"), []byte(eventKey))
 
-		filenames = append(filenames, h.Frontend+"/"+drawerName+"/"+filename)
-		events = append(events, event)
+		files = append(files, uploadedFile{filename: filename, content: partData, metadata: metadata})
+
+		// the quota is checked as early as possible, so that uploads
+		// exceeding it aren't read completely. Files with generated names
+		// never replace existing ones; a named upload only has one file,
+		// which is checked when it is written.
+		added.Bytes += int64(len(partData))
+		added.Files++
+		if name != "" {
+			continue
+		}
+		if usage, err := readUsage(h.DB, drawerName); err == nil {
+			if err := limits.checkQuota(usage, added); err != nil {
+				http.Error(w, err.Error(), limitStatus(err))
+				return
+			}
+		}
 	}
 
-	if err := h.DB.Write(batch, nil); err != nil {
+	// the replaced file is read while the usage counters are locked, so
+	// that concurrent overwrites can't both account for it.
+	var events []*data.Event
+	var replaced []byte
+	err = writeWithUsage(h.DB, drawerName, limits, func(batch *leveldb.Batch) (drawerUsage, error) {
+		var delta drawerUsage
+		for _, f := range files {
+			version := int64(1)
+			if name != "" {
+				var err error
+				replaced, err = h.DB.Get([]byte("file:"+drawerName+":"+f.filename), nil)
+				if err == leveldb.ErrNotFound {
+					replaced = nil
+				} else if err != nil {
+					return drawerUsage{}, fmt.Errorf("looking up file %s:%s failed: %v", drawerName, f.filename, err)
+				}
+				if version, err = keepVersion(h.DB, batch, drawerName, f.filename, replaced); err != nil {
+					return drawerUsage{}, fmt.Errorf("keeping old version of %s:%s failed: %v", drawerName, f.filename, err)
+				}
+			}
+
+			f.metadata.Sha256 = proto.String(contentHash(f.content))
+			f.metadata.Uploaded = proto.Int64(time.Now().Unix())
+			f.metadata.Version = proto.Int64(version)
+			if err := indexTags(h.DB, batch, drawerName, f.filename, f.metadata.Tags); err != nil {
+				return drawerUsage{}, fmt.Errorf("indexing tags of %s:%s failed: %v", drawerName, f.filename, err)
+			}
+			rawMetaData, err := proto.Marshal(f.metadata)
+			if err != nil {
+				return drawerUsage{}, err
+			}
+
+			batch.Put([]byte("file:"+drawerName+":"+f.filename), f.content)
+			batch.Put([]byte("meta:"+drawerName+":"+f.filename), rawMetaData)
+
+			eventKey := "event:" + strconv.FormatInt(time.Now().UnixNano(), 10)
+			event := &data.Event{
+				Type:     data.Event_UPLOAD.Enum(),
+				Drawer:   proto.String(drawerName),
+				Filename: proto.String(f.filename),
+				Id:       proto.String(eventKey),
+				Version:  proto.Int64(version),
+			}
+
+			eventData, err := proto.Marshal(event)
+			if err != nil {
+				return drawerUsage{}, err
+			}
+			batch.Put([]byte(eventKey), eventData)
+			batch.Put([]byte("latest_event"), []byte(eventKey))
+			events = append(events, event)
+
+			delta.Bytes += int64(len(f.content) - len(replaced))
+			if replaced == nil {
+				delta.Files++
+			}
+		}
+		return delta, nil
+	})
+	if le, ok := err.(*limitError); ok {
+		http.Error(w, le.Error(), le.StatusCode)
+		return
+	} else if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		log.Printf("upload transaction failed: %v", err)
 		return
 	}
 
+	var filenames []string
+	for _, f := range files {
+		filenames = append(filenames, h.Frontend+"/"+drawerName+"/"+f.filename)
+		fileAdded(drawerName, len(f.content))
+	}
+	if replaced != nil {
+		fileRemoved(drawerName, len(replaced))
+	}
+
 	if err := json.NewEncoder(w).Encode(filenames); err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		log.Printf("marshalling list of filenames to JSON failed: %v", err)
@@ -461,9 +978,34 @@ func basicAuthEncode(user, pass string) string {
 
 func validDrawerName(drawer string) bool {
 	for _, r := range drawer {
-		if !strings.ContainsRune("abcefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789..:,;$-", r) {
+		if !strings.ContainsRune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789..,;$-", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// validFileName reports whether name can be used as the name of an uploaded
+// file. Names may consist of several path segments separated by slashes.
+func validFileName(name string) bool {
+	if name == "" || len(name) > 1024 {
+		return false
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return false
+		}
+	}
+	for _, r := range name {
+		if !strings.ContainsRune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789._~+@=,-/", r) {
 			return false
 		}
 	}
 	return true
 }
+
+// contentHash returns the hex-encoded SHA-256 hash of a file's content.
+func contentHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akrennmair/cabinet/basicauth"
+	"github.com/akrennmair/cabinet/data"
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	metaHeaderPrefix = "X-Cabinet-Meta-"
+	tagsHeader       = "X-Cabinet-Tags"
+
+	maxAttributes     = 64
+	maxAttributeValue = 1024
+	maxTags           = 64
+
+	attributeChars = "abcdefghijklmnopqrstuvwxyz0123456789-_"
+	tagChars       = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789._-"
+)
+
+// userMetadata is the metadata users supply with their files: attributes,
+// i.e. arbitrary key/value pairs, and tags. Attribute keys are
+// case-insensitive and kept in lower case, as they're delivered as headers.
+type userMetadata struct {
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Tags       []string          `json:"tags,omitempty"`
+}
+
+// parseUserMetadata reads user metadata from X-Cabinet-Meta-<key> and
+// X-Cabinet-Tags headers, and from meta.<key> and tags form fields. Tags are
+// separated by commas.
+func parseUserMetadata(header http.Header, form url.Values) (*userMetadata, error) {
+	u := &userMetadata{Attributes: make(map[string]string)}
+
+	for name, values := range header {
+		if strings.HasPrefix(name, metaHeaderPrefix) && len(values) > 0 {
+			u.Attributes[strings.ToLower(strings.TrimPrefix(name, metaHeaderPrefix))] = values[0]
+		}
+	}
+	for name, values := range form {
+		if strings.HasPrefix(name, "meta.") && len(values) > 0 {
+			u.Attributes[strings.ToLower(strings.TrimPrefix(name, "meta."))] = values[0]
+		}
+	}
+
+	for _, tags := range append(header[tagsHeader], form["tags"]...) {
+		for _, tag := range strings.Split(tags, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				u.Tags = append(u.Tags, tag)
+			}
+		}
+	}
+
+	return u, u.validate()
+}
+
+// merge adds the metadata of other to u. Attributes of other replace those
+// with the same key.
+func (u *userMetadata) merge(other *userMetadata) {
+	for key, value := range other.Attributes {
+		u.Attributes[key] = value
+	}
+	u.Tags = append(u.Tags, other.Tags...)
+}
+
+func (u *userMetadata) validate() error {
+	if len(u.Attributes) > maxAttributes {
+		return fmt.Errorf("more than %d attributes", maxAttributes)
+	}
+	for key, value := range u.Attributes {
+		if !validMetaName(key, attributeChars) {
+			return fmt.Errorf("invalid attribute name %q", key)
+		}
+		if len(value) > maxAttributeValue {
+			return fmt.Errorf("value of attribute %s is longer than %d bytes", key, maxAttributeValue)
+		}
+		for _, r := range value {
+			if r < ' ' || r == 0x7f {
+				return fmt.Errorf("invalid value of attribute %s", key)
+			}
+		}
+	}
+
+	if len(u.Tags) > maxTags {
+		return fmt.Errorf("more than %d tags", maxTags)
+	}
+	for _, tag := range u.Tags {
+		if !validMetaName(tag, tagChars) {
+			return fmt.Errorf("invalid tag %q", tag)
+		}
+	}
+	return nil
+}
+
+func validMetaName(name, allowed string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for _, r := range name {
+		if !strings.ContainsRune(allowed, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply replaces the attributes and tags of metadata. Both are sorted, and
+// duplicate tags are removed.
+func (u *userMetadata) apply(metadata *data.MetaData) {
+	metadata.Attributes = nil
+	keys := make([]string, 0, len(u.Attributes))
+	for key := range u.Attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		metadata.Attributes = append(metadata.Attributes, &data.Attribute{Key: proto.String(key), Value: proto.String(u.Attributes[key])})
+	}
+
+	metadata.Tags = nil
+	tags := append([]string(nil), u.Tags...)
+	sort.Strings(tags)
+	for i, tag := range tags {
+		if i == 0 || tag != tags[i-1] {
+			metadata.Tags = append(metadata.Tags, tag)
+		}
+	}
+}
+
+// metadataUser returns the user metadata contained in metadata.
+func metadataUser(metadata *data.MetaData) *userMetadata {
+	u := &userMetadata{Attributes: make(map[string]string), Tags: metadata.GetTags()}
+	for _, attr := range metadata.GetAttributes() {
+		u.Attributes[attr.GetKey()] = attr.GetValue()
+	}
+	return u
+}
+
+// writeMetadataHeaders adds the attributes and tags of a file to the
+// headers of its delivery.
+func writeMetadataHeaders(header http.Header, metadata *data.MetaData) {
+	for _, attr := range metadata.GetAttributes() {
+		header.Set(metaHeaderPrefix+attr.GetKey(), attr.GetValue())
+	}
+	if len(metadata.GetTags()) > 0 {
+		header.Set(tagsHeader, strings.Join(metadata.GetTags(), ","))
+	}
+}
+
+// tagKey is the key of the index entry of a tagged file.
+func tagKey(tag, drawer, filename string) []byte {
+	return []byte("tag:" + tag + ":" + drawer + ":" + filename)
+}
+
+// indexTags adds the changes of the tag index to batch for a file whose tags
+// change from those in its stored metadata to tags. Deleted files have no
+// tags.
+func indexTags(db *leveldb.DB, batch *leveldb.Batch, drawer, filename string, tags []string) error {
+	rawMetaData, err := db.Get([]byte("meta:"+drawer+":"+filename), nil)
+	if err != nil && err != leveldb.ErrNotFound {
+		return err
+	}
+	var old data.MetaData
+	if rawMetaData != nil {
+		if err := proto.Unmarshal(rawMetaData, &old); err != nil {
+			log.Printf("proto.Unmarshal of metadata for %s:%s failed: %v", drawer, filename, err)
+		}
+	}
+
+	for _, tag := range old.GetTags() {
+		if !contains(tags, tag) {
+			batch.Delete(tagKey(tag, drawer, filename))
+		}
+	}
+	for _, tag := range tags {
+		batch.Put(tagKey(tag, drawer, filename), nil)
+	}
+	return nil
+}
+
+// moveTags adds the renaming of the tag index entries of all files in drawer
+// from to batch. If to is empty, the entries are deleted instead.
+func moveTags(db *leveldb.DB, batch *leveldb.Batch, from, to string) error {
+	prefix := "meta:" + from + ":"
+	iterator := db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iterator.Release()
+	for iterator.Next() {
+		var metadata data.MetaData
+		if err := proto.Unmarshal(iterator.Value(), &metadata); err != nil {
+			continue
+		}
+		filename := strings.TrimPrefix(string(iterator.Key()), prefix)
+		for _, tag := range metadata.GetTags() {
+			batch.Delete(tagKey(tag, from, filename))
+			if to != "" {
+				batch.Put(tagKey(tag, to, filename), nil)
+			}
+		}
+	}
+	return iterator.Error()
+}
+
+// metadataPatch changes the user metadata of a file. Attributes with a null
+// value are removed, all others are added or replaced. Tags replace the
+// existing tags if present.
+type metadataPatch struct {
+	Attributes map[string]*string `json:"attributes"`
+	Tags       *[]string          `json:"tags"`
+}
+
+// metaHandler returns and changes the metadata of files, at
+// /api/meta/<drawer>/<filename>.
+type metaHandler struct {
+	DB         *leveldb.DB
+	Events     chan<- *data.Event
+	AuthFunc   basicauth.AuthenticatorFunc
+	AccessFunc drawerAccessFunc
+}
+
+func (h *metaHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !basicauth.Authenticate(w, r, h.AuthFunc) {
+		return
+	}
+
+	uriParts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/api/meta/"), "/", 2)
+	if len(uriParts) != 2 || uriParts[0] == "" || uriParts[1] == "" {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	drawerName, filename := uriParts[0], uriParts[1]
+
+	if !h.AccessFunc.permits(r, drawerName) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	var (
+		metadata *data.MetaData
+		err      error
+	)
+	switch r.Method {
+	case "GET":
+		metadata, err = readMetadata(h.DB, drawerName, filename)
+	case "PATCH":
+		var patch metadataPatch
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			http.Error(w, "invalid metadata: "+err.Error(), http.StatusNotAcceptable)
+			return
+		}
+		metadata, err = h.update(drawerName, filename, &patch)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if err == leveldb.ErrNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	} else if _, ok := err.(*metadataError); ok {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	} else if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("%s of metadata of %s:%s failed: %v", r.Method, drawerName, filename, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(metadata); err != nil {
+		log.Printf("encoding metadata failed: %v", err)
+	}
+}
+
+// metadataError is returned for invalid metadata patches.
+type metadataError struct {
+	err error
+}
+
+func (e *metadataError) Error() string {
+	return "invalid metadata: " + e.err.Error()
+}
+
+// readMetadata returns the metadata of a file, or leveldb.ErrNotFound if the
+// file doesn't exist.
+func readMetadata(db *leveldb.DB, drawer, filename string) (*data.MetaData, error) {
+	rawMetaData, err := db.Get([]byte("meta:"+drawer+":"+filename), nil)
+	if err != nil {
+		return nil, err
+	}
+	var metadata data.MetaData
+	if err := proto.Unmarshal(rawMetaData, &metadata); err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// update applies patch to the metadata of a file, and writes it together
+// with a METADATA event, which carries the new metadata to replication
+// children. The metadata is read and written with usageMtx held, like by
+// all other writers of files, so that a concurrent upload, delete or drawer
+// change isn't overwritten. It returns leveldb.ErrNotFound if the file
+// doesn't exist.
+func (h *metaHandler) update(drawer, filename string, patch *metadataPatch) (*data.MetaData, error) {
+	var (
+		metadata *data.MetaData
+		event    *data.Event
+	)
+	err := writeWithUsage(h.DB, drawer, drawerLimits{}, func(batch *leveldb.Batch) (drawerUsage, error) {
+		var err error
+		if metadata, err = readMetadata(h.DB, drawer, filename); err != nil {
+			return drawerUsage{}, err
+		}
+
+		u := metadataUser(metadata)
+		for key, value := range patch.Attributes {
+			key = strings.ToLower(key)
+			if value == nil {
+				delete(u.Attributes, key)
+			} else {
+				u.Attributes[key] = *value
+			}
+		}
+		if patch.Tags != nil {
+			u.Tags = *patch.Tags
+		}
+		if err := u.validate(); err != nil {
+			return drawerUsage{}, &metadataError{err}
+		}
+		u.apply(metadata)
+
+		rawMetaData, err := proto.Marshal(metadata)
+		if err != nil {
+			return drawerUsage{}, err
+		}
+
+		if err := indexTags(h.DB, batch, drawer, filename, metadata.Tags); err != nil {
+			return drawerUsage{}, err
+		}
+		batch.Put([]byte("meta:"+drawer+":"+filename), rawMetaData)
+
+		eventKey := "event:" + strconv.FormatInt(time.Now().UnixNano(), 10)
+		event = &data.Event{
+			Type:     data.Event_METADATA.Enum(),
+			Drawer:   proto.String(drawer),
+			Filename: proto.String(filename),
+			Id:       proto.String(eventKey),
+			Metadata: metadata,
+		}
+		eventData, err := proto.Marshal(event)
+		if err != nil {
+			return drawerUsage{}, err
+		}
+		batch.Put([]byte(eventKey), eventData)
+		batch.Put([]byte("latest_event"), []byte(eventKey))
+
+		return drawerUsage{}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if h.Events != nil {
+		h.Events <- event
+	}
+	return metadata, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/akrennmair/cabinet/client"
+	"github.com/akrennmair/cabinet/data"
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestParseUserMetadata(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-Cabinet-Meta-Author", "jane")
+	header.Set("X-Cabinet-Tags", "report, draft")
+	form := map[string][]string{"meta.year": {"2017"}, "tags": {"draft,final"}}
+
+	u, err := parseUserMetadata(header, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var metadata data.MetaData
+	u.apply(&metadata)
+	if !reflect.DeepEqual(metadata.Tags, []string{"draft", "final", "report"}) {
+		t.Errorf("unexpected tags %v", metadata.Tags)
+	}
+	if attrs := metadataUser(&metadata).Attributes; !reflect.DeepEqual(attrs, map[string]string{"author": "jane", "year": "2017"}) {
+		t.Errorf("unexpected attributes %v", attrs)
+	}
+
+	for _, invalid := range []http.Header{
+		{"X-Cabinet-Meta-A.b": {"x"}},
+		{"X-Cabinet-Meta-Note": {"line\nbreak"}},
+		{"X-Cabinet-Meta-Note": {strings.Repeat("x", maxAttributeValue+1)}},
+		{"X-Cabinet-Tags": {"no spaces"}},
+	} {
+		if _, err := parseUserMetadata(invalid, nil); err == nil {
+			t.Errorf("expected error for %v", invalid)
+		}
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	parent := newTestParent(t, nil)
+	defer parent.Server.Close()
+
+	childDB, r := newTestChild(t, parent.Server.URL, nil)
+	defer r.stop()
+
+	c := client.New(parent.Server.URL, "dummy", "auth")
+	ctx := context.Background()
+
+	file, err := c.UploadWithOptions(ctx, strings.NewReader("report"), &client.UploadOptions{
+		Drawer:      "docs",
+		ContentType: "text/plain",
+		Attributes:  map[string]string{"author": "jane"},
+		Tags:        []string{"report", "draft"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.UploadWithOptions(ctx, strings.NewReader("other"), &client.UploadOptions{Drawer: "misc", Tags: []string{"report"}}); err != nil {
+		t.Fatal(err)
+	}
+	var apiErr *client.Error
+	if _, err := c.UploadWithOptions(ctx, strings.NewReader("bad"), &client.UploadOptions{Drawer: "docs", Tags: []string{"no/slash"}}); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotAcceptable {
+		t.Fatalf("uploading invalid tags returned %v", err)
+	}
+
+	info, err := c.Stat(ctx, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Attributes["author"] != "jane" || !reflect.DeepEqual(info.Tags, []string{"draft", "report"}) {
+		t.Fatalf("unexpected metadata %+v", info)
+	}
+
+	files, err := c.List(ctx, "", &client.ListOptions{Tags: []string{"report"}})
+	if err != nil || len(files) != 2 {
+		t.Fatalf("expected 2 files tagged report, got %+v: %v", files, err)
+	}
+	files, err = c.List(ctx, "", &client.ListOptions{Tags: []string{"report", "draft"}})
+	if err != nil || len(files) != 1 || files[0].URL != file || files[0].Attributes["author"] != "jane" {
+		t.Fatalf("expected only %s, got %+v: %v", file, files, err)
+	}
+
+	filename := file[len(parent.Server.URL+"/docs/"):]
+	waitFor(t, "replicated files", func() bool {
+		return caughtUp(parent.DB, childDB)
+	})
+
+	delivered := deliverCount.Value()
+	if err := c.UpdateMetadata(ctx, file, &client.MetadataUpdate{
+		Attributes: map[string]*string{"author": nil, "reviewer": proto.String("john")},
+		Tags:       []string{"final"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.UpdateMetadata(ctx, parent.Server.URL+"/docs/missing", &client.MetadataUpdate{}); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("updating metadata of missing file returned %v", err)
+	}
+
+	waitFor(t, "replicated metadata", func() bool {
+		return hasTaggedFile(childDB, "docs", filename, "final")
+	})
+	if n := deliverCount.Value(); n != delivered {
+		t.Fatalf("file was downloaded again after updating its metadata")
+	}
+
+	if files, err := c.List(ctx, "docs", &client.ListOptions{Tags: []string{"draft"}}); err != nil || len(files) != 0 {
+		t.Fatalf("expected no files tagged draft, got %+v: %v", files, err)
+	}
+	info, err = c.Stat(ctx, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(info.Attributes, map[string]string{"reviewer": "john"}) {
+		t.Fatalf("unexpected attributes %v", info.Attributes)
+	}
+
+	if resp := drawerRequest(t, parent, "POST", "/api/drawers", `{"name": "docs"}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("creating drawer returned %d", resp.StatusCode)
+	}
+	if resp := drawerRequest(t, parent, "POST", "/api/drawers/docs/rename?to=papers", ""); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("renaming drawer returned %d", resp.StatusCode)
+	}
+	waitFor(t, "replicated rename", func() bool {
+		return hasTaggedFile(childDB, "papers", filename, "final")
+	})
+
+	if err := c.Delete(ctx, parent.Server.URL+"/papers/"+filename); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "replicated deletion", func() bool {
+		return !hasTaggedFile(childDB, "papers", filename, "final")
+	})
+
+	for name, db := range map[string]*leveldb.DB{"parent": parent.DB, "child": childDB} {
+		if problems, err := fsck(db, false); err != nil || len(problems) != 0 {
+			t.Fatalf("fsck found problems on %s %+v: %v", name, problems, err)
+		}
+	}
+}
+
+func hasTaggedFile(db *leveldb.DB, drawer, filename, tag string) bool {
+	indexed, _ := db.Has(tagKey(tag, drawer, filename), nil)
+	tagged, _ := hasTag(db, drawer, filename, tag)
+	return indexed && tagged
+}
+
+func TestConcurrentMetadataUpdate(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	h := &metaHandler{DB: db}
+	ctx := context.Background()
+	for round := 0; round < 50; round++ {
+		if _, err := putFile(ctx, db, nil, "test", "file", []byte("old"), &data.MetaData{}, drawerLimits{}); err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			<-start
+			if _, err := putFile(ctx, db, nil, "test", "file", []byte("new content"), &data.MetaData{}, drawerLimits{}); err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			<-start
+			if _, err := h.update("test", "file", &metadataPatch{Tags: &[]string{"patched"}}); err != nil {
+				t.Error(err)
+			}
+		}()
+		close(start)
+		wg.Wait()
+
+		metadata, err := readMetadata(db, "test", "file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if metadata.GetSha256() != contentHash([]byte("new content")) {
+			t.Fatalf("round %d: metadata update overwrote the upload", round)
+		}
+	}
+
+	if _, err := removeFile(db, "test", "file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.update("test", "file", &metadataPatch{Tags: &[]string{"patched"}}); err != leveldb.ErrNotFound {
+		t.Fatalf("updating a deleted file returned %v", err)
+	}
+	if has, _ := db.Has([]byte("meta:test:file"), nil); has {
+		t.Fatal("updating a deleted file recreated its metadata")
+	}
+	if hasTaggedFile(db, "test", "file", "patched") {
+		t.Fatal("updating a deleted file tagged it")
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akrennmair/cabinet/data"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+var (
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "cabinet",
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of HTTP requests by handler and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"handler", "code"})
+	receivedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cabinet",
+		Subsystem: "http",
+		Name:      "received_bytes_total",
+		Help:      "Number of request body bytes received by handler.",
+	}, []string{"handler"})
+	sentBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cabinet",
+		Subsystem: "http",
+		Name:      "sent_bytes_total",
+		Help:      "Number of response body bytes sent by handler.",
+	}, []string{"handler"})
+	drawerFiles = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "cabinet",
+		Subsystem: "drawer",
+		Name:      "files",
+		Help:      "Number of files stored per drawer.",
+	}, []string{"drawer"})
+	drawerBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "cabinet",
+		Subsystem: "drawer",
+		Name:      "bytes",
+		Help:      "Total size of files stored per drawer.",
+	}, []string{"drawer"})
+	webhookDeliveries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cabinet",
+		Subsystem: "webhook",
+		Name:      "deliveries_total",
+		Help:      "Number of webhook delivery attempts by webhook and result (success, failure, dead).",
+	}, []string{"webhook", "result"})
+
+	rateLimitedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "cabinet",
+		Subsystem: "http",
+		Name:      "rate_limited_requests_total",
+		Help:      "Number of requests rejected by the rate limits by class (read, write, upload).",
+	}, []string{"class"})
+)
+
+func init() {
+	prometheus.MustRegister(requestDuration, receivedBytes, sentBytes, drawerFiles, drawerBytes, webhookDeliveries, rateLimitedRequests)
+}
+
+// instrumentHandler wraps h so that request latency as well as received and
+// sent bytes are recorded under the provided handler name.
+func instrumentHandler(name string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ts := time.Now()
+
+		body := &countingReader{r: r.Body}
+		r.Body = body
+		rw := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		h.ServeHTTP(rw, r)
+
+		requestDuration.WithLabelValues(name, strconv.Itoa(rw.status)).Observe(time.Since(ts).Seconds())
+		receivedBytes.WithLabelValues(name).Add(float64(body.n))
+		sentBytes.WithLabelValues(name).Add(float64(rw.n))
+	})
+}
+
+type countingReader struct {
+	r io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) Close() error {
+	return c.r.Close()
+}
+
+// statusRecorder records the status code and number of bytes written. It
+// passes through hijacking and flushing so that websockets and streaming
+// responses keep working.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	n           int64
+	wroteHeader bool
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.status = code
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("underlying ResponseWriter doesn't support hijacking")
+	}
+	return hj.Hijack()
+}
+
+// initDrawerStats initializes the per-drawer file count and size gauges
+// from the files currently stored in the database.
+func initDrawerStats(db *leveldb.DB) error {
+	iterator := db.NewIterator(util.BytesPrefix([]byte("file:")), nil)
+	defer iterator.Release()
+
+	for iterator.Next() {
+		key := strings.SplitN(string(iterator.Key()), ":", 3)
+		if len(key) != 3 {
+			continue
+		}
+		fileAdded(key[1], len(iterator.Value()))
+	}
+
+	return iterator.Error()
+}
+
+func fileAdded(drawer string, size int) {
+	drawerFiles.WithLabelValues(drawer).Inc()
+	drawerBytes.WithLabelValues(drawer).Add(float64(size))
+}
+
+func fileRemoved(drawer string, size int) {
+	drawerFiles.WithLabelValues(drawer).Dec()
+	drawerBytes.WithLabelValues(drawer).Sub(float64(size))
+}
+
+// drawerRemoved removes the file count and size gauges of a drawer that was
+// deleted or renamed.
+func drawerRemoved(drawer string) {
+	drawerFiles.DeleteLabelValues(drawer)
+	drawerBytes.DeleteLabelValues(drawer)
+}
+
+// replStats keeps track of the replication children connected to this
+// instance, and exports their replication lag and queue depth as well as
+// the queue depth of the event dispatcher.
+type replStats struct {
+	DB     *leveldb.DB
+	Events chan *data.Event
+
+	mtx      sync.Mutex
+	children map[*replChild]struct{}
+}
+
+type replChild struct {
+	addr      string
+	lastEvent string
+	queued    int
+}
+
+var (
+	replLagDesc = prometheus.NewDesc("cabinet_repl_child_lag_seconds",
+		"Age difference between the latest local event and the latest event sent to a replication child.",
+		[]string{"child"}, nil)
+	replQueueDesc = prometheus.NewDesc("cabinet_repl_child_queue_depth",
+		"Number of events queued for sending to a replication child.",
+		[]string{"child"}, nil)
+	dispatcherQueueDesc = prometheus.NewDesc("cabinet_dispatcher_queue_depth",
+		"Number of events waiting to be dispatched to subscribers.",
+		nil, nil)
+)
+
+func newReplStats(db *leveldb.DB, events chan *data.Event) *replStats {
+	return &replStats{DB: db, Events: events, children: make(map[*replChild]struct{})}
+}
+
+func (s *replStats) addChild(addr, startEvent string) *replChild {
+	c := &replChild{addr: addr, lastEvent: startEvent}
+	if s == nil {
+		return c
+	}
+	s.mtx.Lock()
+	s.children[c] = struct{}{}
+	s.mtx.Unlock()
+	return c
+}
+
+func (s *replStats) removeChild(c *replChild) {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	delete(s.children, c)
+	s.mtx.Unlock()
+}
+
+func (s *replStats) setLastEvent(c *replChild, event string) {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	c.lastEvent = event
+	s.mtx.Unlock()
+}
+
+func (s *replStats) setQueued(c *replChild, n int) {
+	if s == nil {
+		return
+	}
+	s.mtx.Lock()
+	c.queued = n
+	s.mtx.Unlock()
+}
+
+func (s *replStats) Describe(ch chan<- *prometheus.Desc) {
+	ch <- replLagDesc
+	ch <- replQueueDesc
+	ch <- dispatcherQueueDesc
+}
+
+func (s *replStats) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(dispatcherQueueDesc, prometheus.GaugeValue, float64(len(s.Events)))
+
+	latestEvent, err := s.DB.Get([]byte("latest_event"), nil)
+	if err != nil {
+		latestEvent = []byte("event:0")
+	}
+	latest := eventTime(string(latestEvent))
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for c := range s.children {
+		lag := latest.Sub(eventTime(c.lastEvent))
+		if lag < 0 {
+			lag = 0
+		}
+		ch <- prometheus.MustNewConstMetric(replLagDesc, prometheus.GaugeValue, lag.Seconds(), c.addr)
+		ch <- prometheus.MustNewConstMetric(replQueueDesc, prometheus.GaugeValue, float64(c.queued), c.addr)
+	}
+}
+
+// eventTime returns the point in time encoded in an event ID.
+func eventTime(id string) time.Time {
+	ns, err := strconv.ParseInt(strings.TrimPrefix(id, "event:"), 10, 64)
+	if err != nil {
+		return time.Unix(0, 0)
+	}
+	return time.Unix(0, ns)
+}
+
+// levelDBCollector exports the compaction statistics that LevelDB reports
+// in its leveldb.stats property.
+type levelDBCollector struct {
+	DB *leveldb.DB
+}
+
+var (
+	levelDBTablesDesc = prometheus.NewDesc("cabinet_leveldb_tables",
+		"Number of tables per LevelDB level.", []string{"level"}, nil)
+	levelDBSizeDesc = prometheus.NewDesc("cabinet_leveldb_size_bytes",
+		"Size of tables per LevelDB level.", []string{"level"}, nil)
+	levelDBCompactionTimeDesc = prometheus.NewDesc("cabinet_leveldb_compaction_seconds_total",
+		"Time spent on compactions per LevelDB level.", []string{"level"}, nil)
+	levelDBCompactionReadDesc = prometheus.NewDesc("cabinet_leveldb_compaction_read_bytes_total",
+		"Bytes read by compactions per LevelDB level.", []string{"level"}, nil)
+	levelDBCompactionWriteDesc = prometheus.NewDesc("cabinet_leveldb_compaction_written_bytes_total",
+		"Bytes written by compactions per LevelDB level.", []string{"level"}, nil)
+)
+
+func (c *levelDBCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- levelDBTablesDesc
+	ch <- levelDBSizeDesc
+	ch <- levelDBCompactionTimeDesc
+	ch <- levelDBCompactionReadDesc
+	ch <- levelDBCompactionWriteDesc
+}
+
+func (c *levelDBCollector) Collect(ch chan<- prometheus.Metric) {
+	stats, err := c.DB.GetProperty("leveldb.stats")
+	if err != nil {
+		return
+	}
+
+	for _, l := range parseLevelDBStats(stats) {
+		level := strconv.Itoa(l.Level)
+		ch <- prometheus.MustNewConstMetric(levelDBTablesDesc, prometheus.GaugeValue, float64(l.Tables), level)
+		ch <- prometheus.MustNewConstMetric(levelDBSizeDesc, prometheus.GaugeValue, l.Size, level)
+		ch <- prometheus.MustNewConstMetric(levelDBCompactionTimeDesc, prometheus.CounterValue, l.Time, level)
+		ch <- prometheus.MustNewConstMetric(levelDBCompactionReadDesc, prometheus.CounterValue, l.Read, level)
+		ch <- prometheus.MustNewConstMetric(levelDBCompactionWriteDesc, prometheus.CounterValue, l.Write, level)
+	}
+}
+
+type levelStats struct {
+	Level  int
+	Tables int
+	Size   float64 // bytes
+	Time   float64 // seconds
+	Read   float64 // bytes
+	Write  float64 // bytes
+}
+
+// parseLevelDBStats parses the compaction table returned for the
+// leveldb.stats property. Sizes are reported in MB and converted to bytes.
+func parseLevelDBStats(stats string) []levelStats {
+	var result []levelStats
+
+	for _, line := range strings.Split(stats, "\n") {
+		fields := strings.Split(line, "|")
+		if len(fields) != 6 {
+			continue
+		}
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+
+		var (
+			l   levelStats
+			err error
+			mb  [4]float64
+		)
+		if l.Level, err = strconv.Atoi(fields[0]); err != nil {
+			continue // header line
+		}
+		if l.Tables, err = strconv.Atoi(fields[1]); err != nil {
+			continue
+		}
+		for i := range mb {
+			if mb[i], err = strconv.ParseFloat(fields[i+2], 64); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			continue
+		}
+		l.Size, l.Time, l.Read, l.Write = mb[0]*1048576, mb[1], mb[2]*1048576, mb[3]*1048576
+
+		result = append(result, l)
+	}
+
+	return result
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseLevelDBStats(t *testing.T) {
+	stats := "Compactions\n" +
+		" Level |   Tables   |    Size(MB)   |    Time(sec)  |    Read(MB)   |   Write(MB)\n" +
+		"-------+------------+---------------+---------------+---------------+---------------\n" +
+		"   0   |          2 |       1.00000 |       0.50000 |       0.00000 |       1.00000\n" +
+		"   1   |          5 |      10.50000 |       2.25000 |       4.00000 |       8.00000\n"
+
+	levels := parseLevelDBStats(stats)
+	if len(levels) != 2 {
+		t.Fatalf("expected 2 levels, got %d.", len(levels))
+	}
+
+	expected := levelStats{Level: 1, Tables: 5, Size: 10.5 * 1048576, Time: 2.25, Read: 4 * 1048576, Write: 8 * 1048576}
+	if levels[1] != expected {
+		t.Fatalf("expected %+v, got %+v instead.", expected, levels[1])
+	}
+}
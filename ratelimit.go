@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akrennmair/cabinet/accesslog"
+	"golang.org/x/time/rate"
+)
+
+// rateLimitConfig limits the requests of every client, identified by the
+// authenticated user or the IP address. Zero values don't limit anything.
+type rateLimitConfig struct {
+	// ReadRate and WriteRate are the allowed requests per second, with
+	// bursts of up to ReadBurst and WriteBurst requests.
+	ReadRate   float64 `toml:"read_rate"`
+	ReadBurst  int     `toml:"read_burst"`
+	WriteRate  float64 `toml:"write_rate"`
+	WriteBurst int     `toml:"write_burst"`
+
+	// MaxUploads is the number of concurrent uploads, stores and imports.
+	MaxUploads int `toml:"max_uploads"`
+
+	// DeliveryBandwidth throttles every file delivery to the given bytes
+	// per second.
+	DeliveryBandwidth int64 `toml:"delivery_bandwidth"`
+}
+
+func (c *rateLimitConfig) validate() error {
+	if c.ReadRate < 0 || c.ReadBurst < 0 || c.WriteRate < 0 || c.WriteBurst < 0 || c.MaxUploads < 0 || c.DeliveryBandwidth < 0 {
+		return errors.New("rate limits must not be negative")
+	}
+	return nil
+}
+
+const (
+	// buckets that weren't used for this long are removed.
+	rateLimitIdle = 10 * time.Minute
+
+	maxThrottledWrite = 32 << 10
+)
+
+type rateBucket struct {
+	limiter  *rate.Limiter
+	lastUsed time.Time
+}
+
+// rateLimiter rejects requests exceeding the rate limits with 429 Too Many
+// Requests.
+type rateLimiter struct {
+	h http.Handler
+
+	// LimitsFunc returns the limits of a drawer, and the scope they apply
+	// to: drawers with their own limits have their own buckets, all other
+	// drawers share them.
+	LimitsFunc func(drawer string) (limits rateLimitConfig, scope string)
+
+	// ClientFunc identifies the client a request comes from.
+	ClientFunc func(r *http.Request) string
+
+	mtx       sync.Mutex
+	buckets   map[string]*rateBucket
+	uploads   map[string]int
+	lastSweep time.Time
+}
+
+func (h *rateLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	drawer, err := requestDrawer(r)
+	if err != nil {
+		http.Error(w, "parsing form failed: "+err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	limits, scope := h.LimitsFunc(drawer)
+	client := h.ClientFunc(r)
+
+	class, limit, burst := "read", limits.ReadRate, limits.ReadBurst
+	if isWriteRequest(r) {
+		class, limit, burst = "write", limits.WriteRate, limits.WriteBurst
+	}
+
+	if limit > 0 {
+		if delay := h.reserve(class+"|"+scope+"|"+client, limit, burst); delay > 0 {
+			tooManyRequests(w, class, delay)
+			return
+		}
+	}
+
+	if limits.MaxUploads > 0 && isUploadRequest(r) {
+		key := scope + "|" + client
+		if !h.acquireUpload(key, limits.MaxUploads) {
+			tooManyRequests(w, "upload", time.Second)
+			return
+		}
+		defer h.releaseUpload(key)
+	}
+
+	if limits.DeliveryBandwidth > 0 && class == "read" && !strings.HasPrefix(r.URL.Path, "/api/") {
+		w = newThrottledWriter(w, r.Context(), limits.DeliveryBandwidth)
+	}
+
+	h.h.ServeHTTP(w, r)
+}
+
+// reserve takes a token from the bucket of key. If none is available, the
+// time until the next one is returned.
+func (h *rateLimiter) reserve(key string, limit float64, burst int) time.Duration {
+	if burst == 0 {
+		burst = int(math.Max(1, math.Ceil(limit)))
+	}
+
+	now := time.Now()
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if h.buckets == nil {
+		h.buckets = make(map[string]*rateBucket)
+	}
+	if now.Sub(h.lastSweep) > time.Minute {
+		for k, b := range h.buckets {
+			if now.Sub(b.lastUsed) > rateLimitIdle {
+				delete(h.buckets, k)
+			}
+		}
+		h.lastSweep = now
+	}
+
+	b, found := h.buckets[key]
+	if !found {
+		b = &rateBucket{limiter: rate.NewLimiter(rate.Limit(limit), burst)}
+		h.buckets[key] = b
+	} else if b.limiter.Limit() != rate.Limit(limit) || b.limiter.Burst() != burst {
+		// the configuration was reloaded.
+		b.limiter.SetLimitAt(now, rate.Limit(limit))
+		b.limiter.SetBurstAt(now, burst)
+	}
+	b.lastUsed = now
+
+	reservation := b.limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return delay
+	}
+	return 0
+}
+
+func (h *rateLimiter) acquireUpload(key string, max int) bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if h.uploads == nil {
+		h.uploads = make(map[string]int)
+	}
+	if h.uploads[key] >= max {
+		return false
+	}
+	h.uploads[key]++
+	return true
+}
+
+func (h *rateLimiter) releaseUpload(key string) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if h.uploads[key]--; h.uploads[key] <= 0 {
+		delete(h.uploads, key)
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, class string, delay time.Duration) {
+	rateLimitedRequests.WithLabelValues(class).Inc()
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+	http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
+
+// pathDrawerAPIs are the APIs that take the drawer as first element of
+// their path.
+var pathDrawerAPIs = []string{"/api/meta/", "/api/versions/", "/api/trash/", "/api/undelete/"}
+
+// requestDrawer returns the drawer a request is charged to, read the same
+// way as the handlers do: uploads take it from their form, which includes
+// URL-encoded bodies, other API requests from their path or query, and
+// files from their path.
+func requestDrawer(r *http.Request) (string, error) {
+	for _, prefix := range pathDrawerAPIs {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return strings.SplitN(strings.TrimPrefix(r.URL.Path, prefix), "/", 2)[0], nil
+		}
+	}
+	if r.URL.Path == "/api/upload" {
+		// the form is kept for the handler. Multipart bodies aren't
+		// read, their parts are files.
+		if err := r.ParseForm(); err != nil {
+			return "", err
+		}
+		return r.Form.Get("drawer"), nil
+	}
+	return accesslog.DrawerName(r), nil
+}
+
+func isWriteRequest(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		// stores are GET requests, but write files.
+		return strings.HasPrefix(r.URL.Path, "/api/store") && !strings.HasPrefix(r.URL.Path, "/api/store/jobs/")
+	}
+	return true
+}
+
+func isUploadRequest(r *http.Request) bool {
+	switch r.URL.Path {
+	case "/api/upload", "/api/store", "/api/import":
+		return true
+	}
+	return false
+}
+
+// throttledWriter limits the bandwidth of a response.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	limiter *rate.Limiter
+}
+
+func newThrottledWriter(w http.ResponseWriter, ctx context.Context, bytesPerSecond int64) *throttledWriter {
+	burst := maxThrottledWrite
+	if bytesPerSecond < int64(burst) {
+		burst = int(bytesPerSecond)
+	}
+	return &throttledWriter{ResponseWriter: w, ctx: ctx, limiter: rate.NewLimiter(rate.Limit(bytesPerSecond), burst)}
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > w.limiter.Burst() {
+			n = w.limiter.Burst()
+		}
+		if err := w.limiter.WaitN(w.ctx, n); err != nil {
+			return written, err
+		}
+		m, err := w.ResponseWriter.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
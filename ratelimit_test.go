@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestRateLimiter(t *testing.T) {
+	release := make(chan struct{})
+	limiter := &rateLimiter{
+		h: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/api/upload" {
+				<-release
+			}
+			w.Write([]byte(strings.Repeat("x", 3000)))
+		}),
+		LimitsFunc: func(drawer string) (rateLimitConfig, string) {
+			if drawer == "slow" {
+				return rateLimitConfig{ReadRate: 0.001, ReadBurst: 1, DeliveryBandwidth: 2000}, drawer
+			}
+			return rateLimitConfig{ReadRate: 0.001, ReadBurst: 2, MaxUploads: 1}, ""
+		},
+		ClientFunc: func(r *http.Request) string {
+			if user, _, ok := r.BasicAuth(); ok {
+				return "user:" + user
+			}
+			return "ip:" + r.RemoteAddr
+		},
+	}
+	server := httptest.NewServer(limiter)
+	defer server.Close()
+
+	get := func(path, user string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		if user != "" {
+			req.SetBasicAuth(user, "pass")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	for i := 0; i < 2; i++ {
+		if resp := get("/test/file", "alice"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d within burst returned %d", i, resp.StatusCode)
+		}
+	}
+	resp := get("/test/other", "alice")
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("request exceeding the rate returned %d, Retry-After %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	// other users and drawers with their own limits have their own buckets.
+	if resp := get("/test/file", "bob"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("request of another user returned %d", resp.StatusCode)
+	}
+
+	start := time.Now()
+	if resp := get("/slow/file", "alice"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("request to drawer with own limits returned %d", resp.StatusCode)
+	}
+	// the first 2000 bytes are sent immediately, the rest after 0.5s.
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("throttled delivery took only %s", elapsed)
+	}
+
+	// uploads aren't subject to the read rate, but only one may run at a
+	// time.
+	done := make(chan *http.Response)
+	go func() {
+		req, _ := http.NewRequest("POST", server.URL+"/api/upload?drawer=test", nil)
+		req.SetBasicAuth("alice", "pass")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			close(done)
+			return
+		}
+		resp.Body.Close()
+		done <- resp
+	}()
+
+	waitFor(t, "upload to start", func() bool {
+		limiter.mtx.Lock()
+		defer limiter.mtx.Unlock()
+		return limiter.uploads["|user:alice"] == 1
+	})
+
+	req, _ := http.NewRequest("POST", server.URL+"/api/upload?drawer=test", nil)
+	req.SetBasicAuth("alice", "pass")
+	if resp, err := http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("concurrent upload returned %d", resp.StatusCode)
+	}
+
+	close(release)
+	if resp := <-done; resp == nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload failed: %+v", resp)
+	}
+}
+
+func TestRateLimiterDrawer(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/upload", &uploadFileHandler{DB: db, Frontend: "http://localhost:8080", AuthFunc: authFunc})
+	mux.Handle("/api/meta/", &metaHandler{DB: db, AuthFunc: authFunc})
+	server := httptest.NewServer(&rateLimiter{
+		h: mux,
+		LimitsFunc: func(drawer string) (rateLimitConfig, string) {
+			if drawer == "limited" {
+				return rateLimitConfig{WriteRate: 0.001, WriteBurst: 1}, drawer
+			}
+			return rateLimitConfig{}, ""
+		},
+		ClientFunc: func(r *http.Request) string {
+			return "user:dummy"
+		},
+	})
+	defer server.Close()
+
+	send := func(method, path, contentType string, body *bytes.Buffer) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, server.URL+path, body)
+		req.SetBasicAuth("dummy", "auth")
+		req.Header.Set("Content-Type", contentType)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	upload := func(query string, fields map[string]string) int {
+		t.Helper()
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		for name, value := range fields {
+			mw.WriteField(name, value)
+		}
+		part, _ := mw.CreateFormFile("file", "a.txt")
+		part.Write([]byte("content"))
+		mw.Close()
+		return send("POST", "/api/upload"+query, mw.FormDataContentType(), &body)
+	}
+
+	if status := upload("?drawer=limited&name=a.txt", nil); status != http.StatusOK {
+		t.Fatalf("upload within burst returned %d", status)
+	}
+
+	// a drawer in a multipart field is neither charged nor used.
+	if status := upload("", map[string]string{"drawer": "limited"}); status == http.StatusOK {
+		t.Fatal("upload with the drawer in a multipart field succeeded")
+	}
+	if usage, _ := readUsage(db, "limited"); usage.Files != 1 {
+		t.Fatalf("drawer has %d files", usage.Files)
+	}
+
+	for _, req := range []struct {
+		method, path, contentType, body string
+	}{
+		{"POST", "/api/upload?drawer=limited", "text/plain", ""},
+		{"POST", "/api/upload", "application/x-www-form-urlencoded", "drawer=limited"},
+		{"PATCH", "/api/meta/limited/a.txt", "application/json", `{"tags": ["x"]}`},
+	} {
+		if status := send(req.method, req.path, req.contentType, bytes.NewBufferString(req.body)); status != http.StatusTooManyRequests {
+			t.Errorf("%s %s with %q returned %d", req.method, req.path, req.body, status)
+		}
+	}
+	if status := send("PATCH", "/api/meta/other/a.txt", "application/json", bytes.NewBufferString(`{"tags": ["x"]}`)); status != http.StatusNotFound {
+		t.Errorf("updating metadata in other drawer returned %d", status)
+	}
+}
@@ -1,15 +1,21 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"expvar"
 	"fmt"
 	"golang.org/x/net/websocket"
 	"io/ioutil"
 	"log"
 	"math"
+	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/akrennmair/cabinet/basicauth"
@@ -54,13 +60,42 @@ type replicator struct {
 	Events       chan<- *data.Event
 	Username     string
 	Password     string
+	TLSConfig    *tls.Config
+
+	client *http.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// errParentGoingAway is returned by replicateUntilError when the parent
+// announced that it is shutting down.
+var errParentGoingAway = errors.New("parent is going away")
+
+// start starts the replication from the parent server in the background.
+func (r *replicator) start() {
+	r.client = &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: r.TLSConfig}}
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	r.done = make(chan struct{})
+	go r.replicate()
 }
 
 func (r *replicator) replicate() {
+	defer close(r.done)
+
 	count := 0
 	for {
 		ts := time.Now()
 		err := r.replicateUntilError()
+		if r.ctx.Err() != nil {
+			log.Printf("Stopped replication from %s", r.ParentServer)
+			return
+		}
+		if err == errParentGoingAway {
+			log.Printf("Parent %s is shutting down, reconnecting", r.ParentServer)
+			count = 0
+			continue
+		}
 		if err != nil {
 			replErrors.Add(1)
 			log.Printf("Replication error: %v", err)
@@ -74,12 +109,24 @@ func (r *replicator) replicate() {
 			if count > 0 {
 				backoffTime := time.Duration(math.Pow(2, float64(count))) * time.Second
 				log.Printf("Backing off for %s", backoffTime)
-				time.Sleep(backoffTime)
+				select {
+				case <-time.After(backoffTime):
+				case <-r.ctx.Done():
+					log.Printf("Stopped replication from %s", r.ParentServer)
+					return
+				}
 			}
 		}
 	}
 }
 
+// stop ends the replication and waits until the current event has been
+// fully processed.
+func (r *replicator) stop() {
+	r.cancel()
+	<-r.done
+}
+
 func (r *replicator) replicateUntilError() error {
 	uri := r.ParentServer + "/api/repl"
 	parsedURL, err := url.Parse(uri)
@@ -103,6 +150,8 @@ func (r *replicator) replicateUntilError() error {
 	}
 	cfg.Location = parsedURL
 	cfg.Header.Set("Authorization", "Basic "+basicAuthEncode(r.Username, r.Password))
+	cfg.Dialer = &net.Dialer{Timeout: 30 * time.Second}
+	cfg.TlsConfig = r.TLSConfig
 
 	ws, err := websocket.DialConfig(cfg)
 	if err != nil {
@@ -111,6 +160,18 @@ func (r *replicator) replicateUntilError() error {
 	}
 	defer ws.Close()
 
+	// closing the connection when replication is stopped unblocks a
+	// pending receive.
+	connDone := make(chan struct{})
+	defer close(connDone)
+	go func() {
+		select {
+		case <-r.ctx.Done():
+			ws.Close()
+		case <-connDone:
+		}
+	}()
+
 	latestEvent, err := r.DB.Get([]byte("latest_event"), nil)
 	if err != nil {
 		latestEvent = []byte("event:0")
@@ -143,6 +204,10 @@ func (r *replicator) replicateUntilError() error {
 			return err
 		}
 
+		if event.GetType() == data.Event_GOING_AWAY {
+			return errParentGoingAway
+		}
+
 		replEvents.Add(1)
 
 		if haveEvent, _ := r.DB.Has([]byte(event.GetId()), nil); haveEvent {
@@ -151,37 +216,150 @@ func (r *replicator) replicateUntilError() error {
 			continue
 		}
 
-		batch := new(leveldb.Batch)
-		batch.Put([]byte(event.GetId()), rawMsg)
-		batch.Put([]byte("latest_event"), []byte(event.GetId()))
+		if isDrawerEvent(&event) {
+			if err := applyDrawerEvent(r.DB, &event); err != nil {
+				log.Printf("applying replicated drawer event failed: %v", err)
+				return err
+			}
+			log.Printf("replicated %s to drawer %s", event.GetId(), event.GetDrawer())
+			r.Events <- &event
+			continue
+		}
 
-		switch event.GetType() {
-		case data.Event_UPLOAD:
-			fileContent, metadata, err := r.downloadFile(r.ParentServer + "/" + event.GetDrawer() + "/" + event.GetFilename())
-			if err != nil {
-				log.Printf("Error downloading %s:%s, ignoring file: %v", event.GetDrawer(), event.GetFilename(), err)
-			} else {
-				batch.Put([]byte("file:"+event.GetDrawer()+":"+event.GetFilename()), fileContent)
+		// uploaded files are downloaded before the usage counters are
+		// locked. The uploaded version is fetched, even if it was replaced
+		// in the meantime, so that the same versions are kept.
+		var (
+			fileContent []byte
+			metadata    data.MetaData
+			downloadErr error
+		)
+		if event.GetType() == data.Event_UPLOAD {
+			uri := r.ParentServer + "/" + event.GetDrawer() + "/" + event.GetFilename()
+			if event.Version != nil {
+				uri += "?version=" + strconv.FormatInt(event.GetVersion(), 10)
+			}
+			if fileContent, metadata, downloadErr = r.downloadFile(uri); downloadErr != nil {
+				log.Printf("Error downloading %s:%s, ignoring file: %v", event.GetDrawer(), event.GetFilename(), downloadErr)
+			}
+		}
 
-				rawMetaData, err := proto.Marshal(&metadata)
-				if err != nil {
-					log.Printf("marshalling meta data failed: %v", err)
-					return err
+		// quotas only apply to uploads, not to replicated files.
+		var added, removed []byte
+		err := writeWithUsage(r.DB, event.GetDrawer(), drawerLimits{}, func(batch *leveldb.Batch) (drawerUsage, error) {
+			var err error
+			batch.Put([]byte(event.GetId()), rawMsg)
+			batch.Put([]byte("latest_event"), []byte(event.GetId()))
+
+			switch event.GetType() {
+			case data.Event_UPLOAD:
+				if downloadErr == nil {
+					if removed, err = r.DB.Get([]byte("file:"+event.GetDrawer()+":"+event.GetFilename()), nil); err != nil {
+						removed = nil
+					}
+					version, err := keepVersion(r.DB, batch, event.GetDrawer(), event.GetFilename(), removed)
+					if err != nil {
+						log.Printf("keeping old version failed: %v", err)
+						return drawerUsage{}, err
+					}
+					if event.Version != nil {
+						version = event.GetVersion()
+					}
+					batch.Put([]byte("file:"+event.GetDrawer()+":"+event.GetFilename()), fileContent)
+
+					metadata.Sha256 = proto.String(contentHash(fileContent))
+					metadata.Version = proto.Int64(version)
+					rawMetaData, err := proto.Marshal(&metadata)
+					if err != nil {
+						log.Printf("marshalling meta data failed: %v", err)
+						return drawerUsage{}, err
+					}
+					if err := indexTags(r.DB, batch, event.GetDrawer(), event.GetFilename(), metadata.Tags); err != nil {
+						log.Printf("indexing tags failed: %v", err)
+						return drawerUsage{}, err
+					}
+
+					batch.Put([]byte("meta:"+event.GetDrawer()+":"+event.GetFilename()), rawMetaData)
+					added = fileContent
 				}
-
-				batch.Put([]byte("meta:"+event.GetDrawer()+":"+event.GetFilename()), rawMetaData)
+			case data.Event_DELETE:
+				if removed, err = r.DB.Get([]byte("file:"+event.GetDrawer()+":"+event.GetFilename()), nil); err != nil {
+					removed = nil
+				}
+				if err := indexTags(r.DB, batch, event.GetDrawer(), event.GetFilename(), nil); err != nil {
+					log.Printf("indexing tags failed: %v", err)
+					return drawerUsage{}, err
+				}
+				if err := deleteVersions(r.DB, batch, event.GetDrawer(), event.GetFilename()); err != nil {
+					log.Printf("deleting old versions failed: %v", err)
+					return drawerUsage{}, err
+				}
+				batch.Delete([]byte("file:" + event.GetDrawer() + ":" + event.GetFilename()))
+				batch.Delete([]byte("meta:" + event.GetDrawer() + ":" + event.GetFilename()))
+				batch.Delete([]byte("trash:" + event.GetDrawer() + ":" + event.GetFilename()))
+				batch.Delete([]byte("tmeta:" + event.GetDrawer() + ":" + event.GetFilename()))
+			case data.Event_TRASH:
+				if removed, err = moveToTrash(r.DB, batch, event.GetDrawer(), event.GetFilename(), time.Now()); err != nil {
+					log.Printf("moving file to trash failed: %v", err)
+					return drawerUsage{}, err
+				}
+			case data.Event_UNDELETE:
+				restored, err := restoreFromTrash(r.DB, batch, event.GetDrawer(), event.GetFilename())
+				if err == errNotTrashed || err == errFileExists {
+					log.Printf("undeleting %s:%s failed, ignoring it: %v", event.GetDrawer(), event.GetFilename(), err)
+				} else if err != nil {
+					log.Printf("undeleting file failed: %v", err)
+					return drawerUsage{}, err
+				}
+				added = restored
+			case data.Event_RESTORE:
+				restored, replaced, err := restoreVersion(r.DB, batch, &event)
+				if err == errVersionNotFound {
+					log.Printf("version %d of %s:%s not found, ignoring restore", event.GetRestoredVersion(), event.GetDrawer(), event.GetFilename())
+				} else if err != nil {
+					log.Printf("restoring version failed: %v", err)
+					return drawerUsage{}, err
+				}
+				added, removed = restored, replaced
+			case data.Event_METADATA:
+				// the event carries the new metadata, so the file itself
+				// doesn't need to be downloaded again.
+				if has, _ := r.DB.Has([]byte("file:"+event.GetDrawer()+":"+event.GetFilename()), nil); has && event.Metadata != nil {
+					rawMetaData, err := proto.Marshal(event.Metadata)
+					if err != nil {
+						log.Printf("marshalling meta data failed: %v", err)
+						return drawerUsage{}, err
+					}
+					if err := indexTags(r.DB, batch, event.GetDrawer(), event.GetFilename(), event.Metadata.Tags); err != nil {
+						log.Printf("indexing tags failed: %v", err)
+						return drawerUsage{}, err
+					}
+					batch.Put([]byte("meta:"+event.GetDrawer()+":"+event.GetFilename()), rawMetaData)
+				}
+			default:
+				return drawerUsage{}, fmt.Errorf("unknown event type %d", event.GetType())
 			}
-		case data.Event_DELETE:
-			batch.Delete([]byte("file:" + event.GetDrawer() + ":" + event.GetFilename()))
-		default:
-			return fmt.Errorf("unknown event type %d", event.GetType())
-		}
 
-		if err := r.DB.Write(batch, nil); err != nil {
+			delta := drawerUsage{Bytes: int64(len(added) - len(removed))}
+			if added != nil && removed == nil {
+				delta.Files = 1
+			} else if added == nil && removed != nil {
+				delta.Files = -1
+			}
+			return delta, nil
+		})
+		if err != nil {
 			log.Printf("writing replicated event to database failed: %v", err)
 			return err
 		}
 
+		if added != nil {
+			fileAdded(event.GetDrawer(), len(added))
+		}
+		if removed != nil {
+			fileRemoved(event.GetDrawer(), len(removed))
+		}
+
 		log.Printf("replicated %s to %s:%s", event.GetId(), event.GetDrawer(), event.GetFilename())
 
 		log.Printf("forwarding event %s", event.GetId())
@@ -190,7 +368,15 @@ func (r *replicator) replicateUntilError() error {
 }
 
 func (r *replicator) downloadFile(uri string) (content []byte, metadata data.MetaData, err error) {
-	resp, err := http.Get(uri)
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return nil, metadata, err
+	}
+	// files of private drawers are only delivered to authenticated users.
+	if r.Username != "" {
+		req.SetBasicAuth(r.Username, r.Password)
+	}
+	resp, err := r.client.Do(req.WithContext(r.ctx))
 	if err != nil {
 		return nil, metadata, err
 	}
@@ -206,6 +392,15 @@ func (r *replicator) downloadFile(uri string) (content []byte, metadata data.Met
 	if source := resp.Header.Get("Content-Location"); source != "" {
 		metadata.Source = proto.String(source)
 	}
+	metadata.Scan = parseScanHeader(resp.Header.Get(scanHeader))
+	if name := dispositionName(resp.Header.Get("Content-Disposition")); name != "" {
+		metadata.OriginalName = proto.String(name)
+	}
+	if userMetadata, err := parseUserMetadata(resp.Header, nil); err != nil {
+		log.Printf("invalid metadata of %s: %v", uri, err)
+	} else {
+		userMetadata.apply(&metadata)
+	}
 	return content, metadata, nil
 }
 
@@ -213,6 +408,21 @@ type replHandler struct {
 	DB         *leveldb.DB
 	Replicator chan<- replRequest
 	AuthFunc   basicauth.AuthenticatorFunc
+	AccessFunc drawerAccessFunc
+	Stats      *replStats
+
+	// if RequireClientCert is set, children need to authenticate with a
+	// verified TLS client certificate instead of username and password.
+	RequireClientCert bool
+
+	// when Shutdown is closed, all children are told that this instance is
+	// going away, and are disconnected.
+	Shutdown <-chan struct{}
+
+	// childrenMtx keeps children from being added to while wait waits for
+	// them.
+	childrenMtx sync.Mutex
+	children    sync.WaitGroup
 }
 
 type replRequest struct {
@@ -228,10 +438,24 @@ const (
 )
 
 func (h *replHandler) handleWebsocket(conn *websocket.Conn) {
-	if !basicauth.Authenticate(nil, conn.Request(), h.AuthFunc) {
+	if h.RequireClientCert {
+		if tlsState := conn.Request().TLS; tlsState == nil || len(tlsState.VerifiedChains) == 0 {
+			log.Printf("Rejecting replication child %s without verified client certificate", conn.Request().RemoteAddr)
+			return
+		}
+	} else if !basicauth.Authenticate(nil, conn.Request(), h.AuthFunc) {
+		return
+	} else if !h.AccessFunc.permits(conn.Request(), "") {
+		log.Printf("Rejecting replication child %s whose user can't access all drawers", conn.Request().RemoteAddr)
 		return
 	}
 
+	if !h.addChild() {
+		log.Printf("Rejecting replication child %s while shutting down", conn.Request().RemoteAddr)
+		return
+	}
+	defer h.children.Done()
+
 	replChildren.Add(1)
 	defer replChildren.Add(-1)
 
@@ -274,26 +498,36 @@ func (h *replHandler) handleWebsocket(conn *websocket.Conn) {
 		stopped.
 
 		The handleWebsocket method waits for the quit signal, and then returns. Due
-		to a defer, the channel through which we receive events gets unregistered,
-		and the rawEvents channel gets closed, as well. This makes the forwarding
-		goroutine end its operation. The quit signal also ends the caching goroutine.
+		to a defer, the channel through which we receive events gets unregistered.
+		The quit signal ends the caching goroutine, which closes the channel of
+		cached events on its way out. This makes the forwarding goroutine end its
+		operation.
 
 	*/
-	events := make(chan *data.Event, 1)
-	rawEvents := make(chan []byte)
+	child := h.Stats.addChild(conn.Request().RemoteAddr, replStart.GetEvent())
+	defer h.Stats.removeChild(child)
 
-	defer close(rawEvents)
+	events := make(chan *data.Event, 1)
+	cachedEvents := make(chan *data.Event)
 
 	h.Replicator <- replRequest{Type: subscribe, Events: events}
 
 	defer func() {
-		h.Replicator <- replRequest{Type: unsubscribe, Events: events}
+		// keep draining events so that the dispatcher can't block on us
+		// while we're unsubscribing.
+		for unsubscribed := false; !unsubscribed; {
+			select {
+			case h.Replicator <- replRequest{Type: unsubscribe, Events: events}:
+				unsubscribed = true
+			case <-events:
+			}
+		}
 		close(events)
 	}()
 
 	quit := make(chan bool)
 
-	go cacheEvents(events, rawEvents, quit)
+	go cacheEvents(events, cachedEvents, quit, func(n int) { h.Stats.setQueued(child, n) })
 
 	go func() {
 		iterator := h.DB.NewIterator(&util.Range{Start: []byte(replStart.GetEvent()), Limit: []byte("f")}, nil)
@@ -304,14 +538,21 @@ func (h *replHandler) handleWebsocket(conn *websocket.Conn) {
 				log.Printf("Sending event failed: %v", err)
 				return
 			}
+			h.Stats.setLastEvent(child, string(iterator.Key()))
 		}
 
-		for event := range rawEvents {
+		for event := range cachedEvents {
 			log.Printf("websocketHandler: forwarding event")
-			if err := websocket.Message.Send(conn, event); err != nil {
+			rawData, err := proto.Marshal(event)
+			if err != nil {
+				log.Printf("Marshalling event failed: %v", err)
+				return
+			}
+			if err := websocket.Message.Send(conn, rawData); err != nil {
 				log.Printf("Sending event failed: %v", err)
 				return
 			}
+			h.Stats.setLastEvent(child, event.GetId())
 		}
 
 		log.Printf("stopped sending events to client")
@@ -328,25 +569,79 @@ func (h *replHandler) handleWebsocket(conn *websocket.Conn) {
 		}
 	}()
 
-	<-quit
+	select {
+	case <-quit:
+	case <-h.Shutdown:
+		goingAway := &data.Event{
+			Type:     data.Event_GOING_AWAY.Enum(),
+			Drawer:   proto.String(""),
+			Filename: proto.String(""),
+			Id:       proto.String(""),
+		}
+		if rawData, err := proto.Marshal(goingAway); err == nil {
+			if err := websocket.Message.Send(conn, rawData); err != nil {
+				log.Printf("Sending going away message failed: %v", err)
+			}
+		}
+		conn.Close()
+		<-quit
+	}
 	log.Printf("handleWebsocket: received signal to stop replicating to client")
 }
 
-func cacheEvents(incomingEvents <-chan *data.Event, outgoingEvents chan<- []byte, quit <-chan bool) {
-	cachedEvents := [][]byte{}
+// addChild registers a new replication child, unless Shutdown has been
+// closed.
+func (h *replHandler) addChild() bool {
+	h.childrenMtx.Lock()
+	defer h.childrenMtx.Unlock()
+
+	select {
+	case <-h.Shutdown:
+		return false
+	default:
+	}
+	h.children.Add(1)
+	return true
+}
+
+// wait waits until all replication children have been disconnected, or
+// until ctx is done. It must only be called after Shutdown has been closed.
+func (h *replHandler) wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		// children that are being added right now are waited for, all
+		// later ones are rejected.
+		h.childrenMtx.Lock()
+		h.childrenMtx.Unlock()
+		h.children.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func cacheEvents(incomingEvents <-chan *data.Event, outgoingEvents chan<- *data.Event, quit <-chan bool, queued func(int)) {
+	// only the sender may close outgoingEvents, anything else races with
+	// the send below.
+	defer close(outgoingEvents)
+
+	cachedEvents := []*data.Event{}
 
 	for {
+		queued(len(cachedEvents))
+
 		// if there are currently no cached events, only attempt to receive and listen for
 		// the quit signal.
 		if len(cachedEvents) == 0 {
 			select {
 			case e := <-incomingEvents:
-				rawData, err := proto.Marshal(e)
-				if err != nil {
-					return
-				}
 				log.Printf("cacheEvents: storing event %s", e.GetId())
-				cachedEvents = append(cachedEvents, rawData)
+				cachedEvents = append(cachedEvents, e)
 			case <-quit:
 				return
 			}
@@ -355,12 +650,8 @@ func cacheEvents(incomingEvents <-chan *data.Event, outgoingEvents chan<- []byte
 			// signal.
 			select {
 			case e := <-incomingEvents:
-				rawData, err := proto.Marshal(e)
-				if err != nil {
-					return
-				}
 				log.Printf("cacheEvents: storing event %s", e.GetId())
-				cachedEvents = append(cachedEvents, rawData)
+				cachedEvents = append(cachedEvents, e)
 			case outgoingEvents <- cachedEvents[0]:
 				log.Printf("cacheEvents: forwarding event")
 				cachedEvents = cachedEvents[1:]
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akrennmair/cabinet/data"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+	"golang.org/x/net/websocket"
+)
+
+var testSignKey = []byte("test signing key")
+
+type testParent struct {
+	DB       *leveldb.DB
+	Server   *httptest.Server
+	Repl     *replHandler
+	Jobs     *storeQueue
+	Upload   *uploadFileHandler
+	Import   *importHandler
+	File     *fileHandler
+	Events   chan<- *data.Event
+	Shutdown chan struct{}
+}
+
+// newTestParent starts a parent instance. If tlsConfig is set, the parent
+// serves HTTPS.
+func newTestParent(t *testing.T, tlsConfig *tls.Config) *testParent {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan *data.Event, 64)
+	replRequests := make(chan replRequest)
+	go dispatchEvents(events, replRequests)
+
+	p := &testParent{DB: db, Events: events, Shutdown: make(chan struct{})}
+
+	mux := http.NewServeMux()
+	p.Server = httptest.NewUnstartedServer(mux)
+	if tlsConfig != nil {
+		p.Server.Listener = tls.NewListener(p.Server.Listener, tlsConfig)
+		p.Server.Start()
+		p.Server.URL = strings.Replace(p.Server.URL, "http://", "https://", 1)
+	} else {
+		p.Server.Start()
+	}
+
+	limitsFunc := func(drawer string) drawerLimits {
+		record, err := readDrawer(db, drawer)
+		if err != nil {
+			t.Error(err)
+		}
+		return record.limits(drawerLimits{})
+	}
+
+	fetcher := newTestFetcher(t)
+	p.Jobs = &storeQueue{DB: db, Fetcher: fetcher, Frontend: p.Server.URL, Events: events, LimitsFunc: limitsFunc, RetryDelay: time.Millisecond, MaxRetryDelay: time.Millisecond}
+	if err := p.Jobs.start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Jobs.stop)
+
+	p.Upload = &uploadFileHandler{DB: db, Frontend: p.Server.URL, Events: events, AuthFunc: authFunc, LimitsFunc: limitsFunc, Fetcher: fetcher, Jobs: p.Jobs}
+	mux.Handle("/api/upload", p.Upload)
+	mux.Handle("/api/store", p.Upload)
+	mux.Handle("/api/store/jobs/", &storeJobHandler{Jobs: p.Jobs, AuthFunc: authFunc})
+	p.Repl = &replHandler{DB: db, AuthFunc: authFunc, Replicator: replRequests, Shutdown: p.Shutdown}
+	mux.Handle("/api/repl", websocket.Handler(p.Repl.handleWebsocket))
+	mux.Handle("/api/list", &listHandler{DB: db, Frontend: p.Server.URL, AuthFunc: authFunc})
+	mux.Handle("/api/backup", &backupHandler{DB: db, AuthFunc: authFunc})
+	mux.Handle("/api/export", &exportHandler{DB: db, AuthFunc: authFunc})
+	p.Import = &importHandler{DB: db, Frontend: p.Server.URL, Events: events, AuthFunc: authFunc, LimitsFunc: limitsFunc}
+	mux.Handle("/api/import", p.Import)
+	drawers := &drawerHandler{DB: db, Events: events, AuthFunc: authFunc}
+	mux.Handle("/api/drawers", drawers)
+	mux.Handle("/api/drawers/", drawers)
+	mux.Handle("/api/meta/", &metaHandler{DB: db, Events: events, AuthFunc: authFunc})
+	mux.Handle("/api/versions/", &versionsHandler{DB: db, Frontend: p.Server.URL, Events: events, AuthFunc: authFunc, LimitsFunc: limitsFunc})
+	mux.Handle("/api/events", &feedHandler{DB: db, Frontend: p.Server.URL, Replicator: replRequests, AuthFunc: authFunc, Shutdown: p.Shutdown})
+	mux.Handle("/api/sign", &signHandler{Frontend: p.Server.URL, Key: testSignKey, AuthFunc: authFunc})
+	trash := &trashHandler{DB: db, Events: events, AuthFunc: authFunc, LimitsFunc: limitsFunc}
+	mux.Handle("/api/trash/", trash)
+	mux.Handle("/api/undelete/", trash)
+	p.File = &fileHandler{DB: db, Events: events, AuthFunc: authFunc, SignKey: testSignKey}
+	mux.Handle("/", p.File)
+
+	return p
+}
+
+// setScanner scans all uploads, stores and imports of the parent with s.
+func (p *testParent) setScanner(s *uploadScanner) {
+	s.Events = p.Events
+	p.Upload.Scanner = s
+	p.Jobs.Scanner = s
+	p.Import.Scanner = s
+}
+
+func (p *testParent) upload(t *testing.T, client *http.Client, drawer, contentType, content string) string {
+	var multipartData bytes.Buffer
+	mw := multipart.NewWriter(&multipartData)
+	headers := make(textproto.MIMEHeader)
+	headers.Set("Content-Type", contentType)
+	pw, err := mw.CreatePart(headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw.Write([]byte(content))
+	mw.Close()
+
+	req, err := http.NewRequest("POST", p.Server.URL+"/api/upload?drawer="+drawer, &multipartData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.SetBasicAuth("dummy", "auth")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d instead.", resp.StatusCode)
+	}
+
+	var filenames []string
+	if err := json.NewDecoder(resp.Body).Decode(&filenames); err != nil || len(filenames) != 1 {
+		t.Fatalf("couldn't decode upload response: %v", err)
+	}
+	return filenames[0]
+}
+
+func newTestChild(t *testing.T, parent string, tlsConfig *tls.Config) (*leveldb.DB, *replicator) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan *data.Event, 64)
+	go func() {
+		for range events {
+		}
+	}()
+
+	r := &replicator{ParentServer: parent, DB: db, Username: "dummy", Password: "auth", Events: events, TLSConfig: tlsConfig}
+	r.start()
+	return db, r
+}
+
+// caughtUp returns whether the child has replicated all events of the
+// parent.
+func caughtUp(parentDB, childDB *leveldb.DB) bool {
+	parentLatest, _ := parentDB.Get([]byte("latest_event"), nil)
+	childLatest, _ := childDB.Get([]byte("latest_event"), nil)
+	return string(parentLatest) == string(childLatest)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplicationShutdown(t *testing.T) {
+	parent := newTestParent(t, nil)
+	defer parent.Server.Close()
+
+	childDB, r := newTestChild(t, parent.Server.URL, nil)
+	defer r.stop()
+
+	fileURL := parent.upload(t, http.DefaultClient, "test", "text/plain", "hello world!")
+	key := []byte("file:test:" + fileURL[len(parent.Server.URL+"/test/"):])
+
+	waitFor(t, "replicated file", func() bool {
+		content, err := childDB.Get(key, nil)
+		return err == nil && string(content) == "hello world!"
+	})
+
+	close(parent.Shutdown)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := parent.Repl.wait(ctx); err != nil {
+		t.Fatalf("children weren't disconnected: %v", err)
+	}
+}
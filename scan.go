@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akrennmair/cabinet/data"
+	"github.com/akrennmair/cabinet/scanner"
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+const (
+	defaultScanTimeout      = 60 * time.Second
+	defaultQuarantineDrawer = "quarantine"
+
+	scanHeader = "X-Cabinet-Scan"
+)
+
+// uploadScanner scans uploads for malware before they're stored.
+type uploadScanner struct {
+	Scanner scanner.Scanner
+
+	// Kind is recorded as scanner in the scan results, e.g. clamd.
+	Kind    string
+	Timeout time.Duration
+
+	// Drawers restricts scanning to the listed drawers. If empty, uploads
+	// to all drawers are scanned.
+	Drawers []string
+
+	// QuarantineDrawer receives infected files. If empty, they're only
+	// rejected.
+	QuarantineDrawer string
+
+	// Events receives the events of quarantined files.
+	Events chan<- *data.Event
+}
+
+// newUploadScanner returns the scanner configured in c, or nil if scanning
+// isn't configured.
+func newUploadScanner(c *scanConfig) *uploadScanner {
+	s := &uploadScanner{Timeout: c.Timeout, Drawers: c.Drawers}
+	switch {
+	case c.Clamd != "":
+		network := "tcp"
+		if strings.HasPrefix(c.Clamd, "/") {
+			network = "unix"
+		}
+		s.Scanner, s.Kind = &scanner.Clamd{Network: network, Address: c.Clamd}, "clamd"
+	case len(c.Command) > 0:
+		s.Scanner, s.Kind = &scanner.Exec{Path: c.Command[0], Args: c.Command[1:]}, "exec"
+	case c.URL != "":
+		s.Scanner, s.Kind = &scanner.HTTP{URL: c.URL}, "http"
+	default:
+		return nil
+	}
+
+	if s.Timeout == 0 {
+		s.Timeout = defaultScanTimeout
+	}
+	if c.Action == "quarantine" {
+		s.QuarantineDrawer = c.QuarantineDrawer
+		if s.QuarantineDrawer == "" {
+			s.QuarantineDrawer = defaultQuarantineDrawer
+		}
+	}
+	return s
+}
+
+// scans reports whether uploads to drawer are scanned. A nil uploadScanner
+// doesn't scan anything.
+func (s *uploadScanner) scans(drawer string) bool {
+	return s != nil && (len(s.Drawers) == 0 || contains(s.Drawers, drawer))
+}
+
+func (s *uploadScanner) scan(ctx context.Context, content []byte) (*data.ScanResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.Timeout)
+	defer cancel()
+
+	result, err := s.Scanner.Scan(ctx, bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+
+	scanResult := &data.ScanResult{
+		Scanner:  proto.String(s.Kind),
+		Infected: proto.Bool(result.Infected),
+		Scanned:  proto.Int64(time.Now().Unix()),
+	}
+	if result.Signature != "" {
+		scanResult.Signature = proto.String(result.Signature)
+	}
+	return scanResult, nil
+}
+
+// check scans a file that is about to be stored in drawer, if uploads to
+// drawer are scanned, and records the result in metadata. Infected files are
+// quarantined and rejected with a *limitError, as are files that couldn't be
+// scanned. Every write of user-supplied content goes through check.
+func (s *uploadScanner) check(ctx context.Context, db *leveldb.DB, drawer, filename string, content []byte, metadata *data.MetaData) error {
+	if !s.scans(drawer) {
+		return nil
+	}
+
+	result, err := s.scan(ctx, content)
+	if err != nil {
+		log.Printf("scanning upload to %s:%s failed: %v", drawer, filename, err)
+		return &limitError{StatusCode: http.StatusServiceUnavailable, Message: "scanning the upload failed"}
+	}
+	metadata.Scan = result
+	if !result.GetInfected() {
+		return nil
+	}
+
+	log.Printf("upload to %s:%s is infected with %s", drawer, filename, result.GetSignature())
+
+	if s.QuarantineDrawer != "" {
+		events, err := s.quarantine(ctx, db, drawer, filename, content, metadata)
+		if s.Events != nil {
+			for _, event := range events {
+				s.Events <- event
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("quarantining %s:%s failed: %v", drawer, filename, err)
+		}
+	}
+
+	return &limitError{StatusCode: http.StatusUnprocessableEntity, Message: "file is infected with " + result.GetSignature()}
+}
+
+// quarantine stores an infected file of drawer in the quarantine drawer,
+// as <drawer>/<filename>. The quarantine drawer is created as private drawer
+// if it doesn't exist yet. The events of all changes are returned.
+func (s *uploadScanner) quarantine(ctx context.Context, db *leveldb.DB, drawer, filename string, content []byte, metadata *data.MetaData) ([]*data.Event, error) {
+	var events []*data.Event
+
+	record, err := readDrawer(db, s.QuarantineDrawer)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		now := time.Now().UTC()
+		rawRecord, err := json.Marshal(&drawerRecord{Name: s.QuarantineDrawer, Private: true, UserUploads: true, Created: now, Updated: now})
+		if err != nil {
+			return nil, err
+		}
+		event := newDrawerEvent(data.Event_DRAWER, s.QuarantineDrawer)
+		event.Settings = proto.String(string(rawRecord))
+		if err := applyDrawerEvent(db, event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	event, err := putFile(ctx, db, nil, s.QuarantineDrawer, drawer+"/"+filename, content, metadata, drawerLimits{})
+	if err != nil {
+		return events, err
+	}
+	return append(events, event), nil
+}
+
+// formatScanHeader formats a scan result for the X-Cabinet-Scan header, e.g.
+// "infected; scanner=clamd; signature=Eicar-Signature; scanned=1490000000".
+func formatScanHeader(result *data.ScanResult) string {
+	status := "clean"
+	if result.GetInfected() {
+		status = "infected"
+	}
+	params := map[string]string{
+		"scanner": result.GetScanner(),
+		"scanned": strconv.FormatInt(result.GetScanned(), 10),
+	}
+	if result.Signature != nil {
+		params["signature"] = result.GetSignature()
+	}
+	return mime.FormatMediaType(status, params)
+}
+
+// parseScanHeader parses an X-Cabinet-Scan header, and returns nil if it is
+// missing or invalid.
+func parseScanHeader(header string) *data.ScanResult {
+	status, params, err := mime.ParseMediaType(header)
+	if err != nil || (status != "clean" && status != "infected") || params["scanner"] == "" {
+		return nil
+	}
+
+	result := &data.ScanResult{
+		Scanner:  proto.String(params["scanner"]),
+		Infected: proto.Bool(status == "infected"),
+	}
+	if signature, ok := params["signature"]; ok {
+		result.Signature = proto.String(signature)
+	}
+	if scanned, err := strconv.ParseInt(params["scanned"], 10, 64); err == nil {
+		result.Scanned = proto.Int64(scanned)
+	}
+	return result
+}
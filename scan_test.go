@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/akrennmair/cabinet/client"
+	"github.com/akrennmair/cabinet/data"
+	"github.com/akrennmair/cabinet/scanner"
+	"github.com/golang/protobuf/proto"
+)
+
+// testScanner finds "virus" in files, and fails for "broken" ones.
+type testScanner struct{}
+
+func (testScanner) Scan(ctx context.Context, r io.Reader) (*scanner.Result, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case strings.Contains(string(content), "broken"):
+		return nil, errors.New("scanner broke")
+	case strings.Contains(string(content), "virus"):
+		return &scanner.Result{Infected: true, Signature: "Test-Virus"}, nil
+	}
+	return &scanner.Result{}, nil
+}
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd answers INSTREAM commands like clamd, finding the EICAR test
+// signature.
+func fakeClamd(t *testing.T) *scanner.Clamd {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				br := bufio.NewReader(conn)
+				if command, err := br.ReadString(0); err != nil || command != "zINSTREAM\x00" {
+					io.WriteString(conn, "UNKNOWN COMMAND\x00")
+					return
+				}
+
+				var content bytes.Buffer
+				for {
+					var size uint32
+					if err := binary.Read(br, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					if _, err := io.CopyN(&content, br, int64(size)); err != nil {
+						return
+					}
+				}
+
+				if bytes.Contains(content.Bytes(), []byte(eicar)) {
+					io.WriteString(conn, "stream: Eicar-Test-Signature FOUND\x00")
+				} else {
+					io.WriteString(conn, "stream: OK\x00")
+				}
+			}(conn)
+		}
+	}()
+
+	return &scanner.Clamd{Network: "tcp", Address: l.Addr().String()}
+}
+
+func TestUploadScanning(t *testing.T) {
+	parent := newTestParent(t, nil)
+	defer parent.Server.Close()
+
+	childDB, r := newTestChild(t, parent.Server.URL, nil)
+	defer r.stop()
+
+	parent.setScanner(&uploadScanner{Scanner: testScanner{}, Kind: "test", Timeout: defaultScanTimeout, Drawers: []string{"inbox"}, QuarantineDrawer: "quarantine"})
+
+	c := client.New(parent.Server.URL, "dummy", "auth")
+	c.MaxRetries = 0
+	ctx := context.Background()
+
+	file, err := c.Upload(ctx, strings.NewReader("clean"), "text/plain", "inbox", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if result := parseScanHeader(resp.Header.Get(scanHeader)); result == nil || result.GetScanner() != "test" || result.GetInfected() || result.GetScanned() == 0 {
+		t.Fatalf("unexpected scan result %v", result)
+	}
+
+	filename := file[len(parent.Server.URL+"/inbox/"):]
+	waitFor(t, "replicated scan result", func() bool {
+		rawMetaData, err := childDB.Get([]byte("meta:inbox:"+filename), nil)
+		if err != nil {
+			return false
+		}
+		var metadata data.MetaData
+		return proto.Unmarshal(rawMetaData, &metadata) == nil && metadata.GetScan().GetScanner() == "test"
+	})
+
+	if _, err := c.UploadWithOptions(ctx, strings.NewReader("virus"), &client.UploadOptions{Drawer: "inbox", Name: "evil.exe"}); !errors.Is(err, client.ErrInfected) {
+		t.Fatalf("uploading infected file returned %v", err)
+	}
+	if has, _ := parent.DB.Has([]byte("file:inbox:evil.exe"), nil); has {
+		t.Fatal("infected file was stored")
+	}
+
+	// quarantined files are only delivered to authorized users.
+	quarantined := parent.Server.URL + "/quarantine/inbox/evil.exe"
+	if resp, err := http.Get(quarantined); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("fetching quarantined file without authentication returned %d", resp.StatusCode)
+	}
+	info, err := c.Stat(ctx, quarantined)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len("virus")) {
+		t.Fatalf("unexpected quarantined file %+v", info)
+	}
+
+	var apiErr *client.Error
+	if _, err := c.Upload(ctx, strings.NewReader("broken"), "text/plain", "inbox", ""); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("uploading with a failing scanner returned %v", err)
+	}
+
+	// drawers that aren't listed aren't scanned.
+	if _, err := c.Upload(ctx, strings.NewReader("virus"), "text/plain", "other", ""); err != nil {
+		t.Fatalf("upload to unscanned drawer failed: %v", err)
+	}
+}
+
+func TestScanHeader(t *testing.T) {
+	for _, result := range []*data.ScanResult{
+		{Scanner: proto.String("clamd"), Infected: proto.Bool(false), Scanned: proto.Int64(1490000000)},
+		{Scanner: proto.String("exec"), Infected: proto.Bool(true), Signature: proto.String("Win.Test EICAR"), Scanned: proto.Int64(1490000000)},
+	} {
+		header := formatScanHeader(result)
+		if parsed := parseScanHeader(header); !proto.Equal(parsed, result) {
+			t.Errorf("%s was parsed as %v, expected %v", header, parsed, result)
+		}
+	}
+	if result := parseScanHeader("unknown; scanner=x"); result != nil {
+		t.Errorf("expected nil for unknown status, got %v", result)
+	}
+}
@@ -0,0 +1,84 @@
+package scanner
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// clamdChunkSize is the size of the chunks the content is streamed in. It
+// must stay below clamd's StreamMaxLength.
+const clamdChunkSize = 64 * 1024
+
+// Clamd streams the content to a clamd daemon with the INSTREAM command.
+type Clamd struct {
+	// Network is "tcp" or "unix", Address the host and port or the path of
+	// the socket.
+	Network string
+	Address string
+}
+
+// Scan implements Scanner.
+func (c *Clamd) Scan(ctx context.Context, r io.Reader) (*Result, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, c.Network, c.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// the z prefix terminates commands and replies with a null byte.
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return nil, err
+	}
+
+	chunk := make([]byte, 4+clamdChunkSize)
+	for {
+		n, err := io.ReadFull(r, chunk[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(chunk, uint32(n))
+			if _, err := conn.Write(chunk[:4+n]); err != nil {
+				return nil, err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return nil, err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && reply == "" {
+		return nil, fmt.Errorf("reading reply from clamd failed: %v", err)
+	}
+	return parseClamdReply(strings.TrimRight(reply, "\x00"))
+}
+
+// parseClamdReply parses replies like "stream: OK" and
+// "stream: Eicar-Signature FOUND".
+func parseClamdReply(reply string) (*Result, error) {
+	status := reply
+	if n := strings.Index(reply, ": "); n != -1 {
+		status = reply[n+2:]
+	}
+
+	switch {
+	case status == "OK":
+		return &Result{}, nil
+	case strings.HasSuffix(status, " FOUND"):
+		return &Result{Infected: true, Signature: strings.TrimSuffix(status, " FOUND")}, nil
+	}
+	return nil, fmt.Errorf("clamd: %s", reply)
+}
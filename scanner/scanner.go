@@ -0,0 +1,100 @@
+// Package scanner scans files for malware, with clamd, an external command
+// or an HTTP service.
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+)
+
+// Result is the outcome of a scan. Signature names the malware found in
+// infected files.
+type Result struct {
+	Infected  bool   `json:"infected"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// Scanner scans the content read from r. An error means that the content
+// couldn't be scanned, not that it is infected.
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (*Result, error)
+}
+
+// Exec runs a command with the content on its standard input, like
+// clamscan -. Exit code 0 means the content is clean, and 1 that it is
+// infected, with the signature as the first line of the standard output.
+// Other exit codes are errors.
+type Exec struct {
+	Path string
+	Args []string
+}
+
+// Scan implements Scanner.
+func (e *Exec) Scan(ctx context.Context, r io.Reader) (*Result, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, e.Path, e.Args...)
+	cmd.Stdin = r
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err == nil {
+		return &Result{}, nil
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		signature, _ := bufio.NewReader(&stdout).ReadString('\n')
+		return &Result{Infected: true, Signature: strings.TrimSpace(signature)}, nil
+	}
+	if message := strings.TrimSpace(stderr.String()); message != "" {
+		return nil, fmt.Errorf("%s failed: %v: %s", e.Path, err, message)
+	}
+	return nil, fmt.Errorf("%s failed: %v", e.Path, err)
+}
+
+// HTTP posts the content to a service, which responds with the Result as
+// JSON.
+type HTTP struct {
+	URL string
+
+	// Client is used for the requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// Scan implements Scanner.
+func (h *HTTP) Scan(ctx context.Context, r io.Reader) (*Result, error) {
+	req, err := http.NewRequest("POST", h.URL, r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", h.URL, resp.Status)
+	}
+
+	var result Result
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decoding result from %s failed: %v", h.URL, err)
+	}
+	return &result, nil
+}
@@ -0,0 +1,137 @@
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd answers INSTREAM commands like clamd, finding the EICAR test
+// signature.
+func fakeClamd(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				br := bufio.NewReader(conn)
+				command, err := br.ReadString(0)
+				if err != nil || command != "zINSTREAM\x00" {
+					io.WriteString(conn, "UNKNOWN COMMAND\x00")
+					return
+				}
+
+				var content bytes.Buffer
+				for {
+					var size uint32
+					if err := binary.Read(br, binary.BigEndian, &size); err != nil {
+						return
+					}
+					if size == 0 {
+						break
+					}
+					if _, err := io.CopyN(&content, br, int64(size)); err != nil {
+						return
+					}
+				}
+
+				if bytes.Contains(content.Bytes(), []byte(eicar)) {
+					io.WriteString(conn, "stream: Eicar-Test-Signature FOUND\x00")
+				} else {
+					io.WriteString(conn, "stream: OK\x00")
+				}
+			}(conn)
+		}
+	}()
+
+	return l
+}
+
+func TestClamd(t *testing.T) {
+	l := fakeClamd(t)
+	defer l.Close()
+
+	c := &Clamd{Network: "tcp", Address: l.Addr().String()}
+
+	// content spanning several chunks.
+	clean := strings.Repeat("harmless ", 2*clamdChunkSize/9)
+	for content, expected := range map[string]Result{
+		"":                {},
+		clean:             {},
+		clean + eicar:     {Infected: true, Signature: "Eicar-Test-Signature"},
+		"prefix " + eicar: {Infected: true, Signature: "Eicar-Test-Signature"},
+	} {
+		result, err := c.Scan(context.Background(), strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *result != expected {
+			t.Errorf("scanning %d bytes returned %+v, expected %+v", len(content), result, expected)
+		}
+	}
+
+	if _, err := parseClamdReply("INSTREAM size limit exceeded. ERROR"); err == nil {
+		t.Error("expected error for clamd error reply")
+	}
+}
+
+func TestExec(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not found")
+	}
+
+	e := &Exec{Path: "sh", Args: []string{"-c", `if grep -q EICAR; then echo Eicar-Test-Signature; exit 1; fi`}}
+	if result, err := e.Scan(context.Background(), strings.NewReader("clean")); err != nil || result.Infected {
+		t.Fatalf("clean content returned %+v, %v", result, err)
+	}
+	if result, err := e.Scan(context.Background(), strings.NewReader(eicar)); err != nil || !result.Infected || result.Signature != "Eicar-Test-Signature" {
+		t.Fatalf("infected content returned %+v, %v", result, err)
+	}
+
+	e = &Exec{Path: "sh", Args: []string{"-c", "echo broken >&2; exit 2"}}
+	if _, err := e.Scan(context.Background(), strings.NewReader("")); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Fatalf("expected error, got %v", err)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, _ := ioutil.ReadAll(r.Body)
+		json.NewEncoder(w).Encode(&Result{Infected: bytes.Contains(content, []byte(eicar)), Signature: "eicar"})
+	}))
+	defer server.Close()
+
+	h := &HTTP{URL: server.URL}
+	if result, err := h.Scan(context.Background(), strings.NewReader(eicar)); err != nil || !result.Infected || result.Signature != "eicar" {
+		t.Fatalf("infected content returned %+v, %v", result, err)
+	}
+	if result, err := h.Scan(context.Background(), strings.NewReader("clean")); err != nil || result.Infected {
+		t.Fatalf("clean content returned %+v, %v", result, err)
+	}
+
+	h = &HTTP{URL: server.URL + "/missing\x00"}
+	if _, err := h.Scan(context.Background(), strings.NewReader("")); err == nil {
+		t.Fatal("expected error for invalid URL")
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/akrennmair/cabinet/basicauth"
+)
+
+// fileSignature returns the signature granting access to a file until the
+// provided expiry time, given as Unix timestamp.
+func fileSignature(key []byte, drawer, filename string, expires int64) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s/%s\n%d", drawer, filename, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// checkSignature verifies the expires and signature parameters of a file
+// request. It reports whether the request is signed at all, and if so,
+// whether the signature is valid and hasn't expired yet.
+func checkSignature(key []byte, r *http.Request, drawer, filename string) (signed, valid bool) {
+	query := r.URL.Query()
+	signature := query.Get("signature")
+	if signature == "" {
+		return false, false
+	}
+
+	if len(key) == 0 {
+		return true, false
+	}
+
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return true, false
+	}
+
+	expected := fileSignature(key, drawer, filename, expires)
+	return true, hmac.Equal([]byte(signature), []byte(expected))
+}
+
+// signHandler creates signed, time-limited URLs for files.
+type signHandler struct {
+	Frontend   string
+	Key        []byte
+	AuthFunc   basicauth.AuthenticatorFunc
+	AccessFunc drawerAccessFunc
+}
+
+const defaultSignatureTTL = 24 * time.Hour
+
+func (h *signHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !basicauth.Authenticate(w, r, h.AuthFunc) {
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if len(h.Key) == 0 {
+		http.Error(w, "URL signing is not configured", http.StatusNotImplemented)
+		return
+	}
+
+	drawerName, filename := r.FormValue("drawer"), r.FormValue("file")
+	if drawerName == "" || !validDrawerName(drawerName) {
+		http.Error(w, "invalid drawer name", http.StatusNotAcceptable)
+		return
+	}
+	if filename == "" {
+		http.Error(w, "no filename specified", http.StatusNotAcceptable)
+		return
+	}
+
+	if !h.AccessFunc.permits(r, drawerName) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	ttl := defaultSignatureTTL
+	if t := r.FormValue("ttl"); t != "" {
+		var err error
+		if ttl, err = time.ParseDuration(t); err != nil || ttl <= 0 {
+			http.Error(w, "invalid ttl", http.StatusNotAcceptable)
+			return
+		}
+	}
+
+	expires := time.Now().Add(ttl).Unix()
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("signature", fileSignature(h.Key, drawerName, filename, expires))
+
+	fmt.Fprintf(w, "%s/%s/%s?%s", h.Frontend, drawerName, filename, query.Encode())
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akrennmair/cabinet/basicauth"
+	"github.com/akrennmair/cabinet/data"
+	"github.com/akrennmair/gouuid"
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const (
+	defaultStoreWorkers      = 4
+	defaultStoreAttempts     = 5
+	defaultStoreJobRetention = 7 * 24 * time.Hour
+)
+
+// storeFetched stores content fetched from uri under a generated name and
+// returns the name and the upload event. Unless ext is set, the extension is
+// taken from the URL. The user metadata and the scanner may be nil.
+func storeFetched(ctx context.Context, db *leveldb.DB, s *uploadScanner, drawer, uri, ext string, content []byte, contentType string, userMetadata *userMetadata, limits drawerLimits) (string, *data.Event, error) {
+	filename := gouuid.New().ShortString()
+	if ext != "" {
+		filename += "." + ext
+	} else if parsedURI, err := url.Parse(uri); err == nil {
+		if n := strings.LastIndex(parsedURI.Path, "."); n != -1 {
+			filename += parsedURI.Path[n:]
+		}
+	}
+
+	metadata := &data.MetaData{
+		ContentType: proto.String(contentType),
+		Source:      proto.String(uri),
+	}
+	if parsedURI, err := url.Parse(uri); err == nil {
+		if name := originalName(parsedURI.Path); name != "" {
+			metadata.OriginalName = proto.String(name)
+		}
+	}
+	if userMetadata != nil {
+		userMetadata.apply(metadata)
+	}
+	event, err := putFile(ctx, db, s, drawer, filename, content, metadata, limits)
+	return filename, event, err
+}
+
+// states of store jobs.
+const (
+	jobPending = "pending"
+	jobRunning = "running"
+	jobDone    = "done"
+	jobFailed  = "failed"
+)
+
+// storeJob is an asynchronous /api/store request. Jobs are persisted as
+// storejob:<id>.
+type storeJob struct {
+	ID       string        `json:"id"`
+	URL      string        `json:"url"`
+	Drawer   string        `json:"drawer"`
+	Ext      string        `json:"ext,omitempty"`
+	Metadata *userMetadata `json:"metadata,omitempty"`
+	Status   string        `json:"status"`
+	Attempts int           `json:"attempts"`
+	Read     int64         `json:"read"`
+	Size     int64         `json:"size"`
+	Result   string        `json:"result,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Created  time.Time     `json:"created"`
+	Updated  time.Time     `json:"updated"`
+}
+
+func storeJobKey(id string) []byte {
+	return []byte("storejob:" + id)
+}
+
+// storeQueue runs store jobs with a pool of workers. Failed fetches are
+// retried with exponential backoff if the failure is temporary. Jobs that
+// were pending or running when the queue was stopped are resumed when it is
+// started again.
+type storeQueue struct {
+	DB       *leveldb.DB
+	Fetcher  *fetcher
+	Frontend string
+	Events   chan<- *data.Event
+
+	// LimitsFunc returns the limits of the drawer a job stores to.
+	LimitsFunc drawerLimitsFunc
+
+	// Scanner scans the fetched files. If nil, they aren't scanned.
+	Scanner *uploadScanner
+
+	Workers     int
+	MaxAttempts int
+
+	// RetryDelay is the delay after the first failed attempt. It doubles
+	// with every further attempt, up to MaxRetryDelay.
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+
+	// Retention is the time after which finished jobs are removed.
+	Retention time.Duration
+
+	mtx     sync.Mutex
+	pending []string
+	active  map[string]*storeJob
+	wakeup  chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// start resumes unfinished jobs and starts the workers.
+func (q *storeQueue) start() error {
+	q.active = make(map[string]*storeJob)
+	q.wakeup = make(chan struct{}, 1)
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+
+	var unfinished []*storeJob
+	if err := q.forEach(func(job *storeJob) {
+		if job.Status == jobPending || job.Status == jobRunning {
+			unfinished = append(unfinished, job)
+		}
+	}); err != nil {
+		return err
+	}
+	sort.Slice(unfinished, func(i, j int) bool {
+		return unfinished[i].Created.Before(unfinished[j].Created)
+	})
+	for _, job := range unfinished {
+		q.pending = append(q.pending, job.ID)
+	}
+	if len(q.pending) > 0 {
+		q.wakeup <- struct{}{}
+	}
+
+	workers := q.Workers
+	if workers == 0 {
+		workers = defaultStoreWorkers
+	}
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+
+	q.wg.Add(1)
+	go q.expire()
+
+	return nil
+}
+
+// stop stops the workers. Jobs that are interrupted are resumed on the next
+// start.
+func (q *storeQueue) stop() {
+	q.cancel()
+	q.wg.Wait()
+}
+
+func (q *storeQueue) forEach(f func(job *storeJob)) error {
+	iterator := q.DB.NewIterator(util.BytesPrefix([]byte("storejob:")), nil)
+	defer iterator.Release()
+	for iterator.Next() {
+		var job storeJob
+		if err := json.Unmarshal(iterator.Value(), &job); err != nil {
+			log.Printf("unmarshalling %s failed: %v", iterator.Key(), err)
+			continue
+		}
+		f(&job)
+	}
+	return iterator.Error()
+}
+
+// enqueue persists a new job and schedules it.
+func (q *storeQueue) enqueue(job *storeJob) error {
+	if err := q.save(job); err != nil {
+		return err
+	}
+
+	q.mtx.Lock()
+	q.pending = append(q.pending, job.ID)
+	q.mtx.Unlock()
+
+	select {
+	case q.wakeup <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// job returns the current state of a job, or nil if it doesn't exist.
+func (q *storeQueue) job(id string) (*storeJob, error) {
+	q.mtx.Lock()
+	if job, found := q.active[id]; found {
+		current := *job
+		q.mtx.Unlock()
+		return &current, nil
+	}
+	q.mtx.Unlock()
+
+	rawJob, err := q.DB.Get(storeJobKey(id), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var job storeJob
+	if err := json.Unmarshal(rawJob, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (q *storeQueue) save(job *storeJob) error {
+	rawJob, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return q.DB.Put(storeJobKey(job.ID), rawJob, nil)
+}
+
+// update changes a job while it is being worked on, and persists it.
+func (q *storeQueue) update(job *storeJob, f func()) {
+	q.mtx.Lock()
+	f()
+	job.Updated = time.Now()
+	current := *job
+	q.mtx.Unlock()
+
+	if err := q.save(&current); err != nil {
+		log.Printf("saving store job %s failed: %v", job.ID, err)
+	}
+}
+
+// next waits for the next pending job. It returns false when the queue is
+// stopped.
+func (q *storeQueue) next() (string, bool) {
+	for {
+		q.mtx.Lock()
+		if len(q.pending) > 0 {
+			id := q.pending[0]
+			q.pending = q.pending[1:]
+			if len(q.pending) > 0 {
+				// let another worker pick up the next job.
+				select {
+				case q.wakeup <- struct{}{}:
+				default:
+				}
+			}
+			q.mtx.Unlock()
+			return id, true
+		}
+		q.mtx.Unlock()
+
+		select {
+		case <-q.wakeup:
+		case <-q.ctx.Done():
+			return "", false
+		}
+	}
+}
+
+func (q *storeQueue) work() {
+	defer q.wg.Done()
+
+	for {
+		id, ok := q.next()
+		if !ok {
+			return
+		}
+		q.run(id)
+	}
+}
+
+func (q *storeQueue) run(id string) {
+	job, err := q.job(id)
+	if err != nil || job == nil {
+		log.Printf("loading store job %s failed: %v", id, err)
+		return
+	}
+
+	q.mtx.Lock()
+	q.active[id] = job
+	q.mtx.Unlock()
+
+	defer func() {
+		q.mtx.Lock()
+		delete(q.active, id)
+		q.mtx.Unlock()
+	}()
+
+	maxAttempts := q.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = defaultStoreAttempts
+	}
+
+	delay := q.RetryDelay
+	for {
+		q.update(job, func() {
+			job.Status = jobRunning
+			job.Attempts++
+			job.Read, job.Size = 0, -1
+		})
+
+		content, contentType, err := q.Fetcher.fetch(q.ctx, job.URL, func(read, total int64) {
+			q.mtx.Lock()
+			job.Read, job.Size = read, total
+			q.mtx.Unlock()
+		})
+		if q.ctx.Err() != nil {
+			// the job is resumed on the next start.
+			q.update(job, func() { job.Status = jobPending; job.Attempts-- })
+			return
+		}
+
+		if err == nil {
+			q.finish(job, content, contentType)
+			return
+		}
+
+		fetchErr, ok := err.(*fetchError)
+		if (ok && !fetchErr.Temporary) || job.Attempts >= maxAttempts {
+			q.update(job, func() { job.Status = jobFailed; job.Error = err.Error() })
+			return
+		}
+
+		log.Printf("store job %s: fetching %s failed, attempt %d of %d: %v", job.ID, job.URL, job.Attempts, maxAttempts, err)
+		q.update(job, func() { job.Status = jobPending; job.Error = err.Error() })
+
+		select {
+		case <-time.After(delay):
+		case <-q.ctx.Done():
+			return
+		}
+		if delay *= 2; delay > q.MaxRetryDelay {
+			delay = q.MaxRetryDelay
+		}
+	}
+}
+
+func (q *storeQueue) finish(job *storeJob, content []byte, contentType string) {
+	filename, event, err := storeFetched(q.ctx, q.DB, q.Scanner, job.Drawer, job.URL, job.Ext, content, contentType, job.Metadata, q.LimitsFunc.limits(job.Drawer))
+	if err != nil && q.ctx.Err() != nil {
+		// the scan was interrupted, the job is resumed on the next start.
+		q.update(job, func() { job.Status = jobPending; job.Attempts-- })
+		return
+	}
+	if le, ok := err.(*limitError); ok {
+		q.update(job, func() { job.Status = jobFailed; job.Error = le.Error() })
+		return
+	} else if err != nil {
+		log.Printf("store job %s: store transaction failed: %v", job.ID, err)
+		q.update(job, func() { job.Status = jobFailed; job.Error = "storing file failed" })
+		return
+	}
+
+	if q.Events != nil {
+		q.Events <- event
+	}
+
+	q.update(job, func() {
+		job.Status = jobDone
+		job.Error = ""
+		job.Result = q.Frontend + "/" + job.Drawer + "/" + filename
+	})
+}
+
+// expire removes finished jobs once they're older than the retention.
+func (q *storeQueue) expire() {
+	defer q.wg.Done()
+
+	retention := q.Retention
+	if retention == 0 {
+		retention = defaultStoreJobRetention
+	}
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		batch := new(leveldb.Batch)
+		if err := q.forEach(func(job *storeJob) {
+			if (job.Status == jobDone || job.Status == jobFailed) && time.Since(job.Updated) > retention {
+				batch.Delete(storeJobKey(job.ID))
+			}
+		}); err != nil {
+			log.Printf("expiring store jobs failed: %v", err)
+		} else if err := q.DB.Write(batch, nil); err != nil {
+			log.Printf("expiring store jobs failed: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-q.ctx.Done():
+			return
+		}
+	}
+}
+
+func (h *uploadFileHandler) storeAsync(w http.ResponseWriter, r *http.Request, uri, drawerName string, userMetadata *userMetadata) {
+	parsedURI, err := url.Parse(uri)
+	if err != nil {
+		http.Error(w, "invalid URL: "+err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	if err := h.Fetcher.checkURL(parsedURI); err != nil {
+		http.Error(w, err.Error(), err.(*fetchError).StatusCode)
+		return
+	}
+
+	now := time.Now()
+	job := &storeJob{
+		ID:       gouuid.New().ShortString(),
+		URL:      uri,
+		Drawer:   drawerName,
+		Ext:      r.Form.Get("ext"),
+		Metadata: userMetadata,
+		Status:   jobPending,
+		Size:     -1,
+		Created:  now,
+		Updated:  now,
+	}
+	if err := h.Jobs.enqueue(job); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("enqueueing store job failed: %v", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", h.Frontend+"/api/store/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job)
+}
+
+// storeJobHandler reports the state of a store job on
+// /api/store/jobs/<id>.
+type storeJobHandler struct {
+	Jobs       *storeQueue
+	AuthFunc   basicauth.AuthenticatorFunc
+	AccessFunc drawerAccessFunc
+}
+
+func (h *storeJobHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !basicauth.Authenticate(w, r, h.AuthFunc) {
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/api/store/jobs/")
+	if id == "" || strings.Contains(id, "/") {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	job, err := h.Jobs.job(id)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("loading store job %s failed: %v", id, err)
+		return
+	}
+	if job == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	if !h.AccessFunc.permits(r, job.Drawer) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		log.Printf("encoding store job %s failed: %v", id, err)
+	}
+}
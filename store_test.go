@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/akrennmair/cabinet/client"
+	"github.com/akrennmair/cabinet/data"
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+func TestStoreAsync(t *testing.T) {
+	parent := newTestParent(t, nil)
+	defer parent.Server.Close()
+
+	var requests int32
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing.txt":
+			http.NotFound(w, r)
+		default:
+			// fail the first request to exercise the retries.
+			if atomic.AddInt32(&requests, 1) == 1 {
+				http.Error(w, "try again", http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("remote content"))
+		}
+	}))
+	defer remote.Close()
+
+	job := storeAsync(t, parent, remote.URL+"/file.txt")
+	if job.Status != jobPending || job.Drawer != "test" {
+		t.Fatalf("unexpected new job %+v", job)
+	}
+
+	job = waitForJob(t, parent, job.ID)
+	if job.Status != jobDone || job.Attempts != 2 || job.Read != int64(len("remote content")) {
+		t.Fatalf("unexpected finished job %+v", job)
+	}
+
+	resp, err := http.Get(job.Result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Location") != remote.URL+"/file.txt" {
+		t.Fatalf("fetching %s returned %d, source %s", job.Result, resp.StatusCode, resp.Header.Get("Content-Location"))
+	}
+
+	// permanent failures aren't retried.
+	job = waitForJob(t, parent, storeAsync(t, parent, remote.URL+"/missing.txt").ID)
+	if job.Status != jobFailed || job.Attempts != 1 || job.Error == "" {
+		t.Fatalf("unexpected failed job %+v", job)
+	}
+
+	req, _ := http.NewRequest("GET", parent.Server.URL+"/api/store/jobs/unknown", nil)
+	req.SetBasicAuth("dummy", "auth")
+	if resp, err := http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	} else if resp.Body.Close(); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("unknown job returned %d", resp.StatusCode)
+	}
+}
+
+func TestStoreJobsResume(t *testing.T) {
+	parent := newTestParent(t, nil)
+	defer parent.Server.Close()
+
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("resumed"))
+	}))
+	defer remote.Close()
+
+	// a job that was interrupted by a shutdown.
+	interrupted := &storeJob{ID: "interrupted", URL: remote.URL + "/file.txt", Drawer: "test", Status: jobRunning, Attempts: 1, Created: time.Now()}
+	if err := parent.Jobs.save(interrupted); err != nil {
+		t.Fatal(err)
+	}
+
+	parent.Jobs.stop()
+	if err := parent.Jobs.start(); err != nil {
+		t.Fatal(err)
+	}
+
+	if job := waitForJob(t, parent, "interrupted"); job.Status != jobDone || job.Attempts != 2 {
+		t.Fatalf("unexpected resumed job %+v", job)
+	}
+}
+
+func TestStoreScanning(t *testing.T) {
+	parent := newTestParent(t, nil)
+	defer parent.Server.Close()
+
+	parent.setScanner(&uploadScanner{Scanner: fakeClamd(t), Kind: "clamd", Timeout: defaultScanTimeout, QuarantineDrawer: "quarantine"})
+
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/eicar.com" {
+			w.Write([]byte(eicar))
+			return
+		}
+		w.Write([]byte("clean"))
+	}))
+	defer remote.Close()
+
+	c := client.New(parent.Server.URL, "dummy", "auth")
+	c.MaxRetries = 0
+	ctx := context.Background()
+
+	file, err := c.Store(ctx, remote.URL+"/clean.txt", "test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawMetaData, err := parent.DB.Get([]byte("meta:test:"+file[len(parent.Server.URL+"/test/"):]), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metadata data.MetaData
+	if err := proto.Unmarshal(rawMetaData, &metadata); err != nil || metadata.GetScan().GetScanner() != "clamd" || metadata.GetScan().GetInfected() {
+		t.Fatalf("unexpected scan result %v: %v", metadata.GetScan(), err)
+	}
+
+	if _, err := c.Store(ctx, remote.URL+"/eicar.com", "test", ""); !errors.Is(err, client.ErrInfected) {
+		t.Fatalf("storing infected file returned %v", err)
+	}
+
+	job := waitForJob(t, parent, storeAsync(t, parent, remote.URL+"/eicar.com").ID)
+	if job.Status != jobFailed || !strings.Contains(job.Error, "Eicar-Test-Signature") {
+		t.Fatalf("unexpected job for infected file %+v", job)
+	}
+
+	var stored, quarantined int
+	iterator := parent.DB.NewIterator(util.BytesPrefix([]byte("file:")), nil)
+	for iterator.Next() {
+		switch {
+		case strings.HasPrefix(string(iterator.Key()), "file:test:"):
+			stored++
+		case strings.HasPrefix(string(iterator.Key()), "file:quarantine:test/"):
+			quarantined++
+		}
+	}
+	iterator.Release()
+	if stored != 1 || quarantined != 2 {
+		t.Fatalf("expected 1 stored and 2 quarantined files, got %d and %d", stored, quarantined)
+	}
+}
+
+func storeAsync(t *testing.T, parent *testParent, uri string) *storeJob {
+	req, _ := http.NewRequest("GET", parent.Server.URL+"/api/store?async=1&drawer=test&url="+url.QueryEscape(uri), nil)
+	req.SetBasicAuth("dummy", "auth")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("async store returned %d", resp.StatusCode)
+	}
+
+	var job storeJob
+	if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+		t.Fatal(err)
+	}
+	if location := resp.Header.Get("Location"); location != parent.Server.URL+"/api/store/jobs/"+job.ID {
+		t.Fatalf("unexpected job location %s", location)
+	}
+	return &job
+}
+
+// waitForJob polls the status of a job until it is finished.
+func waitForJob(t *testing.T, parent *testParent, id string) *storeJob {
+	var job storeJob
+	waitFor(t, "store job "+id, func() bool {
+		req, _ := http.NewRequest("GET", parent.Server.URL+"/api/store/jobs/"+id, nil)
+		req.SetBasicAuth("dummy", "auth")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if err := json.NewDecoder(resp.Body).Decode(&job); err != nil {
+			t.Fatal(err)
+		}
+		return job.Status == jobDone || job.Status == jobFailed
+	})
+	return &job
+}
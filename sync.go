@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/akrennmair/cabinet/client"
+)
+
+// syncAction is a change made, or with -dry-run only printed, by sync.
+type syncAction struct {
+	Action string `json:"action"`
+	Name   string `json:"name"`
+}
+
+func syncCommand(c *cli, fs *flag.FlagSet) func(args []string) error {
+	pull := fs.Bool("pull", false, "download the drawer to the directory instead of uploading the directory")
+	del := fs.Bool("delete", false, "delete files that don't exist in the source")
+	dryRun := fs.Bool("dry-run", false, "only print what would be changed")
+
+	return func(args []string) error {
+		if len(args) != 2 {
+			return errUsage
+		}
+
+		var (
+			actions []syncAction
+			err     error
+		)
+
+		report := func(action, name string) {
+			actions = append(actions, syncAction{Action: action, Name: name})
+			if !c.json {
+				fmt.Fprintf(c.stdout, "%s %s\n", action, name)
+			}
+		}
+
+		if *pull {
+			err = c.syncPull(args[0], args[1], *del, *dryRun, report)
+		} else {
+			err = c.syncPush(args[0], args[1], *del, *dryRun, report)
+		}
+		if err != nil {
+			return err
+		}
+
+		if c.json {
+			if actions == nil {
+				actions = []syncAction{}
+			}
+			return c.printJSON(actions)
+		}
+		return nil
+	}
+}
+
+// syncPush uploads all files in dir whose content differs from the drawer's,
+// and deletes files from the drawer that don't exist in dir if del is set.
+func (c *cli) syncPush(dir, drawer string, del, dryRun bool, report func(action, name string)) error {
+	remote, err := c.listDrawer(drawer)
+	if err != nil {
+		return err
+	}
+
+	local, err := localFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	remoteHashes := make(map[string]string)
+	for _, f := range remote {
+		remoteHashes[f.Name] = f.SHA256
+	}
+
+	for _, name := range sortedNames(local) {
+		if hash, found := remoteHashes[name]; found && hash == local[name] {
+			continue
+		}
+
+		report("upload", name)
+		if dryRun {
+			continue
+		}
+		if err := c.syncUpload(filepath.Join(dir, filepath.FromSlash(name)), drawer, name); err != nil {
+			return err
+		}
+	}
+
+	if !del {
+		return nil
+	}
+
+	for _, f := range remote {
+		if _, found := local[f.Name]; found {
+			continue
+		}
+
+		report("delete", f.Name)
+		if dryRun {
+			continue
+		}
+		if err := c.api.Delete(context.Background(), f.URL); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *cli) syncUpload(fn, drawer, name string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buffered := bufio.NewReaderSize(f, 512)
+	contentType := detectContentType(fn, buffered)
+
+	_, err = c.api.UploadWithOptions(context.Background(), rewound(f, buffered), &client.UploadOptions{
+		Drawer:      drawer,
+		ContentType: contentType,
+		Filename:    filepath.Base(fn),
+		Name:        name,
+	})
+	return err
+}
+
+// syncPull downloads all files from the drawer whose content differs from
+// the files in dir, and deletes files from dir that don't exist in the
+// drawer if del is set.
+func (c *cli) syncPull(drawer, dir string, del, dryRun bool, report func(action, name string)) error {
+	remote, err := c.listDrawer(drawer)
+	if err != nil {
+		return err
+	}
+
+	local, err := localFiles(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	remoteNames := make(map[string]bool)
+
+	for _, f := range remote {
+		remoteNames[f.Name] = true
+
+		if hash, found := local[f.Name]; found && hash == f.SHA256 {
+			continue
+		}
+
+		// names are validated by the server, but a drawer must never be able
+		// to write outside of dir.
+		fn := filepath.Join(dir, filepath.FromSlash(f.Name))
+		if rel, err := filepath.Rel(dir, fn); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("refusing to write %s outside of %s", f.Name, dir)
+		}
+
+		report("download", f.Name)
+		if dryRun {
+			continue
+		}
+		if err := c.syncDownload(f.URL, fn); err != nil {
+			return err
+		}
+	}
+
+	if !del {
+		return nil
+	}
+
+	for _, name := range sortedNames(local) {
+		if remoteNames[name] {
+			continue
+		}
+
+		report("delete", name)
+		if dryRun {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, filepath.FromSlash(name))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// syncDownload downloads a file to a temporary file next to fn, and renames
+// it to fn once it is complete.
+func (c *cli) syncDownload(uri, fn string) error {
+	body, _, err := c.api.Get(context.Background(), uri)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(fn), "."+filepath.Base(fn)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), fn)
+}
+
+// listDrawer returns all files of a drawer, sorted by name.
+func (c *cli) listDrawer(drawer string) ([]client.FileInfo, error) {
+	const pageSize = 1000
+
+	var files []client.FileInfo
+	opts := &client.ListOptions{Limit: pageSize}
+
+	for {
+		page, err := c.api.List(context.Background(), drawer, opts)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, page...)
+		if len(page) < pageSize {
+			return files, nil
+		}
+		opts.After = page[len(page)-1].Name
+	}
+}
+
+// localFiles returns the hex-encoded SHA-256 hashes of all regular files
+// within dir, by their slash-separated paths relative to dir.
+func localFiles(dir string) (map[string]string, error) {
+	files := make(map[string]string)
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		hash := sha256.New()
+		if _, err := io.Copy(hash, f); err != nil {
+			return err
+		}
+
+		files[filepath.ToSlash(rel)] = hex.EncodeToString(hash.Sum(nil))
+		return nil
+	})
+
+	return files, err
+}
+
+func sortedNames(files map[string]string) []string {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSync(t *testing.T) {
+	parent := newTestParent(t, nil)
+	defer parent.Server.Close()
+
+	c := &cli{URL: parent.Server.URL, User: "dummy", Password: "auth"}
+
+	src := t.TempDir()
+	writeTestFiles(t, src, map[string]string{
+		"index.html":    "<html>hello</html>",
+		"css/site.css":  "body { color: red; }",
+		"img/a/b/c.txt": "nested",
+	})
+
+	sync := func(args ...string) []syncAction {
+		t.Helper()
+		out, err := runTestCommand(c, "sync", append([]string{"-json"}, args...)...)
+		if err != nil {
+			t.Fatalf("sync %v failed: %v", args, err)
+		}
+		var actions []syncAction
+		if err := json.Unmarshal([]byte(out), &actions); err != nil {
+			t.Fatalf("decoding output %q failed: %v", out, err)
+		}
+		return actions
+	}
+
+	expectActions := func(actions []syncAction, expected ...syncAction) {
+		t.Helper()
+		if len(expected) == 0 {
+			expected = []syncAction{}
+		}
+		if !reflect.DeepEqual(actions, expected) {
+			t.Fatalf("expected actions %+v, got %+v", expected, actions)
+		}
+	}
+
+	expectActions(sync("-dry-run", src, "site"),
+		syncAction{"upload", "css/site.css"},
+		syncAction{"upload", "img/a/b/c.txt"},
+		syncAction{"upload", "index.html"})
+
+	files, err := c.listDrawer("site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("dry run uploaded files: %+v", files)
+	}
+
+	expectActions(sync(src, "site"),
+		syncAction{"upload", "css/site.css"},
+		syncAction{"upload", "img/a/b/c.txt"},
+		syncAction{"upload", "index.html"})
+	expectActions(sync(src, "site"))
+
+	writeTestFiles(t, src, map[string]string{"index.html": "<html>changed</html>"})
+	if err := os.Remove(filepath.Join(src, "css/site.css")); err != nil {
+		t.Fatal(err)
+	}
+
+	expectActions(sync(src, "site"), syncAction{"upload", "index.html"})
+	expectActions(sync("-delete", src, "site"), syncAction{"delete", "css/site.css"})
+
+	dst := filepath.Join(t.TempDir(), "public")
+	writeTestFiles(t, dst, map[string]string{
+		"index.html": "<html>old</html>",
+		"stale.txt":  "stale",
+	})
+
+	expectActions(sync("-pull", "-delete", "site", dst),
+		syncAction{"download", "img/a/b/c.txt"},
+		syncAction{"download", "index.html"},
+		syncAction{"delete", "stale.txt"})
+
+	hashes, err := localFiles(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedHashes, err := localFiles(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(hashes, expectedHashes) {
+		t.Fatalf("pulled files %v don't match %v", hashes, expectedHashes)
+	}
+}
+
+func TestValidFileName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"index.html":       true,
+		"css/site.css":     true,
+		"a/b/c/d.tar.gz":   true,
+		"":                 false,
+		"/etc/passwd":      false,
+		"a//b":             false,
+		"a/../b":           false,
+		"./a":              false,
+		"dir/":             false,
+		"with space.txt":   false,
+		"query?string.txt": false,
+	} {
+		if validFileName(name) != valid {
+			t.Errorf("validFileName(%q) returned %t, expected %t", name, !valid, valid)
+		}
+	}
+}
+
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		fn := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves a TLS certificate and key from files, and reloads
+// them whenever one of the files changes.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mtx     sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// latestModTime returns the most recent modification time of the
+// certificate and key file.
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, fn := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			return latest, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) reload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mtx.Unlock()
+
+	return nil
+}
+
+// maybeReload reloads the certificate if the files have been modified since
+// they were last loaded.
+func (r *certReloader) maybeReload() error {
+	modTime, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	r.mtx.RLock()
+	changed := !modTime.Equal(r.modTime)
+	r.mtx.RUnlock()
+
+	if !changed {
+		return nil
+	}
+
+	if err := r.reload(); err != nil {
+		return err
+	}
+	log.Printf("Reloaded TLS certificate from %s", r.certFile)
+	return nil
+}
+
+// watch checks for modified certificate files in the provided interval
+// until quit is closed.
+func (r *certReloader) watch(interval time.Duration, quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.maybeReload(); err != nil {
+				log.Printf("Reloading TLS certificate failed, keeping the old one: %v", err)
+			}
+		case <-quit:
+			return
+		}
+	}
+}
+
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.cert, nil
+}
+
+// loadCertPool loads a PEM-encoded CA bundle.
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// serverTLSConfig returns the TLS configuration for serving HTTPS. When a
+// client CA bundle is provided, client certificates are verified against
+// it if the client presents one.
+func serverTLSConfig(certs *certReloader, clientCAFile string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return cfg, nil
+}
+
+// clientTLSConfig returns the TLS configuration the replicator uses to
+// connect to its parent. Both the CA bundle and the client certificate are
+// optional.
+func clientTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		if certFile == "" || keyFile == "" {
+			return nil, errors.New("both client certificate and key are required")
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
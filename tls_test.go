@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert creates a certificate signed by parent, or a self-signed CA
+// certificate if parent is nil.
+func newTestCert(t *testing.T, cn string, parent *testCert, usage x509.ExtKeyUsage) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer := &testCert{cert: tmpl, key: key}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		tmpl.ExtKeyUsage = nil
+		tmpl.IPAddresses = nil
+	} else {
+		signer = parent
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer.cert, &key.PublicKey, signer.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{cert: cert, key: key}
+}
+
+// writeFiles writes certificate and key as PEM files to dir, and returns
+// their paths.
+func (c *testCert) writeFiles(t *testing.T, dir, name string) (certFile, keyFile string) {
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+	if err := os.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+
+	ca := newTestCert(t, "test CA", nil, 0)
+	first := newTestCert(t, "first", ca, x509.ExtKeyUsageServerAuth)
+	second := newTestCert(t, "second", ca, x509.ExtKeyUsageServerAuth)
+
+	certFile, keyFile := first.writeFiles(t, dir, "server")
+
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := certs.GetCertificate(nil)
+	if cn := cert.Leaf.Subject.CommonName; cn != "first" {
+		t.Fatalf("expected certificate first, got %s instead.", cn)
+	}
+
+	second.writeFiles(t, dir, "server")
+	future := time.Now().Add(time.Minute)
+	for _, fn := range []string{certFile, keyFile} {
+		if err := os.Chtimes(fn, future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := certs.maybeReload(); err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ = certs.GetCertificate(nil)
+	if cn := cert.Leaf.Subject.CommonName; cn != "second" {
+		t.Fatalf("expected certificate second, got %s instead.", cn)
+	}
+}
+
+func TestReplicationMTLS(t *testing.T) {
+	dir := t.TempDir()
+
+	ca := newTestCert(t, "test CA", nil, 0)
+	caFile, _ := ca.writeFiles(t, dir, "ca")
+	serverCertFile, serverKeyFile := newTestCert(t, "parent", ca, x509.ExtKeyUsageServerAuth).writeFiles(t, dir, "parent")
+	clientCertFile, clientKeyFile := newTestCert(t, "child", ca, x509.ExtKeyUsageClientAuth).writeFiles(t, dir, "child")
+
+	certs, err := newCertReloader(serverCertFile, serverKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig, err := serverTLSConfig(certs, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parent := newTestParent(t, serverConfig)
+	defer parent.Server.Close()
+	parent.Repl.RequireClientCert = true
+
+	anonymousConfig, err := clientTLSConfig(caFile, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err := clientTLSConfig(caFile, clientCertFile, clientKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a child without client certificate must not be able to replicate.
+	anonymousDB, anonymous := newTestChild(t, parent.Server.URL, anonymousConfig)
+	defer anonymous.stop()
+
+	childDB, child := newTestChild(t, parent.Server.URL, clientConfig)
+	defer child.stop()
+
+	uploadClient := &http.Client{Transport: &http.Transport{TLSClientConfig: anonymousConfig}}
+	fileURL := parent.upload(t, uploadClient, "test", "text/plain", "hello world!")
+	key := []byte("file:test:" + fileURL[len(parent.Server.URL+"/test/"):])
+
+	waitFor(t, "replicated file", func() bool {
+		content, err := childDB.Get(key, nil)
+		return err == nil && string(content) == "hello world!"
+	})
+
+	if _, err := anonymousDB.Get(key, nil); err == nil {
+		t.Fatal("child without client certificate replicated file.")
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akrennmair/cabinet/basicauth"
+	"github.com/akrennmair/cabinet/data"
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Trashed files are stored in trash:<drawer>:<filename>, their metadata in
+// tmeta:<drawer>:<filename>. A name is never used by a file and a trashed
+// file at the same time: uploads replace trashed files like existing ones.
+var (
+	errNotTrashed = errors.New("file isn't in the trash")
+	errFileExists = errors.New("a file of the same name exists")
+)
+
+// moveToTrash adds moving a file to the trash to batch, and returns its
+// content, or nil if the file doesn't exist. Trashed files don't count
+// towards the usage of their drawer.
+func moveToTrash(db *leveldb.DB, batch *leveldb.Batch, drawer, filename string, deleted time.Time) ([]byte, error) {
+	content, err := db.Get([]byte("file:"+drawer+":"+filename), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var metadata data.MetaData
+	if rawMetaData, err := db.Get([]byte("meta:"+drawer+":"+filename), nil); err == nil {
+		if err := proto.Unmarshal(rawMetaData, &metadata); err != nil {
+			return nil, err
+		}
+	} else if err != leveldb.ErrNotFound {
+		return nil, err
+	}
+	if metadata.ContentType == nil {
+		metadata.ContentType = proto.String("application/octet-stream")
+	}
+	metadata.Deleted = proto.Int64(deleted.Unix())
+	rawMetaData, err := proto.Marshal(&metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := indexTags(db, batch, drawer, filename, nil); err != nil {
+		return nil, err
+	}
+	batch.Put([]byte("trash:"+drawer+":"+filename), content)
+	batch.Put([]byte("tmeta:"+drawer+":"+filename), rawMetaData)
+	batch.Delete([]byte("file:" + drawer + ":" + filename))
+	batch.Delete([]byte("meta:" + drawer + ":" + filename))
+
+	return content, nil
+}
+
+// restoreFromTrash adds moving a trashed file back to its drawer to batch,
+// and returns its content. It fails with errNotTrashed if the file isn't in
+// the trash, and with errFileExists if another file took its name.
+func restoreFromTrash(db *leveldb.DB, batch *leveldb.Batch, drawer, filename string) ([]byte, error) {
+	if found, err := db.Has([]byte("file:"+drawer+":"+filename), nil); err != nil {
+		return nil, err
+	} else if found {
+		return nil, errFileExists
+	}
+
+	content, err := db.Get([]byte("trash:"+drawer+":"+filename), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, errNotTrashed
+	} else if err != nil {
+		return nil, err
+	}
+
+	var metadata data.MetaData
+	if rawMetaData, err := db.Get([]byte("tmeta:"+drawer+":"+filename), nil); err == nil {
+		if err := proto.Unmarshal(rawMetaData, &metadata); err != nil {
+			return nil, err
+		}
+	} else if err != leveldb.ErrNotFound {
+		return nil, err
+	}
+	if metadata.ContentType == nil {
+		metadata.ContentType = proto.String("application/octet-stream")
+	}
+	metadata.Deleted = nil
+	rawMetaData, err := proto.Marshal(&metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := indexTags(db, batch, drawer, filename, metadata.Tags); err != nil {
+		return nil, err
+	}
+	batch.Put([]byte("file:"+drawer+":"+filename), content)
+	batch.Put([]byte("meta:"+drawer+":"+filename), rawMetaData)
+	batch.Delete([]byte("trash:" + drawer + ":" + filename))
+	batch.Delete([]byte("tmeta:" + drawer + ":" + filename))
+
+	return content, nil
+}
+
+// trashFile moves a file to the trash together with a trash event, which is
+// returned so that the caller can pass it on to the dispatcher. It returns
+// leveldb.ErrNotFound if the file doesn't exist.
+func trashFile(db *leveldb.DB, drawer, filename string) (*data.Event, error) {
+	var event *data.Event
+	var removed []byte
+	err := writeWithUsage(db, drawer, drawerLimits{}, func(batch *leveldb.Batch) (drawerUsage, error) {
+		var err error
+		removed, err = moveToTrash(db, batch, drawer, filename, time.Now())
+		if err != nil {
+			return drawerUsage{}, err
+		}
+		if removed == nil {
+			return drawerUsage{}, leveldb.ErrNotFound
+		}
+
+		eventKey := "event:" + strconv.FormatInt(time.Now().UnixNano(), 10)
+		event = &data.Event{
+			Type:     data.Event_TRASH.Enum(),
+			Drawer:   proto.String(drawer),
+			Filename: proto.String(filename),
+			Id:       proto.String(eventKey),
+		}
+		eventData, err := proto.Marshal(event)
+		if err != nil {
+			return drawerUsage{}, err
+		}
+		batch.Put([]byte(eventKey), eventData)
+		batch.Put([]byte("latest_event"), []byte(eventKey))
+
+		return drawerUsage{Bytes: -int64(len(removed)), Files: -1}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	fileRemoved(drawer, len(removed))
+
+	return event, nil
+}
+
+// purgeTrash deletes the files that were trashed before deadline for good,
+// and returns their delete events.
+func purgeTrash(db *leveldb.DB, deadline time.Time) ([]*data.Event, error) {
+	var (
+		purged []string
+		events []*data.Event
+	)
+
+	iterator := db.NewIterator(util.BytesPrefix([]byte("tmeta:")), nil)
+	for iterator.Next() {
+		var metadata data.MetaData
+		if err := proto.Unmarshal(iterator.Value(), &metadata); err != nil {
+			log.Printf("unmarshalling %s failed: %v", iterator.Key(), err)
+			continue
+		}
+		if time.Unix(metadata.GetDeleted(), 0).Before(deadline) {
+			purged = append(purged, strings.TrimPrefix(string(iterator.Key()), "tmeta:"))
+		}
+	}
+	iterator.Release()
+	if err := iterator.Error(); err != nil {
+		return nil, err
+	}
+
+	for _, key := range purged {
+		fields := strings.SplitN(key, ":", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		event, err := purgeFile(db, fields[0], fields[1], deadline)
+		if err == errNotTrashed {
+			// undeleted or replaced since the trash was scanned.
+			continue
+		} else if err != nil {
+			return events, err
+		}
+		log.Printf("purged %s:%s from the trash", fields[0], fields[1])
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// purgeFile deletes a trashed file and its old versions together with a
+// delete event, which is returned so that the caller can pass it on to the
+// dispatcher. It returns errNotTrashed unless the file is still in the trash
+// and was trashed before deadline.
+func purgeFile(db *leveldb.DB, drawer, filename string, deadline time.Time) (*data.Event, error) {
+	var event *data.Event
+	err := writeWithUsage(db, drawer, drawerLimits{}, func(batch *leveldb.Batch) (drawerUsage, error) {
+		rawMetaData, err := db.Get([]byte("tmeta:"+drawer+":"+filename), nil)
+		if err == leveldb.ErrNotFound {
+			return drawerUsage{}, errNotTrashed
+		} else if err != nil {
+			return drawerUsage{}, err
+		}
+		var metadata data.MetaData
+		if err := proto.Unmarshal(rawMetaData, &metadata); err != nil {
+			return drawerUsage{}, err
+		}
+		if !time.Unix(metadata.GetDeleted(), 0).Before(deadline) {
+			return drawerUsage{}, errNotTrashed
+		}
+
+		if err := deleteVersions(db, batch, drawer, filename); err != nil {
+			return drawerUsage{}, err
+		}
+		batch.Delete([]byte("trash:" + drawer + ":" + filename))
+		batch.Delete([]byte("tmeta:" + drawer + ":" + filename))
+
+		eventKey := "event:" + strconv.FormatInt(time.Now().UnixNano(), 10)
+		event = &data.Event{
+			Type:     data.Event_DELETE.Enum(),
+			Drawer:   proto.String(drawer),
+			Filename: proto.String(filename),
+			Id:       proto.String(eventKey),
+		}
+		eventData, err := proto.Marshal(event)
+		if err != nil {
+			return drawerUsage{}, err
+		}
+		batch.Put([]byte(eventKey), eventData)
+		batch.Put([]byte("latest_event"), []byte(eventKey))
+
+		// trashed files don't count towards the usage.
+		return drawerUsage{}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// trashHandler lists the trashed files of a drawer at /api/trash/<drawer>,
+// and restores trashed files with POST /api/undelete/<drawer>/<filename>.
+type trashHandler struct {
+	DB         *leveldb.DB
+	Events     chan<- *data.Event
+	AuthFunc   basicauth.AuthenticatorFunc
+	AccessFunc drawerAccessFunc
+
+	// LimitsFunc returns the limits of a drawer. Undeleted files count
+	// towards its quota again.
+	LimitsFunc drawerLimitsFunc
+
+	// RetentionFunc returns how long trashed files are kept.
+	RetentionFunc func() time.Duration
+}
+
+type trashedFile struct {
+	Name         string `json:"name"`
+	Drawer       string `json:"drawer"`
+	Size         int64  `json:"size"`
+	ContentType  string `json:"content_type"`
+	OriginalName string `json:"original_name,omitempty"`
+	Version      int64  `json:"version"`
+	Deleted      int64  `json:"deleted"`
+	Purge        int64  `json:"purge"`
+}
+
+func (h *trashHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !basicauth.Authenticate(w, r, h.AuthFunc) {
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/api/trash/"):
+		drawer := strings.TrimPrefix(r.URL.Path, "/api/trash/")
+		if drawer == "" || !validDrawerName(drawer) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if !h.AccessFunc.permits(r, drawer) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		if r.Method != "GET" {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		h.list(w, drawer)
+
+	case strings.HasPrefix(r.URL.Path, "/api/undelete/"):
+		uriParts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/api/undelete/"), "/", 2)
+		if len(uriParts) != 2 || uriParts[0] == "" || uriParts[1] == "" {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if !h.AccessFunc.permits(r, uriParts[0]) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		h.undelete(w, uriParts[0], uriParts[1])
+
+	default:
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	}
+}
+
+func (h *trashHandler) list(w http.ResponseWriter, drawer string) {
+	var retention time.Duration
+	if h.RetentionFunc != nil {
+		retention = h.RetentionFunc()
+	}
+
+	files := []trashedFile{}
+
+	prefix := "trash:" + drawer + ":"
+	iterator := h.DB.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iterator.Release()
+	for iterator.Next() {
+		filename := strings.TrimPrefix(string(iterator.Key()), prefix)
+		file := trashedFile{
+			Name:        filename,
+			Drawer:      drawer,
+			Size:        int64(len(iterator.Value())),
+			ContentType: "application/octet-stream",
+		}
+
+		var metadata data.MetaData
+		if rawMetaData, err := h.DB.Get([]byte("tmeta:"+drawer+":"+filename), nil); err == nil {
+			if err := proto.Unmarshal(rawMetaData, &metadata); err != nil {
+				log.Printf("proto.Unmarshal of metadata for trashed %s:%s failed: %v", drawer, filename, err)
+			}
+		}
+		if metadata.ContentType != nil {
+			file.ContentType = metadata.GetContentType()
+		}
+		file.OriginalName = metadata.GetOriginalName()
+		file.Version = currentVersion(&metadata)
+		file.Deleted = metadata.GetDeleted()
+		file.Purge = time.Unix(file.Deleted, 0).Add(retention).Unix()
+
+		files = append(files, file)
+	}
+	if err := iterator.Error(); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("listing trash of %s failed: %v", drawer, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(files); err != nil {
+		log.Printf("encoding trash failed: %v", err)
+	}
+}
+
+// undelete restores a trashed file with an undelete event.
+func (h *trashHandler) undelete(w http.ResponseWriter, drawer, filename string) {
+	var event *data.Event
+	var restored []byte
+	err := writeWithUsage(h.DB, drawer, h.LimitsFunc.limits(drawer), func(batch *leveldb.Batch) (drawerUsage, error) {
+		var err error
+		if restored, err = restoreFromTrash(h.DB, batch, drawer, filename); err != nil {
+			return drawerUsage{}, err
+		}
+
+		eventKey := "event:" + strconv.FormatInt(time.Now().UnixNano(), 10)
+		event = &data.Event{
+			Type:     data.Event_UNDELETE.Enum(),
+			Drawer:   proto.String(drawer),
+			Filename: proto.String(filename),
+			Id:       proto.String(eventKey),
+		}
+		eventData, err := proto.Marshal(event)
+		if err != nil {
+			return drawerUsage{}, err
+		}
+		batch.Put([]byte(eventKey), eventData)
+		batch.Put([]byte("latest_event"), []byte(eventKey))
+
+		return drawerUsage{Bytes: int64(len(restored)), Files: 1}, nil
+	})
+	switch err {
+	case nil:
+	case errNotTrashed:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errFileExists:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	default:
+		if le, ok := err.(*limitError); ok {
+			http.Error(w, le.Error(), limitStatus(err))
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("undeleting %s:%s failed: %v", drawer, filename, err)
+		return
+	}
+
+	fileAdded(drawer, len(restored))
+
+	if h.Events != nil {
+		h.Events <- event
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akrennmair/cabinet/client"
+	"github.com/akrennmair/cabinet/data"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestTrash(t *testing.T) {
+	parent := newTestParent(t, nil)
+	defer parent.Server.Close()
+
+	childDB, r := newTestChild(t, parent.Server.URL, nil)
+	defer r.stop()
+
+	parent.File.TrashRetention = func() time.Duration { return time.Hour }
+
+	c := client.New(parent.Server.URL, "dummy", "auth")
+	c.MaxRetries = 0
+	ctx := context.Background()
+
+	upload := func(content string) string {
+		t.Helper()
+		file, err := c.UploadWithOptions(ctx, strings.NewReader(content), &client.UploadOptions{Drawer: "docs", Name: "report.txt", Tags: []string{"draft"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	file := upload("report")
+	waitFor(t, "replicated upload", func() bool {
+		has, _ := childDB.Has([]byte("file:docs:report.txt"), nil)
+		return has
+	})
+
+	if err := c.Delete(ctx, file); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Stat(ctx, file); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("trashed file returned %v", err)
+	}
+	if hasTaggedFile(parent.DB, "docs", "report.txt", "draft") {
+		t.Fatal("trashed file is still tagged")
+	}
+	if usage, _ := readUsage(parent.DB, "docs"); usage.Files != 0 {
+		t.Fatalf("trashed file is still counted: %+v", usage)
+	}
+	waitFor(t, "replicated trash", func() bool {
+		hasFile, _ := childDB.Has([]byte("file:docs:report.txt"), nil)
+		trashed, _ := childDB.Has([]byte("trash:docs:report.txt"), nil)
+		return !hasFile && trashed
+	})
+
+	trash, err := c.Trash(ctx, "docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 1 || trash[0].Name != "report.txt" || trash[0].Deleted == 0 {
+		t.Fatalf("unexpected trash %+v", trash)
+	}
+
+	if err := c.Undelete(ctx, file); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := c.Stat(ctx, file); err != nil || info.Size != int64(len("report")) {
+		t.Fatalf("undeleted file returned %+v, %v", info, err)
+	}
+	if !hasTaggedFile(parent.DB, "docs", "report.txt", "draft") {
+		t.Fatal("undeleted file isn't tagged")
+	}
+	var apiErr *client.Error
+	if err := c.Undelete(ctx, file); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusConflict {
+		t.Fatalf("undeleting an existing file returned %v", err)
+	}
+	waitFor(t, "replicated undelete", func() bool {
+		hasFile, _ := childDB.Has([]byte("file:docs:report.txt"), nil)
+		trashed, _ := childDB.Has([]byte("trash:docs:report.txt"), nil)
+		return hasFile && !trashed
+	})
+
+	// uploads replace trashed files.
+	if err := c.Delete(ctx, file); err != nil {
+		t.Fatal(err)
+	}
+	upload("new report")
+	if has, _ := parent.DB.Has([]byte("trash:docs:report.txt"), nil); has {
+		t.Fatal("replaced file is still in the trash")
+	}
+	if info, err := c.Stat(ctx, file); err != nil || info.Version != 2 {
+		t.Fatalf("replacing file returned %+v, %v", info, err)
+	}
+
+	// the purge deletes trashed files for good, also on children.
+	if err := c.Delete(ctx, file); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "replicated trash", func() bool {
+		return caughtUp(parent.DB, childDB)
+	})
+	if events, err := purgeTrash(parent.DB, time.Now().Add(-time.Hour)); err != nil || len(events) != 0 {
+		t.Fatalf("purging before the retention returned %v, %v", events, err)
+	}
+	events, err := purgeTrash(parent.DB, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].GetType() != data.Event_DELETE {
+		t.Fatalf("unexpected purge events %v", events)
+	}
+	parent.Events <- events[0]
+	waitFor(t, "replicated purge", func() bool {
+		trashed, _ := childDB.Has([]byte("trash:docs:report.txt"), nil)
+		return !trashed
+	})
+	if err := c.Undelete(ctx, file); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("undeleting a purged file returned %v", err)
+	}
+	for _, db := range []*leveldb.DB{parent.DB, childDB} {
+		if usage, _ := readUsage(db, "docs"); usage.Files != 0 || usage.Bytes != 0 {
+			t.Fatalf("purged file changed the usage: %+v", usage)
+		}
+	}
+
+	// without retention, files are deleted immediately.
+	parent.File.TrashRetention = nil
+	file = upload("report")
+	if err := c.Delete(ctx, file); err != nil {
+		t.Fatal(err)
+	}
+	if trash, err := c.Trash(ctx, "docs"); err != nil || len(trash) != 0 {
+		t.Fatalf("trash contains %+v, %v", trash, err)
+	}
+	waitFor(t, "replicated delete", func() bool {
+		return caughtUp(parent.DB, childDB)
+	})
+
+	if resp := drawerRequest(t, parent, "GET", "/api/undelete/docs/report.txt", ""); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("GET on undelete returned %d", resp.StatusCode)
+	}
+
+	for _, db := range []*leveldb.DB{parent.DB, childDB} {
+		if problems, err := fsck(db, false); err != nil || len(problems) != 0 {
+			t.Fatalf("fsck found %v, %v", problems, err)
+		}
+	}
+}
+
+func TestUndeleteQuota(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	limitsFunc := func(drawer string) drawerLimits {
+		return drawerLimits{MaxFiles: 1}
+	}
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	mux.Handle("/api/upload", &uploadFileHandler{DB: db, Frontend: server.URL, AuthFunc: authFunc, LimitsFunc: limitsFunc})
+	mux.Handle("/api/undelete/", &trashHandler{DB: db, AuthFunc: authFunc, LimitsFunc: limitsFunc})
+	mux.Handle("/", &fileHandler{DB: db, AuthFunc: authFunc, TrashRetention: func() time.Duration { return time.Hour }})
+
+	c := client.New(server.URL, "dummy", "auth")
+	c.MaxRetries = 0
+	ctx := context.Background()
+
+	first, err := c.Upload(ctx, strings.NewReader("first"), "text/plain", "small", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Upload(ctx, strings.NewReader("second"), "text/plain", "small", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Undelete(ctx, first); !errors.Is(err, client.ErrQuotaExceeded) {
+		t.Fatalf("undeleting into a full drawer returned %v", err)
+	}
+	if usage, _ := readUsage(db, "small"); usage.Files != 1 {
+		t.Fatalf("undelete changed the usage: %+v", usage)
+	}
+	if has, _ := db.Has([]byte("trash:small:"+first[len(server.URL+"/small/"):]), nil); !has {
+		t.Fatal("file was taken out of the trash")
+	}
+}
+
+func TestPurgeRecheck(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	for _, filename := range []string{"replaced", "undeleted"} {
+		if _, err := putFile(ctx, db, nil, "test", filename, []byte("old"), &data.MetaData{}, drawerLimits{}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := trashFile(db, "test", filename); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the files leave the trash after they were found to be expired.
+	deadline := time.Now().Add(time.Second)
+	if _, err := putFile(ctx, db, nil, "test", "replaced", []byte("new"), &data.MetaData{}, drawerLimits{}); err != nil {
+		t.Fatal(err)
+	}
+	batch := new(leveldb.Batch)
+	if _, err := restoreFromTrash(db, batch, "test", "undeleted"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Write(batch, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, filename := range []string{"replaced", "undeleted"} {
+		if _, err := purgeFile(db, "test", filename, deadline); err != errNotTrashed {
+			t.Fatalf("purging %s returned %v", filename, err)
+		}
+		if has, _ := db.Has([]byte("file:test:"+filename), nil); !has {
+			t.Fatalf("%s was deleted", filename)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/akrennmair/cabinet/basicauth"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// drawerUsage is the number of bytes and files in a drawer. The running
+// totals are stored as usage:<drawer> and updated in the same batch as the
+// files.
+type drawerUsage struct {
+	Bytes int64 `json:"bytes"`
+	Files int64 `json:"files"`
+}
+
+// drawerLimits restricts the size of a drawer and its files. Zero values
+// don't restrict anything.
+type drawerLimits struct {
+	MaxBytes    int64 `json:"max_bytes,omitempty"`
+	MaxFiles    int64 `json:"max_files,omitempty"`
+	MaxFileSize int64 `json:"max_file_size,omitempty"`
+
+	// ContentTypes and DenyContentTypes restrict the content types of
+	// files, see drawerRecord.
+	ContentTypes     []string `json:"content_types,omitempty"`
+	DenyContentTypes []string `json:"deny_content_types,omitempty"`
+
+	// Undefined refuses all uploads, because the drawer wasn't created
+	// although explicit_drawers is enabled.
+	Undefined bool `json:"-"`
+}
+
+// drawerLimitsFunc returns the limits of a drawer.
+type drawerLimitsFunc func(drawer string) drawerLimits
+
+// limits returns the limits of drawer. A nil drawerLimitsFunc doesn't
+// restrict anything.
+func (f drawerLimitsFunc) limits(drawer string) drawerLimits {
+	if f == nil {
+		return drawerLimits{}
+	}
+	return f(drawer)
+}
+
+// limitError is returned when a write would exceed a drawer's limits, or
+// when the scanner rejects it.
+type limitError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *limitError) Error() string {
+	return e.Message
+}
+
+// checkFileSize returns an error if a file of size bytes exceeds the maximum
+// file size.
+func (l drawerLimits) checkFileSize(size int64) error {
+	if l.MaxFileSize > 0 && size > l.MaxFileSize {
+		return &limitError{StatusCode: http.StatusRequestEntityTooLarge, Message: fmt.Sprintf("file is larger than the maximum of %d bytes", l.MaxFileSize)}
+	}
+	return nil
+}
+
+// checkContentType returns an error if files of contentType aren't allowed.
+// Denied types take precedence over allowed ones.
+func (l drawerLimits) checkContentType(contentType string) error {
+	if matchContentType(l.DenyContentTypes, contentType) || len(l.ContentTypes) > 0 && !matchContentType(l.ContentTypes, contentType) {
+		return &limitError{StatusCode: http.StatusUnsupportedMediaType, Message: fmt.Sprintf("content type %q isn't allowed", contentType)}
+	}
+	return nil
+}
+
+// checkQuota returns an error if adding delta to usage exceeds the quota,
+// or if the drawer is undefined. Writes that don't increase the usage are
+// always allowed, so that drawers over quota can be cleaned up.
+func (l drawerLimits) checkQuota(usage, delta drawerUsage) error {
+	if l.Undefined {
+		return &limitError{StatusCode: http.StatusNotFound, Message: "drawer doesn't exist"}
+	}
+	if l.MaxBytes > 0 && delta.Bytes > 0 && usage.Bytes+delta.Bytes > l.MaxBytes {
+		return &limitError{StatusCode: http.StatusInsufficientStorage, Message: fmt.Sprintf("drawer quota of %d bytes exceeded", l.MaxBytes)}
+	}
+	if l.MaxFiles > 0 && delta.Files > 0 && usage.Files+delta.Files > l.MaxFiles {
+		return &limitError{StatusCode: http.StatusInsufficientStorage, Message: fmt.Sprintf("drawer quota of %d files exceeded", l.MaxFiles)}
+	}
+	return nil
+}
+
+// limitStatus returns the status code to respond with for err.
+func limitStatus(err error) int {
+	if le, ok := err.(*limitError); ok {
+		return le.StatusCode
+	}
+	return http.StatusInternalServerError
+}
+
+func usageKey(drawer string) []byte {
+	return []byte("usage:" + drawer)
+}
+
+// usageMtx serializes the writes that change the usage counters, from
+// reading the files they replace or remove until the batch with the new
+// usage is written.
+var usageMtx sync.Mutex
+
+func readUsage(db *leveldb.DB, drawer string) (drawerUsage, error) {
+	var usage drawerUsage
+	rawUsage, err := db.Get(usageKey(drawer), nil)
+	if err == leveldb.ErrNotFound {
+		return usage, nil
+	} else if err != nil {
+		return usage, err
+	}
+	err = json.Unmarshal(rawUsage, &usage)
+	return usage, err
+}
+
+// writeWithUsage runs prepare, which adds the changes of a write to batch
+// and returns the resulting change of the usage of drawer, and writes batch
+// together with the new usage. prepare runs with usageMtx held, so the files
+// it reads can't change before the batch is written. If prepare fails,
+// nothing is written and its error is returned. If the new usage exceeds the
+// quota in limits, nothing is written and a *limitError is returned.
+func writeWithUsage(db *leveldb.DB, drawer string, limits drawerLimits, prepare func(batch *leveldb.Batch) (drawerUsage, error)) error {
+	usageMtx.Lock()
+	defer usageMtx.Unlock()
+
+	batch := new(leveldb.Batch)
+	delta, err := prepare(batch)
+	if err != nil {
+		return err
+	}
+
+	usage, err := readUsage(db, drawer)
+	if err != nil {
+		return err
+	}
+	if err := limits.checkQuota(usage, delta); err != nil {
+		return err
+	}
+
+	usage.Bytes += delta.Bytes
+	usage.Files += delta.Files
+	rawUsage, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	batch.Put(usageKey(drawer), rawUsage)
+
+	return db.Write(batch, nil)
+}
+
+// computeUsage counts the bytes and files of all drawers.
+func computeUsage(db *leveldb.DB) (map[string]drawerUsage, error) {
+	usage := make(map[string]drawerUsage)
+
+	iterator := db.NewIterator(util.BytesPrefix([]byte("file:")), nil)
+	defer iterator.Release()
+	for iterator.Next() {
+		fields := strings.SplitN(string(iterator.Key()), ":", 3)
+		if len(fields) != 3 || strings.Contains(fields[2], ":") {
+			// files of drawers with colons in their names, see
+			// colonProblem.
+			continue
+		}
+		u := usage[fields[1]]
+		u.Bytes += int64(len(iterator.Value()))
+		u.Files++
+		usage[fields[1]] = u
+	}
+	return usage, iterator.Error()
+}
+
+// initUsage computes the usage counters of databases that were created
+// before they were introduced.
+func initUsage(db *leveldb.DB) error {
+	iterator := db.NewIterator(util.BytesPrefix([]byte("usage:")), nil)
+	found := iterator.Next()
+	iterator.Release()
+	if found {
+		return iterator.Error()
+	}
+
+	usage, err := computeUsage(db)
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	for drawer, u := range usage {
+		rawUsage, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+		batch.Put(usageKey(drawer), rawUsage)
+	}
+	if batch.Len() > 0 {
+		log.Printf("Initialized usage counters of %d drawers", batch.Len())
+	}
+	return db.Write(batch, nil)
+}
+
+// usageInfo is the usage of a drawer as returned by /api/usage.
+type usageInfo struct {
+	Drawer string `json:"drawer"`
+	drawerUsage
+	Limits drawerLimits `json:"limits"`
+}
+
+// usageHandler reports the usage and limits of all drawers the user can
+// access, or of the drawer given as parameter.
+type usageHandler struct {
+	DB         *leveldb.DB
+	AuthFunc   basicauth.AuthenticatorFunc
+	AccessFunc drawerAccessFunc
+	LimitsFunc drawerLimitsFunc
+}
+
+func (h *usageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !basicauth.Authenticate(w, r, h.AuthFunc) {
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	drawerName := r.FormValue("drawer")
+	if drawerName != "" {
+		if !validDrawerName(drawerName) {
+			http.Error(w, "invalid drawer name", http.StatusNotAcceptable)
+			return
+		}
+		if !h.AccessFunc.permits(r, drawerName) {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+
+		usage, err := readUsage(h.DB, drawerName)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			log.Printf("reading usage of %s failed: %v", drawerName, err)
+			return
+		}
+		h.writeJSON(w, usageInfo{Drawer: drawerName, drawerUsage: usage, Limits: h.LimitsFunc.limits(drawerName)})
+		return
+	}
+
+	infos := []usageInfo{}
+
+	iterator := h.DB.NewIterator(util.BytesPrefix([]byte("usage:")), nil)
+	defer iterator.Release()
+	for iterator.Next() {
+		drawer := strings.TrimPrefix(string(iterator.Key()), "usage:")
+		if !h.AccessFunc.permits(r, drawer) {
+			continue
+		}
+		var usage drawerUsage
+		if err := json.Unmarshal(iterator.Value(), &usage); err != nil {
+			log.Printf("unmarshalling %s failed: %v", iterator.Key(), err)
+			continue
+		}
+		if usage.Files == 0 {
+			continue
+		}
+		infos = append(infos, usageInfo{Drawer: drawer, drawerUsage: usage, Limits: h.LimitsFunc.limits(drawer)})
+	}
+	if err := iterator.Error(); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("iterating usage failed: %v", err)
+		return
+	}
+
+	h.writeJSON(w, infos)
+}
+
+func (h *usageHandler) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("encoding usage failed: %v", err)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/akrennmair/cabinet/client"
+	"github.com/akrennmair/cabinet/data"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/storage"
+)
+
+func TestQuotas(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	limitsFunc := func(drawer string) drawerLimits {
+		if drawer == "small" {
+			return drawerLimits{MaxBytes: 10, MaxFiles: 2, MaxFileSize: 8}
+		}
+		return drawerLimits{MaxFileSize: 100}
+	}
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	mux.Handle("/api/upload", &uploadFileHandler{DB: db, Frontend: server.URL, AuthFunc: authFunc, LimitsFunc: limitsFunc})
+	mux.Handle("/api/usage", &usageHandler{DB: db, AuthFunc: authFunc, LimitsFunc: limitsFunc})
+	mux.Handle("/", &fileHandler{DB: db, AuthFunc: authFunc})
+
+	c := client.New(server.URL, "dummy", "auth")
+	ctx := context.Background()
+
+	upload := func(drawer, content string, expectedStatus int) string {
+		t.Helper()
+		file, err := c.Upload(ctx, strings.NewReader(content), "text/plain", drawer, "")
+		var apiErr *client.Error
+		switch {
+		case expectedStatus == http.StatusOK && err != nil:
+			t.Fatalf("uploading %q to %s failed: %v", content, drawer, err)
+		case expectedStatus != http.StatusOK && (!errors.As(err, &apiErr) || apiErr.StatusCode != expectedStatus):
+			t.Fatalf("uploading %q to %s returned %v, expected %d", content, drawer, err, expectedStatus)
+		case expectedStatus == http.StatusInsufficientStorage && !errors.Is(err, client.ErrQuotaExceeded):
+			t.Fatalf("%v doesn't match ErrQuotaExceeded", err)
+		}
+		return file
+	}
+
+	first := upload("small", "12345", http.StatusOK)
+	upload("small", "123456789", http.StatusRequestEntityTooLarge)
+	upload("small", "123456", http.StatusInsufficientStorage)
+	upload("small", "abc", http.StatusOK)
+	upload("small", "x", http.StatusInsufficientStorage)
+	upload("large", strings.Repeat("x", 101), http.StatusRequestEntityTooLarge)
+	upload("large", strings.Repeat("x", 100), http.StatusOK)
+
+	// deleting files frees the quota.
+	if err := c.Delete(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	upload("small", "x", http.StatusOK)
+
+	req, _ := http.NewRequest("GET", server.URL+"/api/usage", nil)
+	req.SetBasicAuth("dummy", "auth")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var infos []usageInfo
+	if err := json.NewDecoder(resp.Body).Decode(&infos); err != nil {
+		t.Fatal(err)
+	}
+	expected := []usageInfo{
+		{Drawer: "large", drawerUsage: drawerUsage{Bytes: 100, Files: 1}, Limits: drawerLimits{MaxFileSize: 100}},
+		{Drawer: "small", drawerUsage: drawerUsage{Bytes: 4, Files: 2}, Limits: drawerLimits{MaxBytes: 10, MaxFiles: 2, MaxFileSize: 8}},
+	}
+	if !reflect.DeepEqual(infos, expected) {
+		t.Fatalf("expected usage %+v, got %+v", expected, infos)
+	}
+
+	// the counters agree with the files.
+	if problems, err := fsck(db, false); err != nil || len(problems) != 0 {
+		t.Fatalf("fsck found problems %+v: %v", problems, err)
+	}
+}
+
+func TestConcurrentUsage(t *testing.T) {
+	db, err := leveldb.Open(storage.NewMemStorage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	for round := 0; round < 50; round++ {
+		for _, filename := range []string{"deleted", "trashed", "overwritten"} {
+			if _, err := putFile(ctx, db, nil, "test", filename, []byte("content"), &data.MetaData{}, drawerLimits{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// every file is deleted, trashed or overwritten several times at
+		// once, and must only be accounted for once.
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(3)
+			go func() {
+				defer wg.Done()
+				<-start
+				if _, err := removeFile(db, "test", "deleted"); err != nil {
+					t.Error(err)
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				<-start
+				if _, err := trashFile(db, "test", "trashed"); err != nil && err != leveldb.ErrNotFound {
+					t.Error(err)
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				<-start
+				if _, err := putFile(ctx, db, nil, "test", "overwritten", []byte("new content"), &data.MetaData{}, drawerLimits{}); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		usage, err := readUsage(db, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := (drawerUsage{Bytes: int64(len("new content")), Files: 1}); usage != expected {
+			t.Fatalf("round %d: expected usage %+v, got %+v", round, expected, usage)
+		}
+		if _, err := removeFile(db, "test", "overwritten"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := removeFile(db, "test", "trashed"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akrennmair/cabinet/basicauth"
+	"github.com/akrennmair/cabinet/data"
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const versionHeader = "X-Cabinet-Version"
+
+// errVersionNotFound is returned when restoring a version that isn't kept.
+var errVersionNotFound = errors.New("version not found")
+
+// versionKey returns the key of an old version of a file. The content of
+// old versions is stored in version:<drawer>:<filename>:<version>, their
+// metadata in vmeta:<drawer>:<filename>:<version>. Versions are zero-padded
+// so that they are iterated in order.
+func versionKey(kind, drawer, filename string, version int64) []byte {
+	return []byte(fmt.Sprintf("%s:%s:%s:%010d", kind, drawer, filename, version))
+}
+
+func versionPrefix(kind, drawer, filename string) []byte {
+	return []byte(kind + ":" + drawer + ":" + filename + ":")
+}
+
+// currentVersion returns the version of a file from its metadata. Files
+// stored before versions were recorded are version 1.
+func currentVersion(metadata *data.MetaData) int64 {
+	if v := metadata.GetVersion(); v > 0 {
+		return v
+	}
+	return 1
+}
+
+// keepVersion adds keeping the current version of a file to batch before it
+// is replaced, if the drawer keeps versions, and prunes the versions beyond
+// the drawer's max_versions. current is the content of the file, or nil if
+// it doesn't exist. A trashed file of the same name is replaced like an
+// existing one, and removed from the trash. The version of the replacing file
+// is returned.
+func keepVersion(db *leveldb.DB, batch *leveldb.Batch, drawer, filename string, current []byte) (int64, error) {
+	metaKey := []byte("meta:" + drawer + ":" + filename)
+	if current == nil {
+		trashed, err := db.Get([]byte("trash:"+drawer+":"+filename), nil)
+		if err == leveldb.ErrNotFound {
+			return 1, nil
+		} else if err != nil {
+			return 0, err
+		}
+		current, metaKey = trashed, []byte("tmeta:"+drawer+":"+filename)
+		batch.Delete([]byte("trash:" + drawer + ":" + filename))
+		batch.Delete(metaKey)
+	}
+
+	var metadata data.MetaData
+	rawMetaData, err := db.Get(metaKey, nil)
+	if err != nil && err != leveldb.ErrNotFound {
+		return 0, err
+	}
+	if rawMetaData != nil {
+		if err := proto.Unmarshal(rawMetaData, &metadata); err != nil {
+			return 0, err
+		}
+	}
+	version := currentVersion(&metadata)
+	if metadata.Deleted != nil {
+		metadata.Deleted = nil
+		if rawMetaData, err = proto.Marshal(&metadata); err != nil {
+			return 0, err
+		}
+	}
+
+	record, err := readDrawer(db, drawer)
+	if err != nil {
+		return 0, err
+	}
+	if record == nil || !record.Versioning {
+		return version + 1, nil
+	}
+
+	batch.Put(versionKey("version", drawer, filename, version), current)
+	batch.Put(versionKey("vmeta", drawer, filename, version), rawMetaData)
+
+	if record.MaxVersions > 0 {
+		versions, err := listVersions(db, drawer, filename)
+		if err != nil {
+			return 0, err
+		}
+		// the version kept above isn't part of the list yet.
+		for len(versions)+1 > record.MaxVersions {
+			batch.Delete(versionKey("version", drawer, filename, versions[0]))
+			batch.Delete(versionKey("vmeta", drawer, filename, versions[0]))
+			versions = versions[1:]
+		}
+	}
+
+	return version + 1, nil
+}
+
+// listVersions returns the old versions that are kept of a file, oldest
+// first.
+func listVersions(db *leveldb.DB, drawer, filename string) ([]int64, error) {
+	var versions []int64
+
+	prefix := versionPrefix("version", drawer, filename)
+	iterator := db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iterator.Release()
+	for iterator.Next() {
+		version, err := strconv.ParseInt(strings.TrimPrefix(string(iterator.Key()), string(prefix)), 10, 64)
+		if err != nil {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	return versions, iterator.Error()
+}
+
+// deleteVersions adds deleting all old versions of a file to batch.
+func deleteVersions(db *leveldb.DB, batch *leveldb.Batch, drawer, filename string) error {
+	for _, kind := range []string{"version", "vmeta"} {
+		if err := moveKeys(db, batch, string(versionPrefix(kind, drawer, filename)), ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreVersion adds making the version given by a RESTORE event the
+// current version of the file to batch. The replaced version is kept like
+// for uploads. If the event doesn't carry the new version number yet, it is
+// set. The content of the restored and of the replaced version is returned.
+func restoreVersion(db *leveldb.DB, batch *leveldb.Batch, event *data.Event) (restored, replaced []byte, err error) {
+	drawer, filename := event.GetDrawer(), event.GetFilename()
+
+	restored, err = db.Get(versionKey("version", drawer, filename, event.GetRestoredVersion()), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, nil, errVersionNotFound
+	} else if err != nil {
+		return nil, nil, err
+	}
+	var metadata data.MetaData
+	if rawMetaData, err := db.Get(versionKey("vmeta", drawer, filename, event.GetRestoredVersion()), nil); err == nil {
+		if err := proto.Unmarshal(rawMetaData, &metadata); err != nil {
+			return nil, nil, err
+		}
+	} else if err != leveldb.ErrNotFound {
+		return nil, nil, err
+	}
+
+	replaced, err = db.Get([]byte("file:"+drawer+":"+filename), nil)
+	if err == leveldb.ErrNotFound {
+		replaced = nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	version, err := keepVersion(db, batch, drawer, filename, replaced)
+	if err != nil {
+		return nil, nil, err
+	}
+	if event.Version == nil {
+		event.Version = proto.Int64(version)
+	}
+
+	if metadata.ContentType == nil {
+		metadata.ContentType = proto.String("application/octet-stream")
+	}
+	metadata.Version = event.Version
+	rawMetaData, err := proto.Marshal(&metadata)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := indexTags(db, batch, drawer, filename, metadata.Tags); err != nil {
+		return nil, nil, err
+	}
+	batch.Put([]byte("file:"+drawer+":"+filename), restored)
+	batch.Put([]byte("meta:"+drawer+":"+filename), rawMetaData)
+
+	return restored, replaced, nil
+}
+
+// versionsHandler lists the versions of a file at /api/versions/<drawer>/<file>
+// and restores old versions with POST ?restore=<version>.
+type versionsHandler struct {
+	DB         *leveldb.DB
+	Frontend   string
+	Events     chan<- *data.Event
+	AuthFunc   basicauth.AuthenticatorFunc
+	AccessFunc drawerAccessFunc
+	LimitsFunc drawerLimitsFunc
+}
+
+type versionInfo struct {
+	Version     int64  `json:"version"`
+	URL         string `json:"url"`
+	Size        int64  `json:"size"`
+	ContentType string `json:"content_type"`
+	SHA256      string `json:"sha256"`
+	Uploaded    int64  `json:"uploaded,omitempty"`
+	Current     bool   `json:"current,omitempty"`
+}
+
+func (h *versionsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !basicauth.Authenticate(w, r, h.AuthFunc) {
+		return
+	}
+
+	uriParts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/api/versions/"), "/", 2)
+	if len(uriParts) != 2 || uriParts[0] == "" || uriParts[1] == "" {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	drawerName, filename := uriParts[0], uriParts[1]
+
+	if !h.AccessFunc.permits(r, drawerName) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		h.list(w, drawerName, filename)
+	case "POST":
+		h.restore(w, r, drawerName, filename)
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *versionsHandler) list(w http.ResponseWriter, drawer, filename string) {
+	content, err := h.DB.Get([]byte("file:"+drawer+":"+filename), nil)
+	if err == leveldb.ErrNotFound {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("reading %s:%s failed: %v", drawer, filename, err)
+		return
+	}
+
+	current, err := h.versionInfo(content, []byte("meta:"+drawer+":"+filename))
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("reading metadata of %s:%s failed: %v", drawer, filename, err)
+		return
+	}
+	current.URL = h.Frontend + "/" + drawer + "/" + filename
+	current.Current = true
+
+	infos := []*versionInfo{current}
+
+	// newest versions first.
+	prefix := versionPrefix("version", drawer, filename)
+	iterator := h.DB.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iterator.Release()
+	for ok := iterator.Last(); ok; ok = iterator.Prev() {
+		version, err := strconv.ParseInt(strings.TrimPrefix(string(iterator.Key()), string(prefix)), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := h.versionInfo(iterator.Value(), versionKey("vmeta", drawer, filename, version))
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			log.Printf("reading metadata of %s:%s version %d failed: %v", drawer, filename, version, err)
+			return
+		}
+		info.Version = version
+		info.URL = h.Frontend + "/" + drawer + "/" + filename + "?version=" + strconv.FormatInt(version, 10)
+		infos = append(infos, info)
+	}
+	if err := iterator.Error(); err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("listing versions of %s:%s failed: %v", drawer, filename, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(infos); err != nil {
+		log.Printf("encoding versions failed: %v", err)
+	}
+}
+
+func (h *versionsHandler) versionInfo(content, metaKey []byte) (*versionInfo, error) {
+	info := &versionInfo{Size: int64(len(content)), ContentType: "application/octet-stream"}
+
+	var metadata data.MetaData
+	if rawMetaData, err := h.DB.Get(metaKey, nil); err == nil {
+		if err := proto.Unmarshal(rawMetaData, &metadata); err != nil {
+			return nil, err
+		}
+		info.ContentType = metadata.GetContentType()
+	} else if err != leveldb.ErrNotFound {
+		return nil, err
+	}
+
+	info.Version = currentVersion(&metadata)
+	info.SHA256 = metadata.GetSha256()
+	if info.SHA256 == "" {
+		info.SHA256 = contentHash(content)
+	}
+	info.Uploaded = metadata.GetUploaded()
+	return info, nil
+}
+
+// restore makes an old version the current version of a file with a
+// RESTORE event.
+func (h *versionsHandler) restore(w http.ResponseWriter, r *http.Request, drawer, filename string) {
+	version, err := strconv.ParseInt(r.FormValue("restore"), 10, 64)
+	if err != nil || version < 1 {
+		http.Error(w, "invalid version", http.StatusNotAcceptable)
+		return
+	}
+
+	var metadata data.MetaData
+	if rawMetaData, err := h.DB.Get([]byte("meta:"+drawer+":"+filename), nil); err == nil {
+		if err := proto.Unmarshal(rawMetaData, &metadata); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			log.Printf("proto.Unmarshal of metadata for %s:%s failed: %v", drawer, filename, err)
+			return
+		}
+	} else if err != leveldb.ErrNotFound {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("reading metadata of %s:%s failed: %v", drawer, filename, err)
+		return
+	} else {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	if version == currentVersion(&metadata) {
+		http.Error(w, "version is already current", http.StatusConflict)
+		return
+	}
+
+	eventKey := "event:" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	event := &data.Event{
+		Type:            data.Event_RESTORE.Enum(),
+		Drawer:          proto.String(drawer),
+		Filename:        proto.String(filename),
+		Id:              proto.String(eventKey),
+		RestoredVersion: proto.Int64(version),
+	}
+
+	var restored, replaced []byte
+	err = writeWithUsage(h.DB, drawer, h.LimitsFunc.limits(drawer), func(batch *leveldb.Batch) (drawerUsage, error) {
+		var err error
+		if restored, replaced, err = restoreVersion(h.DB, batch, event); err != nil {
+			return drawerUsage{}, err
+		}
+
+		eventData, err := proto.Marshal(event)
+		if err != nil {
+			return drawerUsage{}, err
+		}
+		batch.Put([]byte(eventKey), eventData)
+		batch.Put([]byte("latest_event"), []byte(eventKey))
+
+		delta := drawerUsage{Bytes: int64(len(restored) - len(replaced))}
+		if replaced == nil {
+			delta.Files = 1
+		}
+		return delta, nil
+	})
+	if err == errVersionNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if le, ok := err.(*limitError); ok {
+		http.Error(w, le.Message, le.StatusCode)
+		return
+	} else if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		log.Printf("restoring %s:%s version %d failed: %v", drawer, filename, version, err)
+		return
+	}
+
+	if replaced != nil {
+		fileRemoved(drawer, len(replaced))
+	}
+	fileAdded(drawer, len(restored))
+
+	if h.Events != nil {
+		h.Events <- event
+	}
+
+	w.Header().Set(versionHeader, strconv.FormatInt(event.GetVersion(), 10))
+	w.WriteHeader(http.StatusNoContent)
+}
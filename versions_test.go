@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/akrennmair/cabinet/client"
+	"github.com/akrennmair/cabinet/data"
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// keysWithPrefix returns the keys and values starting with prefix.
+func keysWithPrefix(db *leveldb.DB, prefix string) map[string]string {
+	keys := make(map[string]string)
+	iterator := db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	defer iterator.Release()
+	for iterator.Next() {
+		keys[string(iterator.Key())] = string(iterator.Value())
+	}
+	return keys
+}
+
+func fileVersion(db *leveldb.DB, drawer, filename string) int64 {
+	rawMetaData, err := db.Get([]byte("meta:"+drawer+":"+filename), nil)
+	if err != nil {
+		return 0
+	}
+	var metadata data.MetaData
+	if err := proto.Unmarshal(rawMetaData, &metadata); err != nil {
+		return 0
+	}
+	return metadata.GetVersion()
+}
+
+func TestVersions(t *testing.T) {
+	parent := newTestParent(t, nil)
+	defer parent.Server.Close()
+
+	childDB, r := newTestChild(t, parent.Server.URL, nil)
+	defer r.stop()
+
+	if resp := drawerRequest(t, parent, "POST", "/api/drawers", `{"name": "docs", "versioning": true, "max_versions": 2}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("creating drawer returned %d", resp.StatusCode)
+	}
+
+	c := client.New(parent.Server.URL, "dummy", "auth")
+	c.MaxRetries = 0
+	ctx := context.Background()
+
+	var file string
+	for _, content := range []string{"one", "two", "three", "four"} {
+		var err error
+		if file, err = c.UploadWithOptions(ctx, strings.NewReader(content), &client.UploadOptions{Drawer: "docs", Name: "report.txt", ContentType: "text/plain"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "replicated uploads", func() bool {
+		return fileVersion(childDB, "docs", "report.txt") == 4
+	})
+
+	versions, err := c.Versions(ctx, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 || !versions[0].Current || versions[0].Version != 4 || versions[1].Version != 3 || versions[2].Version != 2 {
+		t.Fatalf("unexpected versions %+v", versions)
+	}
+
+	body, info, err := c.Get(ctx, versions[2].URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := ioutil.ReadAll(body)
+	body.Close()
+	if string(content) != "two" || info.Version != 2 {
+		t.Fatalf("version 2 returned %q as version %d", content, info.Version)
+	}
+	if _, _, err := c.Get(ctx, file+"?version=1"); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("fetching pruned version returned %v", err)
+	}
+
+	version, err := c.Restore(ctx, file, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 5 {
+		t.Fatalf("restored file has version %d", version)
+	}
+	body, info, err = c.Get(ctx, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ = ioutil.ReadAll(body)
+	body.Close()
+	if string(content) != "two" || info.Version != 5 {
+		t.Fatalf("restored file is %q as version %d", content, info.Version)
+	}
+
+	var apiErr *client.Error
+	if _, err := c.Restore(ctx, file, 5); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusConflict {
+		t.Fatalf("restoring the current version returned %v", err)
+	}
+	if _, err := c.Restore(ctx, file, 2); !errors.Is(err, client.ErrNotFound) {
+		t.Fatalf("restoring a pruned version returned %v", err)
+	}
+
+	// children keep the same history.
+	waitFor(t, "replicated restore", func() bool {
+		return fileVersion(childDB, "docs", "report.txt") == 5
+	})
+	for _, prefix := range []string{"file:docs:", "version:docs:"} {
+		if expected, replicated := keysWithPrefix(parent.DB, prefix), keysWithPrefix(childDB, prefix); len(expected) == 0 || !reflect.DeepEqual(expected, replicated) {
+			t.Errorf("child has %v, expected %v", replicated, expected)
+		}
+	}
+	if problems, err := fsck(parent.DB, false); err != nil || len(problems) != 0 {
+		t.Fatalf("fsck found %v, %v", problems, err)
+	}
+
+	// drawers without versioning only count versions.
+	for _, content := range []string{"a", "b"} {
+		if file, err = c.UploadWithOptions(ctx, strings.NewReader(content), &client.UploadOptions{Drawer: "plain", Name: "notes.txt"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if versions, err := c.Versions(ctx, file); err != nil || len(versions) != 1 || versions[0].Version != 2 {
+		t.Fatalf("unversioned file has versions %+v, %v", versions, err)
+	}
+
+	if err := c.Delete(ctx, parent.Server.URL+"/docs/report.txt"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "replicated delete", func() bool {
+		return len(keysWithPrefix(childDB, "version:docs:")) == 0 && len(keysWithPrefix(childDB, "vmeta:docs:")) == 0
+	})
+	if keys := keysWithPrefix(parent.DB, "vmeta:docs:"); len(keys) != 0 {
+		t.Fatalf("old versions weren't deleted: %v", keys)
+	}
+}
+
+func TestRestoreQuota(t *testing.T) {
+	parent := newTestParent(t, nil)
+	defer parent.Server.Close()
+
+	// old versions don't count towards quotas, so their number is limited.
+	if resp := drawerRequest(t, parent, "POST", "/api/drawers", `{"name": "docs", "versioning": true, "max_bytes": 5}`); resp.StatusCode != http.StatusNotAcceptable {
+		t.Fatalf("creating drawer without max_versions returned %d", resp.StatusCode)
+	}
+	if resp := drawerRequest(t, parent, "POST", "/api/drawers", `{"name": "docs", "versioning": true, "max_versions": 2, "max_bytes": 5}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("creating drawer returned %d", resp.StatusCode)
+	}
+
+	c := client.New(parent.Server.URL, "dummy", "auth")
+	c.MaxRetries = 0
+	ctx := context.Background()
+
+	var file string
+	for _, content := range []string{"12345", "1"} {
+		var err error
+		if file, err = c.UploadWithOptions(ctx, strings.NewReader(content), &client.UploadOptions{Drawer: "docs", Name: "a.txt"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.UploadWithOptions(ctx, strings.NewReader("123"), &client.UploadOptions{Drawer: "docs", Name: "b.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Restore(ctx, file, 1); !errors.Is(err, client.ErrQuotaExceeded) {
+		t.Fatalf("restoring over the quota returned %v", err)
+	}
+	if usage, _ := readUsage(parent.DB, "docs"); usage.Bytes != 4 {
+		t.Fatalf("restore changed the usage: %+v", usage)
+	}
+	if version := fileVersion(parent.DB, "docs", "a.txt"); version != 2 {
+		t.Fatalf("file has version %d after failed restore", version)
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/akrennmair/cabinet/data"
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+const defaultWebhookAttempts = 10
+
+// webhook delivers the events of the event log to an HTTP endpoint. The
+// last delivered event is persisted as webhook:<name>:cursor, so deliveries
+// continue where they left off after a restart, and every event is
+// delivered at least once. Events that still fail after the maximum number
+// of attempts are dead-lettered as webhook:<name>:dead:<event ID>.
+type webhook struct {
+	Name       string
+	Config     *webhookConfig
+	DB         *leveldb.DB
+	Frontend   string
+	Replicator chan<- replRequest
+
+	// RetryDelay is the delay after the first failed attempt. It doubles
+	// with every further attempt, up to MaxRetryDelay.
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+
+	client *http.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// deadLetter is stored for events that couldn't be delivered.
+type deadLetter struct {
+	Payload  json.RawMessage `json:"payload"`
+	Error    string          `json:"error"`
+	Attempts int             `json:"attempts"`
+	Time     time.Time       `json:"time"`
+}
+
+func (w *webhook) cursorKey() []byte {
+	return []byte("webhook:" + w.Name + ":cursor")
+}
+
+// start starts delivering events in the background.
+func (w *webhook) start() error {
+	// new webhooks only receive events that happen after they were added.
+	if _, err := w.DB.Get(w.cursorKey(), nil); err == leveldb.ErrNotFound {
+		latest, err := w.DB.Get([]byte("latest_event"), nil)
+		if err != nil && err != leveldb.ErrNotFound {
+			return err
+		}
+		if err := w.DB.Put(w.cursorKey(), latest, nil); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	w.client = &http.Client{Timeout: 30 * time.Second}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	w.done = make(chan struct{})
+
+	go w.run()
+	return nil
+}
+
+// stop stops delivering events and waits until the current delivery has
+// been aborted.
+func (w *webhook) stop() {
+	w.cancel()
+	<-w.done
+}
+
+func (w *webhook) run() {
+	defer close(w.done)
+
+	events := make(chan *data.Event)
+	w.Replicator <- replRequest{Type: subscribe, Events: events}
+
+	defer func() {
+		// keep draining events so that the dispatcher can't block on us
+		// while we're unsubscribing.
+		for unsubscribed := false; !unsubscribed; {
+			select {
+			case w.Replicator <- replRequest{Type: unsubscribe, Events: events}:
+				unsubscribed = true
+			case <-events:
+			}
+		}
+	}()
+
+	// new events only wake up the delivery, which reads them from the event
+	// log, so they don't need to be queued.
+	wakeup := make(chan struct{}, 1)
+	wakeup <- struct{}{}
+	go func() {
+		for {
+			select {
+			case <-events:
+				select {
+				case wakeup <- struct{}{}:
+				default:
+				}
+			case <-w.ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-wakeup:
+			if err := w.deliverPending(); err != nil && w.ctx.Err() == nil {
+				log.Printf("webhook %s: %v", w.Name, err)
+			}
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
+
+// deliverPending delivers all events following the cursor.
+func (w *webhook) deliverPending() error {
+	cursor, err := w.DB.Get(w.cursorKey(), nil)
+	if err != nil {
+		return err
+	}
+
+	keyRange := util.BytesPrefix([]byte("event:"))
+	if len(cursor) > 0 {
+		keyRange.Start = append(cursor, 0)
+	}
+
+	iterator := w.DB.NewIterator(keyRange, nil)
+	defer iterator.Release()
+
+	var skipped []byte
+
+	for iterator.Next() {
+		var event data.Event
+		if err := proto.Unmarshal(iterator.Value(), &event); err != nil {
+			return fmt.Errorf("unmarshalling %s failed: %v", iterator.Key(), err)
+		}
+
+		if !w.matches(&event) {
+			skipped = append(skipped[:0], iterator.Key()...)
+			continue
+		}
+
+		if err := w.deliver(&event); err != nil {
+			return err
+		}
+		skipped = nil
+
+		if err := w.DB.Put(w.cursorKey(), iterator.Key(), nil); err != nil {
+			return err
+		}
+	}
+
+	if skipped != nil {
+		if err := w.DB.Put(w.cursorKey(), skipped, nil); err != nil {
+			return err
+		}
+	}
+
+	return iterator.Error()
+}
+
+func (w *webhook) matches(event *data.Event) bool {
+	if len(w.Config.Drawers) > 0 && !contains(w.Config.Drawers, event.GetDrawer()) {
+		return false
+	}
+	if len(w.Config.Events) == 0 {
+		return true
+	}
+	for _, t := range w.Config.Events {
+		if strings.EqualFold(t, event.GetType().String()) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver posts an event to the webhook, retrying with exponential backoff.
+// If all attempts fail, the event is dead-lettered. It only returns an error
+// if the webhook was stopped or the dead letter couldn't be stored.
+func (w *webhook) deliver(event *data.Event) error {
+	body, err := json.Marshal(newEventPayload(w.DB, w.Frontend, event))
+	if err != nil {
+		return err
+	}
+
+	maxAttempts := w.Config.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = defaultWebhookAttempts
+	}
+
+	delay := w.RetryDelay
+	for attempt := 1; ; attempt++ {
+		err = w.post(event, body)
+		if err == nil {
+			webhookDeliveries.WithLabelValues(w.Name, "success").Inc()
+			return nil
+		}
+		if w.ctx.Err() != nil {
+			return w.ctx.Err()
+		}
+		webhookDeliveries.WithLabelValues(w.Name, "failure").Inc()
+
+		if attempt >= maxAttempts {
+			break
+		}
+
+		log.Printf("webhook %s: delivering %s failed, attempt %d of %d: %v", w.Name, event.GetId(), attempt, maxAttempts, err)
+
+		select {
+		case <-time.After(delay):
+		case <-w.ctx.Done():
+			return w.ctx.Err()
+		}
+		if delay *= 2; delay > w.MaxRetryDelay {
+			delay = w.MaxRetryDelay
+		}
+	}
+
+	log.Printf("webhook %s: giving up on %s after %d attempts: %v", w.Name, event.GetId(), maxAttempts, err)
+	webhookDeliveries.WithLabelValues(w.Name, "dead").Inc()
+
+	rawDeadLetter, err2 := json.Marshal(deadLetter{Payload: body, Error: err.Error(), Attempts: maxAttempts, Time: time.Now()})
+	if err2 != nil {
+		return err2
+	}
+	return w.DB.Put([]byte("webhook:"+w.Name+":dead:"+event.GetId()), rawDeadLetter, nil)
+}
+
+// webhookSignature returns the signature of a delivery's body.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *webhook) post(event *data.Event, body []byte) error {
+	req, err := http.NewRequest("POST", w.Config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Cabinet-Event", event.GetType().String())
+	req.Header.Set("X-Cabinet-Delivery", event.GetId())
+	if w.Config.Secret != "" {
+		req.Header.Set("X-Cabinet-Signature", webhookSignature(w.Config.Secret, body))
+	}
+
+	resp, err := w.client.Do(req.WithContext(w.ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %d", w.Config.URL, resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhook(t *testing.T) {
+	parent := newTestParent(t, nil)
+	defer parent.Server.Close()
+
+	var (
+		mtx      sync.Mutex
+		requests int
+		received []eventPayload
+	)
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		// fail every other request to exercise the retries.
+		if requests++; requests%2 == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+
+		if sig := r.Header.Get("X-Cabinet-Signature"); sig != webhookSignature("secret", body) {
+			t.Errorf("invalid signature %s", sig)
+		}
+
+		var payload eventPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Errorf("decoding payload failed: %v", err)
+		}
+		received = append(received, payload)
+	}))
+	defer receiver.Close()
+
+	// events before the webhook was started aren't delivered.
+	parent.upload(t, http.DefaultClient, "test", "text/plain", "before")
+
+	w := &webhook{
+		Name:          "test",
+		Config:        &webhookConfig{URL: receiver.URL, Secret: "secret", Drawers: []string{"test"}},
+		DB:            parent.DB,
+		Frontend:      parent.Server.URL,
+		Replicator:    parent.Repl.Replicator,
+		RetryDelay:    time.Millisecond,
+		MaxRetryDelay: time.Millisecond,
+	}
+	if err := w.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.stop()
+
+	uploaded := parent.upload(t, http.DefaultClient, "test", "text/plain", "hello")
+	parent.upload(t, http.DefaultClient, "other", "text/plain", "ignored")
+
+	// payloads carry the metadata at delivery time, which is gone once the
+	// file is deleted.
+	waitFor(t, "upload delivery", func() bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return len(received) == 1
+	})
+
+	req, _ := http.NewRequest("DELETE", uploaded, nil)
+	req.SetBasicAuth("dummy", "auth")
+	if resp, err := http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	} else {
+		resp.Body.Close()
+	}
+
+	waitFor(t, "webhook deliveries", func() bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return len(received) == 2
+	})
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	if p := received[0]; p.Type != "UPLOAD" || p.URL != uploaded || p.MetaData.GetContentType() != "text/plain" || p.MetaData.GetSha256() != contentHash([]byte("hello")) {
+		t.Errorf("unexpected upload payload %+v", p)
+	}
+	if p := received[1]; p.Type != "DELETE" || p.URL != uploaded || p.MetaData != nil {
+		t.Errorf("unexpected delete payload %+v", p)
+	}
+}
+
+func TestWebhookDeadLetter(t *testing.T) {
+	parent := newTestParent(t, nil)
+	defer parent.Server.Close()
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	w := &webhook{
+		Name:          "broken",
+		Config:        &webhookConfig{URL: receiver.URL, Events: []string{"upload"}, MaxAttempts: 3},
+		DB:            parent.DB,
+		Frontend:      parent.Server.URL,
+		Replicator:    parent.Repl.Replicator,
+		RetryDelay:    time.Millisecond,
+		MaxRetryDelay: time.Millisecond,
+	}
+	if err := w.start(); err != nil {
+		t.Fatal(err)
+	}
+	defer w.stop()
+
+	parent.upload(t, http.DefaultClient, "test", "text/plain", "hello")
+	latest, err := parent.DB.Get([]byte("latest_event"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "dead letter", func() bool {
+		found, _ := parent.DB.Has([]byte("webhook:broken:dead:"+string(latest)), nil)
+		return found
+	})
+
+	waitFor(t, "cursor to advance", func() bool {
+		cursor, _ := parent.DB.Get(w.cursorKey(), nil)
+		return string(cursor) == string(latest)
+	})
+
+	var letter deadLetter
+	raw, _ := parent.DB.Get([]byte("webhook:broken:dead:"+string(latest)), nil)
+	if err := json.Unmarshal(raw, &letter); err != nil || letter.Attempts != 3 {
+		t.Fatalf("unexpected dead letter %s: %v", raw, err)
+	}
+}